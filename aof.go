@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aofCommands are the write commands logged to the append-only file as
+// they were sent. MIGRATE and DELPATTERN log the DELs they perform locally
+// instead, SET, EXPIRE and RESTORE log themselves with any expiry as an
+// absolute time, and SETRANGE and the INCR family log the SET of their
+// result (see setKeepingTTL), so replaying a command twice does no harm.
+var aofCommands = map[string]bool{
+	"DEL":     true,
+	"GETDEL":  true,
+	"FLUSHDB": true,
+}
+
+// appendOnlyFile logs write commands in RESP, the same bytes a client sends
+type appendOnlyFile struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	path   string
+
+	// rewriteBuf collects commands appended while BGREWRITEAOF runs,
+	// nil when no rewrite is in progress
+	rewriteBuf *bytes.Buffer
+}
+
+// Global AOF, nil unless -appendonly is set
+var aof *appendOnlyFile
+
+func openAOF(path string) (*appendOnlyFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &appendOnlyFile{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		path:   path,
+	}, nil
+}
+
+// Append writes one command and flushes it to the file
+func (a *appendOnlyFile) Append(args []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	writeAOFCommand(a.writer, args)
+	if a.rewriteBuf != nil {
+		writeAOFCommand(a.rewriteBuf, args)
+	}
+
+	return a.writer.Flush()
+}
+
+// writeAOFCommand encodes a command as a RESP array
+func writeAOFCommand(w io.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func (a *appendOnlyFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.writer.Flush()
+	return a.file.Close()
+}
+
+// appendToAOF logs a command if AOF is enabled
+func appendToAOF(args []string) {
+	if aof == nil {
+		return
+	}
+	err := aof.Append(args)
+	if err != nil {
+		fmt.Println("Error writing to AOF:", err)
+	}
+}
+
+// loadAOF replays the append-only file through runCommand and then opens
+// it for appending. A truncated last command (crash mid-write) is dropped.
+//
+// The replay runs over the dataset the WAL brought back, which the logged
+// commands are safe to apply to again (see aofCommands), and isn't logged
+// to the WAL: the AOF holds every write it makes, so the WAL would only
+// grow by a copy of the AOF on every start.
+func loadAOF(path string) error {
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		reader := bufio.NewReader(file)
+		replayed := 0
+
+		resume := store.WAL.Pause()
+		defer resume()
+
+		for {
+			args, err := parseRESP(reader)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fmt.Printf("AOF truncated or corrupt after %d commands: %v\n", replayed, err)
+				break
+			}
+			if len(args) == 0 {
+				continue
+			}
+			err = ValidateCommand(args)
+			if err != nil {
+				fmt.Printf("AOF replay: skipping %v: %v\n", args, err)
+				continue
+			}
+
+			response := runCommand(context.Background(), strings.ToUpper(args[0]), args)
+			if strings.HasPrefix(response, "-") {
+				fmt.Printf("AOF replay: %v failed: %s", args, response)
+			}
+			replayed++
+		}
+
+		file.Close()
+		fmt.Printf("AOF replay complete: replayed %d commands\n", replayed)
+	}
+
+	aof, err = openAOF(path)
+	return err
+}
+
+// startRewrite begins buffering appended commands for a rewrite.
+// It fails if a rewrite is already running.
+func (a *appendOnlyFile) startRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriteBuf != nil {
+		return fmt.Errorf("Background append only file rewriting already in progress")
+	}
+	a.rewriteBuf = new(bytes.Buffer)
+	return nil
+}
+
+// rewrite writes one SET per live key to a temp file, appends the commands
+// buffered since startRewrite and renames it over the AOF.
+//
+// Buffering starts before the snapshot is taken, so a write is either in the
+// snapshot, in the buffer, or both. Every logged command sets a key's
+// value or expiry outright, or deletes it (see aofCommands), so applying
+// one the snapshot already reflects changes nothing.
+func (a *appendOnlyFile) rewrite() error {
+	tmpPath := a.path + ".rewrite"
+
+	err := a.writeSnapshot(tmpPath)
+	if err != nil {
+		a.abortRewrite(tmpPath)
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err = a.finishRewrite(tmpPath)
+	if err != nil {
+		a.rewriteBuf = nil
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeSnapshot dumps the current dataset to path as SET commands, with
+// any expiry as PXAT. It reads a point-in-time copy of the store, so
+// flushes and writes carry on while the file is written.
+func (a *appendOnlyFile) writeSnapshot(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create rewrite file: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+
+	it := store.NewSnapshotIterator()
+	for it.Next() {
+		entry := it.Entry()
+		args := []string{"SET", entry.Key, string(entry.Value)}
+		if entry.ExpiresAt != 0 {
+			args = append(args, "PXAT", strconv.FormatInt(entry.ExpiresAt/int64(time.Millisecond), 10))
+		}
+		writeAOFCommand(writer, args)
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read dataset: %v", err)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write rewrite file: %v", err)
+	}
+	return nil
+}
+
+// finishRewrite appends the buffered tail to the rewritten file and swaps
+// it in. The caller holds a.mu, so no command lands in between.
+func (a *appendOnlyFile) finishRewrite(tmpPath string) error {
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open rewrite file: %v", err)
+	}
+
+	_, err = file.Write(a.rewriteBuf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write rewrite file: %v", err)
+	}
+
+	err = os.Rename(tmpPath, a.path)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to rename rewrite file: %v", err)
+	}
+
+	// The renamed file is the AOF now; keep appending to it
+	a.writer.Flush()
+	a.file.Close()
+	a.file = file
+	a.writer = bufio.NewWriter(file)
+	a.rewriteBuf = nil
+	return nil
+}
+
+func (a *appendOnlyFile) abortRewrite(tmpPath string) {
+	a.mu.Lock()
+	a.rewriteBuf = nil
+	a.mu.Unlock()
+	os.Remove(tmpPath)
+}
+
+// rewriteAOFInBackground runs BGREWRITEAOF's work off the connection
+func rewriteAOFInBackground() {
+	fmt.Println("Background append only file rewriting started")
+	err := aof.rewrite()
+	if err != nil {
+		fmt.Println("Background append only file rewriting failed:", err)
+		return
+	}
+	fmt.Println("Background AOF rewrite finished successfully")
+}
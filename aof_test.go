@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAOFReplay(t *testing.T) {
+	useTestStore(t)
+	useTestAOF(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "SET", "a", "1")
+	expect(t, c, "OK", "SET", "b", "2")
+	expect(t, c, 2, "INCR", "a")
+	expect(t, c, 1, "DEL", "b")
+	expect(t, c, "OK", "SET", "ttl", "t", "EX", "100")
+	expect(t, c, 5, "SETRANGE", "r", "2", "abc")
+	expect(t, c, "OK", "SET", "gone", "g", "PXAT", "1")
+
+	restartTestServer(t, true)
+
+	expect(t, c, "2", "GET", "a")
+	expect(t, c, 0, "EXISTS", "b")
+	expect(t, c, "\x00\x00abc", "GET", "r")
+	expect(t, c, 0, "EXISTS", "gone")
+	if ttl := ttlOf(t, c, "ttl"); ttl <= 90 || ttl > 100 {
+		t.Errorf("ttl has TTL %d after the replay, want the 100s it was given", ttl)
+	}
+	expect(t, c, 3, "DBSIZE")
+
+	// The replay doesn't log the commands again
+	restartTestServer(t, true)
+	expect(t, c, 3, "DBSIZE")
+	expect(t, c, "2", "GET", "a")
+}
+
+// waitForAOFRewrite waits for a BGREWRITEAOF to finish
+func waitForAOFRewrite(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		aof.mu.Lock()
+		running := aof.rewriteBuf != nil
+		aof.mu.Unlock()
+		if !running {
+			return
+		}
+	}
+	t.Fatal("BGREWRITEAOF didn't finish")
+}
+
+// After many overwrites of one key, the rewritten AOF holds a single SET
+// for it, keeps expiries, and still takes the commands that follow
+func TestBGRewriteAOF(t *testing.T) {
+	useTestStore(t)
+	readAOF := useTestAOF(t)
+	c := dialTest(t)
+
+	for i := 0; i < 100; i++ {
+		expect(t, c, "OK", "SET", "k", strconv.Itoa(i))
+	}
+	expect(t, c, "OK", "SET", "ttl", "t", "EX", "100")
+	expect(t, c, "OK", "SET", "gone", "g")
+	expect(t, c, 1, "DEL", "gone")
+
+	expect(t, c, "Background append only file rewriting started", "BGREWRITEAOF")
+	waitForAOFRewrite(t)
+	expect(t, c, "OK", "SET", "after", "a")
+
+	commands := readAOF()
+	sets := make(map[string][]string)
+	for _, args := range commands {
+		if args[0] != "SET" {
+			t.Errorf("rewritten AOF holds %q", args)
+			continue
+		}
+		if sets[args[1]] != nil {
+			t.Errorf("rewritten AOF sets %s more than once", args[1])
+		}
+		sets[args[1]] = args
+	}
+	if len(sets) != 3 {
+		t.Errorf("rewritten AOF sets %d keys, want k, ttl and after: %q", len(sets), commands)
+	}
+	if args := sets["k"]; len(args) != 3 || args[2] != "99" {
+		t.Errorf("rewritten AOF has %q for k, want its last value", args)
+	}
+	if args := sets["ttl"]; len(args) != 5 || args[3] != "PXAT" {
+		t.Errorf("rewritten AOF has %q for ttl, want it with its expiry", args)
+	}
+
+	restartTestServer(t, true)
+	expect(t, c, "99", "GET", "k")
+	expect(t, c, "a", "GET", "after")
+	if ttl := ttlOf(t, c, "ttl"); ttl <= 90 || ttl > 100 {
+		t.Errorf("ttl has TTL %d after replaying the rewritten AOF", ttl)
+	}
+}
+
+// Commands that change a value rather than replace it, sent while
+// BGREWRITEAOF runs, may be both in the snapshot and in the buffered tail;
+// the rewritten AOF still applies each of them once
+func TestBGRewriteAOFDuringWrites(t *testing.T) {
+	useTestStore(t)
+	useTestAOF(t)
+	c := dialTest(t)
+
+	const writes = 300
+	writer := dialTest(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < writes; i++ {
+			if _, err := writer.Do("INCR", "n"); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := writer.Do("SETRANGE", "r", strconv.Itoa(i), "x"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		expect(t, c, "Background append only file rewriting started", "BGREWRITEAOF")
+		waitForAOFRewrite(t)
+	}
+	<-done
+
+	restartTestServer(t, true)
+	expect(t, c, strconv.Itoa(writes), "GET", "n")
+	expect(t, c, strings.Repeat("x", writes), "GET", "r")
+}
+
+// INCR and DECR are logged as the SET of their result, keeping any TTL,
+// so replaying the AOF over the dataset the WAL already brought back
+// doesn't apply them again
+func TestAOFIncrReplayedOnce(t *testing.T) {
+	useTestStore(t)
+	useTestAOF(t)
+	c := dialTest(t)
+
+	expect(t, c, 1, "INCR", "n")
+	expect(t, c, 2, "INCR", "n")
+	expect(t, c, -1, "DECR", "down")
+	expect(t, c, "OK", "SET", "ttl", "10", "EX", "100")
+	expect(t, c, 11, "INCR", "ttl")
+
+	for i := 0; i < 2; i++ {
+		restartTestServer(t, false)
+		expect(t, c, "2", "GET", "n")
+		expect(t, c, "-1", "GET", "down")
+		expect(t, c, "11", "GET", "ttl")
+		if ttl := ttlOf(t, c, "ttl"); ttl <= 90 || ttl > 100 {
+			t.Errorf("ttl has TTL %d after restart %d, want the 100s it was given", ttl, i+1)
+		}
+	}
+}
+
+// With the WAL kept, a restart replays the AOF over the dataset the WAL
+// brought back without changing it, and without logging the replay to the
+// WAL again
+func TestAOFReplayOverWAL(t *testing.T) {
+	useTestStore(t)
+	useTestAOF(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "SET", "a", "1")
+	expect(t, c, "OK", "SET", "b", "2")
+	expect(t, c, 1, "DEL", "b")
+	expect(t, c, 5, "SETRANGE", "r", "2", "abc")
+
+	walSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat("wal.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	before := walSize()
+	for i := 0; i < 2; i++ {
+		restartTestServer(t, false)
+		expect(t, c, "1", "GET", "a")
+		expect(t, c, 0, "EXISTS", "b")
+		expect(t, c, "\x00\x00abc", "GET", "r")
+		if size := walSize(); size != before {
+			t.Errorf("WAL grew from %d to %d bytes over restart %d", before, size, i+1)
+		}
+	}
+	expect(t, c, 2, "DBSIZE")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"small-redis/client"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchConfig controls a redis-benchmark style SET/GET run
+type benchConfig struct {
+	Addr     string
+	Clients  int
+	Requests int // total across all clients
+	Rate     int // target requests per second across all clients, 0 = unlimited
+	DataSize int // value size in bytes
+	KeySpace int // number of distinct keys
+}
+
+// benchResult summarizes a finished benchmark run
+type benchResult struct {
+	Requests   int
+	Errors     int
+	Duration   time.Duration
+	Throughput float64 // requests per second
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+// runBenchmark opens cfg.Clients connections and splits cfg.Requests
+// between them, alternating SET and GET on a fixed key space
+func runBenchmark(cfg benchConfig) (*benchResult, error) {
+	if cfg.Clients <= 0 || cfg.Requests <= 0 {
+		return nil, fmt.Errorf("clients and requests must be positive")
+	}
+	if cfg.KeySpace <= 0 {
+		cfg.KeySpace = 1
+	}
+
+	// Connect everyone up front so dial time isn't measured
+	clients := make([]*client.Client, cfg.Clients)
+	for i := range clients {
+		c, err := client.Dial(cfg.Addr)
+		if err != nil {
+			for _, opened := range clients[:i] {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to connect to %s: %v", cfg.Addr, err)
+		}
+		clients[i] = c
+	}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	// Each client paces itself to its share of the target rate
+	var interval time.Duration
+	if cfg.Rate > 0 {
+		interval = time.Duration(int64(time.Second) * int64(cfg.Clients) / int64(cfg.Rate))
+	}
+
+	value := strings.Repeat("x", cfg.DataSize)
+	latencies := make([][]time.Duration, cfg.Clients)
+	errors := make([]int, cfg.Clients)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i, c := range clients {
+		count := cfg.Requests / cfg.Clients
+		if i < cfg.Requests%cfg.Clients {
+			count++
+		}
+
+		wg.Add(1)
+		go func(i int, c *client.Client, count int) {
+			defer wg.Done()
+
+			samples := make([]time.Duration, 0, count)
+			next := time.Now()
+
+			for n := 0; n < count; n++ {
+				if interval > 0 {
+					if wait := time.Until(next); wait > 0 {
+						time.Sleep(wait)
+					}
+					next = next.Add(interval)
+				}
+
+				key := benchKey(i, n, cfg.Clients, cfg.KeySpace)
+
+				opStart := time.Now()
+				var err error
+				if n%2 == 0 {
+					_, err = c.Do("SET", key, value)
+				} else {
+					_, err = c.Do("GET", key)
+				}
+				samples = append(samples, time.Since(opStart))
+
+				if err != nil {
+					errors[i]++
+				}
+			}
+
+			latencies[i] = samples
+		}(i, c, count)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	all := make([]time.Duration, 0, cfg.Requests)
+	result := &benchResult{Duration: elapsed}
+	for i := range latencies {
+		all = append(all, latencies[i]...)
+		result.Errors += errors[i]
+	}
+	result.Requests = len(all)
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	result.P50 = percentile(all, 50)
+	result.P95 = percentile(all, 95)
+	result.P99 = percentile(all, 99)
+	if len(all) > 0 {
+		result.Max = all[len(all)-1]
+	}
+	if elapsed > 0 {
+		result.Throughput = float64(result.Requests) / elapsed.Seconds()
+	}
+
+	return result, nil
+}
+
+// benchKey returns the key for a worker's nth request. Each SET is
+// followed by a GET of the same key. The workers' keys are interleaved,
+// worker i taking i, i+clients, i+2*clients and so on, so no two workers
+// touch the same key until the key space wraps around.
+func benchKey(worker, n, clients, keySpace int) string {
+	return "key:" + strconv.Itoa((worker+n/2*clients)%keySpace)
+}
+
+// percentile expects sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (len(sorted)*p + 99) / 100
+	if idx > 0 {
+		idx--
+	}
+	return sorted[idx]
+}
+
+// printBenchResult prints the summary in a redis-benchmark like layout
+func printBenchResult(cfg benchConfig, result *benchResult) {
+	fmt.Println("====== SET/GET ======")
+	fmt.Printf("  %d requests completed in %.2f seconds\n", result.Requests, result.Duration.Seconds())
+	fmt.Printf("  %d parallel clients\n", cfg.Clients)
+	fmt.Printf("  %d bytes payload\n", cfg.DataSize)
+	if result.Errors > 0 {
+		fmt.Printf("  %d errors\n", result.Errors)
+	}
+	fmt.Println()
+	fmt.Printf("  throughput: %.2f requests per second\n", result.Throughput)
+	fmt.Printf("  latency: p50=%v p95=%v p99=%v max=%v\n", result.P50, result.P95, result.P99, result.Max)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestBenchmarkRun(t *testing.T) {
+	useTestStore(t)
+
+	cfg := benchConfig{Addr: testAddr, Clients: 4, Requests: 202, DataSize: 8, KeySpace: 1000}
+	result, err := runBenchmark(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Requests != cfg.Requests || result.Errors != 0 {
+		t.Errorf("%d requests with %d errors, want %d without errors", result.Requests, result.Errors, cfg.Requests)
+	}
+	if result.Throughput <= 0 || result.P50 <= 0 || result.Max < result.P99 {
+		t.Errorf("throughput %.0f/s, p50 %v, p99 %v, max %v", result.Throughput, result.P50, result.P99, result.Max)
+	}
+
+	// Every SET went to a key no other worker used: 2 workers making 51
+	// requests, 26 of them SETs, and 2 making 50 with 25 SETs
+	expect(t, dialTest(t), 102, "DBSIZE")
+}
+
+func TestBenchKeysDontOverlap(t *testing.T) {
+	const clients, perClient, keySpace = 5, 40, 1000
+	owner := make(map[string]int)
+	for worker := 0; worker < clients; worker++ {
+		for n := 0; n < perClient; n++ {
+			key := benchKey(worker, n, clients, keySpace)
+			if n%2 == 1 {
+				if key != benchKey(worker, n-1, clients, keySpace) {
+					t.Fatalf("worker %d GETs %s, not the key it just SET", worker, key)
+				}
+				continue
+			}
+			if other, taken := owner[key]; taken {
+				t.Fatalf("workers %d and %d both use %s", other, worker, key)
+			}
+			owner[key] = worker
+		}
+	}
+	if len(owner) != clients*perClient/2 {
+		t.Errorf("%d distinct keys, want %d", len(owner), clients*perClient/2)
+	}
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a minimal RESP client used to talk to another server
+// (MIGRATE, benchmarks, sharding)
+type Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+// ReplyError is an error reply sent by the server (e.g. "-ERR ...")
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// Dial connects to a server without any timeout
+func Dial(addr string) (*Client, error) {
+	return DialTimeout(addr, 0)
+}
+
+// DialTimeout connects to a server. A non-zero timeout is applied both to
+// the dial and to every command sent afterwards
+func DialTimeout(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// Close closes the underlying connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends one command and waits for its reply.
+// Replies are decoded as: simple/bulk string → string, null → nil,
+// integer → int64, array → []interface{}, error → ReplyError (as err)
+func (c *Client) Do(args ...string) (interface{}, error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	err := writeCommand(c.writer, args)
+	if err != nil {
+		return nil, err
+	}
+	err = c.writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return readReply(c.reader)
+}
+
+func writeCommand(w *bufio.Writer, args []string) error {
+	_, err := fmt.Fprintf(w, "*%d\r\n", len(args))
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		_, err = fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return "", fmt.Errorf("empty reply line")
+	}
+	return line, nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, ReplyError(line[1:])
+
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer reply: %s", line)
+		}
+		return n, nil
+
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %s", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %s", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			item, err := readReply(r)
+			if err != nil {
+				// Nested error replies stay as values so the array is fully consumed
+				if replyErr, ok := err.(ReplyError); ok {
+					items[i] = replyErr
+					continue
+				}
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+
+	default:
+		return nil, fmt.Errorf("unknown reply type: %c", line[0])
+	}
+}
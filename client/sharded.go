@@ -0,0 +1,219 @@
+package client
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"small-redis/hashing"
+	"sort"
+	"strconv"
+)
+
+// pointsPerNode is how many positions each server gets on the ring.
+// Each MD5 digest yields 4 points, like ketama (40 digests × 4 = 160).
+const pointsPerNode = 160
+
+// ShardedClient spreads keys over several servers with consistent hashing,
+// so adding or removing a server only remaps about 1/N of the keys.
+// Like Client, it is not safe for concurrent use.
+type ShardedClient struct {
+	ring    []ringPoint
+	clients map[string]*Client
+
+	// hash places keys and servers on the ring; nil means ketama
+	hash hashing.Func
+}
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
+// NewShardedClient connects to every address and builds the hash ring.
+// Keys are placed as ketama clients place them, so they land on the same
+// servers as with other ketama-compatible clients.
+func NewShardedClient(addrs []string) (*ShardedClient, error) {
+	return NewShardedClientWithHash(addrs, nil)
+}
+
+// NewShardedClientWithHash is NewShardedClient with another hash function
+// for placing keys and servers on the ring, nil for ketama. Every client
+// of the same servers must use the same one.
+func NewShardedClientWithHash(addrs []string, hash hashing.Func) (*ShardedClient, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no server addresses given")
+	}
+
+	sc := &ShardedClient{
+		clients: make(map[string]*Client, len(addrs)),
+		hash:    hash,
+	}
+
+	for _, addr := range addrs {
+		err := sc.AddNode(addr)
+		if err != nil {
+			sc.Close()
+			return nil, err
+		}
+	}
+
+	return sc, nil
+}
+
+// AddNode connects to a new server and gives it a share of the ring
+func (sc *ShardedClient) AddNode(addr string) error {
+	if _, exists := sc.clients[addr]; exists {
+		return nil
+	}
+
+	c, err := Dial(addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	sc.clients[addr] = c
+
+	sc.ring = append(sc.ring, ringPointsFor(addr, sc.hash)...)
+	sort.Slice(sc.ring, func(i, j int) bool {
+		return sc.ring[i].hash < sc.ring[j].hash
+	})
+
+	return nil
+}
+
+// RemoveNode drops a server from the ring and closes its connection.
+// Its keys move to the next server clockwise; other keys stay put.
+func (sc *ShardedClient) RemoveNode(addr string) {
+	c, exists := sc.clients[addr]
+	if !exists {
+		return
+	}
+	c.Close()
+	delete(sc.clients, addr)
+
+	kept := sc.ring[:0]
+	for _, p := range sc.ring {
+		if p.addr != addr {
+			kept = append(kept, p)
+		}
+	}
+	sc.ring = kept
+}
+
+// NodeFor returns the address of the server that owns key
+func (sc *ShardedClient) NodeFor(key string) string {
+	if len(sc.ring) == 0 {
+		return ""
+	}
+
+	var h uint32
+	if sc.hash != nil {
+		h = hashing.Mix(sc.hash(key))
+	} else {
+		h = hashing.Ketama(key)
+	}
+	idx := sort.Search(len(sc.ring), func(i int) bool {
+		return sc.ring[i].hash >= h
+	})
+	if idx == len(sc.ring) {
+		idx = 0 // wrap around the ring
+	}
+
+	return sc.ring[idx].addr
+}
+
+// Get returns the value for key from the owning server
+// Returns: value, found, error
+func (sc *ShardedClient) Get(key string) (string, bool, error) {
+	c, err := sc.clientFor(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	reply, err := c.Do("GET", key)
+	if err != nil {
+		return "", false, err
+	}
+	if reply == nil {
+		return "", false, nil
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("unexpected GET reply: %v", reply)
+	}
+	return value, true, nil
+}
+
+// Set stores key on the owning server
+func (sc *ShardedClient) Set(key, value string) error {
+	c, err := sc.clientFor(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("SET", key, value)
+	return err
+}
+
+// Del deletes key from the owning server
+func (sc *ShardedClient) Del(key string) error {
+	c, err := sc.clientFor(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("DEL", key)
+	return err
+}
+
+// Close closes every server connection
+func (sc *ShardedClient) Close() error {
+	var firstErr error
+	for addr, c := range sc.clients {
+		err := c.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(sc.clients, addr)
+	}
+	sc.ring = nil
+	return firstErr
+}
+
+func (sc *ShardedClient) clientFor(key string) (*Client, error) {
+	addr := sc.NodeFor(key)
+	c, exists := sc.clients[addr]
+	if !exists {
+		return nil, fmt.Errorf("no servers available")
+	}
+	return c, nil
+}
+
+// ringPointsFor places a server on the ring the way ketama does:
+// hash "addr-i" with MD5 and cut each digest into four 32-bit points.
+// With another hash each point is the hash of "addr-i", mixed so that a
+// server's points spread around the ring even if the hash keeps similar
+// strings close.
+func ringPointsFor(addr string, hash hashing.Func) []ringPoint {
+	points := make([]ringPoint, 0, pointsPerNode)
+	if hash != nil {
+		for i := 0; i < pointsPerNode; i++ {
+			points = append(points, ringPoint{
+				hash: hashing.Mix(hash(addr + "-" + strconv.Itoa(i))),
+				addr: addr,
+			})
+		}
+		return points
+	}
+
+	for i := 0; i < pointsPerNode/4; i++ {
+		digest := md5.Sum([]byte(addr + "-" + strconv.Itoa(i)))
+		for j := 0; j < 4; j++ {
+			points = append(points, ringPoint{
+				hash: binary.LittleEndian.Uint32(digest[j*4:]),
+				addr: addr,
+			})
+		}
+	}
+	return points
+}
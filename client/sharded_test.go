@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"small-redis/hashing"
+	"sync"
+	"testing"
+)
+
+// startKVServer runs a server that answers GET, SET and DEL from its own
+// map, enough for ShardedClient, and returns its address and the map
+func startKVServer(t *testing.T) (string, *sync.Map) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	data := new(sync.Map)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					reply, err := readReply(reader)
+					if err != nil {
+						return
+					}
+					args := reply.([]interface{})
+					switch args[0] {
+					case "SET":
+						data.Store(args[1], args[2])
+						fmt.Fprint(conn, "+OK\r\n")
+					case "DEL":
+						data.Delete(args[1])
+						fmt.Fprint(conn, ":1\r\n")
+					case "GET":
+						if value, ok := data.Load(args[1]); ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value.(string)), value)
+						} else {
+							fmt.Fprint(conn, "$-1\r\n")
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), data
+}
+
+func startKVServers(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i], _ = startKVServer(t)
+	}
+	return addrs
+}
+
+func TestShardedClientRoutesByKey(t *testing.T) {
+	addr1, data1 := startKVServer(t)
+	addr2, data2 := startKVServer(t)
+	sc, err := NewShardedClient([]string{addr1, addr2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if err := sc.Set(key, "v"+key); err != nil {
+			t.Fatal(err)
+		}
+		owner, other := data1, data2
+		if sc.NodeFor(key) == addr2 {
+			owner, other = data2, data1
+		}
+		if _, ok := owner.Load(key); !ok {
+			t.Errorf("%s isn't on %s, the server that owns it", key, sc.NodeFor(key))
+		}
+		if _, ok := other.Load(key); ok {
+			t.Errorf("%s was also written to the other server", key)
+		}
+
+		value, found, err := sc.Get(key)
+		if err != nil || !found || value != "v"+key {
+			t.Errorf("Get(%s) = %q, %v, %v", key, value, found, err)
+		}
+		if err := sc.Del(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, _ := sc.Get(key); found {
+			t.Errorf("%s still found after Del", key)
+		}
+	}
+}
+
+// Keys spread roughly evenly, and removing one of N servers moves only
+// the keys it held, about 1/N of them
+func TestShardedClientDistributionAndRemap(t *testing.T) {
+	const nodes, keys = 5, 20000
+
+	for name, hash := range map[string]hashing.Func{"ketama": nil, "fnv1a": hashing.FNV1a} {
+		t.Run(name, func(t *testing.T) {
+			addrs := startKVServers(t, nodes)
+			sc, err := NewShardedClientWithHash(addrs, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sc.Close()
+
+			before := make(map[string]string, keys)
+			counts := make(map[string]int)
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("user:%d", i)
+				before[key] = sc.NodeFor(key)
+				counts[before[key]]++
+			}
+			for _, addr := range addrs {
+				share := float64(counts[addr]) / keys
+				if share < 0.5/nodes || share > 1.5/nodes {
+					t.Errorf("%s owns %.1f%% of the keys, want about %.0f%%", addr, share*100, 100.0/nodes)
+				}
+			}
+
+			removed := addrs[2]
+			sc.RemoveNode(removed)
+			moved := 0
+			for key, owner := range before {
+				now := sc.NodeFor(key)
+				if now == removed {
+					t.Fatalf("%s still maps to the removed server", key)
+				}
+				if now != owner {
+					if owner != removed {
+						t.Fatalf("%s moved from %s though that server is still there", key, owner)
+					}
+					moved++
+				}
+			}
+			if moved != counts[removed] {
+				t.Errorf("%d keys moved, want the %d the removed server held", moved, counts[removed])
+			}
+		})
+	}
+}
+
+// The same key maps to the same server on every call and in every client
+// built over the same servers and hash, custom ones included
+func TestShardedClientStableMapping(t *testing.T) {
+	addrs := startKVServers(t, 3)
+	constant := func(string) uint32 { return 42 }
+	for name, hash := range map[string]hashing.Func{"ketama": nil, "fnv1a": hashing.FNV1a, "constant": constant} {
+		t.Run(name, func(t *testing.T) {
+			first, err := NewShardedClientWithHash(addrs, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			second, err := NewShardedClientWithHash(addrs, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("user:%d", i)
+				node := first.NodeFor(key)
+				if again := first.NodeFor(key); again != node {
+					t.Fatalf("%s maps to %s, then %s", key, node, again)
+				}
+				if other := second.NodeFor(key); other != node {
+					t.Fatalf("%s maps to %s in one client and %s in another", key, node, other)
+				}
+				if hash != nil && hash(key) == 42 && node != first.NodeFor("anything") {
+					t.Fatalf("%s and anything hash alike but map to different servers", key)
+				}
+			}
+		})
+	}
+}
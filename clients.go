@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientRegistry tracks the open connections for CLIENT LIST
+type clientRegistry struct {
+	mu       sync.RWMutex
+	sessions map[int64]*session
+}
+
+// Global registry of connected clients
+var clients = &clientRegistry{
+	sessions: make(map[int64]*session),
+}
+
+func (r *clientRegistry) add(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[sess.id] = sess
+}
+
+func (r *clientRegistry) remove(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, sess.id)
+}
+
+func (r *clientRegistry) get(id int64) (*session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sess, exists := r.sessions[id]
+	return sess, exists
+}
+
+// list returns the connected sessions ordered by id
+func (r *clientRegistry) list() []*session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].id < sessions[j].id
+	})
+	return sessions
+}
+
+// clientCommand handles CLIENT LIST, CLIENT INFO, CLIENT ID and
+// CLIENT TRACKING
+func (sess *session) clientCommand(args []string) string {
+	subcommand := strings.ToUpper(args[1])
+
+	switch subcommand {
+	case "ID":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'client|id' command\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", sess.id)
+
+	case "LIST":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'client|list' command\r\n"
+		}
+		var b strings.Builder
+		for _, client := range clients.list() {
+			b.WriteString(client.infoLine())
+			b.WriteString("\n")
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", b.Len(), b.String())
+
+	case "INFO":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'client|info' command\r\n"
+		}
+		return bulkString(sess.infoLine() + "\n")
+
+	case "TRACKING":
+		return sess.trackingCommand(args)
+
+	default:
+		return fmt.Sprintf("-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// infoLine describes the connection in CLIENT LIST format: idle is the
+// seconds since its last command and tot-cmds how many it has sent,
+// counting the one being answered
+func (sess *session) infoLine() string {
+	age := int64(time.Since(sess.createdAt).Seconds())
+	idle := int64(time.Since(time.Unix(0, sess.lastCommandAt.Load())).Seconds())
+	return fmt.Sprintf("id=%d addr=%s age=%d idle=%d tot-cmds=%d", sess.id, sess.addr, age, idle, sess.commands.Load())
+}
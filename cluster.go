@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// clusterSlots is the number of hash slots Redis Cluster divides keys into
+const clusterSlots = 16384
+
+// crc16 is CRC16-CCITT (XModem): polynomial 0x1021, initial value 0,
+// the checksum Redis Cluster hashes keys with
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keyHashSlot returns the slot for key. If the key contains a non-empty
+// {hashtag}, only the part between the first '{' and the next '}' is
+// hashed, so related keys can be kept in one slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// clusterCommand handles CLUSTER KEYSLOT key. There is no cluster; this
+// lets proxies and tooling compute slots the same way Redis does.
+func clusterCommand(args []string) string {
+	switch strings.ToUpper(args[1]) {
+	case "KEYSLOT":
+		if len(args) != 3 {
+			return "-ERR wrong number of arguments for 'cluster|keyslot' command\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", keyHashSlot(args[2]))
+	default:
+		return fmt.Sprintf("-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	// The check value of CRC16-CCITT (XModem)
+	if got := crc16("123456789"); got != 0x31C3 {
+		t.Errorf("crc16(123456789) = %#x, want 0x31c3", got)
+	}
+}
+
+// Slots as Redis computes them, including the hashtag rules from the
+// Redis Cluster specification
+func TestKeyHashSlot(t *testing.T) {
+	cases := []struct {
+		key  string
+		slot int
+	}{
+		{"somekey", 11058},
+		{"foo", 12182},
+		{"foo{hash_tag}", 2515},
+		{"hash_tag", 2515},
+		{"{user1000}.following", keyHashSlot("user1000")},
+		{"{user1000}.followers", keyHashSlot("user1000")},
+		{"foo{}{bar}", int(crc16("foo{}{bar}")) % clusterSlots}, // empty tag: whole key
+		{"foo{{bar}}zap", keyHashSlot("{bar")},                  // up to the first '}'
+		{"foo{bar}{zap}", keyHashSlot("bar")},                   // only the first tag
+		{"{unclosed", int(crc16("{unclosed")) % clusterSlots},
+		{"", 0},
+	}
+	for _, c := range cases {
+		if got := keyHashSlot(c.key); got != c.slot {
+			t.Errorf("keyHashSlot(%q) = %d, want %d", c.key, got, c.slot)
+		}
+	}
+}
+
+func TestClusterKeyslot(t *testing.T) {
+	c := dialTest(t)
+	expect(t, c, "11058", "CLUSTER", "KEYSLOT", "somekey")
+	expect(t, c, "2515", "CLUSTER", "KEYSLOT", "foo{hash_tag}")
+	expect(t, c, "ERR wrong number of arguments for 'cluster|keyslot' command", "CLUSTER", "KEYSLOT")
+	expect(t, c, "ERR unknown subcommand 'NODES'", "CLUSTER", "NODES")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commandArg describes one argument for COMMAND DOCS. typ is a Redis
+// argument type: key, string, integer, unix-time, pure-token, oneof or
+// block; the last two group the arguments in args.
+type commandArg struct {
+	name     string
+	typ      string
+	token    string
+	optional bool
+	multiple bool
+	args     []commandArg
+}
+
+// commandDoc is what COMMAND DOCS reports for a command
+type commandDoc struct {
+	summary string
+	group   string
+	args    []commandArg
+}
+
+func keyArg(name string) commandArg    { return commandArg{name: name, typ: "key"} }
+func stringArg(name string) commandArg { return commandArg{name: name, typ: "string"} }
+func intArg(name string) commandArg    { return commandArg{name: name, typ: "integer"} }
+
+// tokenArg is a keyword that is either present or not
+func tokenArg(token string) commandArg {
+	return commandArg{name: strings.ToLower(token), typ: "pure-token", token: token, optional: true}
+}
+
+// commandDocs documents every command in commandTable
+var commandDocs = map[string]commandDoc{
+	"PING": {summary: "Returns PONG.", group: "connection"},
+	"ECHO": {summary: "Returns the given string.", group: "connection",
+		args: []commandArg{stringArg("message")}},
+	"SET": {summary: "Sets the string value of a key, optionally only if it does or doesn't exist, and with an expiry.", group: "string",
+		args: []commandArg{keyArg("key"), stringArg("value"),
+			{name: "condition", typ: "oneof", optional: true, args: []commandArg{
+				{name: "nx", typ: "pure-token", token: "NX"},
+				{name: "xx", typ: "pure-token", token: "XX"},
+			}},
+			{name: "expiration", typ: "oneof", optional: true, args: []commandArg{
+				{name: "seconds", typ: "integer", token: "EX"},
+				{name: "milliseconds", typ: "integer", token: "PX"},
+				{name: "unix-time-seconds", typ: "unix-time", token: "EXAT"},
+				{name: "unix-time-milliseconds", typ: "unix-time", token: "PXAT"},
+			}},
+		}},
+	"GET": {summary: "Returns the string value of a key.", group: "string",
+		args: []commandArg{keyArg("key")}},
+	"EXISTS": {summary: "Returns how many of the given keys exist.", group: "generic",
+		args: []commandArg{{name: "key", typ: "key", multiple: true}}},
+	"INCR": {summary: "Increments the integer value of a key by one.", group: "string",
+		args: []commandArg{keyArg("key")}},
+	"DECR": {summary: "Decrements the integer value of a key by one.", group: "string",
+		args: []commandArg{keyArg("key")}},
+	"INCRBY": {summary: "Increments the integer value of a key by a number.", group: "string",
+		args: []commandArg{keyArg("key"), intArg("increment")}},
+	"DECRBY": {summary: "Decrements the integer value of a key by a number.", group: "string",
+		args: []commandArg{keyArg("key"), intArg("decrement")}},
+	"EXPIRE": {summary: "Sets the expiration time of a key in seconds.", group: "generic",
+		args: []commandArg{keyArg("key"), intArg("seconds")}},
+	"PEXPIREAT": {summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.", group: "generic",
+		args: []commandArg{keyArg("key"), {name: "unix-time-milliseconds", typ: "unix-time"}}},
+	"TTL": {summary: "Returns the expiration time in seconds of a key.", group: "generic",
+		args: []commandArg{keyArg("key")}},
+	"SETRANGE": {summary: "Overwrites part of a string value from an offset, padding with zero bytes.", group: "string",
+		args: []commandArg{keyArg("key"), intArg("offset"), stringArg("value")}},
+	"GETRANGE": {summary: "Returns a substring of the string value of a key.", group: "string",
+		args: []commandArg{keyArg("key"), intArg("start"), intArg("end")}},
+	"GETDEL": {summary: "Returns the string value of a key and deletes it.", group: "string",
+		args: []commandArg{keyArg("key")}},
+	"GETEX": {summary: "Returns the string value of a key after setting or removing its expiry.", group: "string",
+		args: []commandArg{keyArg("key"),
+			{name: "expiration", typ: "oneof", optional: true, args: []commandArg{
+				{name: "seconds", typ: "integer", token: "EX"},
+				{name: "milliseconds", typ: "integer", token: "PX"},
+				{name: "unix-time-seconds", typ: "unix-time", token: "EXAT"},
+				{name: "unix-time-milliseconds", typ: "unix-time", token: "PXAT"},
+				{name: "persist", typ: "pure-token", token: "PERSIST"},
+			}},
+		}},
+	"DEL": {summary: "Deletes keys and returns how many existed.", group: "generic",
+		args: []commandArg{{name: "key", typ: "key", multiple: true}}},
+	"DELPATTERN": {summary: "Deletes every key matching a glob pattern.", group: "generic",
+		args: []commandArg{stringArg("pattern")}},
+	"FLUSHDB": {summary: "Removes all keys.", group: "server",
+		args: []commandArg{{name: "flush-type", typ: "oneof", optional: true, args: []commandArg{
+			{name: "async", typ: "pure-token", token: "ASYNC"},
+			{name: "sync", typ: "pure-token", token: "SYNC"},
+		}}}},
+	"DBSIZE": {summary: "Returns the number of keys.", group: "server",
+		args: []commandArg{tokenArg("APPROX")}},
+	"DUMP": {summary: "Returns a serialized representation of the value stored at a key.", group: "generic",
+		args: []commandArg{keyArg("key")}},
+	"RESTORE": {summary: "Creates a key from the serialized representation of a value.", group: "generic",
+		args: []commandArg{keyArg("key"), intArg("ttl"), stringArg("serialized-value"), tokenArg("REPLACE")}},
+	"MIGRATE": {summary: "Moves a key to another instance.", group: "generic",
+		args: []commandArg{stringArg("host"), intArg("port"), keyArg("key"), intArg("destination-db"),
+			intArg("timeout"), tokenArg("COPY"), tokenArg("REPLACE")}},
+	"BGREWRITEAOF": {summary: "Rewrites the append-only file in the background.", group: "server"},
+	"MULTI":        {summary: "Starts a transaction.", group: "transactions"},
+	"EXEC":         {summary: "Runs the queued commands of a transaction.", group: "transactions"},
+	"DISCARD":      {summary: "Discards a transaction.", group: "transactions"},
+	"SUBSCRIBE": {summary: "Listens for messages published to channels.", group: "pubsub",
+		args: []commandArg{{name: "channel", typ: "string", multiple: true}}},
+	"UNSUBSCRIBE": {summary: "Stops listening to channels, or to all of them.", group: "pubsub",
+		args: []commandArg{{name: "channel", typ: "string", optional: true, multiple: true}}},
+	"PUBLISH": {summary: "Posts a message to a channel.", group: "pubsub",
+		args: []commandArg{stringArg("channel"), stringArg("message")}},
+	"SSUBSCRIBE": {summary: "Listens for messages published to shard channels.", group: "pubsub",
+		args: []commandArg{{name: "shardchannel", typ: "key", multiple: true}}},
+	"SUNSUBSCRIBE": {summary: "Stops listening to shard channels, or to all of them.", group: "pubsub",
+		args: []commandArg{{name: "shardchannel", typ: "key", optional: true, multiple: true}}},
+	"SPUBLISH": {summary: "Posts a message to a shard channel.", group: "pubsub",
+		args: []commandArg{keyArg("shardchannel"), stringArg("message")}},
+	"HELLO": {summary: "Switches the connection to RESP2 or RESP3 and describes the server.", group: "connection",
+		args: []commandArg{{name: "protover", typ: "integer", optional: true}}},
+	"QUIT": {summary: "Closes the connection.", group: "connection"},
+	"INFO": {summary: "Returns information and statistics about the server.", group: "server",
+		args: []commandArg{{name: "section", typ: "string", optional: true, multiple: true}}},
+	"DEBUG": {summary: "Administrative helpers.", group: "server",
+		args: []commandArg{{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "change-repl-id", typ: "pure-token", token: "CHANGE-REPL-ID"},
+			{name: "clear-wal-errors", typ: "pure-token", token: "CLEAR-WAL-ERRORS"},
+			{name: "wal", typ: "block", args: []commandArg{
+				{name: "wal", typ: "pure-token", token: "WAL"},
+				{name: "verify", typ: "pure-token", token: "VERIFY"},
+			}},
+			{name: "compact", typ: "block", args: []commandArg{
+				{name: "compact", typ: "pure-token", token: "COMPACT"},
+				tokenArg("ASYNC"),
+			}},
+		}}}},
+	"CLIENT": {summary: "Describes clients, returns the connection id or configures client-side caching.", group: "connection",
+		args: []commandArg{{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "list", typ: "pure-token", token: "LIST"},
+			{name: "info", typ: "pure-token", token: "INFO"},
+			{name: "id", typ: "pure-token", token: "ID"},
+			{name: "tracking", typ: "block", args: []commandArg{
+				{name: "tracking", typ: "pure-token", token: "TRACKING"},
+				{name: "status", typ: "oneof", args: []commandArg{
+					{name: "on", typ: "pure-token", token: "ON"},
+					{name: "off", typ: "pure-token", token: "OFF"},
+				}},
+				{name: "client-id", typ: "integer", token: "REDIRECT", optional: true},
+			}},
+		}}}},
+	"CONFIG": {summary: "Reads or changes runtime settings.", group: "server",
+		args: []commandArg{{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "get", typ: "block", args: []commandArg{
+				{name: "get", typ: "pure-token", token: "GET"},
+				stringArg("pattern"),
+			}},
+			{name: "set", typ: "block", args: []commandArg{
+				{name: "set", typ: "pure-token", token: "SET"},
+				stringArg("parameter"),
+				stringArg("value"),
+			}},
+		}}}},
+	"COMMAND": {summary: "Describes the server's commands.", group: "server",
+		args: []commandArg{{name: "subcommand", typ: "oneof", optional: true, args: []commandArg{
+			{name: "count", typ: "pure-token", token: "COUNT"},
+			{name: "info", typ: "block", args: []commandArg{
+				{name: "info", typ: "pure-token", token: "INFO"},
+				{name: "command-name", typ: "string", optional: true, multiple: true},
+			}},
+			{name: "docs", typ: "block", args: []commandArg{
+				{name: "docs", typ: "pure-token", token: "DOCS"},
+				{name: "command-name", typ: "string", optional: true, multiple: true},
+			}},
+		}}}},
+	"CLUSTER": {summary: "Returns the hash slot of a key.", group: "cluster",
+		args: []commandArg{{name: "keyslot", typ: "pure-token", token: "KEYSLOT"}, stringArg("key")}},
+	"ROLE": {summary: "Returns the replication role.", group: "server"},
+}
+
+// commandDocsReply answers COMMAND DOCS [name ...] in the RESP2 form of
+// Redis 7: name, then a flat array of field/value pairs. Unknown names
+// are left out; with no names every command is described.
+func commandDocsReply(names []string) string {
+	if len(names) == 0 {
+		for name := range commandTable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var body strings.Builder
+	count := 0
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		spec, exists := commandTable[name]
+		if !exists {
+			continue
+		}
+		count++
+		doc := commandDocs[name]
+
+		fields := 2
+		if len(doc.args) > 0 {
+			fields = 3
+		}
+		fmt.Fprintf(&body, "$%d\r\n%s\r\n*%d\r\n", len(spec.name), spec.name, fields*2)
+		fmt.Fprintf(&body, "$7\r\nsummary\r\n%s", bulkString(doc.summary))
+		fmt.Fprintf(&body, "$5\r\ngroup\r\n%s", bulkString(doc.group))
+		if len(doc.args) > 0 {
+			body.WriteString("$9\r\narguments\r\n")
+			writeCommandArgs(&body, doc.args)
+		}
+	}
+
+	return fmt.Sprintf("*%d\r\n", count*2) + body.String()
+}
+
+// writeCommandArgs writes args as an array of field/value arrays. Key
+// arguments point at key spec 0, the only one a command has here.
+func writeCommandArgs(w *strings.Builder, args []commandArg) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var flags []string
+		if arg.optional {
+			flags = append(flags, "optional")
+		}
+		if arg.multiple {
+			flags = append(flags, "multiple")
+		}
+
+		fields := 2
+		if arg.typ == "key" {
+			fields++
+		}
+		if arg.token != "" {
+			fields++
+		}
+		if len(flags) > 0 {
+			fields++
+		}
+		if len(arg.args) > 0 {
+			fields++
+		}
+
+		fmt.Fprintf(w, "*%d\r\n", fields*2)
+		fmt.Fprintf(w, "$4\r\nname\r\n%s", bulkString(arg.name))
+		fmt.Fprintf(w, "$4\r\ntype\r\n%s", bulkString(arg.typ))
+		if arg.typ == "key" {
+			w.WriteString("$14\r\nkey_spec_index\r\n:0\r\n")
+		}
+		if arg.token != "" {
+			fmt.Fprintf(w, "$5\r\ntoken\r\n%s", bulkString(arg.token))
+		}
+		if len(flags) > 0 {
+			fmt.Fprintf(w, "$5\r\nflags\r\n*%d\r\n", len(flags))
+			for _, flag := range flags {
+				fmt.Fprintf(w, "+%s\r\n", flag)
+			}
+		}
+		if len(arg.args) > 0 {
+			w.WriteString("$9\r\narguments\r\n")
+			writeCommandArgs(w, arg.args)
+		}
+	}
+}
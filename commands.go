@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Command flags, named as in Redis COMMAND INFO
+const (
+	flagWrite    = 1 << iota // may modify the dataset; refused in read-only mode
+	flagReadOnly             // only reads data
+	flagAdmin                // server administration
+	flagFast                 // O(1) or O(log N)
+	flagLoading              // allowed while the dataset is loading
+	flagPubSub               // manages subscriptions; allowed in subscribe mode
+)
+
+var flagNames = []struct {
+	flag int
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadOnly, "readonly"},
+	{flagAdmin, "admin"},
+	{flagFast, "fast"},
+	{flagLoading, "loading"},
+	{flagPubSub, "pubsub"},
+}
+
+// commandSpec describes a command for validation before it runs.
+// Arity follows Redis: positive means exactly that many arguments
+// (including the command name), negative means at least -arity.
+// firstKey, lastKey and step locate the key arguments (0 if none).
+type commandSpec struct {
+	name     string
+	arity    int
+	flags    int
+	firstKey int
+	lastKey  int
+	step     int
+}
+
+// commandTable lists every command the server understands
+var commandTable = map[string]commandSpec{
+	"PING":         {name: "ping", arity: -1, flags: flagFast | flagLoading},
+	"ECHO":         {name: "echo", arity: -2, flags: flagFast},
+	"SET":          {name: "set", arity: -3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+	"GET":          {name: "get", arity: -2, flags: flagReadOnly | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"EXISTS":       {name: "exists", arity: -2, flags: flagReadOnly | flagFast, firstKey: 1, lastKey: -1, step: 1},
+	"INCR":         {name: "incr", arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"DECR":         {name: "decr", arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"INCRBY":       {name: "incrby", arity: 3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"DECRBY":       {name: "decrby", arity: 3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"EXPIRE":       {name: "expire", arity: 3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"PEXPIREAT":    {name: "pexpireat", arity: 3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"TTL":          {name: "ttl", arity: 2, flags: flagReadOnly | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"SETRANGE":     {name: "setrange", arity: 4, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+	"GETRANGE":     {name: "getrange", arity: 4, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+	"GETDEL":       {name: "getdel", arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"GETEX":        {name: "getex", arity: -2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, step: 1},
+	"DEL":          {name: "del", arity: -2, flags: flagWrite, firstKey: 1, lastKey: -1, step: 1},
+	"DELPATTERN":   {name: "delpattern", arity: 2, flags: flagWrite},
+	"FLUSHDB":      {name: "flushdb", arity: -1, flags: flagWrite},
+	"DBSIZE":       {name: "dbsize", arity: -1, flags: flagReadOnly | flagFast},
+	"DUMP":         {name: "dump", arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+	"RESTORE":      {name: "restore", arity: -4, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+	"MIGRATE":      {name: "migrate", arity: -6, flags: flagWrite, firstKey: 3, lastKey: 3, step: 1},
+	"BGREWRITEAOF": {name: "bgrewriteaof", arity: 1, flags: flagAdmin},
+	"MULTI":        {name: "multi", arity: 1, flags: flagFast | flagLoading},
+	"EXEC":         {name: "exec", arity: 1, flags: flagLoading},
+	"DISCARD":      {name: "discard", arity: 1, flags: flagFast | flagLoading},
+	"SUBSCRIBE":    {name: "subscribe", arity: -2, flags: flagPubSub | flagLoading},
+	"UNSUBSCRIBE":  {name: "unsubscribe", arity: -1, flags: flagPubSub | flagLoading},
+	"PUBLISH":      {name: "publish", arity: 3, flags: flagFast | flagLoading},
+	"SSUBSCRIBE":   {name: "ssubscribe", arity: -2, flags: flagPubSub | flagLoading, firstKey: 1, lastKey: -1, step: 1},
+	"SUNSUBSCRIBE": {name: "sunsubscribe", arity: -1, flags: flagPubSub | flagLoading, firstKey: 1, lastKey: -1, step: 1},
+	"SPUBLISH":     {name: "spublish", arity: 3, flags: flagFast | flagLoading, firstKey: 1, lastKey: 1, step: 1},
+	"HELLO":        {name: "hello", arity: -1, flags: flagFast | flagLoading},
+	"QUIT":         {name: "quit", arity: -1, flags: flagFast | flagLoading},
+	"INFO":         {name: "info", arity: -1, flags: flagLoading},
+	"DEBUG":        {name: "debug", arity: -2, flags: flagAdmin},
+	"CLIENT":       {name: "client", arity: -2, flags: flagLoading},
+	"CONFIG":       {name: "config", arity: -2, flags: flagAdmin | flagLoading},
+	"COMMAND":      {name: "command", arity: -1, flags: flagLoading},
+	"CLUSTER":      {name: "cluster", arity: -2, flags: flagLoading},
+	"ROLE":         {name: "role", arity: 1, flags: flagFast | flagLoading},
+}
+
+// hasFlag reports whether command is known and carries flag
+func hasFlag(command string, flag int) bool {
+	return commandTable[command].flags&flag != 0
+}
+
+// commandKeys returns the key arguments of a validated command. A
+// negative lastKey counts from the end, as in Redis.
+func commandKeys(command string, args []string) []string {
+	spec := commandTable[command]
+	if spec.firstKey == 0 {
+		return nil
+	}
+
+	last := spec.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+
+	var keys []string
+	for i := spec.firstKey; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// unknownCommandArgsLimit is how much of an unknown command's arguments
+// the error quotes, as in Redis
+const unknownCommandArgsLimit = 128
+
+// unknownCommandError names the command as sent and quotes the start of
+// its arguments, in the format Redis uses. Line breaks become spaces so
+// the client's bytes can't end the error reply early.
+func unknownCommandError(args []string) error {
+	var quoted strings.Builder
+	for _, arg := range args[1:] {
+		if quoted.Len() >= unknownCommandArgsLimit {
+			break
+		}
+		room := unknownCommandArgsLimit - quoted.Len()
+		fmt.Fprintf(&quoted, "'%s' ", truncate(arg, room))
+	}
+	message := fmt.Sprintf("unknown command '%s', with args beginning with: %s",
+		truncate(args[0], unknownCommandArgsLimit), quoted.String())
+	return errors.New(lineBreaks.Replace(message))
+}
+
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// ValidateCommand checks a command's name and arity without running it.
+// The error text is what dispatch would reply with after "-ERR ".
+func ValidateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	command := strings.ToUpper(args[0])
+	spec, exists := commandTable[command]
+	if !exists {
+		return unknownCommandError(args)
+	}
+
+	if (spec.arity > 0 && len(args) != spec.arity) || (spec.arity < 0 && len(args) < -spec.arity) {
+		return fmt.Errorf("wrong number of arguments for '%s' command", spec.name)
+	}
+
+	return nil
+}
+
+// commandCommand handles COMMAND, COMMAND COUNT, COMMAND INFO [name ...]
+// and COMMAND DOCS [name ...]
+func commandCommand(args []string) string {
+	if len(args) == 1 {
+		names := make([]string, 0, len(commandTable))
+		for name := range commandTable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return commandInfoReply(names)
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "COUNT":
+		return fmt.Sprintf(":%d\r\n", len(commandTable))
+	case "INFO":
+		names := make([]string, 0, len(args)-2)
+		for _, name := range args[2:] {
+			names = append(names, strings.ToUpper(name))
+		}
+		return commandInfoReply(names)
+	case "DOCS":
+		return commandDocsReply(args[2:])
+	default:
+		return fmt.Sprintf("-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
+
+// commandInfoReply describes each command as
+// [name, arity, [flags], first key, last key, step], or nil if unknown
+func commandInfoReply(names []string) string {
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "*%d\r\n", len(names))
+
+	for _, name := range names {
+		spec, exists := commandTable[name]
+		if !exists {
+			reply.WriteString("*-1\r\n")
+			continue
+		}
+
+		fmt.Fprintf(&reply, "*6\r\n$%d\r\n%s\r\n:%d\r\n", len(spec.name), spec.name, spec.arity)
+
+		var flags []string
+		for _, f := range flagNames {
+			if spec.flags&f.flag != 0 {
+				flags = append(flags, f.name)
+			}
+		}
+		fmt.Fprintf(&reply, "*%d\r\n", len(flags))
+		for _, flag := range flags {
+			fmt.Fprintf(&reply, "+%s\r\n", flag)
+		}
+
+		fmt.Fprintf(&reply, ":%d\r\n:%d\r\n:%d\r\n", spec.firstKey, spec.lastKey, spec.step)
+	}
+
+	return reply.String()
+}
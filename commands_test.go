@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  string // substring of the error, "" for none
+	}{
+		{[]string{"GET", "k"}, ""},
+		{[]string{"get", "k"}, ""},
+		{[]string{"SET", "k", "v", "EX", "10"}, ""},
+		{[]string{"GET"}, "wrong number of arguments for 'get' command"},
+		{[]string{"TTL", "a", "b"}, "wrong number of arguments for 'ttl' command"},
+		{[]string{"SET", "k"}, "wrong number of arguments for 'set' command"},
+		{[]string{"NOPE", "x"}, "unknown command 'NOPE'"},
+		{[]string{}, "empty command"},
+	} {
+		err := ValidateCommand(tc.args)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("ValidateCommand(%q) = %v", tc.args, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("ValidateCommand(%q) = %v, want %q", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	for command, want := range map[string]int{
+		"SET":       flagWrite,
+		"GET":       flagReadOnly | flagFast,
+		"INCR":      flagWrite | flagFast,
+		"DEL":       flagWrite,
+		"DBSIZE":    flagReadOnly | flagFast,
+		"PING":      flagFast | flagLoading,
+		"INFO":      flagLoading,
+		"DEBUG":     flagAdmin,
+		"CONFIG":    flagAdmin | flagLoading,
+		"SUBSCRIBE": flagPubSub | flagLoading,
+	} {
+		if got := commandTable[command].flags; got != want {
+			t.Errorf("%s flags = %b, want %b", command, got, want)
+		}
+	}
+
+	// Every command that takes keys either writes them or only reads them
+	for command, spec := range commandTable {
+		if spec.firstKey == 0 || spec.flags&flagPubSub != 0 || command == "SPUBLISH" {
+			continue
+		}
+		if (spec.flags&flagWrite != 0) == (spec.flags&flagReadOnly != 0) {
+			t.Errorf("%s takes keys but is flagged %b, want exactly one of write and readonly", command, spec.flags)
+		}
+	}
+}
+
+func TestCommandInfo(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, []interface{}{
+		[]interface{}{"get", -2, []interface{}{"readonly", "fast"}, 1, 1, 1},
+		[]interface{}{"incr", 2, []interface{}{"write", "fast"}, 1, 1, 1},
+		nil,
+	}, "COMMAND", "INFO", "get", "INCR", "nosuchcommand")
+}
+
+// Every write-flagged command is refused in read-only mode, while
+// read-only ones still run
+func TestWriteCommandsRefusedReadOnly(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "1")
+	useReadOnly(t, c)
+
+	for _, args := range [][]string{
+		{"SET", "k", "2"},
+		{"INCR", "k"},
+		{"DEL", "k"},
+		{"GETDEL", "k"},
+		{"GETEX", "k", "PERSIST"},
+		{"EXPIRE", "k", "10"},
+		{"SETRANGE", "k", "0", "x"},
+		{"FLUSHDB"},
+		{"DELPATTERN", "*"},
+	} {
+		if !hasFlag(args[0], flagWrite) {
+			t.Fatalf("%s isn't flagged write", args[0])
+		}
+		reply := do(t, c, args...)
+		if err, isErr := reply.(error); !isErr || !strings.HasPrefix(err.Error(), "READONLY") {
+			t.Errorf("%v = %v, want READONLY", args, reply)
+		}
+	}
+	expect(t, c, "1", "GET", "k")
+	expect(t, c, 1, "DBSIZE")
+	expect(t, c, -1, "TTL", "k")
+}
+
+// Unknown commands are reported as Redis does, quoting the command as sent
+// and the start of its arguments
+func TestUnknownCommandError(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "ERR unknown command 'nope', with args beginning with: 'a' 'b c' ", "nope", "a", "b c")
+	expect(t, c, "ERR unknown command 'NOPE', with args beginning with: ", "NOPE")
+
+	// Long arguments are cut off, and line breaks can't end the reply early
+	long := strings.Repeat("x", 200)
+	want := "ERR unknown command 'nope', with args beginning with: '" + long[:unknownCommandArgsLimit] + "' "
+	expect(t, c, want, "nope", long, "never quoted")
+	expect(t, c, "ERR unknown command 'no  pe', with args beginning with: 'a b' ", "no\r\npe", "a\nb")
+	expect(t, c, "PONG", "PING")
+}
+
+// fieldMap turns a flat field/value array from COMMAND DOCS into a map
+func fieldMap(t *testing.T, reply interface{}) map[string]interface{} {
+	t.Helper()
+	pairs, ok := reply.([]interface{})
+	if !ok || len(pairs)%2 != 0 {
+		t.Fatalf("%v isn't a field/value array", reply)
+	}
+	fields := make(map[string]interface{})
+	for i := 0; i < len(pairs); i += 2 {
+		fields[fmt.Sprint(pairs[i])] = pairs[i+1]
+	}
+	return fields
+}
+
+// COMMAND DOCS describes SET's key position and options, and with no
+// names describes every registered command
+func TestCommandDocs(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	reply, ok := do(t, c, "COMMAND", "DOCS", "set", "nosuchcommand").([]interface{})
+	if !ok || len(reply) != 2 || reply[0] != "set" {
+		t.Fatalf("COMMAND DOCS set = %v, want one entry for set", reply)
+	}
+	doc := fieldMap(t, reply[1])
+	if doc["group"] != "string" || doc["summary"] == "" {
+		t.Errorf("set docs = %v", doc)
+	}
+	args, _ := doc["arguments"].([]interface{})
+	if len(args) != 4 {
+		t.Fatalf("set has arguments %v, want key, value, condition and expiration", doc["arguments"])
+	}
+	key := fieldMap(t, args[0])
+	if key["name"] != "key" || key["type"] != "key" || fmt.Sprint(key["key_spec_index"]) != "0" {
+		t.Errorf("set's first argument = %v, want the key", key)
+	}
+	expect(t, c, []interface{}{[]interface{}{"set", -3, []interface{}{"write"}, 1, 1, 1}}, "COMMAND", "INFO", "set")
+
+	tokens := make(map[string]bool)
+	for _, arg := range args[2:] {
+		option := fieldMap(t, arg)
+		if flags := fmt.Sprint(option["flags"]); option["type"] != "oneof" || flags != "[optional]" {
+			t.Errorf("set option %v isn't an optional oneof", option)
+		}
+		choices, _ := option["arguments"].([]interface{})
+		for _, choice := range choices {
+			tokens[fmt.Sprint(fieldMap(t, choice)["token"])] = true
+		}
+	}
+	for _, token := range []string{"NX", "XX", "EX", "PX", "EXAT", "PXAT"} {
+		if !tokens[token] {
+			t.Errorf("set docs don't list the %s option", token)
+		}
+	}
+
+	all, _ := do(t, c, "COMMAND", "DOCS").([]interface{})
+	if len(all) != 2*len(commandTable) {
+		t.Errorf("COMMAND DOCS describes %d commands, want the %d registered", len(all)/2, len(commandTable))
+	}
+	expect(t, c, len(commandTable), "COMMAND", "COUNT")
+	for name := range commandTable {
+		if commandDocs[name].summary == "" {
+			t.Errorf("%s has no docs", name)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"small-redis/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// serverConfig holds settings that come from command line flags
+type serverConfig struct {
+	TombstoneFreeDeletes bool
+	AppendOnly           bool
+	AppendFilename       string
+	MaxOpenSSTables      int
+	CompressThreshold    int
+	SSTableDictionary    bool
+	SSTableMaxSize       int64
+	MemTableAdaptiveMin  int64
+	MemTableAdaptiveMax  int64
+	MemTableIdleFlush    int
+	WALRewriteSize       int64
+	VerifySSTables       bool
+	Persistence          string
+
+	// Settings below can also be changed at runtime with CONFIG SET
+	ReplicaReadOnly boolSetting
+	ProtoMaxBulkLen bulkLenSetting
+	CommandTimeout  intSetting // milliseconds, 0 = no limit
+
+	ClientCommandRate intSetting // commands per second per connection, 0 = no limit
+	PubSubOutputLimit outputBufferLimit
+}
+
+var config serverConfig
+
+// registerConfigFlags binds the server settings to command line flags
+func registerConfigFlags() {
+	flag.BoolVar(&config.TombstoneFreeDeletes, "tombstone-free-deletes", false,
+		"drop deleted keys that were never flushed instead of writing tombstones")
+	flag.BoolVar(&config.AppendOnly, "appendonly", false,
+		"log every write command to an append-only file and replay it on startup")
+	flag.StringVar(&config.AppendFilename, "appendfilename", "appendonly.aof",
+		"path of the append-only file")
+	flag.IntVar(&config.MaxOpenSSTables, "max-open-sstables", storage.DefaultMaxOpenFiles,
+		"maximum number of SSTable files kept open at once")
+	flag.IntVar(&config.CompressThreshold, "memtable-compress-threshold", 0,
+		"compress memtable values of at least this many bytes (0 = off)")
+	flag.Int64Var(&config.MemTableAdaptiveMin, "memtable-adaptive-min", 500,
+		"smallest memtable flush threshold in bytes when adaptive sizing is on")
+	flag.Int64Var(&config.MemTableAdaptiveMax, "memtable-adaptive-max", 0,
+		"largest memtable flush threshold in bytes; > 0 sizes the memtable by the write rate (0 = fixed size)")
+	flag.IntVar(&config.MemTableIdleFlush, "memtable-idle-flush", 0,
+		"flush the memtable after this many seconds without writes (0 = off)")
+	flag.Int64Var(&config.WALRewriteSize, "wal-rewrite-size", storage.DefaultWALRewriteSize,
+		"rewrite the WAL with only the newest record per key once it is this many bytes and has doubled since the last rewrite (0 = never)")
+	flag.BoolVar(&config.SSTableDictionary, "sstable-dictionary", false,
+		"compress SSTable values against a dictionary sampled from each table")
+	flag.Int64Var(&config.SSTableMaxSize, "sstable-max-size", 0,
+		"split compaction output into SSTables of at most this many bytes (0 = no limit)")
+	flag.BoolVar(&config.VerifySSTables, "verify-sstables", false,
+		"check every SSTable's footer, index and entries at startup")
+	flag.StringVar(&config.Persistence, "persistence", "lsm",
+		"lsm to keep data in the WAL and SSTables, none for a volatile in-memory cache")
+	flag.Var(&config.ReplicaReadOnly, "replica-read-only",
+		"reject write commands with -READONLY")
+
+	config.ProtoMaxBulkLen.Store(defaultProtoMaxBulkLen)
+	flag.Var(&config.ProtoMaxBulkLen, "proto-max-bulk-len",
+		"largest bulk string a client may send, in bytes or with a k, kb, m, mb, g or gb suffix (at least 1mb)")
+	flag.Var(&config.CommandTimeout, "command-timeout",
+		"milliseconds after which commands that scan the keyspace give up (0 = no limit)")
+	flag.Var(&config.ClientCommandRate, "client-command-rate",
+		"commands per second one connection may send before getting a rate limit error (0 = no limit)")
+
+	config.PubSubOutputLimit.Set(defaultPubSubOutputLimit)
+	flag.Var(&config.PubSubOutputLimit, "client-output-buffer-limit",
+		`"pubsub <hard> <soft> <soft-seconds>": disconnect subscribers with more output queued than hard, or than soft for soft-seconds (0 = no limit)`)
+}
+
+// boolSetting is a bool that command goroutines read while CONFIG SET
+// changes it. It works as a command line flag too.
+type boolSetting struct {
+	atomic.Bool
+}
+
+func (b *boolSetting) String() string {
+	if b.Load() {
+		return "yes"
+	}
+	return "no"
+}
+
+// Set accepts yes/no like redis.conf, and anything strconv.ParseBool takes
+func (b *boolSetting) Set(value string) error {
+	switch strings.ToLower(value) {
+	case "yes":
+		b.Store(true)
+		return nil
+	case "no":
+		b.Store(false)
+		return nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("argument must be 'yes' or 'no'")
+	}
+	b.Store(parsed)
+	return nil
+}
+
+func (b *boolSetting) IsBoolFlag() bool {
+	return true
+}
+
+// intSetting is the int64 counterpart of boolSetting
+type intSetting struct {
+	atomic.Int64
+}
+
+func (i *intSetting) String() string {
+	return strconv.FormatInt(i.Load(), 10)
+}
+
+func (i *intSetting) Set(value string) error {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("argument must be a non-negative integer")
+	}
+	i.Store(parsed)
+	return nil
+}
+
+// bulkLenSetting is proto-max-bulk-len, a size in bytes or with a memory
+// unit that Redis requires to be at least minProtoMaxBulkLen
+type bulkLenSetting struct {
+	intSetting
+}
+
+func (b *bulkLenSetting) Set(value string) error {
+	parsed, err := parseMemory(value)
+	if err != nil {
+		return err
+	}
+	if parsed < minProtoMaxBulkLen {
+		return fmt.Errorf("proto-max-bulk-len must be 1mb or greater")
+	}
+	b.Store(parsed)
+	return nil
+}
+
+// defaultPubSubOutputLimit is Redis's default for pub/sub clients
+const defaultPubSubOutputLimit = "pubsub 32mb 8mb 60"
+
+// outputBufferLimit is client-output-buffer-limit for the pubsub class,
+// the only one enforced: other clients only get replies they asked for.
+type outputBufferLimit struct {
+	mu          sync.RWMutex
+	hard        int64
+	soft        int64
+	softSeconds int64
+}
+
+func (l *outputBufferLimit) limits() (hard, soft, softSeconds int64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.hard, l.soft, l.softSeconds
+}
+
+func (l *outputBufferLimit) String() string {
+	hard, soft, softSeconds := l.limits()
+	return fmt.Sprintf("pubsub %d %d %d", hard, soft, softSeconds)
+}
+
+// Set takes "pubsub <hard> <soft> <soft-seconds>" as in redis.conf, with
+// sizes in bytes or with a k, kb, m, mb, g or gb suffix
+func (l *outputBufferLimit) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 4 || strings.ToLower(fields[0]) != "pubsub" {
+		return fmt.Errorf("argument must be 'pubsub <hard> <soft> <soft-seconds>'")
+	}
+	hard, err := parseMemory(fields[1])
+	if err != nil {
+		return err
+	}
+	soft, err := parseMemory(fields[2])
+	if err != nil {
+		return err
+	}
+	softSeconds, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || softSeconds < 0 {
+		return fmt.Errorf("soft-seconds must be a non-negative integer")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hard, l.soft, l.softSeconds = hard, soft, softSeconds
+	return nil
+}
+
+// memoryUnits are the size suffixes redis.conf accepts
+var memoryUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+}
+
+// parseMemory reads a size such as 1048576, 1mb or 1m
+func parseMemory(value string) (int64, error) {
+	number := strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	parsed, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", value)
+	}
+	return parsed * multiplier, nil
+}
+
+// configParams are the settings CONFIG GET and CONFIG SET know about
+var configParams = map[string]flag.Value{
+	"replica-read-only":          &config.ReplicaReadOnly,
+	"proto-max-bulk-len":         &config.ProtoMaxBulkLen,
+	"command-timeout":            &config.CommandTimeout,
+	"client-command-rate":        &config.ClientCommandRate,
+	"client-output-buffer-limit": &config.PubSubOutputLimit,
+}
+
+// configCommand handles CONFIG GET pattern [pattern ...] and
+// CONFIG SET parameter value [parameter value ...]
+func configCommand(args []string) string {
+	subcommand := strings.ToUpper(args[1])
+
+	switch subcommand {
+	case "GET":
+		if len(args) < 3 {
+			return "-ERR wrong number of arguments for 'config|get' command\r\n"
+		}
+
+		matched := make(map[string]bool)
+		for _, pattern := range args[2:] {
+			for name := range configParams {
+				if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+					matched[name] = true
+				}
+			}
+		}
+
+		names := make([]string, 0, len(matched))
+		for name := range matched {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var reply strings.Builder
+		fmt.Fprintf(&reply, "*%d\r\n", len(names)*2)
+		for _, name := range names {
+			value := configParams[name].String()
+			fmt.Fprintf(&reply, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(name), name, len(value), value)
+		}
+		return reply.String()
+
+	case "SET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return "-ERR wrong number of arguments for 'config|set' command\r\n"
+		}
+
+		// Check every name first so a bad one doesn't leave a partial update
+		for i := 2; i < len(args); i += 2 {
+			if _, exists := configParams[strings.ToLower(args[i])]; !exists {
+				return fmt.Sprintf("-ERR Unknown option or number of arguments for CONFIG SET - '%s'\r\n", args[i])
+			}
+		}
+
+		// A value can only be checked by setting it, so a bad one puts
+		// back the values set before it, newest first, as Redis does
+		var previous []string
+		for i := 2; i < len(args); i += 2 {
+			param := configParams[strings.ToLower(args[i])]
+			old := param.String()
+			err := param.Set(args[i+1])
+			if err != nil {
+				for j := len(previous) - 1; j >= 0; j-- {
+					configParams[strings.ToLower(args[2+2*j])].Set(previous[j])
+				}
+				return fmt.Sprintf("-ERR CONFIG SET failed (possibly related to argument '%s') - %s\r\n", args[i], err)
+			}
+			previous = append(previous, old)
+		}
+		return "+OK\r\n"
+
+	default:
+		return fmt.Sprintf("-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// debugCommand handles DEBUG subcommand [arg ...]
+func debugCommand(args []string) string {
+	subcommand := strings.ToUpper(args[1])
+
+	switch subcommand {
+	case "CHANGE-REPL-ID":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'debug|change-repl-id' command\r\n"
+		}
+		id := newRunID()
+		runID.Store(&id)
+		return "+OK\r\n"
+
+	case "CLEAR-WAL-ERRORS":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'debug|clear-wal-errors' command\r\n"
+		}
+		err := store.WAL.ClearErrors()
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		return "+OK\r\n"
+
+	case "WAL":
+		// DEBUG WAL VERIFY checks the WAL's records without
+		// replaying them
+		if len(args) != 3 || strings.ToUpper(args[2]) != "VERIFY" {
+			return "-ERR syntax error\r\n"
+		}
+		report, err := store.WAL.Verify()
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		return bulkString(report.String())
+
+	case "COMPACT":
+		// DEBUG COMPACT [ASYNC] merges every SSTable into one and replies
+		// with the resulting SSTable count. A background compaction
+		// already running is waited for, then what it left is merged, so
+		// the count is read once the tables really are compacted. ASYNC
+		// refuses to start while one runs.
+		async := len(args) == 3 && strings.ToUpper(args[2]) == "ASYNC"
+		if len(args) > 3 || (len(args) == 3 && !async) {
+			return "-ERR syntax error\r\n"
+		}
+
+		if async {
+			if _, running := store.CompactionStatus(); running {
+				return "-ERR Background compaction already in progress\r\n"
+			}
+			go func() {
+				err := store.CompactWait()
+				if err != nil {
+					fmt.Printf("compaction failed: %v\n", err)
+				}
+			}()
+			return "+Background compaction started\r\n"
+		}
+
+		err := store.CompactWait()
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		return fmt.Sprintf(":%d\r\n", store.NumSSTables())
+
+	default:
+		return fmt.Sprintf("-ERR unknown subcommand '%s'\r\n", args[1])
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// delPatternBatch is how many matching keys DELPATTERN collects before
+// deleting them. The store's read lock is only held while collecting, so
+// other clients' commands run between batches.
+const delPatternBatch = 1000
+
+// delPattern handles DELPATTERN pattern, a non-standard command that
+// deletes every key matching a glob pattern and returns how many it
+// deleted. Each deletion is logged to the WAL and the AOF as a DEL, so a
+// DELPATTERN cut short by command-timeout leaves consistent logs.
+func delPattern(ctx context.Context, pattern string) string {
+	deleted := 0
+	start := ""
+
+	for {
+		batch := make([]string, 0, delPatternBatch)
+		last := ""
+		exhausted := true
+
+		it := store.NewIteratorFrom(ctx, start)
+		for it.Next() {
+			last = it.Entry().Key
+			if globMatch(pattern, last) {
+				batch = append(batch, last)
+				if len(batch) == delPatternBatch {
+					exhausted = false
+					break
+				}
+			}
+		}
+		scanErr := it.Err()
+		it.Close()
+
+		for _, key := range batch {
+			existed, err := delPatternKey(key)
+			if err != nil {
+				return fmt.Sprintf("-ERR %s\r\n", err)
+			}
+			if existed {
+				deleted++
+			}
+		}
+
+		if errors.Is(scanErr, context.DeadlineExceeded) {
+			return "-ERR operation timed out\r\n"
+		}
+		if scanErr != nil {
+			return fmt.Sprintf("-ERR %s\r\n", scanErr)
+		}
+		if exhausted {
+			return fmt.Sprintf(":%d\r\n", deleted)
+		}
+
+		// The smallest key after the last one scanned
+		start = last + "\x00"
+	}
+}
+
+// delPatternKey deletes one key as a DEL would, under its key lock
+func delPatternKey(key string) (bool, error) {
+	unlock := lockKeys([]string{key})
+	defer unlock()
+
+	err := store.WAL.WriteEntry("DEL", key, "")
+	if err != nil {
+		return false, err
+	}
+	existed, err := store.Delete(key)
+	if err != nil {
+		return false, err
+	}
+	appendToAOF([]string{"DEL", key})
+	tracking.invalidate(key)
+	return existed, nil
+}
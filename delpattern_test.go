@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// DELPATTERN deletes the matching keys, wherever they are stored, leaves
+// the rest alone, and logs each deletion so it survives a restart
+func TestDelPattern(t *testing.T) {
+	useTestStore(t)
+	readAOF := useTestAOF(t)
+	c := dialTest(t)
+
+	for i := 0; i < 40; i++ {
+		expect(t, c, "OK", "SET", "session:"+strconv.Itoa(i), "some session data")
+	}
+	for _, key := range []string{"user:1", "sessions", "xsession:1", "session"} {
+		expect(t, c, "OK", "SET", key, "kept")
+	}
+	expect(t, c, 1, "DEL", "session:0")
+
+	expect(t, c, 39, "DELPATTERN", "session:*")
+	expect(t, c, 0, "EXISTS", "session:1", "session:39")
+	expect(t, c, 4, "EXISTS", "user:1", "sessions", "xsession:1", "session")
+	expect(t, c, 4, "DBSIZE")
+	expect(t, c, 0, "DELPATTERN", "session:*")
+
+	dels := 0
+	for _, args := range readAOF() {
+		if args[0] == "DEL" {
+			dels++
+		}
+	}
+	if dels != 40 {
+		t.Errorf("AOF has %d DELs, want the DEL plus one per deleted key", dels)
+	}
+
+	restartTestServer(t, false)
+	expect(t, c, 0, "EXISTS", "session:1", "session:39")
+	expect(t, c, 4, "DBSIZE")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+)
+
+// DUMP payload layout:
+// [type (1 byte)] [value length (4 bytes)] [value] [version (2 bytes)] [crc64 (8 bytes)]
+const (
+	dumpTypeString = 0
+	dumpVersion    = 1
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var errBadDumpPayload = fmt.Errorf("DUMP payload version or checksum are wrong")
+
+// dumpValue serializes a value for DUMP/MIGRATE
+func dumpValue(value []byte) []byte {
+	payload := make([]byte, 0, 1+4+len(value)+2+8)
+
+	payload = append(payload, dumpTypeString)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(value)))
+	payload = append(payload, value...)
+	payload = binary.LittleEndian.AppendUint16(payload, dumpVersion)
+
+	checksum := crc64.Checksum(payload, crcTable)
+	payload = binary.LittleEndian.AppendUint64(payload, checksum)
+
+	return payload
+}
+
+// restoreValue validates a DUMP payload and returns the value it holds
+func restoreValue(payload []byte) ([]byte, error) {
+	// Smallest payload: type + length + version + crc
+	if len(payload) < 1+4+2+8 {
+		return nil, errBadDumpPayload
+	}
+
+	body := payload[:len(payload)-8]
+	checksum := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if crc64.Checksum(body, crcTable) != checksum {
+		return nil, errBadDumpPayload
+	}
+
+	version := binary.LittleEndian.Uint16(body[len(body)-2:])
+	if version != dumpVersion {
+		return nil, errBadDumpPayload
+	}
+
+	if body[0] != dumpTypeString {
+		return nil, fmt.Errorf("Bad data format")
+	}
+
+	valueLength := binary.LittleEndian.Uint32(body[1:5])
+	if int(valueLength) != len(body)-1-4-2 {
+		return nil, fmt.Errorf("Bad data format")
+	}
+
+	value := make([]byte, valueLength)
+	copy(value, body[5:5+valueLength])
+	return value, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expireCommand handles EXPIRE key seconds and PEXPIREAT key
+// unix-time-milliseconds. A time that has already passed deletes the key.
+// The AOF gets PEXPIREAT either way, so replaying it later doesn't push
+// the expiry back.
+func expireCommand(args []string, absolute bool) string {
+	key := args[1]
+
+	amount, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+
+	now := time.Now().UnixNano()
+	var expiresAt int64
+	if absolute {
+		if amount > math.MaxInt64/int64(time.Millisecond) || amount < math.MinInt64/int64(time.Millisecond) {
+			return fmt.Sprintf("-ERR invalid expire time in '%s' command\r\n", strings.ToLower(args[0]))
+		}
+		expiresAt = amount * int64(time.Millisecond)
+	} else {
+		if amount > (math.MaxInt64-now)/int64(time.Second) || amount < math.MinInt64/int64(time.Second) {
+			return fmt.Sprintf("-ERR invalid expire time in '%s' command\r\n", strings.ToLower(args[0]))
+		}
+		expiresAt = now + amount*int64(time.Second)
+	}
+
+	value, exists, err := store.Get(key)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	if !exists {
+		return ":0\r\n"
+	}
+
+	if expiresAt <= now {
+		err = store.WAL.WriteEntry("DEL", key, "")
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		_, err = store.Delete(key)
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		appendToAOF([]string{"DEL", key})
+		return ":1\r\n"
+	}
+
+	err = store.WAL.WriteExpiringEntry(key, string(value), expiresAt)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	err = store.SetWithExpiry(key, value, expiresAt)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	appendToAOF([]string{"PEXPIREAT", key, strconv.FormatInt(expiresAt/int64(time.Millisecond), 10)})
+	return ":1\r\n"
+}
+
+// ttlCommand handles TTL key: the seconds left until key expires, -1 if
+// it never does and -2 if it doesn't exist
+func ttlCommand(args []string) string {
+	expiresAt, exists := store.ExpiresAt(args[1])
+	if !exists {
+		return ":-2\r\n"
+	}
+	if expiresAt == 0 {
+		return ":-1\r\n"
+	}
+
+	// Rounded to the nearest second, as Redis does
+	remaining := time.Duration(expiresAt - time.Now().UnixNano())
+	return fmt.Sprintf(":%d\r\n", int64(remaining.Round(time.Second)/time.Second))
+}
+
+// getexCommand handles GETEX key [EX seconds | PX milliseconds | EXAT
+// unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]: GET that also
+// sets the key's expiry, or with PERSIST removes it. The store reads the
+// value and changes the expiry in one step. The AOF gets the expiry as
+// PXAT, so replaying it later doesn't push the expiry back.
+func getexCommand(args []string) string {
+	key := args[1]
+
+	var expiresAt int64
+	expiryOption := ""
+	now := time.Now().UnixNano()
+
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "PERSIST":
+			if expiryOption != "" {
+				return "-ERR syntax error\r\n"
+			}
+			expiryOption = option
+
+		case "EX", "PX", "EXAT", "PXAT":
+			if expiryOption != "" || i+1 >= len(args) {
+				return "-ERR syntax error\r\n"
+			}
+			expiryOption = option
+			i++
+
+			amount, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			expiresAt = setExpiry(option, amount, now)
+			if expiresAt <= 0 {
+				return "-ERR invalid expire time in 'getex' command\r\n"
+			}
+
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+
+	// dispatch holds the key's lock, so the value logged here is the one
+	// GetExpire finds
+	value, exists, err := store.Get(key)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	if !exists {
+		return "$-1\r\n"
+	}
+	if expiryOption == "" {
+		return bulkString(value)
+	}
+
+	switch {
+	case expiryOption == "PERSIST":
+		err = store.WAL.WriteEntry("SET", key, string(value))
+	case expiresAt <= now:
+		err = store.WAL.WriteEntry("DEL", key, "")
+	default:
+		err = store.WAL.WriteExpiringEntry(key, string(value), expiresAt)
+	}
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	value, exists, err = store.GetExpire(key, expiresAt)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	if !exists {
+		return "$-1\r\n"
+	}
+
+	switch {
+	case expiryOption == "PERSIST":
+		appendToAOF([]string{"GETEX", key, "PERSIST"})
+	case expiresAt <= now:
+		appendToAOF([]string{"DEL", key})
+	default:
+		appendToAOF([]string{"GETEX", key, "PXAT", strconv.FormatInt(expiresAt/int64(time.Millisecond), 10)})
+	}
+	return bulkString(value)
+}
+
+// setKeepingTTL stores a new value for key without changing when it
+// expires, for commands that modify a value rather than replace it. The
+// caller must hold the key's lock. The result is logged to the AOF as a
+// SET, with any expiry as PXAT, so replaying it again can't apply the
+// change twice.
+func setKeepingTTL(key string, value []byte) error {
+	expiresAt, _ := store.ExpiresAt(key)
+	if expiresAt == 0 {
+		err := store.WAL.WriteEntry("SET", key, string(value))
+		if err != nil {
+			return err
+		}
+		err = store.Set(key, value)
+		if err != nil {
+			return err
+		}
+		appendToAOF([]string{"SET", key, string(value)})
+		return nil
+	}
+
+	err := store.WAL.WriteExpiringEntry(key, string(value), expiresAt)
+	if err != nil {
+		return err
+	}
+	err = store.SetWithExpiry(key, value, expiresAt)
+	if err != nil {
+		return err
+	}
+	appendToAOF([]string{"SET", key, string(value), "PXAT", strconv.FormatInt(expiresAt/int64(time.Millisecond), 10)})
+	return nil
+}
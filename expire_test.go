@@ -0,0 +1,123 @@
+package main
+
+import (
+	"small-redis/client"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ttlOf returns the TTL of key in seconds
+func ttlOf(t *testing.T, c *client.Client, key string) int64 {
+	t.Helper()
+	reply, err := c.Do("TTL", key)
+	if err != nil {
+		t.Fatalf("TTL %s: %v", key, err)
+	}
+	ttl, _ := reply.(int64)
+	return ttl
+}
+
+func TestGetex(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "<nil>", "GETEX", "missing", "EX", "10")
+	expect(t, c, "OK", "SET", "k", "v")
+
+	expect(t, c, "v", "GETEX", "k")
+	expect(t, c, -1, "TTL", "k")
+
+	at := time.Now().Add(time.Hour)
+	for _, args := range [][]string{
+		{"EX", "100"},
+		{"PX", "100000"},
+		{"EXAT", strconv.FormatInt(at.Unix(), 10)},
+		{"PXAT", strconv.FormatInt(at.UnixMilli(), 10)},
+	} {
+		expect(t, c, "v", append([]string{"GETEX", "k"}, args...)...)
+		if ttl := ttlOf(t, c, "k"); ttl <= 0 || ttl > 3600 {
+			t.Errorf("TTL after GETEX %v = %d", args, ttl)
+		}
+	}
+
+	expect(t, c, "v", "GETEX", "k", "PERSIST")
+	expect(t, c, -1, "TTL", "k")
+
+	for _, args := range [][]string{
+		{"EX"},
+		{"EX", "10", "PX", "10"},
+		{"EX", "10", "PERSIST"},
+		{"KEEPTTL"},
+	} {
+		if _, isErr := do(t, c, append([]string{"GETEX", "k"}, args...)...).(error); !isErr {
+			t.Errorf("GETEX k %v was accepted", args)
+		}
+	}
+	if _, isErr := do(t, c, "GETEX", "k", "EX", "0").(error); !isErr {
+		t.Error("GETEX with EX 0 was accepted")
+	}
+
+	// An absolute time already passed deletes the key, returning it
+	expect(t, c, "v", "GETEX", "k", "PXAT", "1")
+	expect(t, c, 0, "EXISTS", "k")
+}
+
+// The expiry GETEX sets is in the WAL, so it survives a restart
+func TestGetexRecovered(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "SET", "k", "v")
+	expect(t, c, "OK", "SET", "p", "v", "EX", "100")
+	expect(t, c, "v", "GETEX", "k", "EX", "100")
+	expect(t, c, "v", "GETEX", "p", "PERSIST")
+
+	closeTestStore()
+	loadDataset()
+
+	if ttl := ttlOf(t, c, "k"); ttl <= 0 {
+		t.Errorf("k has TTL %d after a restart, want its expiry", ttl)
+	}
+	expect(t, c, -1, "TTL", "p")
+}
+
+// Every way of setting a TTL that has already run out leaves the key
+// absent rather than stored with a stale expiry, after a restart too
+func TestImmediateExpiry(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	// SET rejects a non-positive TTL outright, as Redis does, leaving
+	// the key as it was
+	for _, option := range []string{"EX", "PX", "EXAT", "PXAT"} {
+		expect(t, c, "ERR invalid expire time in 'set' command", "SET", "new", "v", option, "0")
+		expect(t, c, "ERR invalid expire time in 'set' command", "SET", "new", "v", option, "-1")
+	}
+	expect(t, c, 0, "EXISTS", "new")
+
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+	expect(t, c, "OK", "SET", "set-past", "v", "PXAT", past)
+
+	for _, args := range [][]string{
+		{"EXPIRE", "expire-negative", "-1"},
+		{"EXPIRE", "expire-zero", "0"},
+		{"PEXPIREAT", "pexpireat-past", past},
+	} {
+		expect(t, c, "OK", "SET", args[1], "v", "EX", "100")
+		expect(t, c, 1, args...)
+	}
+	expect(t, c, 0, "EXPIRE", "missing", "-1")
+
+	check := func() {
+		t.Helper()
+		for _, key := range []string{"set-past", "expire-negative", "expire-zero", "pexpireat-past", "missing"} {
+			expect(t, c, 0, "EXISTS", key)
+			expect(t, c, -2, "TTL", key)
+		}
+		expect(t, c, 0, "DBSIZE")
+	}
+	check()
+	restartTestServer(t, false)
+	check()
+}
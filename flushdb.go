@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// flushDBCommand handles FLUSHDB [ASYNC|SYNC]. The keyspace is empty once
+// it replies either way; ASYNC leaves deleting the old SSTable files to
+// the background instead of waiting for it.
+func flushDBCommand(args []string) string {
+	if len(args) > 2 {
+		return "-ERR syntax error\r\n"
+	}
+
+	async := false
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "ASYNC":
+			async = true
+		case "SYNC":
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+
+	// No write may land between clearing the WAL and emptying the store
+	unlock := lockAllKeys()
+	defer unlock()
+
+	err := store.FlushAll(async)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	tracking.invalidateAll()
+	return "+OK\r\n"
+}
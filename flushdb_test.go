@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// FLUSHDB empties the keyspace in either mode, keeps the writes that
+// follow it, and stays empty after a restart
+func TestFlushDB(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	for _, args := range [][]string{{"FLUSHDB"}, {"FLUSHDB", "SYNC"}, {"FLUSHDB", "async"}} {
+		expect(t, c, "OK", "SET", "a", "1")
+		expect(t, c, "OK", "SET", "b", "2")
+		expect(t, c, "OK", args...)
+		expect(t, c, 0, "DBSIZE")
+		expect(t, c, "<nil>", "GET", "a")
+	}
+	expect(t, c, "ERR syntax error", "FLUSHDB", "LATER")
+	expect(t, c, "ERR syntax error", "FLUSHDB", "ASYNC", "SYNC")
+
+	expect(t, c, "OK", "SET", "after", "kept")
+	restartTestServer(t, false)
+	expect(t, c, 1, "DBSIZE")
+	expect(t, c, "kept", "GET", "after")
+	expect(t, c, 0, "EXISTS", "a", "b")
+}
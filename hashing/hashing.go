@@ -0,0 +1,45 @@
+// Package hashing holds the hash functions that spread keys over lock
+// stripes and servers, so every place that hashes keys can be given the
+// same function.
+package hashing
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+)
+
+// Func hashes a key to 32 bits. It must be deterministic: a key always
+// gets the same hash, in every process.
+type Func func(key string) uint32
+
+// FNV1a is 32-bit FNV-1a: fast, allocation-free and good enough to spread
+// keys evenly. It is the default wherever the hash isn't shared with
+// other programs.
+func FNV1a(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// Ketama is the first four bytes of the key's MD5 digest, as ketama
+// consistent-hashing clients place keys on their ring
+func Ketama(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// Mix scrambles the bits of a hash (the MurmurHash3 finalizer). Hashes
+// like FNV-1a barely differ in their high bits between similar strings,
+// "host-1" and "host-2" say, which matters where hashes are compared
+// rather than taken modulo something.
+func Mix(hash uint32) uint32 {
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
@@ -0,0 +1,103 @@
+package hashing
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/fnv"
+	"hash/maphash"
+	"strconv"
+	"testing"
+)
+
+var testKeys = []string{"", "a", "foo", "user:1000", "{tag}.key", "host-1", "host-2", string([]byte{0, 0xff, '\n'})}
+
+// FNV1a is the standard 32-bit FNV-1a, without its allocations
+func TestFNV1aMatchesStdlib(t *testing.T) {
+	for _, key := range testKeys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		if got, want := FNV1a(key), h.Sum32(); got != want {
+			t.Errorf("FNV1a(%q) = %#x, want %#x", key, got, want)
+		}
+	}
+}
+
+func TestKetama(t *testing.T) {
+	for _, key := range testKeys {
+		digest := md5.Sum([]byte(key))
+		if got, want := Ketama(key), binary.LittleEndian.Uint32(digest[:4]); got != want {
+			t.Errorf("Ketama(%q) = %#x, want %#x", key, got, want)
+		}
+	}
+}
+
+// Every hash gives a key the same value each time, so a key always lands
+// on the same shard or lock
+func TestHashesAreDeterministic(t *testing.T) {
+	for name, hash := range map[string]Func{
+		"fnv1a":  FNV1a,
+		"ketama": Ketama,
+		"mix":    func(key string) uint32 { return Mix(FNV1a(key)) },
+	} {
+		for _, key := range testKeys {
+			first := hash(key)
+			for i := 0; i < 3; i++ {
+				if again := hash(key); again != first {
+					t.Errorf("%s(%q) = %#x, then %#x", name, key, first, again)
+				}
+			}
+		}
+	}
+	// Pinned values, so a change to the functions is noticed
+	if got := FNV1a("foo"); got != 0xa9f37ed7 {
+		t.Errorf("FNV1a(foo) = %#x, want 0xa9f37ed7", got)
+	}
+}
+
+// Mix spreads hashes that differ in a few low bits across the high bits
+func TestMixSpreadsHighBits(t *testing.T) {
+	seen := make(map[uint32]bool)
+	for i := 0; i < 256; i++ {
+		seen[Mix(FNV1a("host-"+strconv.Itoa(i)))>>24] = true
+	}
+	if len(seen) < 128 {
+		t.Errorf("Mix put 256 similar keys in %d of 256 top-byte buckets", len(seen))
+	}
+}
+
+var benchKeys = func() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "user:session:" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+var sink uint64
+
+func BenchmarkFNV1a(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sink += uint64(FNV1a(benchKeys[i%len(benchKeys)]))
+	}
+}
+
+func BenchmarkStdlibFNV32a(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		h := fnv.New32a()
+		h.Write([]byte(benchKeys[i%len(benchKeys)]))
+		sink += uint64(h.Sum32())
+	}
+}
+
+func BenchmarkStdlibMaphash(b *testing.B) {
+	seed := maphash.MakeSeed()
+	for i := 0; i < b.N; i++ {
+		sink += maphash.String(seed, benchKeys[i%len(benchKeys)])
+	}
+}
+
+func BenchmarkKetama(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sink += uint64(Ketama(benchKeys[i%len(benchKeys)]))
+	}
+}
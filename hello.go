@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// serverVersion is the Redis version HELLO reports
+const serverVersion = "7.0.0"
+
+// hello handles HELLO [protover]: it switches the connection to RESP2 or
+// RESP3 and describes the server. Only pub/sub messages and tracking
+// invalidations change with RESP3, becoming push frames; command replies
+// keep their RESP2 types, which RESP3 clients also accept.
+func (sess *session) hello(args []string) string {
+	if len(args) > 2 {
+		return "-ERR HELLO options are not supported\r\n"
+	}
+	if len(args) == 2 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "-ERR Protocol version is not an integer or out of range\r\n"
+		}
+		if version != 2 && version != 3 {
+			return "-NOPROTO unsupported protocol version\r\n"
+		}
+		sess.resp3.Store(version == 3)
+	}
+
+	proto := 2
+	header := "*14\r\n"
+	if sess.resp3.Load() {
+		proto = 3
+		header = "%7\r\n"
+	}
+
+	var reply strings.Builder
+	reply.WriteString(header)
+	reply.WriteString("$6\r\nserver\r\n$5\r\nredis\r\n")
+	fmt.Fprintf(&reply, "$7\r\nversion\r\n%s", bulkString(serverVersion))
+	fmt.Fprintf(&reply, "$5\r\nproto\r\n:%d\r\n", proto)
+	fmt.Fprintf(&reply, "$2\r\nid\r\n:%d\r\n", sess.id)
+	reply.WriteString("$4\r\nmode\r\n$10\r\nstandalone\r\n")
+	reply.WriteString("$4\r\nrole\r\n$6\r\nmaster\r\n")
+	reply.WriteString("$7\r\nmodules\r\n*0\r\n")
+	return reply.String()
+}
+
+// pushFrame frames an array the client didn't ask for, such as a pub/sub
+// message, as a RESP3 push if the connection negotiated RESP3
+func (sess *session) pushFrame(frame string) string {
+	if sess.resp3.Load() {
+		return ">" + frame[1:]
+	}
+	return frame
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// HELLO reports the protocol in use and switches it; other versions and
+// options are refused, leaving the protocol as it was
+func TestHello(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	reply, ok := do(t, c, "HELLO").([]interface{})
+	if !ok || len(reply) != 14 {
+		t.Fatalf("HELLO = %v, want 7 field/value pairs", reply)
+	}
+	fields := make(map[string]string)
+	for i := 0; i < len(reply); i += 2 {
+		fields[fmt.Sprint(reply[i])] = fmt.Sprint(reply[i+1])
+	}
+	if fields["server"] != "redis" || fields["proto"] != "2" || fields["version"] != serverVersion || fields["role"] != "master" {
+		t.Errorf("HELLO = %v", fields)
+	}
+	if id := fmt.Sprint(do(t, c, "CLIENT", "ID")); fields["id"] != id {
+		t.Errorf("HELLO reports id %s, CLIENT ID %s", fields["id"], id)
+	}
+
+	expect(t, c, "NOPROTO unsupported protocol version", "HELLO", "4")
+	expect(t, c, "ERR Protocol version is not an integer or out of range", "HELLO", "three")
+	expect(t, c, "ERR HELLO options are not supported", "HELLO", "3", "AUTH", "user", "pass")
+
+	conn, reader := dialRaw(t)
+	sendRaw(t, conn, "HELLO", "3")
+	readExpected(t, reader, "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n")
+	skipUntil(t, reader, "proto\r\n")
+	readExpected(t, reader, ":3\r\n")
+	skipUntil(t, reader, "modules\r\n")
+	readExpected(t, reader, "*0\r\n")
+	sendRaw(t, conn, "HELLO", "4")
+	readExpected(t, reader, "-NOPROTO unsupported protocol version\r\n")
+	sendRaw(t, conn, "HELLO")
+	readExpected(t, reader, "%7\r\n")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// incrCommand handles the INCR family: it adds delta to the integer stored
+// at key, a missing key counting as 0, and replies with the result.
+// dispatch holds the key's lock, so concurrent increments of a key are
+// applied one after another and none is lost.
+func incrCommand(args []string, delta int64) string {
+	key := args[1]
+
+	var current int64
+	value, exists, err := store.Get(key)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	if exists {
+		current, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return "-ERR increment or decrement would overflow\r\n"
+	}
+	updated := strconv.FormatInt(current+delta, 10)
+
+	err = setKeepingTTL(key, []byte(updated))
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	return fmt.Sprintf(":%s\r\n", updated)
+}
+
+// incrByCommand handles INCRBY and DECRBY key delta, which subtracts
+func incrByCommand(args []string, negate bool) string {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	if negate {
+		if delta == math.MinInt64 {
+			return "-ERR decrement would overflow\r\n"
+		}
+		delta = -delta
+	}
+	return incrCommand(args, delta)
+}
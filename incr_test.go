@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// INCRBY and DECRBY take deltas of either sign, a missing key counting
+// as 0, and keep the key's TTL
+func TestIncrByNegativeDeltas(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, 10, "INCRBY", "k", "10")
+	expect(t, c, -15, "INCRBY", "k", "-25")
+	expect(t, c, -10, "DECRBY", "k", "-5")
+	expect(t, c, -17, "DECRBY", "k", "7")
+	expect(t, c, -17, "INCRBY", "k", "0")
+	expect(t, c, "-17", "GET", "k")
+	expect(t, c, -3, "DECRBY", "missing", "3")
+	expect(t, c, -1, "INCRBY", "other", "-1")
+
+	expect(t, c, "OK", "SET", "ttl", "5", "EX", "100")
+	expect(t, c, 2, "INCRBY", "ttl", "-3")
+	if ttl := ttlOf(t, c, "ttl"); ttl <= 90 {
+		t.Errorf("TTL after INCRBY = %d, want the 100s kept", ttl)
+	}
+
+	expect(t, c, "OK", "SET", "text", "abc")
+	expect(t, c, "ERR value is not an integer or out of range", "INCRBY", "text", "1")
+	expect(t, c, "ERR value is not an integer or out of range", "INCRBY", "k", "1.5")
+	expect(t, c, "ERR value is not an integer or out of range", "DECRBY", "k", "9223372036854775808")
+	expect(t, c, "-17", "GET", "k")
+}
+
+// A result past either end of the int64 range is refused and leaves the
+// value as it was; reaching the end exactly is fine
+func TestIncrByOverflow(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	const overflow = "ERR increment or decrement would overflow"
+	maxInt, minInt := strconv.FormatInt(math.MaxInt64, 10), strconv.FormatInt(math.MinInt64, 10)
+
+	expect(t, c, "OK", "SET", "big", strconv.FormatInt(math.MaxInt64-1, 10))
+	expect(t, c, math.MaxInt64, "INCRBY", "big", "1")
+	expect(t, c, overflow, "INCRBY", "big", "1")
+	expect(t, c, overflow, "DECRBY", "big", "-1")
+	expect(t, c, overflow, "INCR", "big")
+	expect(t, c, maxInt, "GET", "big")
+	expect(t, c, 0, "DECRBY", "big", maxInt)
+
+	expect(t, c, "OK", "SET", "small", strconv.FormatInt(math.MinInt64+1, 10))
+	expect(t, c, math.MinInt64, "DECRBY", "small", "1")
+	expect(t, c, overflow, "DECRBY", "small", "1")
+	expect(t, c, overflow, "INCRBY", "small", "-1")
+	expect(t, c, overflow, "DECR", "small")
+	expect(t, c, minInt, "GET", "small")
+
+	// The smallest int64 can be added but not subtracted, since its
+	// negation doesn't fit
+	expect(t, c, math.MinInt64, "INCRBY", "zero", minInt)
+	expect(t, c, overflow, "INCRBY", "zero", "-1")
+	expect(t, c, "ERR decrement would overflow", "DECRBY", "fresh", minInt)
+	expect(t, c, 0, "EXISTS", "fresh")
+	expect(t, c, -1, "INCRBY", "one", "-1")
+	expect(t, c, overflow, "INCRBY", "one", minInt)
+	expect(t, c, "-1", "GET", "one")
+}
+
+// INCRBY and DECRBY are applied once across restarts with the AOF on,
+// which is replayed over the dataset the WAL brings back
+func TestIncrByAOFRestart(t *testing.T) {
+	useTestStore(t)
+	useTestAOF(t)
+	c := dialTest(t)
+
+	expect(t, c, 5, "INCRBY", "k", "5")
+	expect(t, c, 3, "DECRBY", "k", "2")
+	expect(t, c, -4, "INCRBY", "neg", "-4")
+
+	for i := 0; i < 2; i++ {
+		restartTestServer(t, false)
+		expect(t, c, "3", "GET", "k")
+		expect(t, c, "-4", "GET", "neg")
+	}
+}
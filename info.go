@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"small-redis/storage"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// startTime is when the server started, for uptime
+var startTime time.Time
+
+// runID identifies this server process; DEBUG CHANGE-REPL-ID replaces it
+var runID atomic.Pointer[string]
+
+// newRunID returns 40 random hex characters, like Redis run ids
+func newRunID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// infoSection renders one "# Name" block of INFO output
+type infoSection struct {
+	name   string
+	render func(b *strings.Builder)
+}
+
+// infoSections are printed in this order by INFO with no argument
+var infoSections = []infoSection{
+	{"server", infoServer},
+	{"persistence", infoPersistence},
+	{"stats", infoStats},
+	{"replication", infoReplication},
+}
+
+func infoServer(b *strings.Builder) {
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "run_id:%s\r\n", *runID.Load())
+
+	uptime := int64(time.Since(startTime).Seconds())
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", uptime)
+	fmt.Fprintf(b, "uptime_in_days:%d\r\n", uptime/(24*60*60))
+}
+
+func infoPersistence(b *strings.Builder) {
+	// The store doesn't exist until loading has finished
+	progress, compacting := storage.CompactionProgress{}, false
+	var memtableSize int64
+	var pipeline storage.PipelineStats
+	if ready.Load() {
+		progress, compacting = store.CompactionStatus()
+		memtableSize = store.EffectiveMemTableSize()
+		pipeline = store.PipelineStats()
+	}
+
+	fmt.Fprintf(b, "loading:%d\r\n", boolToInt(!ready.Load()))
+	fmt.Fprintf(b, "persistence:%s\r\n", config.Persistence)
+	fmt.Fprintf(b, "memtable_effective_size:%d\r\n", memtableSize)
+	fmt.Fprintf(b, "memtable_pending_flushes:%d\r\n", pipeline.PendingFlushes)
+	fmt.Fprintf(b, "sstables:%d\r\n", pipeline.SSTables)
+	fmt.Fprintf(b, "compaction_pending_sstables:%d\r\n", pipeline.CompactionPending)
+	fmt.Fprintf(b, "compaction_in_progress:%d\r\n", boolToInt(compacting))
+	if !compacting {
+		return
+	}
+	fmt.Fprintf(b, "current_compaction_entries:%d\r\n", progress.EntriesMerged)
+	fmt.Fprintf(b, "current_compaction_total_entries:%d\r\n", progress.EntriesTotal)
+	fmt.Fprintf(b, "current_compaction_bytes:%d\r\n", progress.BytesProcessed)
+	fmt.Fprintf(b, "current_compaction_total_bytes:%d\r\n", progress.BytesTotal)
+	fmt.Fprintf(b, "current_compaction_perc:%.2f%%\r\n", progress.Fraction()*100)
+	fmt.Fprintf(b, "current_compaction_eta_sec:%d\r\n", int64(progress.Remaining().Seconds()))
+}
+
+func infoStats(b *strings.Builder) {
+	var stats storage.ReadStats
+	if ready.Load() {
+		stats = store.ReadStats()
+	}
+
+	fmt.Fprintf(b, "keyspace_hits:%d\r\n", stats.KeyspaceHits)
+	fmt.Fprintf(b, "keyspace_misses:%d\r\n", stats.KeyspaceMisses)
+	fmt.Fprintf(b, "sstable_probes_total:%d\r\n", stats.SSTableProbes)
+	fmt.Fprintf(b, "sstable_reads_total:%d\r\n", stats.SSTableReads)
+	fmt.Fprintf(b, "bloom_filter_rejections:%d\r\n", stats.BloomFilterRejections)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// infoCommand handles INFO [section ...]
+func infoCommand(args []string) string {
+	wanted := make(map[string]bool)
+	for _, arg := range args[1:] {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(section.name[:1]), section.name[1:])
+		section.render(&b)
+	}
+
+	return fmt.Sprintf("$%d\r\n%s\r\n", b.Len(), b.String())
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"small-redis/client"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// infoField returns a field of INFO, failing the test if it is missing
+func infoField(t *testing.T, c *client.Client, field string) string {
+	t.Helper()
+	info, ok := do(t, c, "INFO").(string)
+	if !ok {
+		t.Fatalf("INFO didn't return a string")
+	}
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			return value
+		}
+	}
+	t.Fatalf("INFO has no %s", field)
+	return ""
+}
+
+func TestRunID(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	runID := infoField(t, c, "run_id")
+	if !regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(runID) {
+		t.Fatalf("run_id = %q, want 40 hex characters", runID)
+	}
+	expect(t, c, "OK", "SET", "k", "v")
+	if again := infoField(t, c, "run_id"); again != runID {
+		t.Errorf("run_id changed from %s to %s between commands", runID, again)
+	}
+
+	expect(t, c, "OK", "DEBUG", "CHANGE-REPL-ID")
+	changed := infoField(t, c, "run_id")
+	if changed == runID || !regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(changed) {
+		t.Errorf("run_id after DEBUG CHANGE-REPL-ID = %q (was %s)", changed, runID)
+	}
+}
+
+// ROLE answers as a master without replicas, [master, offset, []], and
+// INFO replication agrees with it
+func TestRole(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "v")
+
+	conn, reader := dialRaw(t)
+	sendRaw(t, conn, "ROLE")
+	readExpected(t, reader, "*3\r\n$6\r\nmaster\r\n:0\r\n*0\r\n")
+
+	role, ok := do(t, c, "ROLE").([]interface{})
+	if !ok || len(role) != 3 {
+		t.Fatalf("ROLE = %v, want 3 elements", role)
+	}
+	if replicas, ok := role[2].([]interface{}); role[0] != "master" || role[1] != int64(0) || !ok || len(replicas) != 0 {
+		t.Errorf("ROLE = %#v, want master, offset 0 and no replicas", role)
+	}
+	expect(t, c, "ERR wrong number of arguments for 'role' command", "ROLE", "extra")
+
+	if got := infoField(t, c, "role"); got != "master" {
+		t.Errorf("INFO role:%s, want master", got)
+	}
+	if got := infoField(t, c, "connected_slaves"); got != "0" {
+		t.Errorf("INFO connected_slaves:%s, want 0", got)
+	}
+	if got := infoField(t, c, "master_repl_offset"); got != "0" {
+		t.Errorf("INFO master_repl_offset:%s, want ROLE's offset 0", got)
+	}
+}
+
+// clientField returns a field of a CLIENT INFO line
+func clientField(t *testing.T, c *client.Client, field string) int64 {
+	t.Helper()
+	line, _ := do(t, c, "CLIENT", "INFO").(string)
+	for _, part := range strings.Fields(line) {
+		if value, found := strings.CutPrefix(part, field+"="); found {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				t.Fatalf("CLIENT INFO %s=%q", field, value)
+			}
+			return n
+		}
+	}
+	t.Fatalf("CLIENT INFO has no %s: %q", field, line)
+	return 0
+}
+
+// Uptime counts from the server's start and grows; a connection's age
+// counts from when it connected
+func TestUptimeAndClientAge(t *testing.T) {
+	useTestStore(t)
+	old := dialTest(t)
+
+	uptime := func() int64 {
+		t.Helper()
+		n, err := strconv.ParseInt(infoField(t, old, "uptime_in_seconds"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := uptime()
+	if since := int64(time.Since(startTime).Seconds()); before < 0 || before > since {
+		t.Errorf("uptime_in_seconds = %d, %d seconds after the start", before, since)
+	}
+	if days := infoField(t, old, "uptime_in_days"); days != strconv.FormatInt(before/86400, 10) {
+		t.Errorf("uptime_in_days = %s with %d seconds up", days, before)
+	}
+
+	connected := time.Now()
+	time.Sleep(1100 * time.Millisecond)
+	if after := uptime(); after <= before {
+		t.Errorf("uptime_in_seconds went from %d to %d over a second", before, after)
+	}
+
+	fresh := dialTest(t)
+	if age := clientField(t, fresh, "age"); age != 0 {
+		t.Errorf("a new connection has age %d", age)
+	}
+	if age := clientField(t, old, "age"); age < 1 || age > int64(time.Since(connected).Seconds())+1 {
+		t.Errorf("a connection made %v ago has age %d", time.Since(connected), age)
+	}
+}
+
+// INFO reports the memtable's flush threshold, which follows the write
+// rate in adaptive mode
+func TestInfoMemTableEffectiveSize(t *testing.T) {
+	config.MemTableAdaptiveMin, config.MemTableAdaptiveMax = 500, 1<<20
+	t.Cleanup(func() { config.MemTableAdaptiveMin, config.MemTableAdaptiveMax = 500, 0 })
+	useTestStore(t)
+	c := dialTest(t)
+
+	if got := infoField(t, c, "memtable_effective_size"); got != "500" {
+		t.Errorf("memtable_effective_size before any writes = %s, want the minimum", got)
+	}
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 10; i++ {
+		expect(t, c, "OK", "SET", "k"+strconv.Itoa(i), value)
+	}
+	size, err := strconv.ParseInt(infoField(t, c, "memtable_effective_size"), 10, 64)
+	if err != nil || size < 10000 {
+		t.Errorf("memtable_effective_size after 10KB of writes = %d, %v; want it grown", size, err)
+	}
+}
+
+// CLIENT INFO counts the commands a connection has sent, including
+// itself, and CLIENT LIST shows how long each has been idle
+func TestClientCommandStats(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	if n := clientField(t, c, "tot-cmds"); n != 1 {
+		t.Errorf("tot-cmds on a new connection = %d, want 1 for CLIENT INFO itself", n)
+	}
+	expect(t, c, "OK", "SET", "k", "v")
+	expect(t, c, "v", "GET", "k")
+	expect(t, c, "PONG", "PING")
+	do(t, c, "NOSUCHCOMMAND")
+	if n := clientField(t, c, "tot-cmds"); n != 6 {
+		t.Errorf("tot-cmds after five more commands = %d, want 6", n)
+	}
+	if idle := clientField(t, c, "idle"); idle != 0 {
+		t.Errorf("idle = %d while sending commands", idle)
+	}
+	id := do(t, c, "CLIENT", "ID")
+
+	time.Sleep(1100 * time.Millisecond)
+	other := dialTest(t)
+	list, _ := do(t, other, "CLIENT", "LIST").(string)
+	for _, line := range strings.Split(strings.TrimSpace(list), "\n") {
+		if !strings.HasPrefix(line, fmt.Sprintf("id=%v ", id)) {
+			continue
+		}
+		if !strings.Contains(line, " tot-cmds=8") || strings.Contains(line, " idle=0 ") {
+			t.Errorf("CLIENT LIST has %q after eight commands and a second idle", line)
+		}
+		return
+	}
+	t.Errorf("CLIENT LIST doesn't list connection %v: %q", id, list)
+}
+
+// INFO persistence shows the flush and compaction backlog, which an
+// idle store doesn't have
+func TestInfoPipelineBacklog(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "SET", "k", "v")
+	for _, field := range []string{"memtable_pending_flushes", "sstables", "compaction_pending_sstables"} {
+		if value := infoField(t, c, field); value != "0" {
+			t.Errorf("%s = %s on an idle store", field, value)
+		}
+	}
+}
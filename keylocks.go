@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"small-redis/hashing"
+	"sync"
+)
+
+// keyLockStripes is how many mutexes the keys share. Keys on the same
+// stripe wait for each other; memory stays fixed however many keys exist.
+const keyLockStripes = 256
+
+// keyLocks serializes writes to the same key while writes to other keys
+// run concurrently. A write holds its keys' stripes from the WAL record
+// until the store and the AOF have it, so every log sees the writes to a
+// key in the order the memtable applied them, and a check-then-write like
+// RESTORE without REPLACE can't be interleaved with another write.
+var keyLocks [keyLockStripes]sync.Mutex
+
+// keyLockHash picks a key's stripe
+var keyLockHash hashing.Func = hashing.FNV1a
+
+func keyStripe(key string) int {
+	return int(keyLockHash(key) % keyLockStripes)
+}
+
+// lockKeys locks the stripes of keys and returns the function that unlocks
+// them. Stripes are locked in index order, so commands with several keys
+// can't deadlock.
+func lockKeys(keys []string) func() {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, keyStripe(key))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, stripe := range stripes {
+		keyLocks[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			keyLocks[stripes[i]].Unlock()
+		}
+	}
+}
+
+// lockAllKeys locks every stripe, keeping all other writes out, and
+// returns the function that unlocks them
+func lockAllKeys() func() {
+	for stripe := range keyLocks {
+		keyLocks[stripe].Lock()
+	}
+	return func() {
+		for stripe := len(keyLocks) - 1; stripe >= 0; stripe-- {
+			keyLocks[stripe].Unlock()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"small-redis/hashing"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyOnOtherStripe returns a key whose stripe differs from key's
+func keyOnOtherStripe(key string) string {
+	for i := 0; ; i++ {
+		other := "other:" + strconv.Itoa(i)
+		if keyStripe(other) != keyStripe(key) {
+			return other
+		}
+	}
+}
+
+// A key's lock keeps out writers of the same key but not of keys on
+// other stripes, and a command naming a key twice doesn't deadlock
+func TestLockKeys(t *testing.T) {
+	unlock := lockKeys([]string{"a", "a"})
+
+	done := make(chan struct{})
+	go func() {
+		lockKeys([]string{keyOnOtherStripe("a")})()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a key on another stripe waited for the lock")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		lockKeys([]string{"b", "a"})()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("a second writer of the key got its lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+// Concurrent INCRs of one key never lose an update
+func TestConcurrentIncr(t *testing.T) {
+	useTestStore(t)
+	const clients, incrs = 8, 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := dialTest(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < incrs; n++ {
+				if _, err := c.Do("INCR", "counter"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	expect(t, dialTest(t), strconv.Itoa(clients*incrs), "GET", "counter")
+}
+
+// benchmarkIncr runs INCRs in parallel over keys distinct keys. With
+// per-key locks, spreading them over many keys lets them run at once.
+func benchmarkIncr(b *testing.B, keys int) {
+	config.Persistence = "none"
+	b.Cleanup(func() { config.Persistence = "lsm" })
+	useTestStore(b)
+
+	var next sync.Mutex
+	worker := 0
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		key := "counter:" + strconv.Itoa(worker%keys)
+		worker++
+		next.Unlock()
+
+		args := []string{"INCR", key}
+		for pb.Next() {
+			dispatch("INCR", args)
+		}
+	})
+}
+
+func BenchmarkIncrOneKey(b *testing.B)   { benchmarkIncr(b, 1) }
+func BenchmarkIncrManyKeys(b *testing.B) { benchmarkIncr(b, 1024) }
+
+// A key always maps to the same stripe, the one keyLockHash picks, and a
+// replaced hash is used from then on
+func TestKeyStripeStable(t *testing.T) {
+	for _, key := range []string{"", "a", "user:1000", "{tag}.key"} {
+		first := keyStripe(key)
+		if want := int(hashing.FNV1a(key) % keyLockStripes); first != want {
+			t.Errorf("keyStripe(%q) = %d, want %d", key, first, want)
+		}
+		for i := 0; i < 3; i++ {
+			if again := keyStripe(key); again != first {
+				t.Errorf("keyStripe(%q) = %d, then %d", key, first, again)
+			}
+		}
+	}
+
+	defer func(hash hashing.Func) { keyLockHash = hash }(keyLockHash)
+	keyLockHash = func(string) uint32 { return 7 }
+	if got := keyStripe("a"); got != 7 {
+		t.Errorf("keyStripe(a) = %d with a hash returning 7", got)
+	}
+}
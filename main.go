@@ -2,29 +2,83 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"small-redis/storage"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Global store instance
 var store *storage.LSMStore
 
+// ready is false while the dataset is loading at startup
+var ready atomic.Bool
+
 func main() {
 
-	// Create store
-	newStore, err := storage.NewLSMStore(500, "./data")
+	bench := flag.Bool("bench", false, "run a SET/GET benchmark against a running server instead of serving")
+	benchAddr := flag.String("bench-addr", "127.0.0.1:6380", "benchmark target address")
+	benchClients := flag.Int("bench-clients", 50, "number of parallel benchmark connections")
+	benchRequests := flag.Int("bench-requests", 100000, "total number of benchmark requests")
+	benchRate := flag.Int("bench-rate", 0, "target requests per second (0 = unlimited)")
+	benchSize := flag.Int("bench-size", 3, "benchmark value size in bytes")
+	benchKeys := flag.Int("bench-keys", 10000, "number of distinct benchmark keys")
+	verifyWAL := flag.String("verify-wal", "", "check the records of the WAL at this path and exit instead of serving")
+	registerConfigFlags()
+	flag.Parse()
+
+	if config.Persistence != "lsm" && config.Persistence != "none" {
+		fmt.Printf("Invalid -persistence %q: must be lsm or none\n", config.Persistence)
+		os.Exit(1)
+	}
+	if config.MemTableAdaptiveMax > 0 && config.MemTableAdaptiveMin > config.MemTableAdaptiveMax {
+		fmt.Printf("Invalid -memtable-adaptive-min %d: larger than -memtable-adaptive-max\n", config.MemTableAdaptiveMin)
+		os.Exit(1)
+	}
+
+	startTime = time.Now()
+	id := newRunID()
+	runID.Store(&id)
 
-	if err != nil {
-		fmt.Println("Error creating store:", err)
+	if *verifyWAL != "" {
+		report, err := storage.VerifyWALFile(*verifyWAL)
+		if err != nil {
+			fmt.Println("WAL verification failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("WAL check:", report)
+		if !report.OK() {
+			os.Exit(1)
+		}
 		return
 	}
 
-	store = newStore
-
-	defer store.Close()
-	defer store.WAL.Close()
+	if *bench {
+		cfg := benchConfig{
+			Addr:     *benchAddr,
+			Clients:  *benchClients,
+			Requests: *benchRequests,
+			Rate:     *benchRate,
+			DataSize: *benchSize,
+			KeySpace: *benchKeys,
+		}
+		result, err := runBenchmark(cfg)
+		if err != nil {
+			fmt.Println("Benchmark failed:", err)
+			os.Exit(1)
+		}
+		printBenchResult(cfg, result)
+		return
+	}
 
 	// Listen on TCP port 6379 (Redis default port)
 	listener, err := net.Listen("tcp", ":6380")
@@ -36,10 +90,25 @@ func main() {
 
 	fmt.Println("Redis server listening on :6380")
 
-	// Accept connections in a loop
+	// Load the dataset in the background; clients get -LOADING until it's done
+	go loadDataset()
+	defer func() {
+		if ready.Load() {
+			store.Close()
+			store.WAL.Close()
+		}
+	}()
+
+	serve(listener)
+}
+
+// serve accepts connections until listener is closed
+func serve(listener net.Listener) {
 	for {
-		fmt.Println("Waiting for connection...")
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Println("Error accepting connection:", err)
 			continue
@@ -50,9 +119,60 @@ func main() {
 	}
 }
 
+// loadDataset opens the store (loading SSTables and replaying the WAL)
+// and marks the server ready once recovery completes
+func loadDataset() {
+	var newStore *storage.LSMStore
+	var err error
+	if config.Persistence == "none" {
+		newStore = storage.NewInMemoryLSMStore()
+	} else {
+		newStore, err = storage.NewLSMStore(500, "./data")
+		if err != nil {
+			fmt.Println("Error creating store:", err)
+			os.Exit(1)
+		}
+	}
+
+	newStore.TombstoneFreeDeletes = config.TombstoneFreeDeletes
+	newStore.SetMaxOpenFiles(config.MaxOpenSSTables)
+	newStore.SetCompressThreshold(config.CompressThreshold)
+	newStore.SetAdaptiveMemTableSize(config.MemTableAdaptiveMin, config.MemTableAdaptiveMax)
+	newStore.SetIdleFlush(time.Duration(config.MemTableIdleFlush) * time.Second)
+	newStore.WAL.SetRewriteSize(config.WALRewriteSize)
+	newStore.SetSSTableOptions(storage.SSTableOptions{Dictionary: config.SSTableDictionary})
+	newStore.SetMaxSSTableSize(config.SSTableMaxSize)
+
+	if config.VerifySSTables {
+		report := newStore.VerifySSTables()
+		fmt.Println("Integrity scan:", report)
+		for _, problem := range report.Problems {
+			fmt.Println("  ", problem)
+		}
+	}
+
+	store = newStore
+
+	if config.AppendOnly {
+		err = loadAOF(config.AppendFilename)
+		if err != nil {
+			fmt.Println("Error loading AOF:", err)
+			os.Exit(1)
+		}
+	}
+
+	ready.Store(true)
+
+	fmt.Println("Dataset loaded, ready to accept commands")
+}
+
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	sess := newSession(conn)
+	clients.add(sess)
+	defer sess.close()
+
 	// This should print immediately
 	fmt.Printf("New client connected: %s\n", conn.RemoteAddr())
 
@@ -62,89 +182,414 @@ func handleConnection(conn net.Conn) {
 		// Parse the incoming RESP command
 		command, err := parseRESP(reader)
 		if err != nil {
-			fmt.Println("Error parsing:", err)
+			// Tell the client what was wrong before hanging up; on EOF or
+			// a broken connection there is nobody left to tell
+			var protoErr *protocolError
+			switch {
+			case errors.As(err, &protoErr):
+				sess.write(fmt.Sprintf("-ERR %s\r\n", protoErr))
+				fmt.Printf("Protocol error from client %s: %v\n", sess.addr, err)
+			case !isDisconnect(err):
+				fmt.Printf("Error reading from client %s: %v\n", sess.addr, err)
+			}
 			return
 		}
 
-		fmt.Printf("Parsed command: %v\n", command)
+		// Nothing to run and nothing to reply
+		if len(command) == 0 {
+			continue
+		}
 
 		// Execute the command and get response
-		response := executeCommand(command)
+		response := executeCommand(sess, command)
 
-		// Send response back to client
-		conn.Write([]byte(response))
+		// Send response back to client, unless the command queued it
+		// itself
+		if response != "" {
+			sess.write(response)
+		}
+
+		if sess.quit {
+			return
+		}
 
 	}
 
 }
 
+// isDisconnect reports whether a read error only means the client went
+// away: it closed the connection, even mid-command, reset it, or the
+// server closed it (see session.evict). These aren't worth logging.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET)
+}
+
 // executeCommand processes commands and returns RESP responses
-func executeCommand(args []string) string {
+func executeCommand(sess *session, args []string) string {
 	if len(args) == 0 {
 		return "-ERR empty command\r\n"
 	}
 
+	sess.noteCommand()
+
 	// Convert command to uppercase (Redis is case-insensitive)
 	command := strings.ToUpper(args[0])
 
+	// Until recovery completes only commands flagged loading are served
+	if !ready.Load() && !hasFlag(command, flagLoading) {
+		return "-LOADING Redis is loading the dataset in memory\r\n"
+	}
+
+	// QUIT works in any state, even mid-transaction
+	if command == "QUIT" {
+		sess.quit = true
+		return "+OK\r\n"
+	}
+
+	// Admin commands are never throttled, so a limit can always be lifted
+	if !hasFlag(command, flagAdmin) && !sess.rateLimit.allow(config.ClientCommandRate.Load(), time.Now()) {
+		return rateLimitError
+	}
+
+	// Inside MULTI everything but the transaction commands is queued
+	if sess.inMulti && command != "MULTI" && command != "EXEC" && command != "DISCARD" {
+		return sess.queue(args)
+	}
+
+	err := ValidateCommand(args)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	// A subscribed RESP2 connection only takes pub/sub commands and PING;
+	// RESP3 can tell pushes from replies, so it takes anything
+	if sess.subscribed() && !sess.resp3.Load() && !hasFlag(command, flagPubSub) {
+		switch command {
+		case "PING":
+			// Answered as an array so it can't be taken for a message
+			message := ""
+			if len(args) > 1 {
+				message = args[1]
+			}
+			return "*2\r\n$4\r\npong\r\n" + bulkString(message)
+		default:
+			return fmt.Sprintf("-ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n", strings.ToLower(command))
+		}
+	}
+
+	switch command {
+	case "MULTI":
+		return sess.multi()
+	case "EXEC":
+		return sess.exec()
+	case "DISCARD":
+		return sess.discard()
+	case "HELLO":
+		return sess.hello(args)
+	case "SUBSCRIBE":
+		return sess.subscribe(args[1:])
+	case "UNSUBSCRIBE":
+		return sess.unsubscribe(args[1:])
+	case "SSUBSCRIBE":
+		return sess.ssubscribe(args[1:])
+	case "SUNSUBSCRIBE":
+		return sess.sunsubscribe(args[1:])
+	}
+
+	txLock.RLock()
+	defer txLock.RUnlock()
+
+	if command == "GET" {
+		return sess.get(args)
+	}
+	return sess.dispatch(command, args)
+}
+
+// dispatch runs a validated command and logs successful writes to the
+// AOF exactly as received. Writes are refused in read-only mode and while
+// the WAL is failing, and hold their keys' locks until they are logged.
+func dispatch(command string, args []string) string {
+	if hasFlag(command, flagWrite) && config.ReplicaReadOnly.Load() {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	}
+	if hasFlag(command, flagWrite) && store.WAL.Failed() {
+		return "-MISCONF Errors writing to the WAL. Commands that may modify the data set are disabled until DEBUG CLEAR-WAL-ERRORS is run.\r\n"
+	}
+
+	if hasFlag(command, flagWrite) {
+		unlock := lockKeys(commandKeys(command, args))
+		defer unlock()
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	response := runCommand(ctx, command, args)
+
+	if aofCommands[command] && !strings.HasPrefix(response, "-") {
+		appendToAOF(args)
+	}
+
+	// Tell tracking clients that read the keys they have changed
+	if hasFlag(command, flagWrite) && !strings.HasPrefix(response, "-") {
+		for _, key := range commandKeys(command, args) {
+			tracking.invalidate(key)
+		}
+	}
+
+	return response
+}
+
+// commandContext bounds a command by the command-timeout setting.
+// Commands that scan the keyspace give up once it is done; the others
+// finish quickly and ignore it.
+func commandContext() (context.Context, context.CancelFunc) {
+	timeout := config.CommandTimeout.Load()
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+}
+
+// runCommand executes an already upper-cased command whose name and arity
+// were checked by ValidateCommand. It skips the readiness check so AOF
+// replay can use it during startup. Commands that scan the keyspace stop
+// when ctx is done.
+func runCommand(ctx context.Context, command string, args []string) string {
 	switch command {
 	case "PING":
 		return "+PONG\r\n"
 
 	case "ECHO":
-		if len(args) < 2 {
-			return "-ERR wrong number of arguments for 'echo' command\r\n"
-		}
-		message := args[1]
-		return fmt.Sprintf("$%d\r\n%s\r\n", len(message), message)
+		return bulkString(args[1])
 
 	case "SET":
-		if len(args) < 3 {
-			return "-ERR wrong number of arguments for 'set' command\r\n"
-		}
+		return setCommand(args)
+
+	case "GET":
 		key := args[1]
-		value := args[2]
+		value, exists, err := store.Get(key)
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		if !exists {
+			return "$-1\r\n" // Null bulk string in RESP
+		}
+		return bulkString(value)
+
+	case "EXISTS":
+		// A key named twice is counted twice, as in Redis
+		count := 0
+		for _, key := range args[1:] {
+			if store.Exists(key) {
+				count++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", count)
+
+	case "INCR":
+		return incrCommand(args, 1)
+
+	case "DECR":
+		return incrCommand(args, -1)
+
+	case "INCRBY":
+		return incrByCommand(args, false)
+
+	case "DECRBY":
+		return incrByCommand(args, true)
+
+	case "EXPIRE":
+		return expireCommand(args, false)
+
+	case "PEXPIREAT":
+		return expireCommand(args, true)
+
+	case "TTL":
+		return ttlCommand(args)
 
-		var err error
+	case "GETEX":
+		return getexCommand(args)
 
-		err = store.WAL.WriteEntry("SET", key, value)
+	case "SETRANGE":
+		return setRangeCommand(args)
+
+	case "GETRANGE":
+		return getRangeCommand(args)
+
+	case "GETDEL":
+		key := args[1]
+		err := store.WAL.WriteEntry("DEL", key, "")
 		if err != nil {
 			return fmt.Sprintf("-ERR %s\r\n", err)
 		}
 
-		err = store.Set(key, []byte(value))
+		value, existed, err := store.GetDelete(key)
 		if err != nil {
 			return fmt.Sprintf("-ERR %s\r\n", err)
 		}
-		return "+OK\r\n"
+		if !existed {
+			return "$-1\r\n"
+		}
+		return bulkString(value)
 
-	case "GET":
-		if len(args) < 2 {
-			return "-ERR wrong number of arguments for 'get' command\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			err := store.WAL.WriteEntry("DEL", key, "")
+			if err != nil {
+				return fmt.Sprintf("-ERR %s\r\n", err)
+			}
+
+			existed, err := store.Delete(key)
+			if err != nil {
+				return fmt.Sprintf("-ERR %s\r\n", err)
+			}
+			if existed {
+				deleted++
+			}
 		}
-		key := args[1]
-		value, exists := store.Get(key)
-		if !exists {
-			return "$-1\r\n" // Null bulk string in RESP
+
+		return fmt.Sprintf(":%d\r\n", deleted)
+
+	case "FLUSHDB":
+		return flushDBCommand(args)
+
+	case "DELPATTERN":
+		return delPattern(ctx, args[1])
+
+	case "DBSIZE":
+		if len(args) > 2 {
+			return "-ERR wrong number of arguments for 'dbsize' command\r\n"
+		}
+		// DBSIZE APPROX skips the full scan and returns the running estimate
+		if len(args) == 2 {
+			if strings.ToUpper(args[1]) != "APPROX" {
+				return "-ERR syntax error\r\n"
+			}
+			return fmt.Sprintf(":%d\r\n", store.EstimatedKeyCount())
 		}
-		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		count, err := store.CountKeysContext(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "-ERR operation timed out\r\n"
+		}
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		return fmt.Sprintf(":%d\r\n", count)
 
-	case "DEL":
-		if len(args) < 2 {
-			return "-ERR wrong number of arguments for 'del' command\r\n"
+	case "DUMP":
+		value, exists, err := store.Get(args[1])
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		if !exists {
+			return "$-1\r\n"
 		}
+		return bulkString(dumpValue(value))
+
+	case "RESTORE":
 		key := args[1]
 
-		err := store.WAL.WriteEntry("DEL", key, "")
+		ttl, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if ttl < 0 {
+			return "-ERR Invalid TTL value, must be >= 0\r\n"
+		}
+		var expiresAt int64
+		if ttl > 0 {
+			expiresAt = setExpiry("PX", ttl, time.Now().UnixNano())
+			if expiresAt == 0 {
+				return "-ERR Invalid TTL value, must be >= 0\r\n"
+			}
+		}
+
+		replace := false
+		for _, opt := range args[4:] {
+			if strings.ToUpper(opt) != "REPLACE" {
+				return "-ERR syntax error\r\n"
+			}
+			replace = true
+		}
+
+		_, exists, err := store.Get(key)
 		if err != nil {
 			return fmt.Sprintf("-ERR %s\r\n", err)
 		}
+		if exists && !replace {
+			return "-BUSYKEY Target key name already exists.\r\n"
+		}
 
-		store.Delete(key)
+		value, err := restoreValue([]byte(args[3]))
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
 
+		if expiresAt == 0 {
+			err = store.WAL.WriteEntry("SET", key, string(value))
+		} else {
+			err = store.WAL.WriteExpiringEntry(key, string(value), expiresAt)
+		}
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+
+		err = store.SetWithExpiry(key, value, expiresAt)
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+
+		// Logged as a SET, with the TTL as an absolute time so replaying
+		// it later doesn't push the expiry back
+		if expiresAt == 0 {
+			appendToAOF([]string{"SET", key, string(value)})
+		} else {
+			appendToAOF([]string{"SET", key, string(value), "PXAT", strconv.FormatInt(expiresAt/int64(time.Millisecond), 10)})
+		}
 		return "+OK\r\n"
 
+	case "MIGRATE":
+		return migrateCommand(args)
+
+	case "INFO":
+		return infoCommand(args)
+
+	case "DEBUG":
+		return debugCommand(args)
+
+	case "CONFIG":
+		return configCommand(args)
+
+	case "COMMAND":
+		return commandCommand(args)
+
+	case "CLUSTER":
+		return clusterCommand(args)
+
+	case "ROLE":
+		return roleCommand()
+
+	case "PUBLISH":
+		return fmt.Sprintf(":%d\r\n", pubsub.publish(args[1], args[2]))
+
+	case "SPUBLISH":
+		return fmt.Sprintf(":%d\r\n", shardPubsub.publish(args[1], args[2]))
+
+	case "BGREWRITEAOF":
+		if aof == nil {
+			return "-ERR append only file is disabled, start the server with -appendonly\r\n"
+		}
+		err := aof.startRewrite()
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+		go rewriteAOFInBackground()
+		return "+Background append only file rewriting started\r\n"
+
 	default:
-		return fmt.Sprintf("-ERR unknown command '%s'\r\n", command)
+		return fmt.Sprintf("-ERR %s\r\n", unknownCommandError(args))
 	}
 }
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"small-redis/client"
+	"small-redis/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testAddr is where the server under test listens. Tests share the
+// server and its global store, so they don't run in parallel.
+var testAddr string
+
+func TestMain(m *testing.M) {
+	registerConfigFlags()
+	flag.Parse()
+
+	startTime = time.Now()
+	id := newRunID()
+	runID.Store(&id)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Error starting test server:", err)
+		os.Exit(1)
+	}
+	testAddr = listener.Addr().String()
+	go serve(listener)
+
+	code := m.Run()
+	listener.Close()
+	os.Exit(code)
+}
+
+// useTestStore loads an empty dataset in a temporary directory, the way
+// the server does at startup, and closes it when the test ends
+func useTestStore(t testing.TB) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	loadDataset()
+	t.Cleanup(closeTestStore)
+}
+
+// closeTestStore closes the store once a background compaction it started
+// is done; one left running would go on removing files by their relative
+// paths in the next test's directory
+func closeTestStore() {
+	ready.Store(false)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, running := store.CompactionStatus(); !running && store.NumSSTables() < storage.CompactionThreshold {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.Close()
+	store.WAL.Close()
+}
+
+// useTestAOF restarts the test store with -appendonly set, as the server
+// starts with it, and turns it off again when the test ends. It returns a
+// function reading back the commands logged so far.
+func useTestAOF(t *testing.T) func() [][]string {
+	t.Helper()
+	config.AppendOnly = true
+	t.Cleanup(func() {
+		config.AppendOnly = false
+		if aof != nil {
+			aof.Close()
+			aof = nil
+		}
+	})
+	restartTestServer(t, false)
+
+	return func() [][]string {
+		t.Helper()
+		file, err := os.Open(config.AppendFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		var commands [][]string
+		reader := bufio.NewReader(file)
+		for {
+			args, err := parseRESP(reader)
+			if err != nil {
+				return commands
+			}
+			commands = append(commands, args)
+		}
+	}
+}
+
+// restartTestServer closes the store and loads the dataset again. With
+// aofOnly, the WAL and SSTables are removed first, so only the AOF can
+// bring the keys back.
+func restartTestServer(t *testing.T, aofOnly bool) {
+	t.Helper()
+	closeTestStore()
+	if aof != nil {
+		aof.Close()
+		aof = nil
+	}
+
+	if aofOnly {
+		for _, path := range []string{"wal.log", "data"} {
+			if err := os.RemoveAll(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	loadDataset()
+}
+
+// dialTest connects a client to the test server
+func dialTest(t *testing.T) *client.Client {
+	t.Helper()
+	c, err := client.DialTimeout(testAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", testAddr, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// do sends a command and fails the test on a connection error. Error
+// replies come back as a client.ReplyError value.
+func do(t *testing.T, c *client.Client, args ...string) interface{} {
+	t.Helper()
+	reply, err := c.Do(args...)
+	if _, isReply := err.(client.ReplyError); isReply {
+		return err
+	}
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return reply
+}
+
+// expect sends a command and checks its reply
+func expect(t *testing.T, c *client.Client, want interface{}, args ...string) {
+	t.Helper()
+	got := do(t, c, args...)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%v = %#v, want %#v", args, got, want)
+	}
+}
+
+// While the dataset loads, commands other than those allowed during
+// loading get LOADING; once it is loaded they see the recovered data
+func TestLoadingUntilReady(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	// A long WAL makes the next load slow
+	for i := 0; i < 300; i++ {
+		if err := store.WAL.WriteEntry("SET", "key:"+strconv.Itoa(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.WAL.WriteEntry("SET", "last", "loaded")
+	store.Close()
+	store.WAL.Close()
+
+	// Until the load finishes, which may be very quickly, GET is refused
+	// and PING still answered
+	ready.Store(false)
+	expect(t, c, "LOADING Redis is loading the dataset in memory", "GET", "last")
+	expect(t, c, "PONG", "PING")
+	go loadDataset()
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		reply := do(t, c, "GET", "last")
+		if err, isErr := reply.(error); isErr && err.Error() == "LOADING Redis is loading the dataset in memory" {
+			expect(t, c, "PONG", "PING")
+			continue
+		}
+		if !ready.Load() {
+			// Still loading after the reply, so it must have been refused
+			t.Fatalf("GET while loading = %#v, want LOADING", reply)
+		}
+		if reply == "loaded" {
+			break
+		}
+	}
+
+	expect(t, c, "loaded", "GET", "last")
+	expect(t, c, "v", "GET", "key:299")
+}
+
+// dialRaw opens a plain connection to the test server, for tests that
+// need to send bytes the client wouldn't or see the connection close
+func dialRaw(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", testAddr, time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", testAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// expectClosed checks that the server has closed the connection
+func expectClosed(t *testing.T, reader *bufio.Reader) {
+	t.Helper()
+	if line, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("read %q, %v; want the connection closed", line, err)
+	}
+}
+
+// Malformed RESP gets a protocol error reply before the server hangs up
+func TestProtocolErrorReply(t *testing.T) {
+	useTestStore(t)
+
+	for _, tc := range []struct{ send, want string }{
+		{"*abc\r\n", "-ERR Protocol error: invalid array length: abc\r\n"},
+		{"*1\r\n$x\r\n", "-ERR Protocol error: invalid bulk string length: x\r\n"},
+		{"*1\r\n+GET\r\n", "-ERR Protocol error: expected bulk string, got: +GET\r\n"},
+	} {
+		conn, reader := dialRaw(t)
+		if _, err := conn.Write([]byte(tc.send)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil || line != tc.want {
+			t.Errorf("sent %q, got %q, %v; want %q", tc.send, line, err, tc.want)
+		}
+		expectClosed(t, reader)
+	}
+
+	// A well-formed command still works on a new connection
+	expect(t, dialTest(t), "PONG", "PING")
+}
+
+// QUIT replies OK and then the server closes the connection, even inside
+// a transaction
+func TestQuit(t *testing.T) {
+	useTestStore(t)
+
+	for _, before := range []string{"", "*1\r\n$5\r\nMULTI\r\n"} {
+		conn, reader := dialRaw(t)
+		if _, err := conn.Write([]byte(before + "*1\r\n$4\r\nQUIT\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if before != "" {
+			if line, _ := reader.ReadString('\n'); line != "+OK\r\n" {
+				t.Fatalf("MULTI = %q", line)
+			}
+		}
+		if line, err := reader.ReadString('\n'); err != nil || line != "+OK\r\n" {
+			t.Errorf("QUIT = %q, %v; want +OK", line, err)
+		}
+		expectClosed(t, reader)
+	}
+
+	// The closed connection leaves the client registry
+	conn, reader := dialRaw(t)
+	conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	reader.ReadString('\n')
+	connected := len(clients.list())
+	conn.Write([]byte("*1\r\n$4\r\nQUIT\r\n"))
+	reader.ReadString('\n')
+	expectClosed(t, reader)
+	for deadline := time.Now().Add(2 * time.Second); len(clients.list()) >= connected; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still registered after QUIT, want fewer than %d", len(clients.list()), connected)
+		}
+	}
+}
+
+// Once WAL writes keep failing the server refuses writes with MISCONF
+// and goes on serving reads
+func TestMisconfAfterWALFailures(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "v")
+
+	store.WAL.Close()
+	for i := 0; i < storage.WALFailureThreshold; i++ {
+		reply := do(t, c, "SET", "k", "new")
+		if err, isErr := reply.(error); !isErr || strings.HasPrefix(err.Error(), "MISCONF") {
+			t.Fatalf("SET %d after the WAL broke = %v, want the write error", i+1, reply)
+		}
+	}
+
+	for _, args := range [][]string{{"SET", "k", "new"}, {"DEL", "k"}, {"INCR", "n"}} {
+		reply := do(t, c, args...)
+		if err, isErr := reply.(error); !isErr || !strings.HasPrefix(err.Error(), "MISCONF Errors writing to the WAL") {
+			t.Errorf("%v = %v, want MISCONF", args, reply)
+		}
+	}
+	expect(t, c, "v", "GET", "k")
+	expect(t, c, "PONG", "PING")
+}
+
+// useReadOnly turns on replica-read-only the way an operator would, and
+// off again when the test ends
+func useReadOnly(t *testing.T, c *client.Client) {
+	t.Helper()
+	expect(t, c, "OK", "CONFIG", "SET", "replica-read-only", "yes")
+	t.Cleanup(func() { config.ReplicaReadOnly.Store(false) })
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "v")
+
+	useReadOnly(t, c)
+	reply := do(t, c, "SET", "k", "new")
+	if err, isErr := reply.(error); !isErr || err.Error() != "READONLY You can't write against a read only replica." {
+		t.Errorf("SET in read-only mode = %v, want READONLY", reply)
+	}
+	expect(t, c, "v", "GET", "k")
+	expect(t, c, 1, "EXISTS", "k")
+
+	expect(t, c, "OK", "CONFIG", "SET", "replica-read-only", "no")
+	expect(t, c, "OK", "SET", "k", "new")
+	expect(t, c, "new", "GET", "k")
+}
+
+// An empty command, "*0" or a blank line, gets no reply and leaves the
+// connection open for the next one
+func TestEmptyCommandIgnored(t *testing.T) {
+	useTestStore(t)
+	conn, reader := dialRaw(t)
+
+	conn.Write([]byte("*0\r\n\r\n*0\r\n*1\r\n$4\r\nPING\r\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Errorf("first reply = %q, %v; want PONG with nothing before it", line, err)
+	}
+}
+
+// A null argument gets a protocol error reply rather than bringing the
+// connection, or the server, down unannounced
+func TestNullArgumentRejected(t *testing.T) {
+	useTestStore(t)
+	conn, reader := dialRaw(t)
+
+	conn.Write([]byte("*2\r\n$3\r\nGET\r\n$-1\r\n"))
+	want := "-ERR Protocol error: null bulk string not allowed in a request\r\n"
+	if line, err := reader.ReadString('\n'); err != nil || line != want {
+		t.Errorf("GET with a null argument = %q, %v; want %q", line, err, want)
+	}
+	expectClosed(t, reader)
+	expect(t, dialTest(t), "PONG", "PING")
+}
+
+// DEBUG COMPACT merges every SSTable into one and keeps the newest value
+// of each key
+func TestDebugCompact(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		var entries []*storage.Entry
+		if i == 4 {
+			entries = append(entries, &storage.Entry{Key: "own:0", Deleted: true, Timestamp: 5})
+		}
+		entries = append(entries,
+			&storage.Entry{Key: "own:" + strconv.Itoa(i), Value: []byte("v"), Timestamp: int64(i + 1)},
+			&storage.Entry{Key: "shared", Value: []byte(strconv.Itoa(i)), Timestamp: int64(i + 1)})
+		if err := storage.CreateSSTable(fmt.Sprintf("data/sstable-%d.db", i), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loadDataset()
+	t.Cleanup(closeTestStore)
+	c := dialTest(t)
+
+	// Opening five tables may already have started a compaction, which
+	// DEBUG COMPACT waits for
+	expect(t, c, 1, "DEBUG", "COMPACT")
+
+	files, err := os.ReadDir("data")
+	if err != nil || len(files) != 1 {
+		t.Errorf("data directory holds %d files (%v) after compaction, want 1", len(files), err)
+	}
+	expect(t, c, "4", "GET", "shared")
+	expect(t, c, "<nil>", "GET", "own:0")
+	for i := 1; i < 5; i++ {
+		expect(t, c, "v", "GET", "own:"+strconv.Itoa(i))
+	}
+	expect(t, c, "5", "DBSIZE")
+}
+
+// DEBUG COMPACT during a background compaction waits for it and then
+// merges what it left, replying with the count once that is done; DEBUG
+// COMPACT ASYNC refuses to start a second one
+func TestDebugCompactDuringCompaction(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		entries := []*storage.Entry{{Key: "k" + strconv.Itoa(i), Value: []byte("v"), Timestamp: int64(i + 1)}}
+		if err := storage.CreateSSTable(fmt.Sprintf("data/sstable-%d.db", i), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loadDataset()
+	t.Cleanup(closeTestStore)
+	c := dialTest(t)
+
+	// The hook holds the background compaction until released
+	release := make(chan struct{})
+	var once sync.Once
+	store.CompactionHook = func(storage.CompactionProgress) {
+		once.Do(func() { <-release })
+	}
+	t.Cleanup(func() { store.CompactionHook = nil })
+	expect(t, c, "Background compaction started", "DEBUG", "COMPACT", "ASYNC")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, running := store.CompactionStatus(); running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background compaction didn't start")
+		}
+	}
+	expect(t, c, "ERR Background compaction already in progress", "DEBUG", "COMPACT", "ASYNC")
+
+	other := dialTest(t)
+	replied := make(chan interface{})
+	go func() {
+		reply, err := other.Do("DEBUG", "COMPACT")
+		if err != nil {
+			reply = err
+		}
+		replied <- reply
+	}()
+	select {
+	case reply := <-replied:
+		t.Fatalf("DEBUG COMPACT replied %v during a background compaction", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if reply := <-replied; fmt.Sprint(reply) != "1" {
+		t.Errorf("DEBUG COMPACT = %v after the background compaction, want 1", reply)
+	}
+	expect(t, c, 3, "DBSIZE")
+}
+
+// DEBUG WAL VERIFY checks the live WAL's records without replaying them,
+// reporting where a damaged one starts
+func TestDebugWALVerify(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	walSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat("wal.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	offsets := []int64{walSize()}
+	for _, key := range []string{"a", "b", "c"} {
+		expect(t, c, "OK", "SET", key, "value of "+key)
+		offsets = append(offsets, walSize())
+	}
+	want := fmt.Sprintf("3 records verified in %d bytes, no corruption found", offsets[3])
+	expect(t, c, want, "DEBUG", "WAL", "VERIFY")
+
+	file, err := os.OpenFile("wal.log", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	middle := (offsets[1] + offsets[2]) / 2
+	b := make([]byte, 1)
+	file.ReadAt(b, middle)
+	b[0] ^= 0x01
+	if _, err := file.WriteAt(b, middle); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := fmt.Sprint(do(t, c, "DEBUG", "WAL", "VERIFY"))
+	if want := fmt.Sprintf("1 records verified, first corruption at offset %d of %d bytes", offsets[1], offsets[3]); !strings.HasPrefix(reply, want) {
+		t.Errorf("DEBUG WAL VERIFY on a damaged WAL = %q, want %q", reply, want)
+	}
+	expect(t, c, "value of b", "GET", "b")
+	expect(t, c, "ERR syntax error", "DEBUG", "WAL", "CHECK")
+}
+
+// With -persistence none nothing is written to disk, however much is
+// stored, and the data is gone after a restart
+func TestPersistenceNone(t *testing.T) {
+	config.Persistence = "none"
+	t.Cleanup(func() { config.Persistence = "lsm" })
+	useTestStore(t)
+	c := dialTest(t)
+
+	value := strings.Repeat("v", 64*1024)
+	for i := 0; i < 100; i++ {
+		expect(t, c, "OK", "SET", "key:"+strconv.Itoa(i), value)
+	}
+	expect(t, c, "OK", "SET", "k", "v")
+	expect(t, c, 1, "DEL", "key:0")
+	expect(t, c, "v", "GET", "k")
+
+	if got := infoField(t, c, "persistence"); got != "none" {
+		t.Errorf("INFO persistence = %q, want none", got)
+	}
+	files, err := os.ReadDir(".")
+	if err != nil || len(files) != 0 {
+		t.Errorf("working directory holds %v (%v), want nothing", files, err)
+	}
+
+	closeTestStore()
+	loadDataset()
+	expect(t, c, "<nil>", "GET", "k")
+	expect(t, c, 0, "DBSIZE")
+}
+
+// With command-timeout set, a keyspace scan that runs over it is cut
+// short with an error instead of blocking its client
+func TestCommandTimeout(t *testing.T) {
+	config.Persistence = "none"
+	t.Cleanup(func() { config.Persistence = "lsm" })
+	useTestStore(t)
+	c := dialTest(t)
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		store.Set("key:"+strconv.Itoa(i), []byte("v"))
+	}
+	expect(t, c, "OK", "CONFIG", "SET", "command-timeout", "10")
+	t.Cleanup(func() { config.CommandTimeout.Store(0) })
+
+	// Each scan is held up past the timeout: an open iterator blocks a
+	// writer, which in turn keeps the scan from starting until it's closed
+	for _, args := range [][]string{{"DBSIZE"}, {"DELPATTERN", "nomatch:*"}} {
+		it := store.NewIterator()
+		go store.SetMaxSSTableSize(0)
+		time.Sleep(20 * time.Millisecond)
+
+		reply := make(chan any)
+		go func() {
+			got, err := c.Do(args...)
+			if err != nil {
+				got = err
+			}
+			reply <- got
+		}()
+		time.Sleep(50 * time.Millisecond)
+		it.Close()
+
+		if got := <-reply; fmt.Sprint(got) != "ERR operation timed out" {
+			t.Errorf("%v held past the timeout = %v, want it timed out", args, got)
+		}
+	}
+
+	// Commands that don't scan are unaffected, and without the limit the
+	// scan completes
+	expect(t, c, "v", "GET", "key:1")
+	expect(t, c, "OK", "CONFIG", "SET", "command-timeout", "0")
+	expect(t, c, keys, "DBSIZE")
+}
+
+// DEL counts only the keys that existed, each once
+func TestDelCount(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "a", "1")
+	expect(t, c, "OK", "SET", "b", "2")
+
+	expect(t, c, 2, "DEL", "a", "missing", "b", "a")
+	expect(t, c, 0, "DEL", "a", "b")
+	expect(t, c, 0, "DBSIZE")
+}
+
+// A GET reply is written from the stored value, in order with the replies
+// around it; inside a transaction GET still answers through EXEC
+func TestGetStreamsValue(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	large := strings.Repeat("v", 3*writeBufferSize+5)
+	expect(t, c, "OK", "SET", "large", large)
+	expect(t, c, "OK", "SET", "empty", "")
+
+	conn, reader := dialRaw(t)
+	sendRaw(t, conn, "GET", "large")
+	sendRaw(t, conn, "PING")
+	sendRaw(t, conn, "GET", "empty")
+	sendRaw(t, conn, "GET", "missing")
+	readExpected(t, reader, fmt.Sprintf("$%d\r\n%s\r\n", len(large), large))
+	readExpected(t, reader, "+PONG\r\n")
+	readExpected(t, reader, "$0\r\n\r\n")
+	readExpected(t, reader, "$-1\r\n")
+
+	sendRaw(t, conn, "MULTI")
+	sendRaw(t, conn, "GET", "large")
+	sendRaw(t, conn, "EXEC")
+	readExpected(t, reader, "+OK\r\n+QUEUED\r\n")
+	readExpected(t, reader, fmt.Sprintf("*1\r\n$%d\r\n%s\r\n", len(large), large))
+}
+
+// BenchmarkGetLarge measures GET of a 10MB value, reading the reply off
+// the connection. The value is flushed to an SSTable, so one 10MB
+// allocation per GET is reading it back; a second would be the reply
+// copying it.
+func BenchmarkGetLarge(b *testing.B) {
+	useTestStore(b)
+	const size = 10 << 20
+	if reply := dispatch("SET", []string{"SET", "large", strings.Repeat("v", size)}); reply != "+OK\r\n" {
+		b.Fatalf("SET replied %q", reply)
+	}
+
+	conn, err := net.Dial("tcp", testAddr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request := "*2\r\n$3\r\nGET\r\n$5\r\nlarge\r\n"
+	reply := int64(len(fmt.Sprintf("$%d\r\n", size)) + size + 2)
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.WriteString(conn, request); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.CopyN(io.Discard, reader, reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// captureStdout sends what is printed from here on to a pipe, returning
+// the function that restores stdout and gives back what was printed
+func captureStdout(t *testing.T) func() string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- string(data)
+	}()
+
+	restored := false
+	restore := func() string {
+		if restored {
+			return ""
+		}
+		restored = true
+		os.Stdout = stdout
+		w.Close()
+		return <-printed
+	}
+	t.Cleanup(func() { restore() })
+	return restore
+}
+
+// waitForDisconnect waits until the server has finished with the client
+// connected from addr
+func waitForDisconnect(t *testing.T, addr string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		connected := false
+		for _, sess := range clients.list() {
+			connected = connected || sess.addr == addr
+		}
+		if !connected {
+			return
+		}
+	}
+	t.Fatalf("the server still has the connection from %s", addr)
+}
+
+// A client that hangs up, even mid-command or with a reset, isn't logged
+// as an error; a malformed command is answered and logged
+func TestDisconnectLogging(t *testing.T) {
+	useTestStore(t)
+
+	for name, hangUp := range map[string]func(conn *net.TCPConn){
+		"close":            func(conn *net.TCPConn) { conn.Close() },
+		"mid-command":      func(conn *net.TCPConn) { conn.Write([]byte("*2\r\n$3\r\nGET\r\n$5\r\nab")); conn.Close() },
+		"reset":            func(conn *net.TCPConn) { conn.SetLinger(0); conn.Close() },
+		"close-after-quit": func(conn *net.TCPConn) { conn.Write([]byte("*1\r\n$4\r\nQUIT\r\n")); conn.Close() },
+	} {
+		conn, reader := dialRaw(t)
+		sendRaw(t, conn, "PING")
+		readExpected(t, reader, "+PONG\r\n")
+
+		printed := captureStdout(t)
+		addr := conn.LocalAddr().String()
+		hangUp(conn.(*net.TCPConn))
+		waitForDisconnect(t, addr)
+		if output := printed(); strings.Contains(output, addr) {
+			t.Errorf("%s: a client hanging up was logged: %q", name, output)
+		}
+	}
+
+	conn, reader := dialRaw(t)
+	printed := captureStdout(t)
+	addr := conn.LocalAddr().String()
+	conn.Write([]byte("*abc\r\n"))
+	readExpected(t, reader, "-ERR Protocol error: invalid array length: abc\r\n")
+	waitForDisconnect(t, addr)
+	if output, want := printed(), "Protocol error from client "+addr; !strings.Contains(output, want) {
+		t.Errorf("a malformed command logged %q, want %q", output, want)
+	}
+}
+
+func TestIsDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("reading bulk string: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{&protocolError{detail: "invalid array length: abc"}, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.EIO)}, false},
+		{errors.New("something else"), false},
+	} {
+		if got := isDisconnect(tc.err); got != tc.want {
+			t.Errorf("isDisconnect(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
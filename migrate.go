@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"small-redis/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrateCommand handles MIGRATE host port key destination-db timeout [COPY] [REPLACE]
+// The key is DUMPed locally, RESTOREd on the target and, unless COPY is
+// given, deleted locally. On any failure the source key is left untouched.
+func migrateCommand(args []string) string {
+	host := args[1]
+	port := args[2]
+	key := args[3]
+
+	destDB, err := strconv.Atoi(args[4])
+	if err != nil || destDB < 0 {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+
+	timeoutMs, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || timeoutMs < 0 {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	if timeoutMs == 0 {
+		timeoutMs = 1000
+	}
+
+	copyKey := false
+	replace := false
+	for _, opt := range args[6:] {
+		switch strings.ToUpper(opt) {
+		case "COPY":
+			copyKey = true
+		case "REPLACE":
+			replace = true
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+
+	value, exists, err := store.Get(key)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	if !exists {
+		return "+NOKEY\r\n"
+	}
+
+	addr := net.JoinHostPort(host, port)
+	target, err := client.DialTimeout(addr, time.Duration(timeoutMs)*time.Millisecond)
+	if err != nil {
+		return "-IOERR error or timeout connecting to the client\r\n"
+	}
+	defer target.Close()
+
+	if destDB != 0 {
+		_, err = target.Do("SELECT", strconv.Itoa(destDB))
+		if err != nil {
+			return migrateError(err)
+		}
+	}
+
+	// The target gets the time the key has left, at least a millisecond so
+	// a key about to expire isn't restored without one
+	ttl := int64(0)
+	if expiresAt, _ := store.ExpiresAt(key); expiresAt != 0 {
+		ttl = max(int64(time.Duration(expiresAt-time.Now().UnixNano())/time.Millisecond), 1)
+	}
+
+	restoreArgs := []string{"RESTORE", key, strconv.FormatInt(ttl, 10), string(dumpValue(value))}
+	if replace {
+		restoreArgs = append(restoreArgs, "REPLACE")
+	}
+
+	_, err = target.Do(restoreArgs...)
+	if err != nil {
+		return migrateError(err)
+	}
+
+	if !copyKey {
+		err = store.WAL.WriteEntry("DEL", key, "")
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+
+		_, err = store.Delete(key)
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+
+		// The AOF records the local effect, not the MIGRATE itself
+		appendToAOF([]string{"DEL", key})
+	}
+
+	return "+OK\r\n"
+}
+
+// migrateError turns a failure talking to the target into a reply
+func migrateError(err error) string {
+	if replyErr, ok := err.(client.ReplyError); ok {
+		return fmt.Sprintf("-ERR Target instance replied with error: %s\r\n", string(replyErr))
+	}
+	return "-IOERR error or timeout reading to target instance\r\n"
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// migrateTarget stands in for the instance MIGRATE sends keys to. It
+// keeps what it was sent and replies OK to everything, or with
+// restoreReply to a RESTORE when that is set.
+type migrateTarget struct {
+	addr         string
+	restoreReply string
+
+	mu       sync.Mutex
+	commands [][]string
+}
+
+func startMigrateTarget(t *testing.T) *migrateTarget {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	target := &migrateTarget{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go target.serve(conn)
+		}
+	}()
+	return target
+}
+
+func (target *migrateTarget) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := parseRESP(reader)
+		if err != nil {
+			return
+		}
+		target.mu.Lock()
+		target.commands = append(target.commands, args)
+		target.mu.Unlock()
+
+		if args[0] == "RESTORE" && target.restoreReply != "" {
+			conn.Write([]byte(target.restoreReply))
+			continue
+		}
+		conn.Write([]byte("+OK\r\n"))
+	}
+}
+
+// restore returns the RESTORE the target was sent
+func (target *migrateTarget) restore(t *testing.T) []string {
+	t.Helper()
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	for _, args := range target.commands {
+		if args[0] == "RESTORE" {
+			return args
+		}
+	}
+	t.Fatalf("target got no RESTORE: %v", target.commands)
+	return nil
+}
+
+// migrateArgs builds a MIGRATE of key to target
+func (target *migrateTarget) migrateArgs(key string, options ...string) []string {
+	host, port, _ := net.SplitHostPort(target.addr)
+	return append([]string{"MIGRATE", host, port, key, "0", "1000"}, options...)
+}
+
+// A migrated key arrives whole on the target and is gone from the
+// source; RESTOREd back from what the target got, it is the same key
+func TestMigrateRoundTrip(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	target := startMigrateTarget(t)
+
+	value := "binary\x00\r\nvalue"
+	expect(t, c, "OK", "SET", "k", value)
+	expect(t, c, "OK", target.migrateArgs("k")...)
+	expect(t, c, 0, "EXISTS", "k")
+
+	restore := target.restore(t)
+	if restore[1] != "k" || restore[2] != "0" {
+		t.Errorf("target got RESTORE %s %s, want k with no TTL", restore[1], restore[2])
+	}
+	got, err := restoreValue([]byte(restore[3]))
+	if err != nil || string(got) != value {
+		t.Errorf("target payload holds %q, %v; want %q", got, err, value)
+	}
+
+	expect(t, c, "OK", "RESTORE", "k", "0", restore[3])
+	expect(t, c, value, "GET", "k")
+
+	// COPY leaves the source key in place
+	expect(t, c, "OK", target.migrateArgs("k", "COPY", "REPLACE")...)
+	expect(t, c, value, "GET", "k")
+	expect(t, c, "NOKEY", target.migrateArgs("missing")...)
+}
+
+// When the target refuses the key or can't be reached, the source keeps it
+func TestMigrateFailureKeepsKey(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	target := startMigrateTarget(t)
+	target.restoreReply = "-BUSYKEY Target key name already exists.\r\n"
+
+	expect(t, c, "OK", "SET", "k", "v")
+	reply := do(t, c, target.migrateArgs("k")...)
+	if err, isErr := reply.(error); !isErr || !strings.Contains(err.Error(), "BUSYKEY") {
+		t.Errorf("MIGRATE to a target refusing the key = %v, want its BUSYKEY error", reply)
+	}
+	expect(t, c, "v", "GET", "k")
+
+	// Nothing listens on the port of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	reply = do(t, c, "MIGRATE", "127.0.0.1", port, "k", "0", "200")
+	if err, isErr := reply.(error); !isErr || !strings.HasPrefix(err.Error(), "IOERR") {
+		t.Errorf("MIGRATE to a closed port = %v, want IOERR", reply)
+	}
+	expect(t, c, "v", "GET", "k")
+}
+
+func TestRestoreWithTTL(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "SET", "k", "v")
+	payload := do(t, c, "DUMP", "k")
+	expect(t, c, 1, "DEL", "k")
+
+	logged := useTestAOF(t)
+	expect(t, c, "OK", "RESTORE", "k", "5000", payload.(string))
+	expect(t, c, "v", "GET", "k")
+	if ttl := ttlOf(t, c, "k"); ttl < 4 || ttl > 5 {
+		t.Errorf("TTL after RESTORE with 5000ms = %d", ttl)
+	}
+
+	// The AOF gets the expiry as an absolute time
+	commands := logged()
+	if len(commands) != 1 || len(commands[0]) != 5 || commands[0][0] != "SET" || commands[0][3] != "PXAT" {
+		t.Fatalf("AOF holds %q, want a SET with PXAT", commands)
+	}
+	pxat, _ := strconv.ParseInt(commands[0][4], 10, 64)
+	if remaining := time.Until(time.UnixMilli(pxat)); remaining <= 4*time.Second || remaining > 5*time.Second {
+		t.Errorf("AOF expiry is %v away, want 5s", remaining)
+	}
+
+	expect(t, c, "OK", "RESTORE", "k", "0", payload.(string), "REPLACE")
+	expect(t, c, -1, "TTL", "k")
+
+	if _, isErr := do(t, c, "RESTORE", "k", "-1", payload.(string), "REPLACE").(error); !isErr {
+		t.Error("RESTORE with a negative TTL was accepted")
+	}
+}
+
+// The key's remaining time to live goes to the target with it
+func TestMigrateSendsTTL(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	target := startMigrateTarget(t)
+
+	expect(t, c, "OK", "SET", "k", "v", "EX", "100")
+	expect(t, c, "OK", target.migrateArgs("k", "COPY")...)
+
+	ttl, err := strconv.ParseInt(target.restore(t)[2], 10, 64)
+	if err != nil || ttl <= 90_000 || ttl > 100_000 {
+		t.Errorf("RESTORE was sent TTL %d ms, want the 100s the key has left", ttl)
+	}
+}
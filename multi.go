@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// txLock keeps other commands from interleaving with an EXEC.
+// Regular commands hold it shared, EXEC holds it exclusively.
+var txLock sync.RWMutex
+
+// queue validates a command inside MULTI and queues it. A malformed
+// command is rejected now and makes the following EXEC fail.
+func (sess *session) queue(args []string) string {
+	err := ValidateCommand(args)
+	if err != nil {
+		sess.dirty = true
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE":
+		sess.dirty = true
+		return "-ERR Command not allowed inside a transaction\r\n"
+	}
+
+	sess.queued = append(sess.queued, args)
+	return "+QUEUED\r\n"
+}
+
+func (sess *session) multi() string {
+	if sess.inMulti {
+		return "-ERR MULTI calls can not be nested\r\n"
+	}
+	sess.inMulti = true
+	return "+OK\r\n"
+}
+
+// exec runs the queued commands as one unit and replies with an array
+// of their replies
+func (sess *session) exec() string {
+	if !sess.inMulti {
+		return "-ERR EXEC without MULTI\r\n"
+	}
+
+	queued := sess.queued
+	dirty := sess.dirty
+	sess.reset()
+
+	if dirty {
+		return "-EXECABORT Transaction discarded because of previous errors.\r\n"
+	}
+
+	txLock.Lock()
+	defer txLock.Unlock()
+
+	// With more than one write, the WAL frames them so that recovery
+	// applies all of them or none
+	framed := countWrites(queued) > 1
+	if framed {
+		err := store.WAL.BeginTransaction()
+		if err != nil {
+			return fmt.Sprintf("-ERR %s\r\n", err)
+		}
+	}
+
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "*%d\r\n", len(queued))
+	for _, args := range queued {
+		reply.WriteString(sess.dispatch(strings.ToUpper(args[0]), args))
+	}
+
+	// Without its COMMIT, recovery drops every write of the transaction,
+	// so the client must not take the replies as durable. The failed
+	// write also counts toward the WAL's MISCONF threshold.
+	if framed {
+		err := store.WAL.CommitTransaction()
+		if err != nil {
+			return fmt.Sprintf("-ERR Failed to commit the transaction to the WAL, its writes will be lost on restart: %s\r\n", err)
+		}
+	}
+	return reply.String()
+}
+
+// countWrites counts the write commands in a transaction
+func countWrites(queued [][]string) int {
+	writes := 0
+	for _, args := range queued {
+		if hasFlag(strings.ToUpper(args[0]), flagWrite) {
+			writes++
+		}
+	}
+	return writes
+}
+
+func (sess *session) discard() string {
+	if !sess.inMulti {
+		return "-ERR DISCARD without MULTI\r\n"
+	}
+	sess.reset()
+	return "+OK\r\n"
+}
+
+func (sess *session) reset() {
+	sess.inMulti = false
+	sess.dirty = false
+	sess.queued = nil
+}
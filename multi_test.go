@@ -0,0 +1,87 @@
+package main
+
+import (
+	"small-redis/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExec(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "a", "1")
+	expect(t, c, "QUEUED", "SET", "b", "2")
+	expect(t, c, "QUEUED", "GET", "a")
+	expect(t, c, []interface{}{"OK", "OK", "1"}, "EXEC")
+	expect(t, c, "2", "GET", "b")
+}
+
+// When the WAL can't take the COMMIT, the transaction's writes won't be
+// recovered, so EXEC fails instead of replying as if they were durable
+func TestExecReportsFailedWALCommit(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "a", "1")
+	expect(t, c, "QUEUED", "SET", "b", "2")
+
+	// Hold b's key lock so the transaction stops after writing a, and
+	// break the WAL before letting it go on
+	unlock := lockKeys([]string{"b"})
+	reply := make(chan error, 1)
+	go func() {
+		_, err := c.Do("EXEC")
+		reply <- err
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if _, found, _ := store.Get("a"); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			unlock()
+			t.Fatal("transaction didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.WAL.Close()
+	unlock()
+
+	err := <-reply
+	replyErr, ok := err.(client.ReplyError)
+	if !ok || !strings.Contains(string(replyErr), "commit the transaction") {
+		t.Fatalf("EXEC = %v, want an error about the WAL commit", err)
+	}
+}
+
+// A command that fails validation while queued aborts the transaction:
+// EXEC runs none of the queued commands
+func TestExecAbortsAfterBadCommand(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "a", "1")
+	reply := do(t, c, "NOSUCHCOMMAND", "x")
+	if err, isErr := reply.(error); !isErr || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("queuing an unknown command = %v, want an unknown command error", reply)
+	}
+	reply = do(t, c, "GET")
+	if err, isErr := reply.(error); !isErr || !strings.Contains(err.Error(), "wrong number of arguments") {
+		t.Errorf("queuing GET without a key = %v, want an arity error", reply)
+	}
+
+	reply = do(t, c, "EXEC")
+	if err, isErr := reply.(error); !isErr || !strings.HasPrefix(err.Error(), "EXECABORT") {
+		t.Errorf("EXEC = %v, want EXECABORT", reply)
+	}
+	expect(t, c, 0, "EXISTS", "a")
+
+	// The transaction is over; the next one starts clean
+	expect(t, c, "OK", "MULTI")
+	expect(t, c, "QUEUED", "SET", "a", "1")
+	expect(t, c, []interface{}{"OK"}, "EXEC")
+}
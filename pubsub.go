@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pubSubRegistry maps channels to the sessions subscribed to them
+type pubSubRegistry struct {
+	mu          sync.RWMutex
+	channels    map[string]map[*session]bool
+	messageKind string // first element of delivered messages
+}
+
+func newPubSubRegistry(messageKind string) *pubSubRegistry {
+	return &pubSubRegistry{
+		channels:    make(map[string]map[*session]bool),
+		messageKind: messageKind,
+	}
+}
+
+// Global channel registries for SUBSCRIBE/PUBLISH and for the sharded
+// SSUBSCRIBE/SPUBLISH. With a single node there are no shards to route
+// to; shard channels are just a separate namespace.
+var (
+	pubsub      = newPubSubRegistry("message")
+	shardPubsub = newPubSubRegistry("smessage")
+)
+
+func (r *pubSubRegistry) add(channel string, sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscribers, exists := r.channels[channel]
+	if !exists {
+		subscribers = make(map[*session]bool)
+		r.channels[channel] = subscribers
+	}
+	subscribers[sess] = true
+}
+
+func (r *pubSubRegistry) remove(channel string, sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscribers := r.channels[channel]
+	delete(subscribers, sess)
+	if len(subscribers) == 0 {
+		delete(r.channels, channel)
+	}
+}
+
+// isSubscribed reports whether sess is subscribed to channel
+func (r *pubSubRegistry) isSubscribed(channel string, sess *session) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.channels[channel][sess]
+}
+
+// publish sends message to every subscriber of channel and returns how
+// many received it
+func (r *pubSubRegistry) publish(channel, message string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	subscribers := r.channels[channel]
+	frame := pubSubFrame(r.messageKind, channel, message)
+	for sess := range subscribers {
+		sess.push(sess.pushFrame(frame))
+	}
+	return len(subscribers)
+}
+
+func (sess *session) subscribe(channels []string) string {
+	return sess.subscribeTo(pubsub, sess.channels, "subscribe", channels)
+}
+
+func (sess *session) unsubscribe(channels []string) string {
+	return sess.unsubscribeFrom(pubsub, sess.channels, "unsubscribe", channels)
+}
+
+func (sess *session) ssubscribe(channels []string) string {
+	return sess.subscribeTo(shardPubsub, sess.shardChannels, "ssubscribe", channels)
+}
+
+func (sess *session) sunsubscribe(channels []string) string {
+	return sess.unsubscribeFrom(shardPubsub, sess.shardChannels, "sunsubscribe", channels)
+}
+
+// subscribed reports whether the session is in subscribe mode
+func (sess *session) subscribed() bool {
+	return len(sess.channels) > 0 || len(sess.shardChannels) > 0
+}
+
+// subscribeTo adds channels to the session's subscriptions in one
+// registry, replying once per channel with the number of channels it
+// holds there afterwards
+func (sess *session) subscribeTo(registry *pubSubRegistry, subscribed map[string]bool, kind string, channels []string) string {
+	var reply strings.Builder
+	for _, channel := range channels {
+		if !subscribed[channel] {
+			subscribed[channel] = true
+			registry.add(channel, sess)
+		}
+		reply.WriteString(sess.pushFrame(pubSubCountReply(kind, channel, len(subscribed))))
+	}
+	return reply.String()
+}
+
+// unsubscribeFrom removes channels, or every channel when none are given,
+// replying once per channel with the remaining count
+func (sess *session) unsubscribeFrom(registry *pubSubRegistry, subscribed map[string]bool, kind string, channels []string) string {
+	if len(channels) == 0 {
+		// Nothing to leave still gets one reply, with a nil channel
+		if len(subscribed) == 0 {
+			return sess.pushFrame(fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$-1\r\n:0\r\n", len(kind), kind))
+		}
+		channels = sortedChannels(subscribed)
+	}
+
+	var reply strings.Builder
+	for _, channel := range channels {
+		if subscribed[channel] {
+			delete(subscribed, channel)
+			registry.remove(channel, sess)
+		}
+		reply.WriteString(sess.pushFrame(pubSubCountReply(kind, channel, len(subscribed))))
+	}
+	return reply.String()
+}
+
+// sortedChannels returns a subscription set's channels in a stable order
+func sortedChannels(subscribed map[string]bool) []string {
+	channels := make([]string, 0, len(subscribed))
+	for channel := range subscribed {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// pubSubFrame encodes a pub/sub push such as ["message", channel, payload]
+func pubSubFrame(kind, channel, payload string) string {
+	return fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(kind), kind, len(channel), channel, len(payload), payload)
+}
+
+// pubSubCountReply encodes a (un)subscribe confirmation with the
+// session's current subscription count
+func pubSubCountReply(kind, channel string, count int) string {
+	return fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n",
+		len(kind), kind, len(channel), channel, count)
+}
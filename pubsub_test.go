@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"small-redis/client"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readExpected reads len(want) bytes and checks they are want
+func readExpected(t *testing.T, reader *bufio.Reader, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("reading %q: %v (got %q)", want, err, got)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func countReply(kind, channel string, count int) string {
+	return fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(kind), kind, len(channel), channel, count)
+}
+
+// UNSUBSCRIBE without channels leaves every channel, one reply each with
+// the count going down to 0
+func TestUnsubscribeAll(t *testing.T) {
+	useTestStore(t)
+	conn, reader := dialRaw(t)
+	send := func(args ...string) {
+		t.Helper()
+		var b strings.Builder
+		writeAOFCommand(&b, args)
+		if _, err := conn.Write([]byte(b.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("SUBSCRIBE", "c1", "c2", "c1", "c3")
+	readExpected(t, reader, countReply("subscribe", "c1", 1)+countReply("subscribe", "c2", 2)+
+		countReply("subscribe", "c1", 2)+countReply("subscribe", "c3", 3))
+
+	send("UNSUBSCRIBE")
+	readExpected(t, reader, countReply("unsubscribe", "c1", 2)+countReply("unsubscribe", "c2", 1)+
+		countReply("unsubscribe", "c3", 0))
+
+	// With nothing left, one reply with a nil channel
+	send("UNSUBSCRIBE")
+	readExpected(t, reader, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n")
+
+	// Out of subscribed mode, regular commands work again
+	send("PING")
+	readExpected(t, reader, "+PONG\r\n")
+}
+
+// A subscribed RESP2 connection refuses anything but pub/sub commands,
+// PING and QUIT, and answers PING as an array echoing its argument. Over
+// RESP3, where pushes can't be mistaken for replies, everything works.
+func TestSubscribedModeCommands(t *testing.T) {
+	useTestStore(t)
+	expect(t, dialTest(t), "OK", "SET", "k", "v")
+	conn, reader := dialRaw(t)
+
+	sendRaw(t, conn, "SUBSCRIBE", "c")
+	readExpected(t, reader, countReply("subscribe", "c", 1))
+
+	for _, args := range [][]string{{"GET", "k"}, {"SET", "k", "x"}, {"MULTI"}} {
+		sendRaw(t, conn, args...)
+		readExpected(t, reader, fmt.Sprintf("-ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n", strings.ToLower(args[0])))
+	}
+	sendRaw(t, conn, "PING")
+	readExpected(t, reader, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+	sendRaw(t, conn, "PING", "hello")
+	readExpected(t, reader, "*2\r\n$4\r\npong\r\n$5\r\nhello\r\n")
+	sendRaw(t, conn, "SSUBSCRIBE", "s")
+	readExpected(t, reader, countReply("ssubscribe", "s", 1))
+	sendRaw(t, conn, "SUNSUBSCRIBE")
+	readExpected(t, reader, countReply("sunsubscribe", "s", 0))
+
+	// The value wasn't changed by the refused SET
+	sendRaw(t, conn, "UNSUBSCRIBE")
+	readExpected(t, reader, countReply("unsubscribe", "c", 0))
+	sendRaw(t, conn, "GET", "k")
+	readExpected(t, reader, "$1\r\nv\r\n")
+
+	resp3, reader3 := dialRaw(t)
+	sendRaw(t, resp3, "HELLO", "3")
+	sendRaw(t, resp3, "PING")
+	skipUntil(t, reader3, "+PONG\r\n")
+	sendRaw(t, resp3, "SUBSCRIBE", "c")
+	readExpected(t, reader3, ">3\r\n$9\r\nsubscribe\r\n$1\r\nc\r\n:1\r\n")
+	sendRaw(t, resp3, "GET", "k")
+	readExpected(t, reader3, "$1\r\nv\r\n")
+}
+
+// A subscriber gets each publisher's messages whole and in the order
+// they were published, with several publishers going at once
+func TestPublishOrdering(t *testing.T) {
+	useTestStore(t)
+	conn, reader := dialRaw(t)
+	conn.Write([]byte("*2\r\n$9\r\nSUBSCRIBE\r\n$2\r\nch\r\n"))
+	readExpected(t, reader, countReply("subscribe", "ch", 1))
+
+	const publishers, perPublisher = 4, 250
+	padding := strings.Repeat("x", 100)
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		c := dialTest(t)
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for n := 0; n < perPublisher; n++ {
+				if _, err := c.Do("PUBLISH", "ch", fmt.Sprintf("%d:%d:%s", p, n, padding)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(p)
+	}
+
+	next := make([]int, publishers)
+	for i := 0; i < publishers*perPublisher; i++ {
+		frame, err := parseRESP(reader)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		var p, n int
+		var rest string
+		if len(frame) != 3 || frame[0] != "message" || frame[1] != "ch" {
+			t.Fatalf("message %d is %q", i, frame)
+		}
+		if _, err := fmt.Sscanf(frame[2], "%d:%d:%s", &p, &n, &rest); err != nil || rest != padding {
+			t.Fatalf("message %d payload %q", i, frame[2])
+		}
+		if n != next[p] {
+			t.Fatalf("publisher %d's message %d arrived when %d was next", p, n, next[p])
+		}
+		next[p]++
+	}
+	wg.Wait()
+}
+
+// Shard channels are a namespace of their own: an SSUBSCRIBEr gets
+// SPUBLISH messages but not PUBLISH ones, and a SUBSCRIBEr the reverse
+func TestShardChannelsSeparateFromGlobal(t *testing.T) {
+	useTestStore(t)
+	shard, shardReader := dialRaw(t)
+	sendRaw(t, shard, "SSUBSCRIBE", "ch")
+	readExpected(t, shardReader, countReply("ssubscribe", "ch", 1))
+	global, globalReader := dialRaw(t)
+	sendRaw(t, global, "SUBSCRIBE", "ch")
+	readExpected(t, globalReader, countReply("subscribe", "ch", 1))
+
+	c := dialTest(t)
+	expect(t, c, 1, "PUBLISH", "ch", "to global")
+	expect(t, c, 1, "SPUBLISH", "ch", "to shard")
+
+	readExpected(t, shardReader, "*3\r\n$8\r\nsmessage\r\n$2\r\nch\r\n$8\r\nto shard\r\n")
+	readExpected(t, globalReader, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$9\r\nto global\r\n")
+
+	sendRaw(t, shard, "SUNSUBSCRIBE", "ch")
+	readExpected(t, shardReader, countReply("sunsubscribe", "ch", 0))
+	expect(t, c, 0, "SPUBLISH", "ch", "nobody")
+	expect(t, c, 1, "PUBLISH", "ch", "still global")
+}
+
+// usePubSubLimit sets client-output-buffer-limit for the test
+func usePubSubLimit(t *testing.T, c *client.Client, limit string) {
+	t.Helper()
+	expect(t, c, "OK", "CONFIG", "SET", "client-output-buffer-limit", limit)
+	t.Cleanup(func() { config.PubSubOutputLimit.Set(defaultPubSubOutputLimit) })
+}
+
+// stalledSubscriber subscribes to channel on a connection that is then
+// never read from
+func stalledSubscriber(t *testing.T, channel string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, reader := dialRaw(t)
+	sendRaw(t, conn, "SUBSCRIBE", channel)
+	readExpected(t, reader, countReply("subscribe", channel, 1))
+	return conn, reader
+}
+
+// publishUntilDropped publishes to channel, pausing between messages,
+// until no subscriber is left. It fails the test if that takes more than
+// limit publishes or any one publish is slow.
+func publishUntilDropped(t *testing.T, c *client.Client, channel string, pause time.Duration, limit int) time.Duration {
+	t.Helper()
+	message := strings.Repeat("m", 16<<10)
+	start := time.Now()
+	for i := 0; i < limit; i++ {
+		begin := time.Now()
+		reply := do(t, c, "PUBLISH", channel, message)
+		if took := time.Since(begin); took > time.Second {
+			t.Fatalf("publish %d took %v", i, took)
+		}
+		if fmt.Sprint(reply) == "0" {
+			return time.Since(start)
+		}
+		time.Sleep(pause)
+	}
+	t.Fatalf("the subscriber was still there after %d publishes", limit)
+	return 0
+}
+
+// expectDisconnected reads whatever the server sent before closing the
+// connection, failing if it is still open
+func expectDisconnected(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, reader); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("the slow subscriber wasn't disconnected")
+	}
+}
+
+// A subscriber that stops reading doesn't hold up the publisher, and is
+// disconnected once its queued output passes the hard limit
+func TestSlowSubscriberHardLimit(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	usePubSubLimit(t, c, "pubsub 1mb 0 0")
+	conn, reader := stalledSubscriber(t, "ch")
+
+	publishUntilDropped(t, c, "ch", 0, 50000)
+	expectDisconnected(t, conn, reader)
+	expect(t, c, "PONG", "PING")
+}
+
+// Over the soft limit alone, the subscriber gets its grace period before
+// it is disconnected
+func TestSlowSubscriberSoftLimit(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	usePubSubLimit(t, c, "pubsub 0 64kb 1")
+	conn, reader := stalledSubscriber(t, "ch")
+
+	if took := publishUntilDropped(t, c, "ch", time.Millisecond, 100000); took < time.Second {
+		t.Errorf("the subscriber was dropped after %v, within its grace period", took)
+	}
+	expectDisconnected(t, conn, reader)
+}
+
+// useRESP3 switches a raw connection to RESP3, skipping HELLO's reply
+func useRESP3(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+	t.Helper()
+	sendRaw(t, conn, "HELLO", "3")
+	skipUntil(t, reader, "modules\r\n")
+	readExpected(t, reader, "*0\r\n")
+}
+
+// A RESP3 subscriber gets its messages and confirmations as '>' push
+// frames, while a RESP2 subscriber on the same channel gets '*' arrays
+func TestRESP3PushFrames(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	resp3, resp3Reader := dialRaw(t)
+	useRESP3(t, resp3, resp3Reader)
+	resp2, resp2Reader := dialRaw(t)
+
+	sendRaw(t, resp3, "SUBSCRIBE", "ch")
+	readExpected(t, resp3Reader, ">"+countReply("subscribe", "ch", 1)[1:])
+	sendRaw(t, resp2, "SUBSCRIBE", "ch")
+	readExpected(t, resp2Reader, countReply("subscribe", "ch", 1))
+
+	expect(t, c, 2, "PUBLISH", "ch", "hi")
+	readExpected(t, resp3Reader, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n")
+	readExpected(t, resp2Reader, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n")
+
+	// A RESP3 connection may run any command while subscribed, and its
+	// reply keeps its usual type
+	expect(t, c, "OK", "SET", "k", "v")
+	sendRaw(t, resp3, "GET", "k")
+	readExpected(t, resp3Reader, "$1\r\nv\r\n")
+
+	sendRaw(t, resp3, "UNSUBSCRIBE", "ch")
+	readExpected(t, resp3Reader, ">"+countReply("unsubscribe", "ch", 0)[1:])
+
+	// Switching back to RESP2 brings back '*' frames
+	sendRaw(t, resp3, "HELLO", "2")
+	skipUntil(t, resp3Reader, "modules\r\n")
+	readExpected(t, resp3Reader, "*0\r\n")
+	sendRaw(t, resp3, "SSUBSCRIBE", "sh")
+	readExpected(t, resp3Reader, countReply("ssubscribe", "sh", 1))
+	expect(t, c, 1, "SPUBLISH", "sh", "hi")
+	readExpected(t, resp3Reader, "*3\r\n$8\r\nsmessage\r\n$2\r\nsh\r\n$2\r\nhi\r\n")
+}
+
+// A redirected invalidation reaches a RESP3 subscriber as a push frame
+func TestRESP3RedirectedInvalidation(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "v")
+
+	sub, subReader := dialRaw(t)
+	useRESP3(t, sub, subReader)
+	sendRaw(t, sub, "CLIENT", "ID")
+	id, err := subReader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(id, ":") {
+		t.Fatalf("CLIENT ID = %q, %v", id, err)
+	}
+	sendRaw(t, sub, "SUBSCRIBE", invalidateChannel)
+	readExpected(t, subReader, ">"+countReply("subscribe", invalidateChannel, 1)[1:])
+
+	tracker := dialTest(t)
+	expect(t, tracker, "OK", "CLIENT", "TRACKING", "ON", "REDIRECT", strings.TrimSpace(id[1:]))
+	expect(t, tracker, "v", "GET", "k")
+	expect(t, c, 1, "DEL", "k")
+	readExpected(t, subReader, ">3\r\n$7\r\nmessage\r\n$20\r\n"+invalidateChannel+"\r\n*1\r\n$1\r\nk\r\n")
+}
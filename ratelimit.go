@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// rateLimitError is the reply to a command over client-command-rate
+const rateLimitError = "-ERR rate limit exceeded, retry later\r\n"
+
+// commandBucket is a token bucket limiting how fast one connection can
+// send commands. It holds up to one second's worth of tokens, so a client
+// can burst up to the rate. Only the connection's goroutine uses it.
+type commandBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// allow takes a token if one is left, refilling the bucket at rate tokens
+// per second first. rate 0 means no limit.
+func (b *commandBucket) allow(rate int64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	if b.lastRefill.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(float64(rate), b.tokens+now.Sub(b.lastRefill).Seconds()*float64(rate))
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandBucket(t *testing.T) {
+	var b commandBucket
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		if !b.allow(0, now) {
+			t.Fatal("a command was refused with no limit")
+		}
+	}
+
+	// A full bucket takes a burst of the rate, then refills at the rate
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if b.allow(10, now) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("a burst of 20 at rate 10 let %d through, want 10", allowed)
+	}
+	if b.allow(10, now.Add(50*time.Millisecond)) {
+		t.Error("allowed after half a token's refill")
+	}
+	if !b.allow(10, now.Add(100*time.Millisecond)) || b.allow(10, now.Add(100*time.Millisecond)) {
+		t.Error("a tenth of a second at rate 10 didn't refill exactly one token")
+	}
+
+	// An idle bucket refills only to the rate
+	later := now.Add(time.Hour)
+	allowed = 0
+	for i := 0; i < 20; i++ {
+		if b.allow(10, later) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("after an hour idle, a burst let %d through, want 10", allowed)
+	}
+}
+
+// A connection bursting past client-command-rate is throttled, while
+// another connection and admin commands aren't
+func TestClientCommandRate(t *testing.T) {
+	useTestStore(t)
+	admin := dialTest(t)
+	expect(t, admin, "OK", "CONFIG", "SET", "client-command-rate", "50")
+	t.Cleanup(func() { config.ClientCommandRate.Store(0) })
+
+	conn, reader := dialRaw(t)
+	const burst = 200
+	var b strings.Builder
+	for i := 0; i < burst; i++ {
+		writeAOFCommand(&b, []string{"PING"})
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	served, throttled := 0, 0
+	for i := 0; i < burst; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		switch line {
+		case "+PONG\r\n":
+			served++
+		case rateLimitError:
+			throttled++
+		default:
+			t.Fatalf("reply %d is %q", i, line)
+		}
+	}
+	if served < 50 || served > 60 || throttled != burst-served {
+		t.Errorf("a burst of %d at rate 50: %d served, %d throttled", burst, served, throttled)
+	}
+
+	// Other connections have buckets of their own
+	other := dialTest(t)
+	for i := 0; i < 40; i++ {
+		expect(t, other, "PONG", "PING")
+	}
+
+	// Admin commands get through on the throttled connection
+	sendRaw(t, conn, "CONFIG", "SET", "client-command-rate", "0")
+	readExpected(t, reader, "+OK\r\n")
+	sendRaw(t, conn, "PING")
+	readExpected(t, reader, "+PONG\r\n")
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// replOffset is the replication offset reported by ROLE and INFO. This
+// server is always a master without replicas and keeps no replication
+// backlog, so it never advances.
+const replOffset = 0
+
+// roleCommand handles ROLE: [master, offset, [replicas...]]
+func roleCommand() string {
+	return fmt.Sprintf("*3\r\n$6\r\nmaster\r\n:%d\r\n*0\r\n", replOffset)
+}
+
+func infoReplication(b *strings.Builder) {
+	b.WriteString("role:master\r\n")
+	b.WriteString("connected_slaves:0\r\n")
+	fmt.Fprintf(b, "master_repl_offset:%d\r\n", replOffset)
+}
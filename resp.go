@@ -3,11 +3,59 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
 
-// Parse one command from the connection
+const (
+	// defaultProtoMaxBulkLen is the default proto-max-bulk-len, as in Redis
+	defaultProtoMaxBulkLen = 512 * 1024 * 1024
+
+	// minProtoMaxBulkLen is the smallest proto-max-bulk-len Redis accepts
+	minProtoMaxBulkLen = 1024 * 1024
+
+	// maxArrayLength caps the number of arguments in one command
+	maxArrayLength = 1024 * 1024
+)
+
+// protocolError is malformed RESP from the client, as opposed to an I/O
+// error or the client disconnecting
+type protocolError struct {
+	detail string
+}
+
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.detail
+}
+
+func newProtocolError(format string, args ...interface{}) error {
+	return &protocolError{detail: fmt.Sprintf(format, args...)}
+}
+
+// bulkString encodes value as a RESP bulk string. The reply is built in
+// one allocation of exactly its size, so a large value is copied once
+// (fmt.Sprintf would grow a buffer and then copy it into a string). A
+// top-level GET skips even that copy (see session.get).
+func bulkString[T string | []byte](value T) string {
+	header := "$" + strconv.Itoa(len(value)) + "\r\n"
+
+	var b strings.Builder
+	b.Grow(len(header) + len(value) + 2)
+	b.WriteString(header)
+	switch v := any(value).(type) {
+	case string:
+		b.WriteString(v)
+	case []byte:
+		b.Write(v)
+	}
+	b.WriteString("\r\n")
+
+	return b.String()
+}
+
+// Parse one command from the connection. An empty command (a blank line
+// or "*0") comes back as an empty slice for the caller to skip.
 func parseRESP(reader *bufio.Reader) ([]string, error) {
 	// Read the first line
 	line, err := reader.ReadString('\n')
@@ -18,9 +66,9 @@ func parseRESP(reader *bufio.Reader) ([]string, error) {
 	// Remove \r\n from the end
 	line = strings.TrimSpace(line)
 
-	// Check what type of data this is
+	// A blank line is an empty inline command, which Redis ignores
 	if len(line) == 0 {
-		return nil, fmt.Errorf("empty line")
+		return []string{}, nil
 	}
 
 	// RESP uses first character to identify type
@@ -31,7 +79,7 @@ func parseRESP(reader *bufio.Reader) ([]string, error) {
 		// Array - this is what we need for commands
 		return parseArray(reader, line)
 	default:
-		return nil, fmt.Errorf("unknown RESP type: %c", firstChar)
+		return nil, newProtocolError("unknown RESP type: %c", firstChar)
 	}
 }
 
@@ -39,8 +87,11 @@ func parseArray(reader *bufio.Reader, line string) ([]string, error) {
 	// line is "*1" - extract the number
 	countStr := line[1:]                 // Remove the '*', get "1"
 	count, err := strconv.Atoi(countStr) // Convert string to int
-	if err != nil {
-		return nil, fmt.Errorf("invalid array length: %s", countStr)
+	if err != nil || count < 0 {
+		return nil, newProtocolError("invalid array length: %s", countStr)
+	}
+	if count > maxArrayLength {
+		return nil, newProtocolError("invalid multibulk length")
 	}
 
 	// Create a slice to hold the results
@@ -68,26 +119,46 @@ func parseBulkString(reader *bufio.Reader) (string, error) {
 	line = strings.TrimSpace(line)
 
 	// Check it starts with $
-	if line[0] != '$' {
-		return "", fmt.Errorf("expected bulk string, got: %s", line)
+	if len(line) == 0 || line[0] != '$' {
+		return "", newProtocolError("expected bulk string, got: %s", line)
 	}
 
 	// Extract the length: "4" from "$4"
 	lengthStr := line[1:]
 	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
-		return "", fmt.Errorf("invalid bulk string length: %s", lengthStr)
+
+	// "$-1" is a null bulk string: valid in replies, but like Redis we
+	// don't accept null arguments in requests
+	if err == nil && length == -1 {
+		return "", newProtocolError("null bulk string not allowed in a request")
+	}
+	if err != nil || length < 0 {
+		return "", newProtocolError("invalid bulk string length: %s", lengthStr)
 	}
 
-	// Read exactly 'length' bytes for the actual string
+	// Check the declared length before allocating for it
+	if int64(length) > config.ProtoMaxBulkLen.Load() {
+		return "", newProtocolError("invalid bulk length")
+	}
+
+	// Read exactly 'length' bytes for the actual string; a single Read
+	// may return less when the value arrives split across packets
 	data := make([]byte, length)
-	_, err = reader.Read(data)
+	_, err = io.ReadFull(reader, data)
 	if err != nil {
 		return "", err
 	}
 
-	// Read the trailing \r\n
-	reader.ReadString('\n')
+	// The value must be followed by \r\n; anything else means the
+	// declared length doesn't match what was sent
+	var crlf [2]byte
+	_, err = io.ReadFull(reader, crlf[:])
+	if err != nil {
+		return "", err
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return "", newProtocolError("expected \\r\\n after bulk string")
+	}
 
 	return string(data), nil
 }
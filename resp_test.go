@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader hands out its data a few bytes per Read, cycling through
+// the chunk sizes, the way TCP may split a command across packets
+type chunkReader struct {
+	data  string
+	sizes []int
+	n     int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	size := min(r.sizes[r.n%len(r.sizes)], len(p), len(r.data))
+	r.n++
+	copy(p, r.data[:size])
+	r.data = r.data[size:]
+	return size, nil
+}
+
+func TestParseRESPFragmented(t *testing.T) {
+	value := strings.Repeat("v\r\n", 20) // longer than the reader's buffer, with line ends inside
+	stream := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$60\r\n" + value + "\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"
+	want := [][]string{{"SET", "key", value}, {"GET", "key"}}
+
+	sources := map[string]io.Reader{
+		"one byte at a time": iotest.OneByteReader(strings.NewReader(stream)),
+		"uneven chunks":      &chunkReader{data: stream, sizes: []int{1, 2, 5, 3, 7}},
+		"half reads":         iotest.HalfReader(strings.NewReader(stream)),
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(source, 16)
+			for _, wantArgs := range want {
+				args, err := parseRESP(reader)
+				if err != nil {
+					t.Fatalf("parseRESP: %v", err)
+				}
+				if !reflect.DeepEqual(args, wantArgs) {
+					t.Fatalf("parseRESP = %q, want %q", args, wantArgs)
+				}
+			}
+			if _, err := parseRESP(reader); err != io.EOF {
+				t.Errorf("after the last command: %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// A command cut off mid-value is an error, not a short argument
+func TestParseRESPTruncated(t *testing.T) {
+	reader := bufio.NewReader(iotest.OneByteReader(strings.NewReader("*1\r\n$10\r\nabc")))
+	if args, err := parseRESP(reader); err == nil {
+		t.Errorf("parseRESP of a truncated value = %q, want an error", args)
+	}
+}
+
+// A declared bulk length over proto-max-bulk-len is refused before
+// anything is allocated for it
+func TestParseRESPRejectsOversizedBulk(t *testing.T) {
+	stream := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$999999999999\r\n"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := parseRESP(bufio.NewReader(strings.NewReader(stream)))
+	runtime.ReadMemStats(&after)
+
+	if err == nil || err.Error() != "Protocol error: invalid bulk length" {
+		t.Errorf("parseRESP with a 1TB bulk length: %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("parseRESP allocated %d bytes before refusing", allocated)
+	}
+}
+
+func TestProtoMaxBulkLen(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	// Below the minimum CONFIG SET takes, to keep the values small
+	config.ProtoMaxBulkLen.Store(10)
+	t.Cleanup(func() { config.ProtoMaxBulkLen.Store(defaultProtoMaxBulkLen) })
+
+	expect(t, c, "OK", "SET", "k", "0123456789")
+
+	conn, reader := dialRaw(t)
+	conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$11\r\n01234567890\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "-ERR Protocol error: invalid bulk length\r\n" {
+		t.Errorf("SET of 11 bytes with a limit of 10 = %q", line)
+	}
+	expectClosed(t, reader)
+	expect(t, c, "0123456789", "GET", "k")
+}
+
+// CONFIG SET takes proto-max-bulk-len with a memory unit and refuses
+// anything under 1mb, leaving the other values of the same call unchanged
+func TestProtoMaxBulkLenMinimum(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	t.Cleanup(func() {
+		config.ProtoMaxBulkLen.Store(defaultProtoMaxBulkLen)
+		config.CommandTimeout.Store(0)
+	})
+
+	expect(t, c, "OK", "CONFIG", "SET", "proto-max-bulk-len", "1mb")
+	expect(t, c, []interface{}{"proto-max-bulk-len", "1048576"}, "CONFIG", "GET", "proto-max-bulk-len")
+
+	for _, value := range []string{"10", "1048575", "1000k", "-1", "big"} {
+		reply, err := c.Do("CONFIG", "SET", "command-timeout", "50", "proto-max-bulk-len", value)
+		if err == nil || !strings.Contains(err.Error(), "proto-max-bulk-len") {
+			t.Errorf("CONFIG SET proto-max-bulk-len %s = %v, %v; want it refused", value, reply, err)
+		}
+	}
+	expect(t, c, []interface{}{"proto-max-bulk-len", "1048576"}, "CONFIG", "GET", "proto-max-bulk-len")
+	expect(t, c, []interface{}{"command-timeout", "0"}, "CONFIG", "GET", "command-timeout")
+
+	expect(t, c, "OK", "CONFIG", "SET", "proto-max-bulk-len", "2097152", "command-timeout", "50")
+	if limit := config.ProtoMaxBulkLen.Load(); limit != 2<<20 {
+		t.Errorf("proto-max-bulk-len is %d, want 2097152", limit)
+	}
+}
+
+func TestParseRESPEmptyCommand(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("*0\r\n\r\n"))
+	for i := 0; i < 2; i++ {
+		args, err := parseRESP(reader)
+		if err != nil || args == nil || len(args) != 0 {
+			t.Errorf("empty command %d = %q, %v; want an empty slice", i, args, err)
+		}
+	}
+}
+
+// A null or negative bulk length in a request is a protocol error
+func TestParseRESPRejectsNullBulk(t *testing.T) {
+	for _, stream := range []string{
+		"*2\r\n$3\r\nGET\r\n$-1\r\n",
+		"*2\r\n$3\r\nGET\r\n$-5\r\n",
+	} {
+		args, err := parseRESP(bufio.NewReader(strings.NewReader(stream)))
+		var protoErr *protocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("parseRESP(%q) = %q, %v; want a protocol error", stream, args, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nextClientID numbers connections in the order they arrive
+var nextClientID atomic.Int64
+
+// writeBufferSize is the size of each connection's output buffer
+const writeBufferSize = 16 * 1024
+
+// session is the per-connection state
+type session struct {
+	id        int64
+	addr      string
+	createdAt time.Time
+
+	conn net.Conn
+
+	// outbox feeds writeLoop, the only goroutine writing to conn, so
+	// replies and pub/sub messages go out whole and in the order queued.
+	// It never blocks a sender; push limits how far it can grow instead.
+	outboxMu     sync.Mutex
+	outbox       []outMessage
+	outboxClosed bool
+	outboxReady  chan struct{} // signalled when outbox gains messages or closes
+	outboxBytes  atomic.Int64  // queued and not yet written
+	writerDone   chan struct{}
+
+	// overSoftLimit is when the outbox last went over the pub/sub soft
+	// limit (unix nanoseconds), 0 while under it
+	overSoftLimit atomic.Int64
+	evicted       atomic.Bool
+
+	inMulti bool
+	dirty   bool // a command failed validation while queuing
+	queued  [][]string
+
+	channels      map[string]bool // pub/sub subscriptions
+	shardChannels map[string]bool // sharded pub/sub subscriptions
+
+	// CLIENT TRACKING state; read by other connections' invalidations
+	tracking         atomic.Bool
+	trackingRedirect atomic.Int64 // client id to notify instead, 0 for none
+
+	// Command statistics for CLIENT LIST and CLIENT INFO
+	commands      atomic.Int64
+	lastCommandAt atomic.Int64 // unix nanoseconds; createdAt until the first command
+
+	rateLimit commandBucket // client-command-rate throttling
+
+	resp3 atomic.Bool // HELLO 3 was sent; read by pub/sub and tracking senders
+
+	quit bool // QUIT was received; close after replying
+}
+
+// outMessage is one queued write: text as is, or for a bulk reply the
+// header in text followed by value and a CRLF. A bulk value goes from the
+// stored bytes to the writer's buffer without being copied into a reply
+// string first.
+type outMessage struct {
+	text  string
+	bulk  bool
+	value []byte
+}
+
+// size is how many bytes the message writes
+func (msg outMessage) size() int64 {
+	if msg.bulk {
+		return int64(len(msg.text) + len(msg.value) + 2)
+	}
+	return int64(len(msg.text))
+}
+
+// newSession sets up the connection's state and starts its writer
+func newSession(conn net.Conn) *session {
+	sess := &session{
+		id:            nextClientID.Add(1),
+		addr:          conn.RemoteAddr().String(),
+		createdAt:     time.Now(),
+		conn:          conn,
+		outboxReady:   make(chan struct{}, 1),
+		writerDone:    make(chan struct{}),
+		channels:      make(map[string]bool),
+		shardChannels: make(map[string]bool),
+	}
+	sess.lastCommandAt.Store(sess.createdAt.UnixNano())
+	go sess.writeLoop()
+	return sess
+}
+
+// noteCommand counts a command received on the connection
+func (sess *session) noteCommand() {
+	sess.commands.Add(1)
+	sess.lastCommandAt.Store(time.Now().UnixNano())
+}
+
+// write queues a reply or pushed message for the client. Messages
+// written after the session closed are dropped.
+func (sess *session) write(response string) {
+	sess.enqueue(outMessage{text: response})
+}
+
+// writeBulk queues value as a bulk string reply, written from value itself
+// rather than a copy of it; the caller must not change value afterwards
+func (sess *session) writeBulk(value []byte) {
+	sess.enqueue(outMessage{text: "$" + strconv.Itoa(len(value)) + "\r\n", bulk: true, value: value})
+}
+
+func (sess *session) enqueue(msg outMessage) {
+	sess.outboxMu.Lock()
+	if sess.outboxClosed {
+		sess.outboxMu.Unlock()
+		return
+	}
+	sess.outbox = append(sess.outbox, msg)
+	sess.outboxBytes.Add(msg.size())
+	sess.outboxMu.Unlock()
+
+	sess.signalWriter()
+}
+
+func (sess *session) signalWriter() {
+	select {
+	case sess.outboxReady <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// push queues a message the client didn't ask for, such as a pub/sub
+// delivery. A client reading too slowly to keep its outbox within the
+// pubsub client-output-buffer-limit is disconnected instead, so the
+// sender is never held up by it.
+func (sess *session) push(message string) {
+	if sess.evicted.Load() {
+		return
+	}
+
+	queued := sess.outboxBytes.Load() + int64(len(message))
+	hard, soft, softSeconds := config.PubSubOutputLimit.limits()
+	if hard > 0 && queued > hard {
+		sess.evict(fmt.Sprintf("%d bytes queued, over the hard limit of %d", queued, hard))
+		return
+	}
+	if soft > 0 && queued > soft {
+		now := time.Now().UnixNano()
+		since := sess.overSoftLimit.Load()
+		if since == 0 {
+			sess.overSoftLimit.Store(now)
+		} else if time.Duration(now-since) >= time.Duration(softSeconds)*time.Second {
+			sess.evict(fmt.Sprintf("%d bytes queued, over the soft limit of %d for %ds", queued, soft, softSeconds))
+			return
+		}
+	} else {
+		sess.overSoftLimit.Store(0)
+	}
+
+	sess.write(message)
+}
+
+// evict disconnects a client whose output has fallen too far behind. The
+// connection's reader then fails and cleans the session up as usual.
+func (sess *session) evict(reason string) {
+	if !sess.evicted.CompareAndSwap(false, true) {
+		return
+	}
+	fmt.Printf("Closing client id=%d addr=%s: output buffer limit reached (%s)\n", sess.id, sess.addr, reason)
+	sess.conn.Close()
+}
+
+// writeLoop writes queued messages until the outbox is closed. After a
+// write error it keeps draining so senders never block on a dead client.
+//
+// Messages go through a buffered writer, which copies them to the socket
+// in buffer-sized chunks instead of converting each one to a []byte, and
+// is flushed whenever the outbox runs empty. A bulk reply's header, value
+// and CRLF are written one after another, never joined.
+func (sess *session) writeLoop() {
+	defer close(sess.writerDone)
+
+	writer := bufio.NewWriterSize(sess.conn, writeBufferSize)
+	failed := false
+	for range sess.outboxReady {
+		sess.outboxMu.Lock()
+		batch := sess.outbox
+		sess.outbox = nil
+		closed := sess.outboxClosed
+		sess.outboxMu.Unlock()
+
+		for _, msg := range batch {
+			if !failed {
+				_, err := writer.WriteString(msg.text)
+				if err == nil && msg.bulk {
+					_, err = writer.Write(msg.value)
+					if err == nil {
+						_, err = writer.WriteString("\r\n")
+					}
+				}
+				failed = err != nil
+			}
+			sess.outboxBytes.Add(-msg.size())
+		}
+		if !failed && len(batch) > 0 {
+			failed = writer.Flush() != nil
+		}
+
+		if closed {
+			return
+		}
+	}
+}
+
+// dispatch runs a validated command, handling the ones that act on the
+// connection itself before falling back to the global dispatch
+func (sess *session) dispatch(command string, args []string) string {
+	if command == "CLIENT" {
+		return sess.clientCommand(args)
+	}
+
+	response := dispatch(command, args)
+	if !strings.HasPrefix(response, "-") {
+		sess.trackReads(command, args)
+	}
+	return response
+}
+
+// get answers a GET sent outside a transaction. The stored value is
+// queued as is, so a large value goes to the connection without being
+// copied into a reply string; the reply is queued and "" returned.
+func (sess *session) get(args []string) string {
+	value, exists, err := store.Get(args[1])
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	sess.trackReads("GET", args)
+	if !exists {
+		return "$-1\r\n"
+	}
+	sess.writeBulk(value)
+	return ""
+}
+
+// close drops the session's subscriptions and registry entry once the
+// client is gone, then waits for queued output to be written
+func (sess *session) close() {
+	clients.remove(sess)
+
+	// Once removed from every channel no publisher can still be sending,
+	// so the outbox can be closed
+	for channel := range sess.channels {
+		pubsub.remove(channel, sess)
+	}
+	for channel := range sess.shardChannels {
+		shardPubsub.remove(channel, sess)
+	}
+	sess.channels = nil
+	sess.shardChannels = nil
+
+	sess.outboxMu.Lock()
+	sess.outboxClosed = true
+	sess.outboxMu.Unlock()
+	sess.signalWriter()
+	<-sess.writerDone
+}
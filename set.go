@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setCommand handles SET key value [NX | XX] [EX seconds | PX milliseconds
+// | EXAT unix-time-seconds | PXAT unix-time-milliseconds]. A SET that NX
+// or XX skips replies nil. dispatch holds the key's lock, so the check and
+// the write can't interleave with another write. The AOF gets the expiry
+// as PXAT, so replaying it later doesn't push the expiry back.
+func setCommand(args []string) string {
+	key := args[1]
+	value := args[2]
+
+	var nx, xx bool
+	var expiresAt int64
+	expiryOption := ""
+	now := time.Now().UnixNano()
+
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "NX", "XX":
+			if nx || xx {
+				return "-ERR syntax error\r\n"
+			}
+			nx = option == "NX"
+			xx = option == "XX"
+
+		case "EX", "PX", "EXAT", "PXAT":
+			if expiryOption != "" || i+1 >= len(args) {
+				return "-ERR syntax error\r\n"
+			}
+			expiryOption = option
+			i++
+
+			amount, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			expiresAt = setExpiry(option, amount, now)
+			if expiresAt <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+
+	if nx || xx {
+		if store.Exists(key) != xx {
+			return "$-1\r\n"
+		}
+	}
+
+	var err error
+	if expiresAt == 0 {
+		err = store.WAL.WriteEntry("SET", key, value)
+	} else {
+		err = store.WAL.WriteExpiringEntry(key, value, expiresAt)
+	}
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	err = store.SetWithExpiry(key, []byte(value), expiresAt)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	if expiresAt == 0 {
+		appendToAOF([]string{"SET", key, value})
+	} else {
+		appendToAOF([]string{"SET", key, value, "PXAT", strconv.FormatInt(expiresAt/int64(time.Millisecond), 10)})
+	}
+	return "+OK\r\n"
+}
+
+// setExpiry turns a SET expiry option into Unix nanoseconds, or returns 0
+// if the amount isn't positive or the time doesn't fit
+func setExpiry(option string, amount int64, now int64) int64 {
+	if amount <= 0 {
+		return 0
+	}
+
+	var unit time.Duration
+	relative := option == "EX" || option == "PX"
+	switch option {
+	case "EX", "EXAT":
+		unit = time.Second
+	case "PX", "PXAT":
+		unit = time.Millisecond
+	}
+
+	limit := int64(math.MaxInt64)
+	if relative {
+		limit -= now
+	}
+	if amount > limit/int64(unit) {
+		return 0
+	}
+
+	expiresAt := amount * int64(unit)
+	if relative {
+		expiresAt += now
+	}
+	return expiresAt
+}
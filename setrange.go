@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// setRangeCommand handles SETRANGE key offset value: it overwrites part of
+// the string at key starting at offset, padding with zero bytes as needed,
+// and replies with the new length. dispatch holds the key's lock, so the
+// read, the change and the write can't interleave with another write.
+//
+// Unlike Redis, an empty value at a positive offset still creates (or
+// pads) the key, so SETRANGE always leaves a value at least offset long.
+func setRangeCommand(args []string) string {
+	key := args[1]
+	value := args[3]
+
+	offset, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	if offset < 0 {
+		return "-ERR offset is out of range\r\n"
+	}
+	// Compared without adding, which could overflow for an offset near
+	// the int64 limit
+	if offset > config.ProtoMaxBulkLen.Load()-int64(len(value)) {
+		return "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"
+	}
+
+	current, _, err := store.Get(key)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	end := int(offset) + len(value)
+
+	// Nothing would change
+	if len(value) == 0 && end <= len(current) {
+		return fmt.Sprintf(":%d\r\n", len(current))
+	}
+
+	updated := make([]byte, max(len(current), end))
+	copy(updated, current)
+	copy(updated[offset:], value)
+
+	err = setKeepingTTL(key, updated)
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+
+	return fmt.Sprintf(":%d\r\n", len(updated))
+}
+
+// getRangeCommand handles GETRANGE key start end, with negative offsets
+// counting from the end and both ends inclusive, as in Redis
+func getRangeCommand(args []string) string {
+	start, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	end, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+
+	value, _, err := store.Get(args[1])
+	if err != nil {
+		return fmt.Sprintf("-ERR %s\r\n", err)
+	}
+	length := int64(len(value))
+
+	if start < 0 && end < 0 && start > end {
+		return "$0\r\n\r\n"
+	}
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = max(length+end, 0)
+	}
+	end = min(end, length-1)
+	if start > end || length == 0 {
+		return "$0\r\n\r\n"
+	}
+
+	return bulkString(value[start : end+1])
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// SETRANGE pads with zero bytes, also for an empty value past the end,
+// and keeps the key's TTL
+func TestSetRangePadding(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	expect(t, c, 5, "SETRANGE", "k", "3", "ab")
+	expect(t, c, "\x00\x00\x00ab", "GET", "k")
+	expect(t, c, 4, "SETRANGE", "empty", "4", "")
+	expect(t, c, "\x00\x00\x00\x00", "GET", "empty")
+	expect(t, c, 5, "SETRANGE", "k", "2", "")
+	expect(t, c, 7, "SETRANGE", "k", "0", "1234567")
+	expect(t, c, "1234567", "GET", "k")
+
+	expect(t, c, "OK", "SET", "ttl", "hello", "EX", "100")
+	expect(t, c, 5, "SETRANGE", "ttl", "0", "J")
+	expect(t, c, "Jello", "GET", "ttl")
+	if ttl := ttlOf(t, c, "ttl"); ttl <= 0 {
+		t.Errorf("TTL after SETRANGE = %d, want it kept", ttl)
+	}
+
+	expect(t, c, "ERR offset is out of range", "SETRANGE", "k", "-1", "x")
+	expect(t, c, "ERR value is not an integer or out of range", "SETRANGE", "k", "one", "x")
+}
+
+// An offset past proto-max-bulk-len is refused, including one so large
+// that adding the value's length would overflow
+func TestSetRangeOffsetLimit(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+
+	limit := config.ProtoMaxBulkLen.Load()
+	tooLong := "ERR string exceeds maximum allowed size (proto-max-bulk-len)"
+	expect(t, c, tooLong, "SETRANGE", "k", strconv.FormatInt(limit, 10), "x")
+	expect(t, c, tooLong, "SETRANGE", "k", "9223372036854775807", "x")
+	expect(t, c, tooLong, "SETRANGE", "k", "9223372036854775806", "xy")
+	expect(t, c, 0, "EXISTS", "k")
+	expect(t, c, "PONG", "PING")
+}
+
+func TestGetRange(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "This is a string")
+
+	for _, r := range []struct {
+		start, end string
+		want       string
+	}{
+		{"0", "3", "This"},
+		{"-3", "-1", "ing"},
+		{"0", "-1", "This is a string"},
+		{"10", "100", "string"},
+		{"-100", "3", "This"},
+		{"5", "3", ""},
+		{"-1", "-3", ""},
+		{"100", "200", ""},
+	} {
+		expect(t, c, r.want, "GETRANGE", "k", r.start, r.end)
+	}
+	expect(t, c, "", "GETRANGE", "missing", "0", "-1")
+}
+
+// SETRANGE reads, changes and writes the value as one step: clients
+// filling in the bytes of one key between them never undo each other's
+// changes, and readers never see a value cut short or padded
+func TestSetRangeConcurrent(t *testing.T) {
+	useTestStore(t)
+	const clients, length = 8, 400
+	expect(t, dialTest(t), "OK", "SET", "k", strings.Repeat("-", length))
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := dialTest(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := i; offset < length; offset += clients {
+				if _, err := c.Do("SETRANGE", "k", strconv.Itoa(offset), "x"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	reader := dialTest(t)
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		value := fmt.Sprint(do(t, reader, "GET", "k"))
+		if len(value) != length || strings.Contains(value, "\x00") {
+			t.Fatalf("GET during SETRANGEs = %q", value)
+		}
+	}
+
+	expect(t, reader, strings.Repeat("x", length), "GET", "k")
+}
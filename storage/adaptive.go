@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// writeWindowSeconds is how far back the write rate is measured. An
+// adaptive memtable is sized to hold about this long's worth of writes.
+const writeWindowSeconds = 10
+
+// writeWindow counts bytes written over the last writeWindowSeconds, in
+// one bucket per second
+type writeWindow struct {
+	mu      sync.Mutex
+	seconds [writeWindowSeconds]int64 // the unix second each bucket counts
+	bytes   [writeWindowSeconds]int64
+}
+
+func (w *writeWindow) add(now time.Time, n int64) {
+	second := now.Unix()
+	i := second % writeWindowSeconds
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.seconds[i] != second {
+		w.seconds[i] = second
+		w.bytes[i] = 0
+	}
+	w.bytes[i] += n
+}
+
+// total returns the bytes written in the window ending at now
+func (w *writeWindow) total(now time.Time) int64 {
+	second := now.Unix()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var total int64
+	for i := range w.bytes {
+		if age := second - w.seconds[i]; age >= 0 && age < writeWindowSeconds {
+			total += w.bytes[i]
+		}
+	}
+	return total
+}
+
+// adaptiveSizing grows the memtable flush threshold while writes are
+// heavy, so flushes stay infrequent, and shrinks it when they slow down,
+// so there's less to replay after a crash
+type adaptiveSizing struct {
+	min, max int64
+	writes   writeWindow
+}
+
+// size is the flush threshold for the write rate at now: what was written
+// in the last writeWindowSeconds, kept within min and max
+func (a *adaptiveSizing) size(now time.Time) int64 {
+	return min(max(a.writes.total(now), a.min), a.max)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// The flush threshold follows the writes of the last window: it grows
+// with a burst, up to the maximum, and falls back to the minimum once
+// the burst has left the window
+func TestAdaptiveSizingFollowsWriteRate(t *testing.T) {
+	sizing := &adaptiveSizing{min: 1000, max: 50000}
+	start := time.Unix(1700000000, 0)
+
+	if got := sizing.size(start); got != 1000 {
+		t.Errorf("size with no writes = %d, want the minimum", got)
+	}
+
+	// A burst over three seconds
+	for s := 0; s < 3; s++ {
+		for i := 0; i < 100; i++ {
+			sizing.writes.add(start.Add(time.Duration(s)*time.Second), 50)
+		}
+	}
+	if got := sizing.size(start.Add(2 * time.Second)); got != 15000 {
+		t.Errorf("size during the burst = %d, want the 15000 bytes written", got)
+	}
+
+	// Heavier writes hit the maximum
+	sizing.writes.add(start.Add(3*time.Second), 100000)
+	if got := sizing.size(start.Add(3 * time.Second)); got != 50000 {
+		t.Errorf("size after a heavy second = %d, want the maximum", got)
+	}
+
+	// The early seconds leave the window first, then the rest
+	if got := sizing.size(start.Add(12 * time.Second)); got != 50000 {
+		t.Errorf("size with the heavy second still in the window = %d, want the maximum", got)
+	}
+	if got := sizing.size(start.Add(13 * time.Second)); got != 1000 {
+		t.Errorf("size once writes stopped = %d, want the minimum", got)
+	}
+}
+
+// With adaptive sizing on, writes move the memtable's flush threshold and
+// EffectiveMemTableSize reports it
+func TestAdaptiveMemTableSize(t *testing.T) {
+	store := openTestStore(t)
+	if got := store.EffectiveMemTableSize(); got != DefaultMemTableSize {
+		t.Errorf("EffectiveMemTableSize = %d, want the fixed size %d", got, DefaultMemTableSize)
+	}
+
+	store.SetAdaptiveMemTableSize(1024, 1<<20)
+	if got := store.EffectiveMemTableSize(); got != 1024 {
+		t.Errorf("EffectiveMemTableSize before any writes = %d, want the minimum", got)
+	}
+
+	value := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		store.Set(string(rune('a'+i)), value)
+	}
+	grown := store.EffectiveMemTableSize()
+	if grown < 20*1000 || grown > 1<<20 {
+		t.Errorf("EffectiveMemTableSize after 20KB of writes = %d, want about that", grown)
+	}
+	if got := store.memTable.maxSize; got != grown {
+		t.Errorf("memtable flushes at %d, want the effective size %d", got, grown)
+	}
+
+	store.SetAdaptiveMemTableSize(0, 0)
+	if got := store.EffectiveMemTableSize(); got != DefaultMemTableSize {
+		t.Errorf("EffectiveMemTableSize after turning it off = %d, want %d", got, DefaultMemTableSize)
+	}
+	if got := store.memTable.maxSize; got != DefaultMemTableSize {
+		t.Errorf("memtable flushes at %d after turning it off, want %d", got, DefaultMemTableSize)
+	}
+}
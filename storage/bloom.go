@@ -0,0 +1,57 @@
+package storage
+
+import "small-redis/hashing"
+
+// bloomBitsPerKey and bloomHashCount size an SSTable's bloom filter for a
+// false positive rate of about 1%
+const (
+	bloomBitsPerKey = 10
+	bloomHashCount  = 7
+)
+
+// bloomFilter answers whether a table might hold a key without touching
+// its index or file. It is built from the index when the table is opened,
+// so the file format doesn't change.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter builds a filter holding keys
+func newBloomFilter(keys map[string]int64) *bloomFilter {
+	size := max(len(keys)*bloomBitsPerKey, 64)
+	filter := &bloomFilter{bits: make([]uint64, (size+63)/64)}
+	for key := range keys {
+		filter.add(key)
+	}
+	return filter
+}
+
+// bloomHashes returns the two hashes a key's bit positions are derived
+// from, as h1 + i*h2. h2 is odd so the positions don't repeat early.
+func bloomHashes(key string) (uint32, uint32) {
+	h1 := hashing.FNV1a(key)
+	return h1, hashing.Mix(h1) | 1
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHashes(key)
+	size := uint32(len(f.bits) * 64)
+	for i := uint32(0); i < bloomHashCount; i++ {
+		bit := (h1 + i*h2) % size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain reports whether key might have been added. False means it
+// certainly wasn't.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+	size := uint32(len(f.bits) * 64)
+	for i := uint32(0); i < bloomHashCount; i++ {
+		bit := (h1 + i*h2) % size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	keys := make(map[string]int64)
+	for i := 0; i < 10000; i++ {
+		keys[fmt.Sprintf("key:%d", i)] = int64(i)
+	}
+	filter := newBloomFilter(keys)
+
+	for key := range keys {
+		if !filter.mayContain(key) {
+			t.Fatalf("%s was added but the filter rules it out", key)
+		}
+	}
+
+	falsePositives := 0
+	const lookups = 10000
+	for i := 0; i < lookups; i++ {
+		if filter.mayContain(fmt.Sprintf("other:%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / lookups; rate > 0.03 {
+		t.Errorf("false positive rate %.2f%%, want about 1%%", rate*100)
+	}
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	filter := newBloomFilter(nil)
+	if filter.mayContain("anything") {
+		t.Error("an empty filter should rule out every key")
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Value codecs for memtable entries. SSTables hold raw values, or values
+// compressed against a shared dictionary (see trainDictionary).
+const (
+	CodecRaw   byte = 0
+	CodecFlate byte = 1
+)
+
+// compressValue deflates value, returning ok=false when that doesn't make
+// it smaller (already compressed data, random bytes)
+func compressValue(value []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, false
+	}
+	writer.Write(value)
+	err = writer.Close()
+	if err != nil || buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decodeValue returns the raw bytes of a value stored with codec
+func decodeValue(value []byte, codec byte) ([]byte, error) {
+	switch codec {
+	case CodecRaw:
+		return value, nil
+	case CodecFlate:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(value)))
+	default:
+		return nil, fmt.Errorf("unknown value codec %d", codec)
+	}
+}
+
+// rawValue returns entry's value decoded from its codec
+func rawValue(entry *Entry) ([]byte, error) {
+	value, err := decodeValue(entry.Value, entry.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode value of %s: %w", entry.Key, err)
+	}
+	return value, nil
+}
+
+// decodedCopy returns a copy of entry with a raw value
+func decodedCopy(entry *Entry) (*Entry, error) {
+	entryCopy := *entry
+	if entry.Codec == CodecRaw {
+		return &entryCopy, nil
+	}
+
+	value, err := rawValue(entry)
+	if err != nil {
+		return nil, err
+	}
+	entryCopy.Value = value
+	entryCopy.Codec = CodecRaw
+	return &entryCopy, nil
+}
+
+// dictionarySize is the most a shared SSTable dictionary holds. Every
+// value re-reads the dictionary into the compressor, so a bigger one makes
+// writing slower without compressing small values much better.
+const dictionarySize = 8 * 1024
+
+// trainDictionary builds a compression dictionary for an SSTable from a
+// sample of its values, taking evenly spaced values across the table
+// until dictionarySize is reached. Values that share structure (JSON with
+// the same fields, say) then compress against what they have in common
+// instead of each on its own. Returns nil if there are no values.
+func trainDictionary(entries []*Entry) []byte {
+	var values [][]byte
+	total := 0
+	for _, entry := range entries {
+		if !entry.Deleted && len(entry.Value) > 0 {
+			values = append(values, entry.Value)
+			total += len(entry.Value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Aim for enough values to fill the dictionary, spread over the table
+	wanted := dictionarySize / (total/len(values) + 1)
+	step := 1
+	if wanted > 0 && len(values) > wanted {
+		step = len(values) / wanted
+	}
+
+	dict := make([]byte, 0, dictionarySize)
+	for i := 0; i < len(values) && len(dict) < dictionarySize; i += step {
+		room := dictionarySize - len(dict)
+		value := values[i]
+		if len(value) > room {
+			value = value[:room]
+		}
+		dict = append(dict, value...)
+	}
+	return dict
+}
+
+// dictCompressor deflates values against a shared dictionary, reusing
+// one flate writer for all of them. Lower levels store short inputs
+// without looking for matches in the dictionary, so it uses the best.
+type dictCompressor struct {
+	buf    bytes.Buffer
+	writer *flate.Writer
+}
+
+func newDictCompressor(dict []byte) (*dictCompressor, error) {
+	c := &dictCompressor{}
+	writer, err := flate.NewWriterDict(&c.buf, flate.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	c.writer = writer
+	return c, nil
+}
+
+func (c *dictCompressor) compress(value []byte) ([]byte, error) {
+	c.buf.Reset()
+	c.writer.Reset(&c.buf)
+
+	_, err := c.writer.Write(value)
+	if err == nil {
+		err = c.writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(c.buf.Bytes()), nil
+}
+
+// inflateWithDict reverses dictCompressor.compress
+func inflateWithDict(value, dict []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReaderDict(bytes.NewReader(value), dict))
+}
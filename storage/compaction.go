@@ -1,6 +1,47 @@
 package storage
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// progressInterval is how many entries CompactSSTables reads between
+// progress reports
+const progressInterval = 1000
+
+// CompactionProgress is a snapshot of a running compaction. Totals come
+// from the input tables' footers, so they are known before reading starts.
+type CompactionProgress struct {
+	StartedAt      time.Time
+	EntriesMerged  int64 // entries read from the input tables so far
+	EntriesTotal   int64
+	BytesProcessed int64
+	BytesTotal     int64
+}
+
+// Fraction is how much of the input has been processed, from 0 to 1
+func (p CompactionProgress) Fraction() float64 {
+	if p.BytesTotal == 0 {
+		return 0
+	}
+	return float64(p.BytesProcessed) / float64(p.BytesTotal)
+}
+
+// Remaining estimates the time left from the rate so far
+func (p CompactionProgress) Remaining() time.Duration {
+	fraction := p.Fraction()
+	if fraction == 0 {
+		return 0
+	}
+	elapsed := time.Since(p.StartedAt)
+	return time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+}
+
+// ProgressFunc receives compaction progress reports
+type ProgressFunc func(CompactionProgress)
 
 func mergeEntries(e1, e2 *Entry) *Entry {
 	if e1.Timestamp > e2.Timestamp {
@@ -14,14 +55,20 @@ func mergeEntries(e1, e2 *Entry) *Entry {
 func MergeTwoSSTables(sst1, sst2 *SSTable, outputPath string) (string, error) {
 
 	// Read entries from both SSTables
-	entries1 := getAllEntriesFromSSTable(sst1)
-	entries2 := getAllEntriesFromSSTable(sst2)
+	entries1, err := getAllEntriesFromSSTable(sst1, nil)
+	if err != nil {
+		return "", err
+	}
+	entries2, err := getAllEntriesFromSSTable(sst2, nil)
+	if err != nil {
+		return "", err
+	}
 
 	// Step 4: Merge the two sorted lists
 	mergedEntries := mergeSortedEntries(entries1, entries2)
 
 	// Write merged entries to new SSTable
-	err := CreateSSTable(outputPath, mergedEntries)
+	err = CreateSSTable(outputPath, mergedEntries)
 	if err != nil {
 		return "", err
 	}
@@ -29,24 +76,64 @@ func MergeTwoSSTables(sst1, sst2 *SSTable, outputPath string) (string, error) {
 	return outputPath, nil
 }
 
-func getAllEntriesFromSSTable(sst *SSTable) []*Entry {
+// getAllEntriesFromSSTable reads every entry in key order, calling onRead
+// (if not nil) with each one and its size in the file. An entry that can't
+// be read fails the whole read, so compaction stops and keeps its inputs
+// rather than writing a table without it.
+func getAllEntriesFromSSTable(sst *SSTable, onRead func(*Entry, int64)) ([]*Entry, error) {
+	if sst.indexCorrupt.Load() {
+		return scanAllEntries(sst, onRead)
+	}
+
 	entries := make([]*Entry, 0)
 
 	for key, offset := range sst.index {
-		entry, err := ReadEntryAtOffset(sst.file, offset)
-		if err != nil {
-			continue // skip this entry
+		entry, size, err := sst.readEntrySized(offset)
+		if err != nil && !errors.Is(err, ErrIndexCorruption) {
+			return nil, fmt.Errorf("failed to read %q from %s: %w", key, sst.FilePath(), err)
 		}
 
-		// Sanity check
-		if entry.Key != key {
-			continue
+		// The index can't be trusted; read the file itself instead
+		if err != nil || entry.Key != key {
+			fmt.Printf("index corruption in %s, reading it with a scan\n", sst.FilePath())
+			sst.indexCorrupt.Store(true)
+			return scanAllEntries(sst, onRead)
 		}
 
 		entries = append(entries, entry)
+		if onRead != nil {
+			onRead(entry, size)
+		}
+	}
+
+	// The index is a map, so restore key order for the merge
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries, nil
+}
+
+// scanAllEntries is getAllEntriesFromSSTable for a table whose index is
+// corrupt. It fails if an entry can't be read, since the ones after it
+// can't be found without the index.
+func scanAllEntries(sst *SSTable, onRead func(*Entry, int64)) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := sst.walk(func(entry *Entry, size int64) {
+		entries = append(entries, entry)
+		if onRead != nil {
+			onRead(entry, size)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan of %s failed: %w", sst.FilePath(), err)
 	}
 
-	return entries
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries, nil
 }
 
 func mergeSortedEntries(entries1, entries2 []*Entry) []*Entry {
@@ -60,10 +147,9 @@ func mergeSortedEntries(entries1, entries2 []*Entry) []*Entry {
 			mergedEntries = append(mergedEntries, entries2[j])
 			j++
 		} else {
-			merged := mergeEntries(entries1[i], entries2[j])
-			if !merged.Deleted {
-				mergedEntries = append(mergedEntries, merged)
-			}
+			// Tombstones are kept: a later merge may bring in an older
+			// value they still have to hide
+			mergedEntries = append(mergedEntries, mergeEntries(entries1[i], entries2[j]))
 			i++
 			j++
 		}
@@ -79,20 +165,106 @@ func mergeSortedEntries(entries1, entries2 []*Entry) []*Entry {
 	return mergedEntries
 }
 
-func CompactSSTables(sstables []*SSTable, outputPath string) (string, error) {
+// dropDeadEntries removes tombstones and entries whose TTL passed before
+// now. Only safe on the result of merging every table, as older versions
+// of those keys would otherwise come back.
+func dropDeadEntries(entries []*Entry, now int64) []*Entry {
+	live := entries[:0]
+	expired := 0
+	for _, entry := range entries {
+		if entry.Deleted {
+			continue
+		}
+		if entry.IsExpired(now) {
+			expired++
+			continue
+		}
+		live = append(live, entry)
+	}
+	if expired > 0 {
+		fmt.Printf("Compaction dropped %d expired entries\n", expired)
+	}
+	return live
+}
+
+// sstableFooterSize is the size of the footer every table ends with
+const sstableFooterSize = 20
+
+// splitEntries cuts key-ordered entries into runs whose tables stay
+// within maxSize bytes, each holding at least one entry, so a single entry
+// larger than maxSize gets a table of its own. Sizes are estimated from
+// the uncompressed entries, so dictionary tables come out smaller. With
+// maxSize <= 0 everything stays in one run.
+func splitEntries(entries []*Entry, maxSize int64, opts SSTableOptions) [][]*Entry {
+	if maxSize <= 0 || len(entries) == 0 {
+		return [][]*Entry{entries}
+	}
+
+	version := uint32(Version)
+	fixed := int64(sstableFooterSize)
+	if opts.Dictionary {
+		version = VersionDict
+		fixed += dictionarySize + 4
+	}
+
+	var runs [][]*Entry
+	start := 0
+	size := fixed
+	for i, entry := range entries {
+		// The entry itself and its index record: key length, key, offset
+		entrySize := EncodedEntrySize(entry, version) + int64(4+len(entry.Key)+8)
+		if i > start && size+entrySize > maxSize {
+			runs = append(runs, entries[start:i])
+			start = i
+			size = fixed
+		}
+		size += entrySize
+	}
+	return append(runs, entries[start:])
+}
+
+// CompactSSTables merges sstables (newest entry wins) into new tables and
+// returns their paths. The output is one table at outputPath(0), or with
+// maxOutputSize > 0 as many tables as it takes to keep each within that
+// many bytes, at outputPath(1), outputPath(2) and so on; their key ranges
+// don't overlap. If progress is not nil it is called every
+// progressInterval entries while the inputs are read, and once more when
+// the output has been written. opts controls the format of the new tables.
+func CompactSSTables(sstables []*SSTable, outputPath func(part int) string, maxOutputSize int64, opts SSTableOptions, progress ProgressFunc) ([]string, error) {
 	if len(sstables) == 0 {
-		return "", fmt.Errorf("no sstables to compact")
+		return nil, fmt.Errorf("no sstables to compact")
 	}
 
-	if len(sstables) == 1 {
+	if len(sstables) == 1 && !sstables[0].indexCorrupt.Load() {
 		// Only one SSTable, nothing to compact
-		return sstables[0].FilePath(), nil
+		return []string{sstables[0].FilePath()}, nil
+	}
+
+	status := CompactionProgress{StartedAt: time.Now()}
+	for _, sst := range sstables {
+		status.EntriesTotal += int64(sst.NumEntries())
+		status.BytesTotal += sst.dataEnd
+	}
+	report := func() {
+		if progress != nil {
+			progress(status)
+		}
 	}
 
 	// Collect all entries from all SSTables
 	allEntries := make([][]*Entry, len(sstables))
 	for i, sst := range sstables {
-		allEntries[i] = getAllEntriesFromSSTable(sst)
+		entries, err := getAllEntriesFromSSTable(sst, func(entry *Entry, size int64) {
+			status.EntriesMerged++
+			status.BytesProcessed += size
+			if status.EntriesMerged%progressInterval == 0 {
+				report()
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		allEntries[i] = entries
 	}
 
 	// Merge all entries together
@@ -101,11 +273,28 @@ func CompactSSTables(sstables []*SSTable, outputPath string) (string, error) {
 		merged = mergeSortedEntries(merged, allEntries[i])
 	}
 
-	// Write to new SSTable
-	err := CreateSSTable(outputPath, merged)
-	if err != nil {
-		return "", err
+	// Every table is an input, so nothing older is left for a tombstone
+	// or an expired entry to hide
+	merged = dropDeadEntries(merged, time.Now().UnixNano())
+
+	// Write the new SSTables
+	var paths []string
+	for part, run := range splitEntries(merged, maxOutputSize, opts) {
+		path := outputPath(part)
+		err := CreateSSTableWithOptions(path, run, opts)
+		if err != nil {
+			for _, written := range paths {
+				os.Remove(written)
+			}
+			return nil, err
+		}
+		paths = append(paths, path)
 	}
 
-	return outputPath, nil
+	// A table read with a scan may hold less than its footer counted, so
+	// finish at 100% explicitly
+	status.BytesProcessed = status.BytesTotal
+	report()
+
+	return paths, nil
 }
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestSSTables writes each list of entries to its own SSTable in dir
+// and opens them, newest first as the store keeps them
+func openTestSSTables(t *testing.T, dir string, tables ...[]*Entry) []*SSTable {
+	t.Helper()
+	files := NewFilePool(16)
+	var sstables []*SSTable
+	for i, entries := range tables {
+		path := filepath.Join(dir, fmt.Sprintf("sstable-%d.db", i))
+		if err := CreateSSTable(path, entries); err != nil {
+			t.Fatalf("CreateSSTable: %v", err)
+		}
+		sst, err := OpenSSTable(path, files)
+		if err != nil {
+			t.Fatalf("OpenSSTable: %v", err)
+		}
+		t.Cleanup(func() { sst.Close() })
+		sstables = append([]*SSTable{sst}, sstables...)
+	}
+	return sstables
+}
+
+func TestCompactionDropsExpiredEntries(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UnixNano()
+	past := now - int64(time.Hour)
+	future := now + int64(time.Hour)
+
+	sstables := openTestSSTables(t, dir,
+		[]*Entry{
+			{Key: "expired", Value: []byte("x"), Timestamp: 1, ExpiresAt: past},
+			{Key: "live", Value: []byte("old"), Timestamp: 1},
+			{Key: "ttl", Value: []byte("t"), Timestamp: 1, ExpiresAt: future},
+		},
+		[]*Entry{
+			{Key: "live", Value: []byte("new"), Timestamp: 2},
+			{Key: "renewed", Value: []byte("r"), Timestamp: 2, ExpiresAt: future},
+		},
+		[]*Entry{
+			{Key: "renewed", Value: []byte("r"), Timestamp: 3, ExpiresAt: past},
+		},
+	)
+
+	paths, err := CompactSSTables(sstables, func(part int) string {
+		return filepath.Join(dir, fmt.Sprintf("out-%d.db", part))
+	}, 0, SSTableOptions{}, nil)
+	if err != nil {
+		t.Fatalf("CompactSSTables: %v", err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("got %d output tables, want 1", len(paths))
+	}
+
+	out, err := OpenSSTable(paths[0], NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	entries, err := getAllEntriesFromSSTable(out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*Entry)
+	for _, entry := range entries {
+		got[entry.Key] = entry
+	}
+	if len(got) != 2 {
+		t.Errorf("output holds %d keys, want live and ttl: %v", len(got), entries)
+	}
+	if e := got["live"]; e == nil || string(e.Value) != "new" {
+		t.Errorf("live = %+v, want the newest value", e)
+	}
+	if e := got["ttl"]; e == nil || e.ExpiresAt != future {
+		t.Errorf("ttl = %+v, want its expiry kept", e)
+	}
+	for _, key := range []string{"expired", "renewed"} {
+		if got[key] != nil {
+			t.Errorf("%s survived compaction after expiring", key)
+		}
+	}
+}
+
+// Progress is reported every progressInterval entries while the inputs are
+// read, before any output is written, and the last report is 100%
+func TestCompactionProgress(t *testing.T) {
+	dir := t.TempDir()
+	const perTable = 2500
+	var tables [][]*Entry
+	for table := 0; table < 3; table++ {
+		var entries []*Entry
+		for i := 0; i < perTable; i++ {
+			entries = append(entries, &Entry{Key: fmt.Sprintf("key:%d:%05d", table, i), Value: []byte("value"), Timestamp: 1})
+		}
+		tables = append(tables, entries)
+	}
+	sstables := openTestSSTables(t, dir, tables...)
+
+	output := filepath.Join(dir, "out.db")
+	var reports []CompactionProgress
+	var written []bool
+	_, err := CompactSSTables(sstables, func(int) string { return output }, 0, SSTableOptions{}, func(p CompactionProgress) {
+		reports = append(reports, p)
+		_, err := os.Stat(output)
+		written = append(written, err == nil)
+	})
+	if err != nil {
+		t.Fatalf("CompactSSTables: %v", err)
+	}
+
+	const total = 3 * perTable
+	if len(reports) != total/progressInterval+1 {
+		t.Fatalf("got %d progress reports for %d entries, want one every %d and a last one", len(reports), total, progressInterval)
+	}
+	for i, p := range reports[:len(reports)-1] {
+		if written[i] {
+			t.Errorf("report %d came after the output was written", i)
+		}
+		if p.EntriesTotal != total || p.EntriesMerged != int64((i+1)*progressInterval) {
+			t.Errorf("report %d: %d of %d entries merged, want %d of %d", i, p.EntriesMerged, p.EntriesTotal, (i+1)*progressInterval, total)
+		}
+		if fraction := p.Fraction(); fraction <= 0 || fraction >= 1 || (i > 0 && fraction <= reports[i-1].Fraction()) {
+			t.Errorf("report %d is at %.2f, after %.2f", i, fraction, reports[max(i-1, 0)].Fraction())
+		}
+	}
+	last := reports[len(reports)-1]
+	if !written[len(written)-1] || last.Fraction() != 1 || last.EntriesMerged != total {
+		t.Errorf("last report at %.2f with %d entries merged, output written: %v; want 100%% of %d once written",
+			last.Fraction(), last.EntriesMerged, written[len(written)-1], total)
+	}
+}
+
+// An entry that can't be read fails the compaction rather than being
+// left out of its output, and the input tables are kept
+func TestCompactionAbortsOnUnreadableEntry(t *testing.T) {
+	dir := t.TempDir()
+	sstables := openTestSSTables(t, dir,
+		[]*Entry{{Key: "a", Value: []byte("1"), Timestamp: 1}, {Key: "b", Value: []byte("2"), Timestamp: 1}},
+		[]*Entry{{Key: "c", Value: []byte("3"), Timestamp: 2}},
+	)
+	damaged := sstables[1].FilePath()
+	patchUint32(t, damaged, 4+1, 0xFFFFFFF0) // value length of "a"
+
+	output := filepath.Join(dir, "out.db")
+	_, err := CompactSSTables(sstables, func(int) string { return output }, 0, SSTableOptions{}, nil)
+	if err == nil {
+		t.Fatal("compaction succeeded with an unreadable entry")
+	}
+	if _, statErr := os.Stat(output); !os.IsNotExist(statErr) {
+		t.Errorf("compaction left an output table behind: %v", statErr)
+	}
+	for _, sst := range sstables {
+		if _, statErr := os.Stat(sst.FilePath()); statErr != nil {
+			t.Errorf("input %s is gone: %v", sst.FilePath(), statErr)
+		}
+	}
+}
+
+// checkSplitOutput checks that tables were each written within maxSize
+// bytes and hold consecutive, non-overlapping key ranges
+func checkSplitOutput(t *testing.T, tables []*SSTable, maxSize int64) {
+	t.Helper()
+	sorted := slices.Clone(tables)
+	slices.SortFunc(sorted, func(a, b *SSTable) int {
+		minA, _ := a.KeyRange()
+		minB, _ := b.KeyRange()
+		return strings.Compare(minA, minB)
+	})
+	for i, sst := range sorted {
+		if size := fileSize(t, sst.FilePath()); size > maxSize {
+			t.Errorf("%s is %d bytes, over the %d byte limit", sst.FilePath(), size, maxSize)
+		}
+		if i == 0 {
+			continue
+		}
+		_, prevMax := sorted[i-1].KeyRange()
+		if minKey, _ := sst.KeyRange(); minKey <= prevMax {
+			t.Errorf("%s starts at %s, within the previous table that ends at %s", sst.FilePath(), minKey, prevMax)
+		}
+	}
+}
+
+// With a maximum output size, compaction writes several tables that each
+// stay within it and together hold every key exactly once
+func TestCompactionSplitsOutput(t *testing.T) {
+	dir := t.TempDir()
+	const keys = 3000
+	value := bytes.Repeat([]byte("v"), 100)
+	var tables [][]*Entry
+	for table := 0; table < 3; table++ {
+		var entries []*Entry
+		for i := table; i < keys; i += 2 {
+			entries = append(entries, &Entry{
+				Key:       fmt.Sprintf("key:%05d", i),
+				Value:     append(slices.Clip(value), byte('0'+table)),
+				Timestamp: int64(table + 1),
+			})
+		}
+		tables = append(tables, entries)
+	}
+	sstables := openTestSSTables(t, dir, tables...)
+
+	const maxSize = 32 << 10
+	paths, err := CompactSSTables(sstables, func(part int) string {
+		return filepath.Join(dir, fmt.Sprintf("out-%d.db", part))
+	}, maxSize, SSTableOptions{}, nil)
+	if err != nil {
+		t.Fatalf("CompactSSTables: %v", err)
+	}
+	if len(paths) < 10 {
+		t.Fatalf("%d keys of over 100 bytes went into %d tables of at most %d bytes", keys, len(paths), maxSize)
+	}
+
+	files := NewFilePool(len(paths))
+	var outputs []*SSTable
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		sst, err := OpenSSTable(path, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sst.Close()
+		outputs = append(outputs, sst)
+
+		entries, err := getAllEntriesFromSSTable(sst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if seen[entry.Key] {
+				t.Errorf("%s is in more than one output table", entry.Key)
+			}
+			seen[entry.Key] = true
+			// Odd keys are only in table 1, and even keys from 2 on were
+			// last written by table 2
+			var i int
+			fmt.Sscanf(entry.Key, "key:%d", &i)
+			newest := i % 2
+			if i >= 2 && newest == 0 {
+				newest = 2
+			}
+			if last := entry.Value[len(entry.Value)-1]; last != byte('0'+newest) {
+				t.Errorf("%s = ...%c, want the value from table %d", entry.Key, last, newest)
+			}
+		}
+	}
+	if len(seen) != keys {
+		t.Errorf("output holds %d keys, want %d", len(seen), keys)
+	}
+	checkSplitOutput(t, outputs, maxSize)
+}
+
+// An entry larger than the maximum output size gets a table of its own
+// rather than failing the compaction
+func TestCompactionOversizedEntry(t *testing.T) {
+	dir := t.TempDir()
+	sstables := openTestSSTables(t, dir,
+		[]*Entry{
+			{Key: "a", Value: []byte("small"), Timestamp: 1},
+			{Key: "b", Value: bytes.Repeat([]byte("x"), 4096), Timestamp: 1},
+		},
+		[]*Entry{{Key: "c", Value: []byte("small"), Timestamp: 2}},
+	)
+
+	paths, err := CompactSSTables(sstables, func(part int) string {
+		return filepath.Join(dir, fmt.Sprintf("out-%d.db", part))
+	}, 1024, SSTableOptions{}, nil)
+	if err != nil {
+		t.Fatalf("CompactSSTables: %v", err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("got %d output tables, want a, b and c in one each", len(paths))
+	}
+	if size := fileSize(t, paths[1]); size < 4096 {
+		t.Errorf("b's table is %d bytes, smaller than its value", size)
+	}
+}
+
+// The store splits its compaction output at SetMaxSSTableSize, finds every
+// key in the split tables, and counts them as one towards the next
+// compaction, also after reopening
+func TestStoreCompactionSplitsOutput(t *testing.T) {
+	var tables [][]*Entry
+	for table := 0; table < 2; table++ {
+		var entries []*Entry
+		for i := 0; i < 1000; i++ {
+			entries = append(entries, &Entry{
+				Key:       fmt.Sprintf("key:%04d", i),
+				Value:     []byte(fmt.Sprintf("%0100d", table)),
+				Timestamp: int64(table + 1),
+			})
+		}
+		tables = append(tables, entries)
+	}
+	store := openTestStore(t, tables...)
+
+	const maxSize = 16 << 10
+	store.SetMaxSSTableSize(maxSize)
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(store *LSMStore) {
+		t.Helper()
+		store.mu.RLock()
+		sstables, groups := slices.Clone(store.sstables), store.tableGroups()
+		store.mu.RUnlock()
+		if len(sstables) < 5 || groups != 1 {
+			t.Fatalf("%d SSTables counting as %d, want several counting as one", len(sstables), groups)
+		}
+		checkSplitOutput(t, sstables, maxSize)
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key:%04d", i)
+			if value, found, _ := store.Get(key); !found || string(value) != fmt.Sprintf("%0100d", 1) {
+				t.Fatalf("%s = %q, %v after the split compaction", key, value, found)
+			}
+		}
+	}
+	check(store)
+	check(reopenStore(t, store))
+}
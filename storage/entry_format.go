@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The on-disk layout of an Entry, in SSTables and in WAL records, in
+// format version order:
+//
+//	key length   uint32
+//	key          bytes
+//	value length uint32
+//	value        bytes
+//	timestamp    int64
+//	deleted      byte (0 or 1)
+//	expires at   int64 (version 2 and later)
+//
+// All integers are little endian. A new field goes at the end, read only
+// from files of the version that introduced it. SSTables record their
+// version in the footer and the WAL in its header.
+
+// EncodeEntry writes entry in the layout of version with a single Write
+// and returns the number of bytes written
+func EncodeEntry(w io.Writer, entry *Entry, version uint32) (int64, error) {
+	buf := appendEntry(make([]byte, 0, EncodedEntrySize(entry, version)), entry, version)
+
+	n, err := w.Write(buf)
+	if err != nil {
+		return int64(n), fmt.Errorf("failed to write entry: %v", err)
+	}
+	return int64(n), nil
+}
+
+// appendEntry appends entry in the layout of version to buf, so a caller
+// with a buffer to reuse can encode without allocating
+func appendEntry(buf []byte, entry *Entry, version uint32) []byte {
+	return appendEntryFields(buf, entry.Key, entry.Value, entry.Timestamp, entry.Deleted, entry.ExpiresAt, version)
+}
+
+// appendEntryFields is appendEntry for an entry given field by field,
+// which lets the WAL encode a value it holds as a string without copying
+// it into a []byte first
+func appendEntryFields[V string | []byte](buf []byte, key string, value V, timestamp int64, deleted bool, expiresAt int64, version uint32) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+	buf = append(buf, value...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(timestamp))
+
+	var deletedByte byte = 0
+	if deleted {
+		deletedByte = 1
+	}
+	buf = append(buf, deletedByte)
+
+	if entryHasExpiry(version) {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(expiresAt))
+	}
+	return buf
+}
+
+// DecodeEntry reads one entry in the layout of version from r, which holds
+// at most size bytes. Fields the version doesn't have are left zero. The
+// key and value lengths are checked against size before anything is
+// allocated for them, so a damaged length can't ask for gigabytes.
+func DecodeEntry(r io.Reader, size int64, version uint32) (*Entry, error) {
+	var header [4]byte
+	remaining := size - entryMetadataSize(version)
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, readError("key length", err)
+	}
+	remaining -= 4
+	keyBytes, err := makeField("key", binary.LittleEndian.Uint32(header[:]), remaining-4)
+	if err != nil {
+		return nil, err
+	}
+	remaining -= int64(len(keyBytes))
+	_, err = io.ReadFull(r, keyBytes)
+	if err != nil {
+		return nil, readError("key", err)
+	}
+
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, readError("value length", err)
+	}
+	remaining -= 4
+	valueBytes, err := makeField("value", binary.LittleEndian.Uint32(header[:]), remaining)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(r, valueBytes)
+	if err != nil {
+		return nil, readError("value", err)
+	}
+
+	metadata := make([]byte, entryMetadataSize(version))
+	_, err = io.ReadFull(r, metadata)
+	if err != nil {
+		return nil, readError("metadata", err)
+	}
+
+	entry := &Entry{
+		Key:       string(keyBytes),
+		Value:     valueBytes,
+		Timestamp: int64(binary.LittleEndian.Uint64(metadata[0:8])),
+		Deleted:   metadata[8] != 0,
+	}
+	if entryHasExpiry(version) {
+		entry.ExpiresAt = int64(binary.LittleEndian.Uint64(metadata[9:17]))
+	}
+	return entry, nil
+}
+
+// makeField allocates a key or value of length read from disk, or fails
+// with ErrIndexCorruption if fewer than length bytes are left for it
+func makeField(what string, length uint32, remaining int64) ([]byte, error) {
+	if int64(length) > remaining {
+		return nil, fmt.Errorf("%w: %s length %d runs past the end of the entry (%d bytes left)",
+			ErrIndexCorruption, what, length, max(remaining, 0))
+	}
+	return make([]byte, length), nil
+}
+
+// EncodedEntrySize is how many bytes EncodeEntry writes for entry
+func EncodedEntrySize(entry *Entry, version uint32) int64 {
+	return int64(4+len(entry.Key)+4+len(entry.Value)) + entryMetadataSize(version)
+}
+
+// entryMetadataSize is the size of the fields after the value
+func entryMetadataSize(version uint32) int64 {
+	size := int64(8 + 1)
+	if entryHasExpiry(version) {
+		size += 8
+	}
+	return size
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEntryRoundTrip(t *testing.T) {
+	entries := []*Entry{
+		{Key: "user:1", Value: []byte("Alice"), Timestamp: 1699123456000000000},
+		{Key: "session:9", Value: []byte("token"), Timestamp: 1699123460000000000, ExpiresAt: 1699127060000000000},
+		{Key: "gone", Timestamp: 42, Deleted: true},
+		{Key: "", Value: []byte{}, Timestamp: 0},
+	}
+
+	for _, version := range []uint32{VersionV1, Version} {
+		for _, entry := range entries {
+			var buf bytes.Buffer
+			n, err := EncodeEntry(&buf, entry, version)
+			if err != nil {
+				t.Fatalf("EncodeEntry(%q, v%d): %v", entry.Key, version, err)
+			}
+			if n != EncodedEntrySize(entry, version) || int(n) != buf.Len() {
+				t.Fatalf("EncodeEntry(%q, v%d) wrote %d bytes, EncodedEntrySize says %d, buffer holds %d",
+					entry.Key, version, n, EncodedEntrySize(entry, version), buf.Len())
+			}
+
+			got, err := DecodeEntry(&buf, n, version)
+			if err != nil {
+				t.Fatalf("DecodeEntry(%q, v%d): %v", entry.Key, version, err)
+			}
+			want := *entry
+			if !entryHasExpiry(version) {
+				want.ExpiresAt = 0
+			}
+			if got.Key != want.Key || !bytes.Equal(got.Value, want.Value) || got.Timestamp != want.Timestamp ||
+				got.Deleted != want.Deleted || got.ExpiresAt != want.ExpiresAt {
+				t.Errorf("v%d round trip of %+v gave %+v", version, want, *got)
+			}
+		}
+	}
+}
+
+// An entry written in the oldest layout is still read by this version,
+// with the fields it doesn't have left zero
+func TestDecodeEntryOlderVersion(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := EncodeEntry(&buf, &Entry{Key: "k", Value: []byte("v"), Timestamp: 7, ExpiresAt: 99}, VersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeEntry(bytes.NewReader(buf.Bytes()), int64(buf.Len()), VersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != "k" || string(got.Value) != "v" || got.Timestamp != 7 || got.ExpiresAt != 0 {
+		t.Errorf("got %+v", *got)
+	}
+
+	// Read as the current version, the v1 bytes run out before the expiry
+	_, err = DecodeEntry(bytes.NewReader(buf.Bytes()), int64(buf.Len()), Version)
+	if err == nil {
+		t.Error("reading a v1 entry as the current version should fail")
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors callers can test for with errors.Is. ErrIndexCorruption and
+// ErrChecksumMismatch are both kinds of ErrSSTableCorrupt.
+// ErrUnsupportedVersion is not: the file may well be intact. ErrWALCorrupt
+// marks a WAL record that is cut short or damaged.
+var (
+	ErrMemTableImmutable = &StorageError{Message: "memtable is immutable"}
+
+	ErrSSTableCorrupt   = &StorageError{Message: "sstable corrupt"}
+	ErrIndexCorruption  = &StorageError{Message: "index corruption", Kind: ErrSSTableCorrupt}
+	ErrChecksumMismatch = &StorageError{Message: "checksum mismatch", Kind: ErrSSTableCorrupt}
+
+	ErrUnsupportedVersion = &StorageError{Message: "unsupported sstable version"}
+
+	ErrWALCorrupt = &StorageError{Message: "WAL corrupt"}
+)
+
+// StorageError is a storage failure class; Kind is the broader class it
+// belongs to, if any
+type StorageError struct {
+	Message string
+	Kind    error
+}
+
+func (e *StorageError) Error() string {
+	return e.Message
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Kind
+}
+
+// readError describes a failed read of what from an SSTable. Running out
+// of data means the file is shorter than its footer or index claims, so
+// that is reported as corruption rather than an I/O error.
+func readError(what string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: failed to read %s: %v", ErrSSTableCorrupt, what, err)
+	}
+	return fmt.Errorf("failed to read %s: %v", what, err)
+}
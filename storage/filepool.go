@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultMaxOpenFiles = 256 // SSTable files kept open at once
+)
+
+// FilePool keeps at most limit SSTable files open, opening them on demand
+// and closing the least recently used one to make room. Files are shared:
+// callers Acquire a file, read from it with ReadAt and Release it.
+//
+// A file that is in use is never closed, so when every open file is busy
+// the pool goes over its limit until some are released.
+type FilePool struct {
+	mu    sync.Mutex
+	limit int
+	files map[string]*list.Element // path → element holding a *pooledFile
+	lru   *list.List               // front is the most recently used
+}
+
+type pooledFile struct {
+	path    string
+	file    *os.File
+	refs    int
+	evicted bool // close as soon as the last reader releases it
+}
+
+func NewFilePool(limit int) *FilePool {
+	if limit <= 0 {
+		limit = DefaultMaxOpenFiles
+	}
+	return &FilePool{
+		limit: limit,
+		files: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// Acquire returns an open handle for path. Every Acquire must be paired
+// with a Release.
+func (p *FilePool) Acquire(path string) (*os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if elem, exists := p.files[path]; exists {
+		pf := elem.Value.(*pooledFile)
+		pf.refs++
+		p.lru.MoveToFront(elem)
+		return pf.file, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	pf := &pooledFile{path: path, file: file, refs: 1}
+	p.files[path] = p.lru.PushFront(pf)
+	p.trim()
+
+	return file, nil
+}
+
+// Release hands back a file from Acquire
+func (p *FilePool) Release(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elem, exists := p.files[path]
+	if !exists {
+		return
+	}
+	pf := elem.Value.(*pooledFile)
+	pf.refs--
+
+	if pf.evicted && pf.refs == 0 {
+		p.closeFile(elem)
+		return
+	}
+	p.trim()
+}
+
+// Evict closes path's handle, waiting for current readers to release it
+func (p *FilePool) Evict(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elem, exists := p.files[path]
+	if !exists {
+		return nil
+	}
+	pf := elem.Value.(*pooledFile)
+	if pf.refs > 0 {
+		pf.evicted = true
+		return nil
+	}
+	return p.closeFile(elem)
+}
+
+// SetLimit changes how many files may stay open, closing idle ones if
+// there are now too many
+func (p *FilePool) SetLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultMaxOpenFiles
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.limit = limit
+	p.trim()
+}
+
+// OpenCount returns how many files are currently open
+func (p *FilePool) OpenCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lru.Len()
+}
+
+// trim closes idle files, least recently used first, until the pool is
+// within its limit. Caller must hold p.mu.
+func (p *FilePool) trim() {
+	elem := p.lru.Back()
+	for p.lru.Len() > p.limit && elem != nil {
+		prev := elem.Prev()
+		if elem.Value.(*pooledFile).refs == 0 {
+			p.closeFile(elem)
+		}
+		elem = prev
+	}
+}
+
+// closeFile closes and forgets one file. Caller must hold p.mu.
+func (p *FilePool) closeFile(elem *list.Element) error {
+	pf := elem.Value.(*pooledFile)
+	p.lru.Remove(elem)
+	delete(p.files, pf.path)
+	return pf.file.Close()
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Reads across many more SSTables than the pool may keep open all
+// succeed, and the number of open files stays within the limit
+func TestFilePoolBoundsOpenFiles(t *testing.T) {
+	const tables, limit = 40, 4
+	dir := t.TempDir()
+	files := NewFilePool(limit)
+
+	var sstables []*SSTable
+	for i := 0; i < tables; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("sstable-%d.db", i))
+		key := fmt.Sprintf("key:%02d", i)
+		if err := CreateSSTable(path, []*Entry{{Key: key, Value: []byte(key), Timestamp: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		sst, err := OpenSSTable(path, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sst.Close() })
+		sstables = append(sstables, sst)
+	}
+
+	var wg sync.WaitGroup
+	for reader := 0; reader < 3; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 5; round++ {
+				for i, sst := range sstables {
+					key := fmt.Sprintf("key:%02d", i)
+					value, found, err := sst.Get(key)
+					if err != nil || !found || string(value) != key {
+						t.Errorf("Get(%s) = %q, %v, %v", key, value, found, err)
+						return
+					}
+					// Three readers hold at most three files, so the pool
+					// never needs to go over its limit
+					if open := files.OpenCount(); open > limit {
+						t.Errorf("%d files open, limit %d", open, limit)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if open := files.OpenCount(); open > limit {
+		t.Errorf("%d files open after the reads, limit %d", open, limit)
+	}
+}
+
+// A file in use is never closed: the pool goes over its limit while every
+// file is busy and trims back once they are released
+func TestFilePoolKeepsBusyFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := NewFilePool(2)
+
+	var paths []string
+	for i := 0; i < 4; i++ {
+		paths = append(paths, writeTestSSTableAt(t, filepath.Join(dir, fmt.Sprintf("sstable-%d.db", i))))
+		if _, err := files.Acquire(paths[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if open := files.OpenCount(); open != 4 {
+		t.Errorf("%d files open with 4 in use, want all 4", open)
+	}
+
+	for _, path := range paths {
+		files.Release(path)
+	}
+	if open := files.OpenCount(); open != 2 {
+		t.Errorf("%d files open after releasing them, want the limit of 2", open)
+	}
+
+	// Evicting a file that is in use closes it at its last release
+	file, err := files.Acquire(paths[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files.Evict(paths[3])
+	if _, err := file.ReadAt(make([]byte, 1), 0); err != nil {
+		t.Errorf("evicted file was closed while in use: %v", err)
+	}
+	files.Release(paths[3])
+	if open := files.OpenCount(); open != 1 {
+		t.Errorf("%d files open after the evicted one was released, want 1", open)
+	}
+}
+
+// writeTestSSTableAt writes a one-entry SSTable to path and returns path
+func writeTestSSTableAt(t *testing.T, path string) string {
+	t.Helper()
+	if err := CreateSSTable(path, []*Entry{{Key: "k", Value: []byte("v")}}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flushMarkerName is the file in the data directory holding the first
+// SSTable id written after the last FlushAll. Tables with lower ids were
+// flushed away; if a crash kept them from being deleted, they are deleted
+// when the store is next opened instead of being loaded.
+const flushMarkerName = "FLUSHED"
+
+// FlushAll empties the store. The WAL is cleared, and the memtables are
+// replaced and the SSTables detached under the lock, so the keyspace is
+// empty as soon as it returns. With async the detached SSTables are
+// deleted in the background, otherwise before it returns; either way a
+// restart won't load them. Callers must keep writes out while it runs.
+func (store *LSMStore) FlushAll(async bool) error {
+	store.mu.Lock()
+
+	// The WAL holds every key's latest write, so a crash before it is
+	// reset restores the whole keyspace rather than part of it
+	if !store.inMemory {
+		err := writeFlushMarker(store.dataDir, store.nextSSTableID)
+		if err != nil {
+			store.mu.Unlock()
+			return err
+		}
+	}
+
+	err := store.WAL.Reset()
+	if err != nil {
+		// Put the old marker back; the tables are still in use
+		if !store.inMemory {
+			writeFlushMarker(store.dataDir, store.flushedBelow)
+		}
+		store.mu.Unlock()
+		return fmt.Errorf("failed to reset WAL: %v", err)
+	}
+	store.flushedBelow = store.nextSSTableID
+
+	oldSSTables := store.sstables
+	oldMemTable := store.memTable
+
+	store.sstables = nil
+	store.compactedTables = 0
+	store.memTable = NewMemTable(store.memtableSize)
+	store.memTable.SetCompressThreshold(store.compressThreshold)
+	// A flush still writing the immutable memtable notices it is gone and
+	// drops its output
+	store.immutableMemTable = nil
+	store.flushes++
+	store.liveKeys.Store(0)
+
+	store.mu.Unlock()
+
+	// Readers reach the memtable under the read lock, so none can still
+	// be using it
+	oldMemTable.release()
+
+	fmt.Printf("Flushed the keyspace; deleting %d SSTables\n", len(oldSSTables))
+	if async {
+		go store.deleteFlushedSSTables(oldSSTables)
+		return nil
+	}
+	store.deleteFlushedSSTables(oldSSTables)
+	return nil
+}
+
+// deleteFlushedSSTables deletes the tables a FlushAll detached, once a
+// compaction or snapshot iterator that may still be reading them has
+// finished
+func (store *LSMStore) deleteFlushedSSTables(sstables []*SSTable) {
+	for store.compacting.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.waitForSnapshots()
+
+	for _, sst := range sstables {
+		filePath := sst.FilePath()
+		sst.Close()
+		os.Remove(filePath)
+	}
+
+	err := SyncDir(store.dataDir)
+	if err != nil {
+		fmt.Printf("failed to sync data directory after flush: %v\n", err)
+	}
+	fmt.Printf("✓ Deleted %d flushed SSTables\n", len(sstables))
+}
+
+// writeFlushMarker durably records that SSTables below id were flushed
+func writeFlushMarker(dir string, id int) error {
+	path := filepath.Join(dir, flushMarkerName)
+	tmpPath := path + ".tmp"
+
+	err := os.WriteFile(tmpPath, []byte(strconv.Itoa(id)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write flush marker: %v", err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to rename flush marker: %v", err)
+	}
+	return SyncDir(dir)
+}
+
+// readFlushMarker returns the id in the flush marker, or 0 if there is none
+func readFlushMarker(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, flushMarkerName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read flush marker: %v", err)
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid flush marker %q", data)
+	}
+	return id, nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openFlushTestStore opens a store with three SSTables, below the
+// compaction threshold, and a key in the memtable, all logged in the WAL
+func openFlushTestStore(t *testing.T) *LSMStore {
+	t.Helper()
+	var tables [][]*Entry
+	for i := 0; i < 3; i++ {
+		tables = append(tables, []*Entry{{Key: fmt.Sprintf("old:%d", i), Value: []byte("v"), Timestamp: 1}})
+	}
+	store := openTestStore(t, tables...)
+	setLogged(t, store, "old:memtable", "v")
+	return store
+}
+
+// setLogged sets key as a command does, through the WAL
+func setLogged(t *testing.T, store *LSMStore, key, value string) {
+	t.Helper()
+	if err := store.WAL.WriteEntry("SET", key, value); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(key, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sstableFiles lists the SSTable files in the test store's data directory
+func sstableFiles(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("data", "sstable-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// reopenStore closes store and opens the data directory again
+func reopenStore(t *testing.T, store *LSMStore) *LSMStore {
+	t.Helper()
+	store.Close()
+	store.WAL.Close()
+	reopened, err := NewLSMStore(0, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	t.Cleanup(func() {
+		reopened.Close()
+		reopened.WAL.Close()
+	})
+	return reopened
+}
+
+func checkOnlyNewKeys(t *testing.T, store *LSMStore) {
+	t.Helper()
+	for _, key := range []string{"old:0", "old:1", "old:2", "old:memtable"} {
+		if store.Exists(key) {
+			t.Errorf("%s exists after the flush", key)
+		}
+	}
+	if value, found, _ := store.Get("new"); !found || string(value) != "after" {
+		t.Errorf("Get(new) = %q, %v; want the write made after the flush", value, found)
+	}
+	if n, err := store.CountKeys(); err != nil || n != 1 {
+		t.Errorf("CountKeys = %d, %v; want 1", n, err)
+	}
+}
+
+// FlushAll(true) empties the keyspace at once and leaves the files to a
+// background delete, here held up by a compaction; writes made after it
+// are kept, and the old files go once the compaction ends
+func TestFlushAllAsync(t *testing.T) {
+	store := openFlushTestStore(t)
+	if files := sstableFiles(t); len(files) != 3 {
+		t.Fatalf("store starts with %d SSTables", len(files))
+	}
+
+	store.compacting.Store(true)
+	returned := make(chan error, 1)
+	go func() { returned <- store.FlushAll(true) }()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FlushAll(true) waited for the compaction")
+	}
+	if files := sstableFiles(t); len(files) != 3 {
+		t.Errorf("%d SSTables left while the background delete waits, want 3", len(files))
+	}
+	setLogged(t, store, "new", "after")
+	checkOnlyNewKeys(t, store)
+
+	store.compacting.Store(false)
+	for deadline := time.Now().Add(5 * time.Second); len(sstableFiles(t)) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("old SSTables not deleted: %v", sstableFiles(t))
+		}
+	}
+	checkOnlyNewKeys(t, store)
+	checkOnlyNewKeys(t, reopenStore(t, store))
+}
+
+// FlushAll(false) has deleted the old files by the time it returns
+func TestFlushAllSync(t *testing.T) {
+	store := openFlushTestStore(t)
+	if err := store.FlushAll(false); err != nil {
+		t.Fatal(err)
+	}
+	if files := sstableFiles(t); len(files) != 0 {
+		t.Errorf("SSTables left after a synchronous flush: %v", files)
+	}
+	setLogged(t, store, "new", "after")
+	checkOnlyNewKeys(t, reopenStore(t, store))
+}
+
+// A crash before the background delete doesn't bring the flushed keys
+// back: the marker makes startup delete the old tables instead
+func TestFlushAllCrashBeforeDelete(t *testing.T) {
+	store := openFlushTestStore(t)
+
+	// Keep copies of the tables to put back, as if they were never deleted
+	saved := make(map[string][]byte)
+	for _, path := range sstableFiles(t) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved[path] = data
+	}
+	if err := store.FlushAll(false); err != nil {
+		t.Fatal(err)
+	}
+	setLogged(t, store, "new", "after")
+	for path, data := range saved {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkOnlyNewKeys(t, reopenStore(t, store))
+	if files := sstableFiles(t); len(files) != 0 {
+		t.Errorf("flushed SSTables left after startup: %v", files)
+	}
+}
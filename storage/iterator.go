@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Iterator walks the live keys of an LSMStore in key order, merging the
+// memtables and SSTables so each key is seen once with its newest value.
+// Tombstoned and expired keys are skipped.
+//
+// The iterator holds the store's read lock until Close, so layers can't be
+// swapped out underneath it. Don't write to the store from the goroutine
+// that is iterating; collect keys and write after Close instead. A
+// snapshot iterator (see NewSnapshotIterator) doesn't hold the lock.
+type Iterator struct {
+	store    *LSMStore
+	sources  []iteratorSource // newest first
+	now      int64
+	current  *Entry
+	err      error
+	closed   bool
+	snapshot bool
+
+	ctx   context.Context
+	steps int // keys visited, to check ctx every cancelCheckInterval
+}
+
+// cancelCheckInterval is how many keys an iterator visits between checks
+// of its context
+const cancelCheckInterval = 256
+
+// iteratorSource is one sorted layer: either memtable entries or the
+// sorted keys of an SSTable, whose entries are read on demand
+type iteratorSource struct {
+	entries []*Entry
+	sst     *SSTable
+	keys    []string
+	pos     int
+}
+
+func (src *iteratorSource) valid() bool {
+	if src.sst != nil {
+		return src.pos < len(src.keys)
+	}
+	return src.pos < len(src.entries)
+}
+
+func (src *iteratorSource) key() string {
+	if src.sst != nil {
+		return src.keys[src.pos]
+	}
+	return src.entries[src.pos].Key
+}
+
+// seek moves to the first key at or after start
+func (src *iteratorSource) seek(start string) {
+	if src.sst != nil {
+		src.pos = sort.SearchStrings(src.keys, start)
+		return
+	}
+	src.pos = sort.Search(len(src.entries), func(i int) bool {
+		return src.entries[i].Key >= start
+	})
+}
+
+func (src *iteratorSource) entry() (*Entry, error) {
+	if src.sst == nil {
+		entry := src.entries[src.pos]
+		if entry.Codec == CodecRaw {
+			return entry, nil
+		}
+		return decodedCopy(entry)
+	}
+
+	key := src.keys[src.pos]
+	entry, err := src.sst.readEntry(src.sst.index[key])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from %s: %w", key, src.sst.FilePath(), err)
+	}
+	return entry, nil
+}
+
+// NewIterator snapshots the store's layers and returns an iterator
+// positioned before the first key. Callers must Close it.
+func (store *LSMStore) NewIterator() *Iterator {
+	return store.NewIteratorContext(context.Background())
+}
+
+// NewIteratorContext is NewIterator for an iterator that stops once ctx
+// is done, with ctx's error as its Err
+func (store *LSMStore) NewIteratorContext(ctx context.Context) *Iterator {
+	return store.NewIteratorFrom(ctx, "")
+}
+
+// NewIteratorFrom is NewIteratorContext for an iterator positioned before
+// the first key at or after start, so a long scan can be done in pieces,
+// releasing the read lock in between. SSTables whose keys all come before
+// start are left out.
+func (store *LSMStore) NewIteratorFrom(ctx context.Context, start string) *Iterator {
+	store.mu.RLock()
+
+	it := &Iterator{
+		store: store,
+		now:   time.Now().UnixNano(),
+		ctx:   ctx,
+	}
+
+	it.sources = append(it.sources, iteratorSource{entries: store.memTable.Snapshot()})
+	if store.immutableMemTable != nil {
+		it.sources = append(it.sources, iteratorSource{entries: store.immutableMemTable.Snapshot()})
+	}
+	for _, sst := range store.sstables {
+		if _, maxKey := sst.KeyRange(); len(sst.index) == 0 || maxKey < start {
+			continue
+		}
+		it.sources = append(it.sources, iteratorSource{sst: sst, keys: sst.sortedKeys()})
+	}
+
+	if start != "" {
+		for i := range it.sources {
+			it.sources[i].seek(start)
+		}
+	}
+	return it
+}
+
+// NewSnapshotIterator is NewIterator for an iterator over a point-in-time
+// copy of the store's layers that releases the read lock at once, so a
+// long scan doesn't hold up flushes and memtable rotations. Later writes
+// aren't seen, and the SSTables it reads aren't deleted until it is
+// closed. It is safe to write to the store while iterating.
+func (store *LSMStore) NewSnapshotIterator() *Iterator {
+	it := store.NewIterator()
+	it.snapshot = true
+	// Counted before the lock is released, so a compaction swapping out
+	// these SSTables next waits for this iterator before deleting them
+	store.snapshots.Add(1)
+	store.mu.RUnlock()
+	return it
+}
+
+// Next advances to the next live key. It returns false when the store is
+// exhausted or an error occurred (see Err).
+func (it *Iterator) Next() bool {
+	for !it.closed && it.err == nil {
+		it.steps++
+		if it.steps%cancelCheckInterval == 0 {
+			it.err = it.ctx.Err()
+			if it.err != nil {
+				return false
+			}
+		}
+
+		// Find the smallest key across all layers
+		minKey := ""
+		found := false
+		for i := range it.sources {
+			src := &it.sources[i]
+			if src.valid() && (!found || src.key() < minKey) {
+				minKey = src.key()
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+
+		// The newest layer holding the key wins; older versions are skipped
+		var winner *Entry
+		for i := range it.sources {
+			src := &it.sources[i]
+			if !src.valid() || src.key() != minKey {
+				continue
+			}
+			if winner == nil {
+				winner, it.err = src.entry()
+				if it.err != nil {
+					return false
+				}
+			}
+			src.pos++
+		}
+
+		if winner.Deleted || winner.IsExpired(it.now) {
+			continue
+		}
+
+		it.current = winner
+		return true
+	}
+
+	return false
+}
+
+// Entry returns the entry the iterator is positioned at
+func (it *Iterator) Entry() *Entry {
+	return it.current
+}
+
+// Err returns the first error hit while reading SSTables, or the
+// context's error if it was cancelled
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the store's read lock, or for a snapshot iterator the
+// SSTables it reads
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	if it.snapshot {
+		it.store.snapshots.Add(-1)
+		return
+	}
+	it.store.mu.RUnlock()
+}
+
+// sortedKeys returns the SSTable's keys in order
+func (sst *SSTable) sortedKeys() []string {
+	keys := make([]string, 0, len(sst.index))
+	for key := range sst.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
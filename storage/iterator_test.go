@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A scan whose context is done stops with the context's error instead of
+// visiting every key
+func TestIteratorStopsWhenContextDone(t *testing.T) {
+	store := NewInMemoryLSMStore()
+	for i := 0; i < 10*cancelCheckInterval; i++ {
+		store.Set("key:"+strconv.Itoa(i), []byte("v"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	it := store.NewIteratorContext(ctx)
+	visited := 0
+	for it.Next() {
+		visited++
+	}
+	err := it.Err()
+	it.Close()
+	if !errors.Is(err, context.DeadlineExceeded) || visited >= cancelCheckInterval {
+		t.Errorf("iterator visited %d keys and ended with %v, want it stopped by the deadline", visited, err)
+	}
+
+	if _, err := store.CountKeysContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CountKeysContext = %v, want context.DeadlineExceeded", err)
+	}
+	if n, err := store.CountKeys(); err != nil || n != 10*cancelCheckInterval {
+		t.Errorf("CountKeys = %d, %v; want %d", n, err, 10*cancelCheckInterval)
+	}
+}
+
+// A snapshot iterator doesn't hold the read lock: writes and flushes go on
+// while it is open without changing what it sees, and a compaction waits
+// for it to close before deleting the SSTables it reads
+func TestSnapshotIterator(t *testing.T) {
+	store := openTestStore(t,
+		[]*Entry{{Key: "a", Value: []byte("1"), Timestamp: 1}, {Key: "b", Value: []byte("1"), Timestamp: 1}},
+		[]*Entry{{Key: "b", Value: []byte("2"), Timestamp: 2}},
+	)
+	store.Set("c", []byte("3"))
+
+	it := store.NewSnapshotIterator()
+	store.Set("d", []byte("4"))
+	store.Delete("a")
+	flushTestStore(t, store)
+	inputs := sstableFiles(t)
+
+	// Wait for the compaction to swap in its output, which it can do with
+	// the iterator open, and give it time to delete the inputs
+	compacted := make(chan error)
+	go func() { compacted <- store.Compact() }()
+	for deadline := time.Now().Add(5 * time.Second); store.NumSSTables() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("compaction didn't swap in its output: %d SSTables", store.NumSSTables())
+		}
+	}
+	select {
+	case err := <-compacted:
+		t.Fatalf("compaction finished with a snapshot iterator open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, path := range inputs {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("compaction input %s is gone with a snapshot iterator open: %v", path, err)
+		}
+	}
+
+	got := make(map[string]string)
+	for it.Next() {
+		got[it.Entry().Key] = string(it.Entry().Value)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	if want := map[string]string{"a": "1", "b": "2", "c": "3"}; !maps.Equal(got, want) {
+		t.Errorf("snapshot iterator saw %v, want %v", got, want)
+	}
+
+	if err := <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.CountKeys(); err != nil || n != 3 {
+		t.Errorf("CountKeys = %d, %v after the compaction; want b, c and d", n, err)
+	}
+}
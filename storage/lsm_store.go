@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +32,71 @@ type LSMStore struct {
 
 	WAL *WAL
 
+	// TombstoneFreeDeletes drops keys that only live in the active memtable
+	// instead of writing a tombstone; tombstones are still written when an
+	// older layer holds the key. Saves memtable space for churny caches.
+	TombstoneFreeDeletes bool
+
+	// liveKeys is a cheap running estimate of the number of live keys,
+	// corrected with an exact count at startup and after compaction
+	liveKeys atomic.Int64
+
+	// compacting is set while a Compact runs, and compactionInputs is
+	// how many SSTables it is merging (0 until it has picked them)
+	compacting       atomic.Bool
+	compactionInputs atomic.Int64
+
+	// snapshots counts open snapshot iterators, which read SSTables
+	// without the read lock; SSTables are only deleted while it is 0
+	snapshots atomic.Int64
+
+	// flushes counts FlushAll calls, so a flush or compaction that ran
+	// across one can tell its output is stale, and flushedBelow is the id
+	// in the flush marker (see flush_all.go); guarded by mu
+	flushes      int
+	flushedBelow int
+
+	// maxSSTableSize caps the size of each table compaction writes, 0
+	// for no limit, and compactedTables is how many tables at the end of
+	// sstables the last compaction wrote; guarded by mu
+	maxSSTableSize  int64
+	compactedTables int
+
+	// recovering is set while the WAL is replayed. Compaction waits for
+	// it to finish: replay keeps flushing, and every compaction would read
+	// all the tables flushed so far into memory again.
+	recovering atomic.Bool
+
+	// progress is the latest report from the running compaction
+	progress atomic.Pointer[CompactionProgress]
+
+	// CompactionHook, if set, also receives every compaction progress report
+	CompactionHook ProgressFunc
+
+	// files bounds how many SSTable files are open at once
+	files *FilePool
+
+	// compressThreshold is handed to every new memtable
+	compressThreshold int
+
+	// sstableOptions control the format of flushed and compacted SSTables
+	sstableOptions SSTableOptions
+
+	// adaptive, if set, replaces memtableSize with a flush threshold that
+	// follows the write rate
+	adaptive atomic.Pointer[adaptiveSizing]
+
+	// lastWrite is when the last Set or Delete happened, in Unix nanoseconds
+	lastWrite atomic.Int64
+
+	// idleFlushStop stops the running idle flush loop, if any
+	idleFlushStop chan struct{}
+
+	readCounters readCounters
+
+	// inMemory stores never flush; everything stays in the memtable
+	inMemory bool
+
 	mu sync.RWMutex
 }
 
@@ -52,12 +120,13 @@ func NewLSMStore(memtableSize int64, dataDir string) (*LSMStore, error) {
 
 	store := &LSMStore{
 		memTable:          NewMemTable(memtableSize),
-		immutableMemTable: NewMemTable(memtableSize),
+		immutableMemTable: nil,
 		sstables:          make([]*SSTable, 0),
 		memtableSize:      memtableSize,
 		dataDir:           dataDir,
 		nextSSTableID:     0,
 		WAL:               wal,
+		files:             NewFilePool(DefaultMaxOpenFiles),
 	}
 
 	// Load existing SSTables from disk
@@ -66,21 +135,116 @@ func NewLSMStore(memtableSize int64, dataDir string) (*LSMStore, error) {
 		return nil, fmt.Errorf("failed to load sstables: %w", err)
 	}
 
+	store.recovering.Store(true)
 	err = wal.Recover(store)
+	store.recovering.Store(false)
 	if err != nil {
 		fmt.Println("Error recovering WAL:", err)
 		return nil, err
 	}
 
+	store.reconcileKeyCount()
+
+	// Merge what replay flushed
+	store.maybeCompact()
+
 	return store, nil
 
 }
 
+// NewInMemoryLSMStore returns a store without persistence: nothing is
+// logged, the memtable is never flushed and no files are created, so the
+// data is lost when the process exits
+func NewInMemoryLSMStore() *LSMStore {
+	fmt.Println("Creating in-memory store (persistence disabled)...")
+
+	return &LSMStore{
+		memTable:     NewMemTable(DefaultMemTableSize),
+		sstables:     make([]*SSTable, 0),
+		memtableSize: DefaultMemTableSize,
+		WAL:          NewDisabledWAL(),
+		files:        NewFilePool(DefaultMaxOpenFiles),
+		inMemory:     true,
+	}
+}
+
+// Persistent reports whether the store writes anything to disk
+func (store *LSMStore) Persistent() bool {
+	return !store.inMemory
+}
+
+// SetMaxOpenFiles limits how many SSTable files stay open at once
+func (store *LSMStore) SetMaxOpenFiles(limit int) {
+	store.files.SetLimit(limit)
+}
+
+// SetCompressThreshold makes the memtable store values of at least
+// threshold bytes compressed, trading CPU for memory; 0 turns it off
+func (store *LSMStore) SetCompressThreshold(threshold int) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.compressThreshold = threshold
+	store.memTable.SetCompressThreshold(threshold)
+}
+
+// SetAdaptiveMemTableSize makes the memtable flush threshold follow the
+// write rate between minSize and maxSize bytes instead of staying at the
+// size the store was created with. maxSize <= 0 turns it off.
+func (store *LSMStore) SetAdaptiveMemTableSize(minSize, maxSize int64) {
+	if maxSize <= 0 {
+		store.adaptive.Store(nil)
+		store.mu.RLock()
+		store.memTable.SetMaxSize(store.memtableSize)
+		store.mu.RUnlock()
+		return
+	}
+	store.adaptive.Store(&adaptiveSizing{min: minSize, max: maxSize})
+}
+
+// EffectiveMemTableSize returns the size at which the memtable is flushed
+// right now
+func (store *LSMStore) EffectiveMemTableSize() int64 {
+	adaptive := store.adaptive.Load()
+	if adaptive == nil {
+		return store.memtableSize
+	}
+	return adaptive.size(time.Now())
+}
+
+// noteWrite records a write of n bytes for idle flushing and feeds it into
+// the adaptive sizing, if on, moving memTable's flush threshold to match
+func (store *LSMStore) noteWrite(memTable *MemTable, n int64) {
+	now := time.Now()
+	store.lastWrite.Store(now.UnixNano())
+
+	adaptive := store.adaptive.Load()
+	if adaptive == nil {
+		return
+	}
+	adaptive.writes.add(now, n)
+	memTable.SetMaxSize(adaptive.size(now))
+}
+
+// SetSSTableOptions sets the format of SSTables written from now on.
+// Existing tables keep theirs until compaction rewrites them.
+func (store *LSMStore) SetSSTableOptions(opts SSTableOptions) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.sstableOptions = opts
+}
+
 // Close all SSTables
 func (store *LSMStore) Close() error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
+	if store.idleFlushStop != nil {
+		close(store.idleFlushStop)
+		store.idleFlushStop = nil
+	}
+
 	for _, sst := range store.sstables {
 		if err := sst.Close(); err != nil {
 			return err
@@ -90,44 +254,103 @@ func (store *LSMStore) Close() error {
 	return nil
 }
 
-func (store *LSMStore) Get(key string) ([]byte, bool) {
+// Get returns key's live value. It fails if the value was found but
+// can't be decoded.
+func (store *LSMStore) Get(key string) ([]byte, bool, error) {
+	// Readers share the lock; it only keeps rotation and compaction from
+	// swapping layers (and closing SSTables) underneath the lookup
+	store.mu.RLock()
+	defer store.mu.RUnlock()
 
-	fmt.Println("Getting key:", key)
+	entry, found := store.lookup(key)
+	if !found || entry.Deleted || entry.IsExpired(time.Now().UnixNano()) {
+		store.readCounters.misses.Add(1)
+		return nil, false, nil
+	}
 
-	store.PrintStats()
+	value, err := rawValue(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	store.readCounters.hits.Add(1)
+	return value, true, nil
+}
 
-	// store.mu.RLock()
+// Exists reports whether key holds a live value, without copying it out
+func (store *LSMStore) Exists(key string) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
 
-	// defer store.mu.RUnlock()
+	entry, found := store.lookup(key)
+	if !found || entry.Deleted || entry.IsExpired(time.Now().UnixNano()) {
+		store.readCounters.misses.Add(1)
+		return false
+	}
 
-	fmt.Println("Getting key:", key)
+	store.readCounters.hits.Add(1)
+	return true
+}
 
-	// Check MemTable
-	value, found := store.memTable.Get(key)
+// ExpiresAt returns when key expires (Unix nanoseconds, 0 for never),
+// and false if it holds no live value
+func (store *LSMStore) ExpiresAt(key string) (int64, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
 
-	fmt.Println("MemTable value:", value, found)
+	entry, found := store.lookup(key)
+	if !found || entry.Deleted || entry.IsExpired(time.Now().UnixNano()) {
+		return 0, false
+	}
+	return entry.ExpiresAt, true
+}
 
+// lookup returns the newest entry for key across all layers. The first layer
+// holding the key wins, even if that entry is a tombstone or has expired,
+// so older versions further down can't resurface. Caller must hold store.mu.
+func (store *LSMStore) lookup(key string) (*Entry, bool) {
+	// Check MemTable
+	entry, found := store.memTable.Lookup(key)
 	if found {
-		return value, true
+		return entry, true
 	}
 
+	return store.lookupBelowMemTable(key)
+}
+
+// lookupBelowMemTable is lookup without the active memtable
+func (store *LSMStore) lookupBelowMemTable(key string) (*Entry, bool) {
 	// Check Immutable MemTable
 	if store.immutableMemTable != nil {
-		value, found := store.immutableMemTable.Get(key)
+		entry, found := store.immutableMemTable.Lookup(key)
 		if found {
-			return value, true
+			return entry, true
 		}
 	}
 
 	// check SSTables
 	for _, sst := range store.sstables {
-		value, found, err := sst.Get(key)
+		if !sst.inKeyRange(key) {
+			continue
+		}
+		if !sst.bloom.mayContain(key) {
+			store.readCounters.bloomRejections.Add(1)
+			continue
+		}
+		entry, found, err := sst.Lookup(key)
+		store.readCounters.probes.Add(1)
+		if found || err != nil {
+			// The index had the key, so the entry was read from the file
+			store.readCounters.reads.Add(1)
+		}
+		if errors.Is(err, ErrIndexCorruption) {
+			entry, found, err = store.repairLookup(sst, key, err)
+		}
 		if err != nil {
 			fmt.Printf("failed to get value from sstable: %v\n", err)
 			continue
 		}
 		if found {
-			return value, true
+			return entry, true
 		}
 	}
 
@@ -135,66 +358,370 @@ func (store *LSMStore) Get(key string) ([]byte, bool) {
 }
 
 func (store *LSMStore) Set(key string, value []byte) error {
-	store.mu.Lock()
-	defer store.mu.Unlock()
+	return store.SetWithExpiry(key, value, 0)
+}
+
+// SetWithExpiry stores a value that expires at expiresAt
+// (Unix nanoseconds, 0 for no expiry). An expiry that has already passed
+// deletes the key instead, as Redis does for EXPIRE with a negative TTL,
+// rather than writing a value no read could return.
+func (store *LSMStore) SetWithExpiry(key string, value []byte, expiresAt int64) error {
+	if expiresAt > 0 && expiresAt <= time.Now().UnixNano() {
+		_, err := store.Delete(key)
+		return err
+	}
+
+	// The memtable synchronizes itself; the shared lock only pins
+	// store.memTable so it can't be rotated mid-insert
+	store.mu.RLock()
+	memTable := store.memTable
+	wasLive := store.likelyLive(key)
+	err := memTable.SetWithExpiry(key, value, expiresAt)
+	store.mu.RUnlock()
 
-	// Check MemTable
-	err := store.memTable.Set(key, value)
 	if err != nil {
 		return fmt.Errorf("failed to set value in memtable: %w", err)
 	}
 
-	// Check Immutable MemTable
-	if store.memTable.ShouldFlush() {
-		err = store.rotateMemTable()
-		if err != nil {
-			return fmt.Errorf("failed to rotate memtable: %w", err)
-		}
+	if !wasLive {
+		store.liveKeys.Add(1)
+	}
+
+	store.noteWrite(memTable, entrySize(key, value))
+	store.maybeRotate(memTable)
+	return nil
+}
+
+// Delete removes key and reports whether it held a live value. The
+// memtable checks and deletes in one step and the lower layers can't change
+// under the read lock, so a concurrent write of the key is either counted
+// or lands after the delete.
+func (store *LSMStore) Delete(key string) (bool, error) {
+	prev, err := store.deleteKey(key)
+	return prev != nil, err
+}
+
+// GetDelete removes key and returns the live value it held, as one step:
+// like Delete, a concurrent write of the key either lands before and is
+// the value returned, or lands after the delete and survives it
+func (store *LSMStore) GetDelete(key string) ([]byte, bool, error) {
+	prev, err := store.deleteKey(key)
+	if prev == nil {
+		return nil, false, err
+	}
+	value, err := rawValue(prev)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// GetExpire returns key's live value and sets when it expires (Unix
+// nanoseconds, 0 for never) as one step, for GETEX: the memtable checks
+// and updates the key under its own lock, so a concurrent write of the key
+// either lands first and is the value returned, or lands after and keeps
+// its own expiry. An expiry that has already passed deletes the key, as
+// SetWithExpiry does.
+func (store *LSMStore) GetExpire(key string, expiresAt int64) ([]byte, bool, error) {
+	if expiresAt > 0 && expiresAt <= time.Now().UnixNano() {
+		return store.GetDelete(key)
+	}
+
+	// The lower layers can't change under the read lock, so what they
+	// hold for key stays current until the memtable is updated
+	store.mu.RLock()
+	memTable := store.memTable
+	var below *Entry
+	if _, found := memTable.Lookup(key); !found {
+		below, _ = store.lookupBelowMemTable(key)
+	}
+	entry, found, err := memTable.SetExpiry(key, expiresAt, below)
+	store.mu.RUnlock()
+
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to set expiry in memtable: %w", err)
+	}
+	if !found {
+		return nil, false, nil
+	}
+
+	store.noteWrite(memTable, entrySize(key, entry.Value))
+	store.maybeRotate(memTable)
+	value, err := rawValue(&entry)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// deleteKey deletes key and returns the live entry it held beforehand,
+// or nil if it held none. The entry may still be compressed.
+func (store *LSMStore) deleteKey(key string) (*Entry, error) {
+	store.mu.RLock()
+	memTable := store.memTable
+	wasLive := store.likelyLive(key)
+	var prev Entry
+	var found bool
+	var err error
+	if store.TombstoneFreeDeletes && !store.existsBelowMemTable(key) {
+		prev, found, err = memTable.Remove(key)
+	} else {
+		prev, found, err = memTable.Delete(key)
+	}
+	var live *Entry
+	if err == nil {
+		live = store.liveBefore(key, &prev, found)
+	}
+	store.mu.RUnlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete value in memtable: %w", err)
+	}
+
+	if wasLive {
+		store.liveKeys.Add(-1)
+	}
+
+	store.noteWrite(memTable, entrySize(key, nil))
+	store.maybeRotate(memTable)
+	return live, nil
+}
+
+// liveBefore returns the live entry key held before a delete that found
+// prev in the memtable (if found), or nil. Caller must hold store.mu.
+func (store *LSMStore) liveBefore(key string, prev *Entry, found bool) *Entry {
+	entry := prev
+	if !found {
+		entry, found = store.lookupBelowMemTable(key)
+	}
+	if !found || entry.Deleted || entry.IsExpired(time.Now().UnixNano()) {
+		return nil
+	}
+	return entry
+}
+
+// ReplaySet applies a SET read back from the WAL with its original
+// timestamp. It's skipped if the store already holds a write to key at or
+// after that time, e.g. the same write already flushed to an SSTable, so an
+// older record can never clobber a newer value.
+func (store *LSMStore) ReplaySet(key string, value []byte, expiresAt int64, timestamp int64) error {
+	store.mu.RLock()
+	memTable := store.memTable
+	applied := false
+	var err error
+	if !store.hasWriteSince(key, timestamp) {
+		// An expiry that has passed since still shadows older values
+		err = memTable.SetAt(key, value, expiresAt, timestamp)
+		applied = true
+	}
+	store.mu.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to set value in memtable: %w", err)
 	}
 
+	if applied {
+		store.replayRotate(memTable)
+	}
 	return nil
 }
 
-func (store *LSMStore) Delete(key string) error {
+// ReplayDelete is ReplaySet for deletes; it always leaves a tombstone
+func (store *LSMStore) ReplayDelete(key string, timestamp int64) error {
+	store.mu.RLock()
+	memTable := store.memTable
+	applied := false
+	var err error
+	if !store.hasWriteSince(key, timestamp) {
+		_, _, err = memTable.DeleteAt(key, timestamp)
+		applied = true
+	}
+	store.mu.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to delete value in memtable: %w", err)
+	}
+
+	if applied {
+		store.replayRotate(memTable)
+	}
+	return nil
+}
+
+// hasWriteSince reports whether the newest record for key was written at or
+// after timestamp. Caller must hold store.mu.
+func (store *LSMStore) hasWriteSince(key string, timestamp int64) bool {
+	entry, found := store.lookup(key)
+	return found && entry.Timestamp >= timestamp
+}
+
+// maybeRotate rotates memTable out if it's full and still the active one
+func (store *LSMStore) maybeRotate(memTable *MemTable) {
+	if store.inMemory || !memTable.ShouldFlush() {
+		return
+	}
+
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	// Check MemTable
-	err := store.memTable.Delete(key)
+	// Another writer may have rotated it already
+	if store.memTable != memTable {
+		return
+	}
+
+	store.rotateMemTable()
+}
+
+// repairLookup answers a lookup that hit a corrupt index by scanning the
+// SSTable, and schedules a compaction to rewrite the table the first time
+// it happens. Caller must hold store.mu.
+func (store *LSMStore) repairLookup(sst *SSTable, key string, lookupErr error) (*Entry, bool, error) {
+	fmt.Printf("read-repair: %s: %v; scanning for %q\n", sst.FilePath(), lookupErr, key)
+
+	entry, found, err := sst.ScanLookup(key)
 	if err != nil {
-		return fmt.Errorf("failed to delete value in memtable: %w", err)
+		return nil, false, err
 	}
 
-	// Check Immutable MemTable
-	if store.memTable.ShouldFlush() {
-		err = store.rotateMemTable()
-		if err != nil {
-			return fmt.Errorf("failed to rotate memtable: %w", err)
+	if sst.indexCorrupt.CompareAndSwap(false, true) {
+		fmt.Printf("read-repair: scheduling compaction to rewrite %s\n", sst.FilePath())
+		go func() {
+			err := store.Compact()
+			if err != nil {
+				fmt.Printf("compaction failed: %v\n", err)
+			}
+		}()
+	}
+
+	return entry, found, nil
+}
+
+// replayRotate is maybeRotate for WAL replay. Replay outruns background
+// flushes, so a full memtable is flushed to an SSTable before replay goes
+// on; memory stays bounded by the memtable size however large the WAL is.
+func (store *LSMStore) replayRotate(memTable *MemTable) {
+	if store.inMemory || !memTable.ShouldFlush() {
+		return
+	}
+
+	store.mu.Lock()
+	swapped := store.memTable == memTable && store.swapMemTable()
+	store.mu.Unlock()
+
+	if swapped {
+		store.flushImmutableMemTable()
+	}
+}
+
+// likelyLive guesses whether key currently holds a value without reading
+// from disk: the memtables answer exactly, while an SSTable index hit is
+// assumed to be a live value. Caller must hold store.mu.
+func (store *LSMStore) likelyLive(key string) bool {
+	now := time.Now().UnixNano()
+
+	if entry, found := store.memTable.Lookup(key); found {
+		return !entry.Deleted && !entry.IsExpired(now)
+	}
+
+	if store.immutableMemTable != nil {
+		if entry, found := store.immutableMemTable.Lookup(key); found {
+			return !entry.Deleted && !entry.IsExpired(now)
 		}
 	}
-	return nil
+
+	for _, sst := range store.sstables {
+		if sst.ContainsKey(key) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (store *LSMStore) rotateMemTable() error {
-	store.memTable.MakeImmutable()
+// CountKeys returns the exact number of live keys by scanning every layer
+func (store *LSMStore) CountKeys() (int64, error) {
+	return store.CountKeysContext(context.Background())
+}
+
+// CountKeysContext is CountKeys that gives up with ctx's error once ctx
+// is done
+func (store *LSMStore) CountKeysContext(ctx context.Context) (int64, error) {
+	it := store.NewIteratorContext(ctx)
+	defer it.Close()
+
+	var count int64
+	for it.Next() {
+		count++
+	}
+
+	return count, it.Err()
+}
+
+// EstimatedKeyCount returns the running live-key estimate without scanning
+func (store *LSMStore) EstimatedKeyCount() int64 {
+	count := store.liveKeys.Load()
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// reconcileKeyCount replaces the running estimate with an exact count
+func (store *LSMStore) reconcileKeyCount() {
+	count, err := store.CountKeys()
+	if err != nil {
+		fmt.Printf("failed to count keys: %v\n", err)
+		return
+	}
+	store.liveKeys.Store(count)
+}
 
+// existsBelowMemTable reports whether the immutable memtable or any SSTable
+// holds a record for key. Caller must hold store.mu.
+func (store *LSMStore) existsBelowMemTable(key string) bool {
 	if store.immutableMemTable != nil {
-		// Still Flushing the Immutable MemTable
-		// wait for 0.1 seconds
-		// Hacky Fix (ideally queue this task)
-		time.Sleep(100 * time.Millisecond)
-		if store.immutableMemTable.IsImmutable() {
-			return fmt.Errorf("still flushing the immutable memtable, cannot rotate")
+		if _, found := store.immutableMemTable.Lookup(key); found {
+			return true
 		}
 	}
 
-	store.immutableMemTable = store.memTable
+	for _, sst := range store.sstables {
+		if sst.ContainsKey(key) {
+			return true
+		}
+	}
 
-	store.memTable = NewMemTable(store.memtableSize)
+	return false
+}
+
+// rotateMemTable hands the active memtable to a background flush.
+// If the previous flush is still running the memtable keeps growing and
+// the next write retries. Caller must hold store.mu.
+func (store *LSMStore) rotateMemTable() bool {
+	if !store.swapMemTable() {
+		return false
+	}
 
 	go store.flushImmutableMemTable()
 
-	return nil
+	return true
+}
+
+// swapMemTable makes the active memtable the immutable one and starts a
+// new one, unless a flush is still pending. Caller must hold store.mu and
+// flush the immutable memtable afterwards.
+func (store *LSMStore) swapMemTable() bool {
+	if store.immutableMemTable != nil {
+		return false
+	}
+
+	store.memTable.MakeImmutable()
+	store.immutableMemTable = store.memTable
+
+	store.memTable = NewMemTable(store.memtableSize)
+	store.memTable.SetCompressThreshold(store.compressThreshold)
+
+	return true
 }
 
 func (store *LSMStore) flushImmutableMemTable() {
@@ -207,6 +734,7 @@ func (store *LSMStore) flushImmutableMemTable() {
 	}
 	// get name for new sstable
 	memtableToFlush := store.immutableMemTable
+	opts := store.sstableOptions
 
 	sstableID := store.nextSSTableID
 	store.nextSSTableID++
@@ -217,26 +745,41 @@ func (store *LSMStore) flushImmutableMemTable() {
 
 	path := fmt.Sprintf("%s/sstable-%d.db", store.dataDir, sstableID)
 
-	err := FlushMemTableToSSTable(memtableToFlush, path)
+	err := FlushMemTableToSSTable(memtableToFlush, path, opts)
 	if err != nil {
 		fmt.Printf("failed to flush memtable to sstable: %v\n", err)
 		return
 	}
-	sstable, err := OpenSSTable(path)
+	sstable, err := OpenSSTable(path, store.files)
 	if err != nil {
 		fmt.Printf("failed to open sstable: %v\n", err)
 		return
 	}
 
 	store.mu.Lock()
-	defer store.mu.Unlock()
+
+	// A FlushAll emptied the store while this one ran
+	if store.immutableMemTable != memtableToFlush {
+		store.mu.Unlock()
+		sstable.Close()
+		os.Remove(path)
+		memtableToFlush.release()
+		return
+	}
 
 	store.sstables = append([]*SSTable{sstable}, store.sstables...)
 
 	store.immutableMemTable = nil
 
+	store.mu.Unlock()
+
+	// Readers reach the memtable under the read lock, so none can still
+	// be using it
+	memtableToFlush.release()
+
 	fmt.Printf("flushed immutable memtable to sstable: %s\n", path)
 
+	// maybeCompact takes the read lock itself
 	store.maybeCompact()
 }
 
@@ -246,6 +789,7 @@ func extractSSTableId(fileName string) int {
 
 	idStr := strings.TrimPrefix(base, "sstable-")
 	idStr = strings.TrimSuffix(idStr, ".db")
+	idStr, _, _ = strings.Cut(idStr, "-") // a compaction output split off the first
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -263,28 +807,55 @@ func (store *LSMStore) loadSSTables() error {
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
+	// Temp files are SSTables a crash interrupted before the rename
+	tmpFiles, err := filepath.Glob(filepath.Join(store.dataDir, "sstable-*.db.tmp"))
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %v", err)
+	}
+	for _, file := range tmpFiles {
+		os.Remove(file)
+	}
+
 	// Find all sstable files in the directory
 	files, err := filepath.Glob(filepath.Join(store.dataDir, "sstable-*.db"))
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %v", err)
 	}
 
+	// Tables below the flush marker were flushed away before a crash
+	// could delete them, and new ids must not fall below it
+	store.flushedBelow, err = readFlushMarker(store.dataDir)
+	if err != nil {
+		return err
+	}
+	store.nextSSTableID = max(store.nextSSTableID, store.flushedBelow)
+	kept := files[:0]
+	for _, file := range files {
+		if extractSSTableId(file) < store.flushedBelow {
+			os.Remove(file)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	files = kept
+
 	if len(files) == 0 {
 		return nil
 	}
 
-	// sort files by id
+	// sort files by id, newest first like store.sstables; recovery can
+	// leave several tables behind, and lookups must see the newest first
 	sort.Slice(files, func(i, j int) bool {
 		idI := extractSSTableId(files[i])
 		idJ := extractSSTableId(files[j])
-		return idI < idJ // Decending order
+		return idI > idJ // Descending order
 	})
 
 	// Load SSTables Index from disk
 	for _, file := range files {
-		sstable, err := OpenSSTable(file)
+		sstable, err := OpenSSTable(file, store.files)
 		if err != nil {
-			return fmt.Errorf("failed to open sstable: %v", err)
+			return fmt.Errorf("failed to open sstable %s: %w", file, err)
 		}
 		store.sstables = append(store.sstables, sstable)
 
@@ -294,10 +865,27 @@ func (store *LSMStore) loadSSTables() error {
 		}
 	}
 
+	// The oldest tables sharing an id are the split output of the last
+	// compaction
+	oldestID := extractSSTableId(files[len(files)-1])
+	for _, file := range files {
+		if extractSSTableId(file) == oldestID {
+			store.compactedTables++
+		}
+	}
+
 	fmt.Printf("✓ Loaded %d SSTables from disk\n", len(store.sstables))
 	return nil
 }
 
+// NumSSTables returns how many SSTables the store currently reads from
+func (store *LSMStore) NumSSTables() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.sstables)
+}
+
 // Stats returns storage statistics
 func (store *LSMStore) Stats() map[string]interface{} {
 	store.mu.RLock()
@@ -305,6 +893,7 @@ func (store *LSMStore) Stats() map[string]interface{} {
 
 	stats := map[string]interface{}{
 		"memtable_size":      store.memTable.Size(),
+		"memtable_max_size":  store.EffectiveMemTableSize(),
 		"memtable_entries":   store.memTable.Count(),
 		"immutable_memtable": store.immutableMemTable != nil,
 		"num_sstables":       len(store.sstables),
@@ -333,44 +922,122 @@ func (store *LSMStore) PrintStats() {
 	fmt.Println("======================")
 }
 
+// Compact merges every SSTable into one. Reading the inputs and writing the
+// output happen without holding store.mu (SSTable reads go through ReadAt,
+// so concurrent lookups are fine); the lock is only taken to pick the inputs
+// and to swap the result in. If a compaction is already running it does
+// nothing; see CompactWait.
 func (store *LSMStore) Compact() error {
+	// One compaction at a time; a second one would merge the same inputs
+	if !store.compacting.CompareAndSwap(false, true) {
+		return nil
+	}
+	return store.compact()
+}
+
+// CompactWait is Compact for callers that need every SSTable merged when
+// it returns: a compaction already running is waited for, and then the
+// tables it left, including any flushed meanwhile, are compacted.
+func (store *LSMStore) CompactWait() error {
+	for !store.compacting.CompareAndSwap(false, true) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return store.compact()
+}
+
+// compact is Compact once the caller has set store.compacting, which it
+// clears when done
+func (store *LSMStore) compact() error {
+	defer store.compacting.Store(false)
+	defer store.progress.Store(nil)
+
 	store.mu.Lock()
 
-	// If there is only one sstable, nothing to compact
-	if len(store.sstables) <= 1 {
+	// If there is only one sstable, nothing to compact unless its index
+	// needs rebuilding
+	if len(store.sstables) == 0 || (len(store.sstables) == 1 && !store.sstables[0].indexCorrupt.Load()) {
 		store.mu.Unlock()
 		return nil
 	}
 
 	fmt.Println("Starting compaction...")
 
-	// create new sstable filename
+	// create new sstable filenames. Tables split off the output share its
+	// id, so they all load as older than the flushes that finish meanwhile.
 	newId := store.nextSSTableID
 	store.nextSSTableID++
-	outputPath := fmt.Sprintf("%s/sstable-%d.db", store.dataDir, newId)
+	outputPath := func(part int) string {
+		if part == 0 {
+			return fmt.Sprintf("%s/sstable-%d.db", store.dataDir, newId)
+		}
+		return fmt.Sprintf("%s/sstable-%d-%d.db", store.dataDir, newId, part)
+	}
+	maxOutputSize := store.maxSSTableSize
 
 	// get old sstables
 	oldSSTables := store.sstables
+	opts := store.sstableOptions
+	flushes := store.flushes
+	store.compactionInputs.Store(int64(len(oldSSTables)))
+	defer store.compactionInputs.Store(0)
 
 	store.mu.Unlock()
 
 	// compact sstables
-	newSSTablePath, err := CompactSSTables(oldSSTables, outputPath)
+	newSSTablePaths, err := CompactSSTables(oldSSTables, outputPath, maxOutputSize, opts, func(p CompactionProgress) {
+		store.progress.Store(&p)
+		if store.CompactionHook != nil {
+			store.CompactionHook(p)
+		}
+	})
 	if err != nil {
 		return fmt.Errorf("failed to compact sstables: %v", err)
 	}
 
-	// open new sstable
-	newSSTable, err := OpenSSTable(newSSTablePath)
-	if err != nil {
-		return fmt.Errorf("failed to open new sstable: %v", err)
+	// open new sstables
+	newSSTables := make([]*SSTable, 0, len(newSSTablePaths))
+	for _, path := range newSSTablePaths {
+		newSSTable, err := OpenSSTable(path, store.files)
+		if err != nil {
+			for _, sst := range newSSTables {
+				sst.Close()
+			}
+			for _, path := range newSSTablePaths {
+				os.Remove(path)
+			}
+			return fmt.Errorf("failed to open new sstable: %v", err)
+		}
+		newSSTables = append(newSSTables, newSSTable)
 	}
 
 	store.mu.Lock()
-	defer store.mu.Unlock()
 
-	store.sstables = []*SSTable{newSSTable}
+	// A FlushAll detached the inputs meanwhile and deletes them itself
+	if store.flushes != flushes {
+		store.mu.Unlock()
+		for _, sst := range newSSTables {
+			sst.Close()
+			os.Remove(sst.FilePath())
+		}
+		fmt.Println("Compaction result dropped: the store was flushed")
+		return nil
+	}
+
+	// Flushes that finished meanwhile were prepended and are newer than
+	// anything compacted, so they stay in front of the merged tables. The
+	// merged tables don't overlap, so their order doesn't matter.
+	flushedSince := len(store.sstables) - len(oldSSTables)
+	sstables := make([]*SSTable, 0, flushedSince+len(newSSTables))
+	sstables = append(sstables, store.sstables[:flushedSince]...)
+	store.sstables = append(sstables, newSSTables...)
+	store.compactedTables = len(newSSTables)
+
+	store.mu.Unlock()
 
+	// No reader can still see the old tables: lookups and iterators hold
+	// the read lock, and the swap above waited for them. Snapshot
+	// iterators don't, so they are waited for here.
+	store.waitForSnapshots()
 	for _, sst := range oldSSTables {
 		filePath := sst.FilePath()
 		sst.Close()
@@ -378,18 +1045,122 @@ func (store *LSMStore) Compact() error {
 		fmt.Printf("✓ Deleted old SSTable: %s\n\n", filePath)
 	}
 
-	fmt.Printf("✓ Compacted %d SSTables into %s\n\n", len(oldSSTables), newSSTablePath)
+	// Make the removals durable
+	err = SyncDir(store.dataDir)
+	if err != nil {
+		fmt.Printf("failed to sync data directory after compaction: %v\n", err)
+	}
+
+	fmt.Printf("✓ Compacted %d SSTables into %s\n\n", len(oldSSTables), strings.Join(newSSTablePaths, ", "))
+
+	// Compaction rewrote everything anyway; resync the key estimate
+	store.reconcileKeyCount()
 
 	return nil
 }
 
+// waitForSnapshots waits until no snapshot iterator is open, before
+// SSTables one could be reading are deleted
+func (store *LSMStore) waitForSnapshots() {
+	for store.snapshots.Load() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SetMaxSSTableSize makes compaction split its output into tables of at
+// most size bytes, 0 for a single table
+func (store *LSMStore) SetMaxSSTableSize(size int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.maxSSTableSize = size
+}
+
+// CompactionStatus returns the latest progress of the running compaction,
+// or false if none is running
+func (store *LSMStore) CompactionStatus() (CompactionProgress, bool) {
+	if !store.compacting.Load() {
+		return CompactionProgress{}, false
+	}
+	p := store.progress.Load()
+	if p == nil {
+		// Running, but no report yet
+		return CompactionProgress{}, true
+	}
+	return *p, true
+}
+
+// SetIdleFlush makes the store flush the memtable once no write has come
+// in for interval, even if it isn't full, so an idle server doesn't keep
+// recent writes only in the WAL. 0 turns it off.
+func (store *LSMStore) SetIdleFlush(interval time.Duration) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.idleFlushStop != nil {
+		close(store.idleFlushStop)
+		store.idleFlushStop = nil
+	}
+	if interval <= 0 || store.inMemory {
+		return
+	}
+
+	stop := make(chan struct{})
+	store.idleFlushStop = stop
+	go store.idleFlushLoop(interval, stop)
+}
+
+// idleFlushLoop checks twice per interval, so the flush comes between one
+// and one and a half intervals after the last write
+func (store *LSMStore) idleFlushLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(time.Unix(0, store.lastWrite.Load())) < interval {
+			continue
+		}
+
+		store.mu.Lock()
+		// A rotation fails while the previous flush is still running; the
+		// next tick tries again
+		if store.memTable.Count() > 0 && store.rotateMemTable() {
+			fmt.Println("flushing memtable after idle period")
+		}
+		store.mu.Unlock()
+	}
+}
+
+// tableGroups is the SSTable count CompactionThreshold applies to: the
+// tables the last compaction split its output into count as one, or they
+// would trigger the next compaction on their own. Caller must hold
+// store.mu.
+func (store *LSMStore) tableGroups() int {
+	return len(store.sstables) - max(store.compactedTables-1, 0)
+}
+
 func (store *LSMStore) maybeCompact() {
+	if store.recovering.Load() {
+		return
+	}
+
 	store.mu.RLock()
-	numSSTables := len(store.sstables)
+	numSSTables := store.tableGroups()
 	store.mu.RUnlock()
 
 	if numSSTables >= CompactionThreshold {
 		fmt.Println("Compaction threshold reached, starting compaction...")
-		go store.Compact() // Run in background
+		// Run in background
+		go func() {
+			err := store.Compact()
+			if err != nil {
+				fmt.Printf("compaction failed: %v\n", err)
+			}
+		}()
 	}
 }
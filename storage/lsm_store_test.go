@@ -0,0 +1,740 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a store in a temporary directory whose data
+// directory already holds an SSTable for each list of entries, the last
+// one newest. The store and its WAL are closed when the test ends.
+func openTestStore(t *testing.T, tables ...[]*Entry) *LSMStore {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	if err := os.MkdirAll("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, entries := range tables {
+		path := filepath.Join("data", fmt.Sprintf("sstable-%d.db", i))
+		if err := CreateSSTable(path, entries); err != nil {
+			t.Fatalf("CreateSSTable: %v", err)
+		}
+	}
+
+	store, err := NewLSMStore(0, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.WAL.Close()
+	})
+	return store
+}
+
+func TestGetExpire(t *testing.T) {
+	store := openTestStore(t, []*Entry{
+		{Key: "flushed", Value: []byte("on disk"), Timestamp: 1},
+		{Key: "gone", Timestamp: 1, Deleted: true},
+	})
+	store.Set("fresh", []byte("in memory"))
+	later := time.Now().Add(time.Hour).UnixNano()
+
+	for _, key := range []string{"fresh", "flushed"} {
+		value, found, err := store.GetExpire(key, later)
+		if err != nil || !found {
+			t.Fatalf("GetExpire(%s) = %v, %v", key, found, err)
+		}
+		if want, _, _ := store.Get(key); string(value) != string(want) {
+			t.Errorf("GetExpire(%s) = %q, want %q", key, value, want)
+		}
+		if expiresAt, _ := store.ExpiresAt(key); expiresAt != later {
+			t.Errorf("%s expires at %d, want %d", key, expiresAt, later)
+		}
+	}
+
+	// 0 removes the expiry again
+	if _, found, _ := store.GetExpire("flushed", 0); !found {
+		t.Fatal("flushed not found")
+	}
+	if expiresAt, found := store.ExpiresAt("flushed"); !found || expiresAt != 0 {
+		t.Errorf("flushed expires at %d after persisting", expiresAt)
+	}
+
+	// A time that has passed deletes the key, returning its value
+	value, found, err := store.GetExpire("fresh", time.Now().Add(-time.Second).UnixNano())
+	if err != nil || !found || string(value) != "in memory" {
+		t.Errorf("GetExpire in the past = %q, %v, %v", value, found, err)
+	}
+	if store.Exists("fresh") {
+		t.Error("fresh survived an expiry in the past")
+	}
+
+	for _, key := range []string{"gone", "missing"} {
+		if _, found, _ := store.GetExpire(key, later); found {
+			t.Errorf("GetExpire(%s) found a value", key)
+		}
+		if store.Exists(key) {
+			t.Errorf("GetExpire(%s) created the key", key)
+		}
+	}
+}
+
+// setSequence sets key to 0, 1, ... n-1 in turn while fn runs
+// concurrently, and returns once both are done
+func setSequence(t *testing.T, store *LSMStore, key string, n int, fn func(done func() bool)) {
+	t.Helper()
+	var finished atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn(finished.Load)
+	}()
+
+	for i := 0; i < n; i++ {
+		if err := store.Set(key, []byte(strconv.Itoa(i))); err != nil {
+			t.Error(err)
+		}
+	}
+	finished.Store(true)
+	wg.Wait()
+}
+
+// Every value GETDEL takes is one SET wrote, none is taken twice, and the
+// last one written is either taken or still there: no update is lost
+// between the read and the delete
+func TestGetDeleteConcurrentWithSet(t *testing.T) {
+	store := openTestStore(t)
+	const n = 2000
+
+	var taken []int
+	setSequence(t, store, "k", n, func(done func() bool) {
+		for !done() {
+			value, found, err := store.GetDelete("k")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if found {
+				i, _ := strconv.Atoi(string(value))
+				taken = append(taken, i)
+			}
+		}
+	})
+	value, found, err := store.GetDelete("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		i, _ := strconv.Atoi(string(value))
+		taken = append(taken, i)
+	}
+
+	for i := 1; i < len(taken); i++ {
+		if taken[i] <= taken[i-1] {
+			t.Fatalf("GETDEL returned %d after %d: a value came back twice or out of order", taken[i], taken[i-1])
+		}
+	}
+	if len(taken) == 0 || taken[len(taken)-1] != n-1 {
+		t.Errorf("the last value written, %d, was lost (taken: %d values)", n-1, len(taken))
+	}
+	if store.Exists("k") {
+		t.Error("k still exists after the final GETDEL")
+	}
+}
+
+// An expiry that has already passed deletes the key instead of storing
+// a value no read could return, and keeps the key estimate right
+func TestSetWithPastExpiry(t *testing.T) {
+	store := openTestStore(t, []*Entry{{Key: "flushed", Value: []byte("on disk"), Timestamp: 1}})
+	store.reconcileKeyCount()
+	store.Set("fresh", []byte("in memory"))
+	past := time.Now().Add(-time.Second).UnixNano()
+
+	for _, key := range []string{"fresh", "flushed", "missing"} {
+		if err := store.SetWithExpiry(key, []byte("stale"), past); err != nil {
+			t.Fatalf("SetWithExpiry(%s): %v", key, err)
+		}
+		if store.Exists(key) {
+			t.Errorf("%s exists after a set with a past expiry", key)
+		}
+		if _, found := store.ExpiresAt(key); found {
+			t.Errorf("%s has an expiry after a set with a past expiry", key)
+		}
+	}
+	if n := store.EstimatedKeyCount(); n != 0 {
+		t.Errorf("key estimate = %d, want 0", n)
+	}
+	if n, err := store.CountKeys(); err != nil || n != 0 {
+		t.Errorf("CountKeys = %d, %v; want 0", n, err)
+	}
+}
+
+// GETEX running alongside SET never revives an older value, and leaves
+// the expiry on the key only if it ran after the last SET
+func TestGetExpireConcurrentWithSet(t *testing.T) {
+	store := openTestStore(t)
+	const n = 2000
+	later := time.Now().Add(time.Hour).UnixNano()
+
+	last := -1
+	setSequence(t, store, "k", n, func(done func() bool) {
+		for !done() {
+			value, found, err := store.GetExpire("k", later)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !found {
+				continue
+			}
+			i, _ := strconv.Atoi(string(value))
+			if i < last {
+				t.Errorf("GETEX returned %d after %d", i, last)
+				return
+			}
+			last = i
+		}
+	})
+
+	value, _, _ := store.Get("k")
+	if string(value) != strconv.Itoa(n-1) {
+		t.Fatalf("k = %q after the last SET of %d", value, n-1)
+	}
+	expiresAt, _ := store.ExpiresAt("k")
+	if expiresAt != 0 && expiresAt != later {
+		t.Errorf("k expires at %d", expiresAt)
+	}
+	if expiresAt == later && last != n-1 {
+		t.Errorf("k kept an expiry set before the last SET (GETEX last saw %d)", last)
+	}
+}
+
+// flushTestStore writes the memtable out to an SSTable and waits for it
+func flushTestStore(t *testing.T, store *LSMStore) {
+	t.Helper()
+	store.mu.Lock()
+	swapped := store.swapMemTable()
+	store.mu.Unlock()
+	if !swapped {
+		t.Fatal("a flush was already pending")
+	}
+	store.flushImmutableMemTable()
+}
+
+// A TTL survives the flush to an SSTable and still expires the key there;
+// compaction keeps the newest TTL and drops keys that have expired
+func TestTTLThroughFlushAndCompaction(t *testing.T) {
+	store := openTestStore(t)
+	later := time.Now().Add(time.Hour).UnixNano()
+	soon := time.Now().Add(50 * time.Millisecond).UnixNano()
+
+	store.SetWithExpiry("short", []byte("s"), soon)
+	store.SetWithExpiry("long", []byte("l"), later)
+	store.Set("plain", []byte("p"))
+	flushTestStore(t, store)
+
+	if store.memTable.Count() != 0 || store.NumSSTables() != 1 {
+		t.Fatalf("after the flush: %d memtable entries, %d SSTables", store.memTable.Count(), store.NumSSTables())
+	}
+	if expiresAt, _ := store.ExpiresAt("long"); expiresAt != later {
+		t.Errorf("long expires at %d after the flush, want %d", expiresAt, later)
+	}
+	if value, found, _ := store.Get("short"); !found || string(value) != "s" {
+		t.Errorf("short = %q, %v before expiring", value, found)
+	}
+
+	time.Sleep(time.Until(time.Unix(0, soon)) + 10*time.Millisecond)
+	if _, found, _ := store.Get("short"); found || store.Exists("short") {
+		t.Error("short is still readable from the SSTable after expiring")
+	}
+
+	// A newer TTL for long lands in a second table
+	newer := later + int64(time.Hour)
+	store.SetWithExpiry("long", []byte("l"), newer)
+	flushTestStore(t, store)
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.NumSSTables() != 1 {
+		t.Fatalf("%d SSTables after compaction, want 1", store.NumSSTables())
+	}
+	sst := store.sstables[0]
+	if sst.ContainsKey("short") {
+		t.Error("compaction kept the expired key")
+	}
+	entry, found, err := sst.Lookup("long")
+	if err != nil || !found || entry.ExpiresAt != newer {
+		t.Errorf("compacted long = %+v, %v, %v; want expiry %d", entry, found, err, newer)
+	}
+	if entry, _, _ := sst.Lookup("plain"); entry == nil || entry.ExpiresAt != 0 {
+		t.Errorf("compacted plain = %+v, want no expiry", entry)
+	}
+}
+
+// pointIndexAt rewrites the index entry for key in the SSTable at path so
+// it leads to the entry of other instead
+func pointIndexAt(t *testing.T, path, key, other string) {
+	t.Helper()
+	file, footer := readTestFooter(t, path)
+	index, err := ReadIndex(file, footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(index))
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	position := footer.IndexStartOffset
+	for _, k := range keys {
+		if k == key {
+			patchUint64(t, path, position+4+int64(len(k)), uint64(index[other]))
+			return
+		}
+		position += indexEntryOverhead + int64(len(k))
+	}
+	t.Fatalf("%s has no index entry for %q", path, key)
+}
+
+// A memtable value that can't be decoded fails the reads that return it,
+// GET, iteration and flushing, instead of panicking; reads that only look
+// at whether the key is there still work
+func TestUndecodableValue(t *testing.T) {
+	store := openTestStore(t)
+	store.Set("good", []byte("g"))
+	store.Set("bad", []byte("b"))
+	store.memTable.mu.Lock()
+	for _, entry := range store.memTable.entries {
+		if entry.Key == "bad" {
+			entry.Value, entry.Codec = []byte("not deflate"), CodecFlate
+		}
+	}
+	store.memTable.mu.Unlock()
+
+	if value, found, err := store.Get("bad"); err == nil || !strings.Contains(err.Error(), "failed to decode value of bad") {
+		t.Errorf("Get(bad) = %q, %v, %v; want a decode error", value, found, err)
+	}
+	if value, found, err := store.Get("good"); err != nil || !found || string(value) != "g" {
+		t.Errorf("Get(good) = %q, %v, %v", value, found, err)
+	}
+	if !store.Exists("bad") {
+		t.Error("Exists(bad) = false")
+	}
+	if _, _, err := store.GetExpire("bad", time.Now().Add(time.Hour).UnixNano()); err == nil {
+		t.Error("GetExpire(bad) didn't fail")
+	}
+
+	it := store.NewIterator()
+	for it.Next() {
+		if it.Entry().Key == "bad" {
+			t.Errorf("iterator returned bad = %q", it.Entry().Value)
+		}
+	}
+	if err := it.Err(); err == nil || !strings.Contains(err.Error(), "failed to decode value of bad") {
+		t.Errorf("iterator Err = %v, want a decode error", err)
+	}
+	it.Close()
+
+	path := filepath.Join(t.TempDir(), "sstable.db")
+	if err := FlushMemTableToSSTable(store.memTable, path, SSTableOptions{}); err == nil {
+		t.Error("flushing the memtable didn't fail")
+	}
+
+	if _, _, err := store.GetDelete("bad"); err == nil {
+		t.Error("GetDelete(bad) didn't fail")
+	}
+}
+
+// A lookup whose index entry leads to the wrong key finds the right value
+// by scanning the table instead of falling through to an older one, and
+// the table is compacted so its index is rebuilt
+func TestReadRepairOnCorruptIndex(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSSTable("data/sstable-0.db", []*Entry{{Key: "a", Value: []byte("old"), Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSSTable("data/sstable-1.db", []*Entry{
+		{Key: "a", Value: []byte("new"), Timestamp: 2},
+		{Key: "b", Value: []byte("2"), Timestamp: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pointIndexAt(t, "data/sstable-1.db", "a", "b")
+
+	store, err := NewLSMStore(0, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.WAL.Close()
+	})
+
+	if value, found, _ := store.Get("a"); !found || string(value) != "new" {
+		t.Errorf("a = %q, %v through the corrupt index, want \"new\"", value, found)
+	}
+	if value, found, _ := store.Get("b"); !found || string(value) != "2" {
+		t.Errorf("b = %q, %v, want \"2\"", value, found)
+	}
+
+	// The repair scheduled a compaction that rewrites the index
+	deadline := time.Now().Add(5 * time.Second)
+	for store.NumSSTables() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := store.NumSSTables(); n != 1 {
+		t.Fatalf("%d SSTables after the repair, want them compacted into 1", n)
+	}
+	entry, found, err := store.sstables[0].Lookup("a")
+	if err != nil || !found || string(entry.Value) != "new" {
+		t.Errorf("compacted a = %+v, %v, %v; want \"new\" through the index", entry, found, err)
+	}
+}
+
+// Delete reports whether the key held a live value, wherever it is
+// stored: deleting it again, or a key that never existed or has expired,
+// reports false
+func TestDeleteReportsExistence(t *testing.T) {
+	store := openTestStore(t, []*Entry{
+		{Key: "flushed", Value: []byte("on disk"), Timestamp: 1},
+		{Key: "gone", Deleted: true, Timestamp: 1},
+		{Key: "stale", Value: []byte("x"), Timestamp: 1, ExpiresAt: 1},
+	})
+	store.Set("fresh", []byte("in memory"))
+
+	for _, c := range []struct {
+		key     string
+		existed bool
+	}{
+		{"fresh", true},
+		{"fresh", false},
+		{"flushed", true},
+		{"flushed", false},
+		{"gone", false},
+		{"stale", false},
+		{"never", false},
+	} {
+		existed, err := store.Delete(c.key)
+		if err != nil || existed != c.existed {
+			t.Errorf("Delete(%s) = %v, %v; want %v", c.key, existed, err, c.existed)
+		}
+	}
+}
+
+// Once no writes have come in for the idle interval the memtable is
+// flushed even though it isn't full, and an empty one isn't
+func TestIdleFlush(t *testing.T) {
+	store := openTestStore(t)
+	const interval = 100 * time.Millisecond
+	store.SetIdleFlush(interval)
+
+	start := time.Now()
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("2"))
+	if n := store.NumSSTables(); n != 0 {
+		t.Fatalf("%d SSTables right after the writes", n)
+	}
+
+	for store.NumSSTables() == 0 && time.Since(start) < 10*interval {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := store.NumSSTables(); n != 1 {
+		t.Fatalf("%d SSTables after being idle for %v, want 1", n, time.Since(start))
+	}
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("flushed %v after the last write, before the idle interval", elapsed)
+	}
+	if value, found, _ := store.Get("a"); !found || string(value) != "1" {
+		t.Errorf("a = %q, %v after the idle flush", value, found)
+	}
+
+	// Nothing written since, so nothing more to flush
+	time.Sleep(3 * interval)
+	if n := store.NumSSTables(); n != 1 {
+		t.Errorf("%d SSTables after idling with an empty memtable, want 1", n)
+	}
+}
+
+// With TombstoneFreeDeletes a key that never left the memtable is removed
+// outright, while one in an SSTable still gets a tombstone
+func TestTombstoneFreeDeletes(t *testing.T) {
+	store := openTestStore(t, []*Entry{{Key: "flushed", Value: []byte("1"), Timestamp: 1}})
+	store.TombstoneFreeDeletes = true
+
+	store.Set("fresh", []byte("2"))
+	store.Set("kept", []byte("3"))
+	for _, key := range []string{"fresh", "flushed"} {
+		if existed, err := store.Delete(key); err != nil || !existed {
+			t.Fatalf("Delete(%s) = %v, %v", key, existed, err)
+		}
+	}
+	flushTestStore(t, store)
+
+	sst := store.sstables[0]
+	if sst.ContainsKey("fresh") {
+		t.Error("the next SSTable holds a tombstone for a key that was never flushed")
+	}
+	if entry, found, _ := sst.Lookup("flushed"); !found || !entry.Deleted {
+		t.Errorf("flushed = %+v, want a tombstone over the older SSTable", entry)
+	}
+	for key, want := range map[string]bool{"fresh": false, "flushed": false, "kept": true} {
+		if store.Exists(key) != want {
+			t.Errorf("Exists(%s) = %v, want %v", key, !want, want)
+		}
+	}
+}
+
+// openSmallTestStore is openTestStore with a memtable of size bytes, so
+// writes rotate and flush it often
+func openSmallTestStore(tb testing.TB, size int64) *LSMStore {
+	tb.Helper()
+	tb.Chdir(tb.TempDir())
+	store, err := NewLSMStore(size, "data")
+	if err != nil {
+		tb.Fatalf("NewLSMStore: %v", err)
+	}
+	tb.Cleanup(func() {
+		store.Close()
+		store.WAL.Close()
+	})
+	return store
+}
+
+// Readers and writers running at once, through memtable rotations and
+// flushes, see no torn state and lose no write. Run with -race.
+func TestLSMStoreConcurrentReadWrite(t *testing.T) {
+	store := openSmallTestStore(t, 4<<10)
+	const writers, readers, perWriter = 4, 4, 300
+
+	var wg sync.WaitGroup
+	var done atomic.Bool
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; !done.Load(); i++ {
+				key := fmt.Sprintf("w%d:%d", i%writers, i%perWriter)
+				if value, found, _ := store.Get(key); found && string(value) != key {
+					t.Errorf("Get(%s) = %q", key, value)
+					return
+				}
+			}
+		}(r)
+	}
+
+	var writeWG sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writeWG.Add(1)
+		go func(w int) {
+			defer writeWG.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%d:%d", w, i)
+				if err := store.Set(key, []byte(key)); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%10 == 0 {
+					if _, err := store.Delete(fmt.Sprintf("w%d:%d", w, i/2)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	writeWG.Wait()
+	done.Store(true)
+	wg.Wait()
+
+	if store.NumSSTables() == 0 {
+		t.Error("the memtable never flushed; the test didn't exercise rotation")
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			key := fmt.Sprintf("w%d:%d", w, i)
+			// Step 2i deleted key i when it was a multiple of 10
+			wantFound := !(i%5 == 0 && 2*i < perWriter)
+			if _, found, _ := store.Get(key); found != wantFound {
+				t.Errorf("Get(%s) found = %v, want %v", key, found, wantFound)
+			}
+		}
+	}
+}
+
+func BenchmarkLSMStoreParallel(b *testing.B) {
+	store := openSmallTestStore(b, 1<<20)
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprintf("key:%d", i), []byte("value"))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := fmt.Sprintf("key:%d", i%1000)
+			// One write for every three reads
+			if i%4 == 0 {
+				store.Set(key, []byte("value"))
+			} else {
+				store.Get(key)
+			}
+		}
+	})
+}
+
+// The running key estimate stays close to the exact count under mixed
+// writes across flushes, and matches it again after a compaction
+func TestEstimatedKeyCount(t *testing.T) {
+	store := openSmallTestStore(t, 8<<10)
+	rng := rand.New(rand.NewSource(1))
+
+	check := func(step int) {
+		t.Helper()
+		exact, err := store.CountKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate := store.EstimatedKeyCount()
+		if diff := estimate - exact; diff < -exact/10 || diff > exact/10 {
+			t.Errorf("step %d: estimate %d, exact count %d", step, estimate, exact)
+		}
+	}
+
+	for i := 1; i <= 5000; i++ {
+		key := fmt.Sprintf("key:%d", rng.Intn(1000))
+		if rng.Intn(3) == 0 {
+			store.Delete(key)
+		} else {
+			store.Set(key, []byte("value"))
+		}
+		if i%500 == 0 {
+			check(i)
+		}
+	}
+
+	// A compaction the writes started may still be running, and may leave
+	// a single table that Compact wouldn't touch. Once it is done, flush
+	// the memtable so there is something to merge, then compact; Compact
+	// alone would return at once while one runs, before the estimate is
+	// updated.
+	waitForPipeline(t, store)
+	flushTestStore(t, store)
+	if err := store.CompactWait(); err != nil {
+		t.Fatal(err)
+	}
+	exact, _ := store.CountKeys()
+	if estimate := store.EstimatedKeyCount(); estimate != exact {
+		t.Errorf("after compaction: estimate %d, exact count %d", estimate, exact)
+	}
+}
+
+// CompactWait waits out a compaction already running instead of returning
+// at once as Compact does, then merges what is left
+func TestCompactWait(t *testing.T) {
+	store := openTestStore(t,
+		[]*Entry{{Key: "a", Value: []byte("1"), Timestamp: 1}},
+		[]*Entry{{Key: "b", Value: []byte("2"), Timestamp: 2}},
+	)
+	store.compacting.Store(true)
+	if err := store.Compact(); err != nil || store.NumSSTables() != 2 {
+		t.Fatalf("Compact during a compaction = %v with %d SSTables, want it to do nothing", err, store.NumSSTables())
+	}
+
+	compacted := make(chan error)
+	go func() { compacted <- store.CompactWait() }()
+	select {
+	case err := <-compacted:
+		t.Fatalf("CompactWait returned %v during a compaction", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	store.compacting.Store(false)
+	if err := <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	if n := store.NumSSTables(); n != 1 {
+		t.Errorf("%d SSTables after CompactWait, want 1", n)
+	}
+}
+
+// Compaction merges without holding the store lock, so GETs and SETs sent
+// while it runs are answered right away instead of waiting for it
+func TestGetDuringCompaction(t *testing.T) {
+	const perTable = 2000
+	var tables [][]*Entry
+	for table := 0; table < 3; table++ {
+		var entries []*Entry
+		for i := 0; i < perTable; i++ {
+			entries = append(entries, &Entry{Key: fmt.Sprintf("key:%d:%04d", table, i), Value: []byte("v"), Timestamp: 1})
+		}
+		tables = append(tables, entries)
+	}
+	store := openTestStore(t, tables...)
+
+	// Hold the compaction mid-merge, after it has picked its inputs
+	paused := make(chan struct{})
+	release := make(chan struct{})
+	resume := sync.OnceFunc(func() { close(release) })
+	defer resume()
+	var once sync.Once
+	store.CompactionHook = func(CompactionProgress) {
+		once.Do(func() {
+			close(paused)
+			<-release
+		})
+	}
+	compacted := make(chan error, 1)
+	go func() { compacted <- store.Compact() }()
+	<-paused
+
+	served := make(chan time.Duration, 1)
+	go func() {
+		var slowest time.Duration
+		for i := 0; i < 300; i++ {
+			start := time.Now()
+			key := fmt.Sprintf("key:%d:%04d", i%3, i)
+			if value, found, _ := store.Get(key); !found || string(value) != "v" {
+				t.Errorf("Get(%s) = %q, %v during compaction", key, value, found)
+			}
+			if err := store.Set(fmt.Sprintf("new:%d", i), []byte("n")); err != nil {
+				t.Error(err)
+			}
+			slowest = max(slowest, time.Since(start))
+		}
+		served <- slowest
+	}()
+	select {
+	case slowest := <-served:
+		if slowest > time.Second {
+			t.Errorf("slowest GET and SET took %v during compaction", slowest)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GET blocked behind a running compaction")
+	}
+
+	resume()
+	if err := <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key:0:0000", "key:2:1999", "new:299"} {
+		if _, found, _ := store.Get(key); !found {
+			t.Errorf("%s missing after compaction", key)
+		}
+	}
+}
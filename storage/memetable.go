@@ -1,10 +1,11 @@
 package storage
 
 import (
-	"fmt"
+	"slices"
 	"sort"
 	"sync"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -16,7 +17,20 @@ type Entry struct {
 	Key       string
 	Value     []byte
 	Timestamp int64
-	Deleted   bool // Tombstone for deletions
+	Deleted   bool  // Tombstone for deletions
+	ExpiresAt int64 // Unix nanoseconds, 0 means no expiry
+	Codec     byte  // how Value is encoded in the memtable, see CodecRaw
+}
+
+// entryPool recycles the entries of flushed memtables. A memtable's
+// entries are only reachable through it (Lookup and Snapshot hand out
+// copies, GetAllEntries is only used by the flush itself), so once the
+// store drops a flushed memtable they can be reused.
+var entryPool = sync.Pool{New: func() any { return new(Entry) }}
+
+// IsExpired reports whether the entry has a TTL that passed before now
+func (e *Entry) IsExpired(now int64) bool {
+	return e.ExpiresAt > 0 && e.ExpiresAt <= now
 }
 
 // MemTable represents an in-memory sorted buffer
@@ -27,6 +41,10 @@ type MemTable struct {
 	maxSize   int64
 	mu        sync.RWMutex
 	immutable bool
+
+	// compressThreshold is the value size at which Set stores values
+	// compressed, 0 to never compress
+	compressThreshold int
 }
 
 func NewMemTable(maxSize int64) *MemTable {
@@ -41,8 +59,31 @@ func NewMemTable(maxSize int64) *MemTable {
 	}
 }
 
-// Set adds or updates a key-value pair
+// entryOverhead is what an entry takes beyond its key and value bytes:
+// the Entry struct and its pointer in the sorted entries slice. Allocator
+// rounding and spare slice capacity aren't counted.
+const entryOverhead = int64(unsafe.Sizeof(Entry{}) + unsafe.Sizeof((*Entry)(nil)))
+
+// entrySize is the accounted size of one entry. Every path that adds, changes
+// or removes an entry adjusts sizeBytes by the difference of these values.
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key)+len(value)) + entryOverhead
+}
+
+// Set adds or updates a key-value pair, clearing any previous expiry
 func (mt *MemTable) Set(key string, value []byte) error {
+	return mt.SetWithExpiry(key, value, 0)
+}
+
+// SetWithExpiry adds or updates a key-value pair that expires at expiresAt
+// (Unix nanoseconds, 0 for no expiry)
+func (mt *MemTable) SetWithExpiry(key string, value []byte, expiresAt int64) error {
+	return mt.SetAt(key, value, expiresAt, time.Now().UnixNano())
+}
+
+// SetAt is SetWithExpiry with an explicit write timestamp, used when
+// replaying a logged write so it keeps its original time
+func (mt *MemTable) SetAt(key string, value []byte, expiresAt int64, timestamp int64) error {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 
@@ -50,83 +91,191 @@ func (mt *MemTable) Set(key string, value []byte) error {
 		return ErrMemTableImmutable
 	}
 
+	value, codec := mt.encodeValue(value)
+
 	// Find position using binary search
 	idx := sort.Search(len(mt.entries), func(i int) bool {
 		return mt.entries[i].Key >= key
 	})
 
-	// Calculate entry size
-	entrySize := int64(len(key) + len(value) + 24) // 24 bytes for metadata
-
-	// Key already exists - update it
+	// Key already exists - update it (possibly reviving a tombstone)
 	if idx < len(mt.entries) && mt.entries[idx].Key == key {
-		oldSize := int64(len(mt.entries[idx].Value))
+		oldSize := entrySize(key, mt.entries[idx].Value)
 		mt.entries[idx].Value = value
-		mt.entries[idx].Timestamp = time.Now().UnixNano()
+		mt.entries[idx].Timestamp = timestamp
 		mt.entries[idx].Deleted = false
-		mt.sizeBytes = mt.sizeBytes - oldSize + int64(len(value))
+		mt.entries[idx].ExpiresAt = expiresAt
+		mt.entries[idx].Codec = codec
+		mt.sizeBytes += entrySize(key, value) - oldSize
 		return nil
 	}
 
 	// Insert new entry at correct position
-	entry := &Entry{
+	entry := entryPool.Get().(*Entry)
+	*entry = Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: timestamp,
 		Deleted:   false,
+		ExpiresAt: expiresAt,
+		Codec:     codec,
 	}
 
 	// Insert at idx to keep sorted order
 	mt.entries = append(mt.entries, nil)
 	copy(mt.entries[idx+1:], mt.entries[idx:])
 	mt.entries[idx] = entry
-	mt.sizeBytes += entrySize
+	mt.sizeBytes += entrySize(key, value)
 
 	return nil
 }
 
-// Delete marks a key as deleted (tombstone)
-func (mt *MemTable) Delete(key string) error {
+// encodeValue returns value as the memtable stores it, compressed if it
+// is at least compressThreshold bytes and that helps, and its codec.
+// Caller must hold mt.mu.
+func (mt *MemTable) encodeValue(value []byte) ([]byte, byte) {
+	if mt.compressThreshold > 0 && len(value) >= mt.compressThreshold {
+		if compressed, ok := compressValue(value); ok {
+			return compressed, CodecFlate
+		}
+	}
+	return value, CodecRaw
+}
+
+// SetExpiry changes when key expires (Unix nanoseconds, 0 for never),
+// keeping its value, and returns the updated entry. below is the newest
+// entry for key in the layers under the memtable, nil if none; it is
+// copied in if the memtable doesn't hold the key. If the key holds no
+// live value, nothing changes and found is false.
+func (mt *MemTable) SetExpiry(key string, expiresAt int64, below *Entry) (Entry, bool, error) {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 
 	if mt.immutable {
-		return ErrMemTableImmutable
+		return Entry{}, false, ErrMemTableImmutable
 	}
 
-	// Find position
+	now := time.Now().UnixNano()
 	idx := sort.Search(len(mt.entries), func(i int) bool {
 		return mt.entries[i].Key >= key
 	})
 
-	entrySize := int64(len(key) + 24) // No value, just metadata
+	if idx < len(mt.entries) && mt.entries[idx].Key == key {
+		entry := mt.entries[idx]
+		if entry.Deleted || entry.IsExpired(now) {
+			return Entry{}, false, nil
+		}
+		entry.ExpiresAt = expiresAt
+		entry.Timestamp = now
+		return *entry, true, nil
+	}
+
+	if below == nil || below.Deleted || below.IsExpired(now) {
+		return Entry{}, false, nil
+	}
+
+	// A value from the immutable memtable may still be encoded
+	value, codec := below.Value, below.Codec
+	if codec == CodecRaw {
+		value, codec = mt.encodeValue(below.Value)
+	}
+	entry := entryPool.Get().(*Entry)
+	*entry = Entry{
+		Key:       key,
+		Value:     value,
+		Timestamp: now,
+		ExpiresAt: expiresAt,
+		Codec:     codec,
+	}
+
+	mt.entries = append(mt.entries, nil)
+	copy(mt.entries[idx+1:], mt.entries[idx:])
+	mt.entries[idx] = entry
+	mt.sizeBytes += entrySize(key, value)
+
+	return *entry, true, nil
+}
+
+// Delete marks a key as deleted (tombstone). It returns the entry the
+// memtable held for key beforehand and whether there was one.
+func (mt *MemTable) Delete(key string) (Entry, bool, error) {
+	return mt.DeleteAt(key, time.Now().UnixNano())
+}
 
-	// Key exists - mark as deleted
+// DeleteAt is Delete with an explicit write timestamp
+func (mt *MemTable) DeleteAt(key string, timestamp int64) (Entry, bool, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.immutable {
+		return Entry{}, false, ErrMemTableImmutable
+	}
+
+	// Find position
+	idx := sort.Search(len(mt.entries), func(i int) bool {
+		return mt.entries[i].Key >= key
+	})
+
+	// Key exists - mark as deleted and drop the value it no longer needs
 	if idx < len(mt.entries) && mt.entries[idx].Key == key {
+		prev := *mt.entries[idx]
+		mt.sizeBytes += entrySize(key, nil) - entrySize(key, mt.entries[idx].Value)
+		mt.entries[idx].Value = nil
 		mt.entries[idx].Deleted = true
-		mt.entries[idx].Timestamp = time.Now().UnixNano()
-		return nil
+		mt.entries[idx].Timestamp = timestamp
+		mt.entries[idx].ExpiresAt = 0
+		mt.entries[idx].Codec = CodecRaw
+		return prev, true, nil
 	}
 
 	// Key doesn't exist - still insert tombstone
-	entry := &Entry{
+	entry := entryPool.Get().(*Entry)
+	*entry = Entry{
 		Key:       key,
 		Value:     nil,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: timestamp,
 		Deleted:   true,
 	}
 
 	mt.entries = append(mt.entries, nil)
 	copy(mt.entries[idx+1:], mt.entries[idx:])
 	mt.entries[idx] = entry
-	mt.sizeBytes += entrySize
+	mt.sizeBytes += entrySize(key, nil)
 
-	return nil
+	return Entry{}, false, nil
+}
+
+// Remove drops a key's entry outright, without leaving a tombstone.
+// Only safe when no older layer (immutable memtable, SSTable) holds the key.
+// Like Delete, it returns the entry it dropped and whether there was one.
+func (mt *MemTable) Remove(key string) (Entry, bool, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.immutable {
+		return Entry{}, false, ErrMemTableImmutable
+	}
+
+	idx := sort.Search(len(mt.entries), func(i int) bool {
+		return mt.entries[i].Key >= key
+	})
+
+	if idx < len(mt.entries) && mt.entries[idx].Key == key {
+		removed := mt.entries[idx]
+		prev := *removed
+		mt.sizeBytes -= entrySize(key, removed.Value)
+		mt.entries = slices.Delete(mt.entries, idx, idx+1) // zeroes the freed slot
+
+		*removed = Entry{}
+		entryPool.Put(removed)
+		return prev, true, nil
+	}
+
+	return Entry{}, false, nil
 }
 
-// Get retrieves a value by key
-func (mt *MemTable) Get(key string) ([]byte, bool) {
-	fmt.Println("Getting key from MemTable:", key)
+// Get retrieves a value by key, failing if it can't be decoded
+func (mt *MemTable) Get(key string) ([]byte, bool, error) {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
 
@@ -136,10 +285,34 @@ func (mt *MemTable) Get(key string) ([]byte, bool) {
 	})
 
 	if idx < len(mt.entries) && mt.entries[idx].Key == key {
-		if mt.entries[idx].Deleted {
-			return nil, false
+		if mt.entries[idx].Deleted || mt.entries[idx].IsExpired(time.Now().UnixNano()) {
+			return nil, false, nil
 		}
-		return mt.entries[idx].Value, true
+		value, err := rawValue(mt.entries[idx])
+		if err != nil {
+			return nil, false, err
+		}
+		return value, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// Lookup returns a copy of the entry stored for key, including tombstones
+// and expired entries, so callers can tell "deleted here" from "not here".
+// The value is left in its codec; most callers only look at the rest, and
+// the ones that return it decode it (see rawValue).
+func (mt *MemTable) Lookup(key string) (*Entry, bool) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	idx := sort.Search(len(mt.entries), func(i int) bool {
+		return mt.entries[i].Key >= key
+	})
+
+	if idx < len(mt.entries) && mt.entries[idx].Key == key {
+		entry := *mt.entries[idx]
+		return &entry, true
 	}
 
 	return nil, false
@@ -159,17 +332,76 @@ func (mt *MemTable) MakeImmutable() {
 	mt.immutable = true
 }
 
-// GetAllEntries returns all entries in sorted order
-func (mt *MemTable) GetAllEntries() []*Entry {
+// GetAllEntries returns all entries in sorted order, with raw values
+func (mt *MemTable) GetAllEntries() ([]*Entry, error) {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
 
 	// Already sorted!
 	result := make([]*Entry, len(mt.entries))
-	copy(result, mt.entries)
+	for i, entry := range mt.entries {
+		if entry.Codec == CodecRaw {
+			result[i] = entry
+			continue
+		}
+		decoded, err := decodedCopy(entry)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = decoded
+	}
+	return result, nil
+}
+
+// Snapshot returns copies of all entries in sorted order, safe to read
+// while the memtable keeps changing. Values are left in their codec, to be
+// decoded as they are read.
+func (mt *MemTable) Snapshot() []*Entry {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	result := make([]*Entry, len(mt.entries))
+	for i, entry := range mt.entries {
+		entryCopy := *entry
+		result[i] = &entryCopy
+	}
 	return result
 }
 
+// SetCompressThreshold makes Set compress values of at least threshold
+// bytes; 0 turns compression off. Values already stored are left as is.
+func (mt *MemTable) SetCompressThreshold(threshold int) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.compressThreshold = threshold
+}
+
+// release hands the memtable's entries back to entryPool and empties it.
+// The memtable must be unreachable, and entries from GetAllEntries must
+// no longer be in use.
+func (mt *MemTable) release() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	for i, entry := range mt.entries {
+		// Clear it so a reused entry carries nothing over, and so the
+		// pool doesn't keep the value alive
+		*entry = Entry{}
+		entryPool.Put(entry)
+		mt.entries[i] = nil
+	}
+	mt.entries = nil
+	mt.sizeBytes = 0
+}
+
+// SetMaxSize changes the size at which ShouldFlush reports the memtable
+// full
+func (mt *MemTable) SetMaxSize(maxSize int64) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.maxSize = maxSize
+}
+
 // Size returns the approximate size in bytes
 func (mt *MemTable) Size() int64 {
 	mt.mu.RLock()
@@ -190,16 +422,3 @@ func (mt *MemTable) IsImmutable() bool {
 	defer mt.mu.RUnlock()
 	return mt.immutable
 }
-
-// Errors
-var (
-	ErrMemTableImmutable = &StorageError{Message: "memtable is immutable"}
-)
-
-type StorageError struct {
-	Message string
-}
-
-func (e *StorageError) Error() string {
-	return e.Message
-}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+// recomputedSize adds up the accounted size of every entry from scratch
+func recomputedSize(mt *MemTable) int64 {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	var size int64
+	for _, entry := range mt.entries {
+		size += entrySize(entry.Key, entry.Value)
+	}
+	return size
+}
+
+// Thousands of mixed writes leave Size() equal to the sum of the entries
+// it holds, whichever path each write took
+func TestMemTableSizeAccounting(t *testing.T) {
+	mt := NewMemTable(1 << 30)
+	mt.SetCompressThreshold(64)
+	rng := rand.New(rand.NewSource(1))
+	model := make(map[string][]byte)
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key:%d", rng.Intn(200))
+		switch op := rng.Intn(10); {
+		case op < 5:
+			// Short values, and long compressible ones stored compressed
+			value := bytes.Repeat([]byte{byte('a' + rng.Intn(26))}, rng.Intn(200))
+			if err := mt.Set(key, value); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		case op < 8:
+			if _, _, err := mt.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, key)
+		case op < 9:
+			if _, _, err := mt.Remove(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, key)
+		default:
+			// A key the memtable doesn't hold is copied in from below
+			below := &Entry{Key: key, Value: bytes.Repeat([]byte("b"), 100)}
+			_, held := mt.Lookup(key)
+			if _, _, err := mt.SetExpiry(key, 1<<62, below); err != nil {
+				t.Fatal(err)
+			}
+			if !held {
+				model[key] = below.Value
+			}
+		}
+
+		if got, want := mt.Size(), recomputedSize(mt); got != want {
+			t.Fatalf("after %d ops Size() = %d, recomputed %d", i+1, got, want)
+		}
+	}
+
+	for key, want := range model {
+		if got, found, _ := mt.Get(key); !found || !bytes.Equal(got, want) {
+			t.Errorf("Get(%s) = %d bytes, %v; want %d bytes", key, len(got), found, len(want))
+		}
+	}
+	if mt.Size() < 0 {
+		t.Errorf("Size() went negative: %d", mt.Size())
+	}
+}
+
+// Above the threshold a compressible value is held compressed, taking
+// less of the memtable's size, and reads back byte for byte
+func TestMemTableCompressesLargeValues(t *testing.T) {
+	value := bytes.Repeat([]byte("a fairly compressible line of text\n"), 30000) // about 1MB
+
+	plain := NewMemTable(1 << 30)
+	plain.Set("big", value)
+
+	compressed := NewMemTable(1 << 30)
+	compressed.SetCompressThreshold(4096)
+	compressed.Set("big", value)
+	compressed.Set("small", []byte("under the threshold"))
+
+	if compressed.Size() >= plain.Size()/10 {
+		t.Errorf("compressed memtable size %d, uncompressed %d", compressed.Size(), plain.Size())
+	}
+	got, found, _ := compressed.Get("big")
+	if !found || !bytes.Equal(got, value) {
+		t.Errorf("Get(big) returned %d bytes, want the %d written", len(got), len(value))
+	}
+	if entry, _ := compressed.Lookup("small"); entry == nil || entry.Codec != CodecRaw {
+		t.Errorf("small = %+v, want it stored as is", entry)
+	}
+
+	// A flushed table holds the value as written
+	path := filepath.Join(t.TempDir(), "sstable-0.db")
+	if err := FlushMemTableToSSTable(compressed, path, SSTableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sst, err := OpenSSTable(path, NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	got, found, err = sst.Get("big")
+	if err != nil || !found || !bytes.Equal(got, value) {
+		t.Errorf("flushed big = %d bytes, %v, %v", len(got), found, err)
+	}
+}
+
+// A compressed entry looked up from one memtable, as GETEX does with the
+// immutable one, is taken over by another as it is, not compressed twice
+func TestMemTableSetExpiryKeepsEncodedValue(t *testing.T) {
+	value := bytes.Repeat([]byte("a fairly compressible line of text\n"), 300)
+	older := NewMemTable(1 << 30)
+	older.SetCompressThreshold(1024)
+	older.Set("k", value)
+	below, _ := older.Lookup("k")
+	if below.Codec != CodecFlate {
+		t.Fatalf("k is stored with codec %d, want it compressed", below.Codec)
+	}
+
+	newer := NewMemTable(1 << 30)
+	newer.SetCompressThreshold(1024)
+	entry, found, err := newer.SetExpiry("k", 1<<62, below)
+	if err != nil || !found || entry.Codec != CodecFlate || len(entry.Value) != len(below.Value) {
+		t.Fatalf("SetExpiry = %+v, %v, %v; want the compressed value kept", entry, found, err)
+	}
+	got, found, err := newer.Get("k")
+	if err != nil || !found || !bytes.Equal(got, value) {
+		t.Errorf("Get(k) = %d bytes, %v, %v; want the %d written", len(got), found, err, len(value))
+	}
+}
+
+// Entries handed back to the pool carry nothing over: released and
+// removed entries are zeroed, and new entries built from pooled ones have
+// no stale value, tombstone or expiry
+func TestPooledEntriesAreReset(t *testing.T) {
+	old := NewMemTable(DefaultMemTableSize)
+	old.SetWithExpiry("a", []byte("value a"), 1<<62)
+	old.Set("b", []byte("value b"))
+	old.Delete("c")
+	old.Set("d", []byte("value d"))
+	pooled := slices.Clone(old.entries)
+
+	old.Remove("d")
+	old.release()
+	for _, entry := range pooled {
+		if entry.Key != "" || entry.Value != nil || entry.Timestamp != 0 || entry.Deleted || entry.ExpiresAt != 0 || entry.Codec != 0 {
+			t.Errorf("pooled entry still holds %+v", *entry)
+		}
+	}
+
+	// Enough new entries that the pooled ones are likely reused
+	mt := NewMemTable(DefaultMemTableSize)
+	for i := 0; i < 100; i++ {
+		key := "key:" + strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			mt.Set(key, []byte("v"))
+		case 1:
+			mt.Delete(key)
+		case 2:
+			mt.SetExpiry(key, 0, &Entry{Key: key, Value: []byte("below")})
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := "key:" + strconv.Itoa(i)
+		entry, found := mt.Lookup(key)
+		want := Entry{Key: key, Value: []byte("v"), Timestamp: entry.Timestamp}
+		switch i % 3 {
+		case 1:
+			want.Value, want.Deleted = nil, true
+		case 2:
+			want.Value = []byte("below")
+		}
+		if !found || entry.Key != want.Key || !bytes.Equal(entry.Value, want.Value) ||
+			entry.Deleted != want.Deleted || entry.ExpiresAt != 0 || entry.Codec != CodecRaw {
+			t.Errorf("%s = %+v, %v; want %+v", key, entry, found, want)
+		}
+	}
+}
+
+// BenchmarkMemTableWrites fills and flushes memtables the way the store
+// does, so entries are recycled through the pool; see allocs/op
+func BenchmarkMemTableWrites(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	value := []byte("value")
+	b.ReportAllocs()
+
+	mt := NewMemTable(DefaultMemTableSize)
+	for i := 0; i < b.N; i++ {
+		n := i % len(keys)
+		if n == 0 && i > 0 {
+			mt.release()
+			mt = NewMemTable(DefaultMemTableSize)
+		}
+		if i%4 == 3 {
+			mt.Delete(keys[n])
+		} else {
+			mt.Set(keys[n], value)
+		}
+	}
+}
+
+// Size estimates the memory the entries hold: filling a memtable grows
+// the heap by about what Size reports
+func TestMemTableSizeMatchesHeap(t *testing.T) {
+	if want := int64(unsafe.Sizeof(Entry{}) + unsafe.Sizeof((*Entry)(nil))); entryOverhead != want {
+		t.Errorf("entryOverhead = %d, want %d for the struct and its slice pointer", entryOverhead, want)
+	}
+
+	// Two collections empty the entry pool, so every entry below is a
+	// new allocation
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// Keys and values are built here so the heap only keeps what the
+	// memtable does
+	mt := NewMemTable(1 << 30)
+	for i := 0; i < 20000; i++ {
+		mt.Set(fmt.Sprintf("key:%011d", i), bytes.Repeat([]byte{'v'}, 96))
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(mt)
+
+	grown := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	if size := mt.Size(); size < grown*3/4 || size > grown*5/4 {
+		t.Errorf("Size = %d after the heap grew by %d, want within 25%%", size, grown)
+	}
+}
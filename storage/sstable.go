@@ -4,112 +4,48 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 const (
 	MagicNumber = 0xBABECAFE
-	Version     = 1
-)
-
-type IndexEntry struct {
-	Key    string
-	Offset int64
-}
+	Version     = 2
 
-func WriteKey(file *os.File, key string) (int64, error) {
-	var bytesWritten int64 = 0
+	// VersionV1 files have no ExpiresAt in the entry metadata
+	VersionV1 = 1
 
-	keyLength := uint32(len(key))
-	err := binary.Write(file, binary.LittleEndian, keyLength)
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write key length: %v", err)
-	}
-	bytesWritten += 4
-
-	// Write KeyBytes
-	n, err := file.Write([]byte(key))
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write key bytes: %v", err)
-	}
-	bytesWritten += int64(n)
+	// VersionDict files have the Version entry layout, but every value
+	// that isn't a tombstone is compressed against a dictionary stored
+	// between the entries and the index, followed by its uint32 length
+	VersionDict = 3
+)
 
-	return bytesWritten, nil
+// supportedVersion reports whether this code can read files of version.
+// Newer versions are refused rather than misread.
+func supportedVersion(version uint32) bool {
+	return version >= VersionV1 && version <= VersionDict
 }
 
-func WriteValue(file *os.File, value []byte) (int64, error) {
-	var bytesWritten int64 = 0
-
-	valueLength := uint32(len(value))
-	err := binary.Write(file, binary.LittleEndian, valueLength)
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write value length: %v", err)
-	}
-	bytesWritten += 4
-
-	// Write ValueBytes
-	n, err := file.Write(value)
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write value bytes: %v", err)
-	}
-	bytesWritten += int64(n)
-
-	return bytesWritten, nil
+// entryHasExpiry reports whether entries of version carry ExpiresAt
+func entryHasExpiry(version uint32) bool {
+	return version >= Version
 }
 
-func WriteMetadata(file *os.File, timestamp int64, isDeleted bool) (int64, error) {
-
-	var bytesWritten int64 = 0
-
-	err := binary.Write(file, binary.LittleEndian, timestamp)
-
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write timestamp: %v", err)
-	}
-	bytesWritten += 8
-
-	var deletedByte byte = 0
-
-	if isDeleted {
-		deletedByte = 1
-	}
-
-	err = binary.Write(file, binary.LittleEndian, deletedByte)
-
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write deleted byte: %v", err)
-	}
-	bytesWritten += 1
-
-	return bytesWritten, nil
+// SSTableOptions control how new SSTables are written
+type SSTableOptions struct {
+	// Dictionary compresses values against a dictionary sampled from the
+	// table's own values and stored in the file
+	Dictionary bool
 }
 
-func WriteEntry(file *os.File, key string, value []byte, timestamp int64, isDeleted bool) (int64, error) {
-
-	var bytesWritten int64 = 0
-
-	n, err := WriteKey(file, key)
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write key: %v", err)
-	}
-	bytesWritten += n
-
-	n, err = WriteValue(file, value)
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write value: %v", err)
-	}
-	bytesWritten += n
-
-	n, err = WriteMetadata(file, timestamp, isDeleted)
-	if err != nil {
-		return bytesWritten, fmt.Errorf("failed to write metadata: %v", err)
-	}
-	bytesWritten += n
-
-	return bytesWritten, nil
+type IndexEntry struct {
+	Key    string
+	Offset int64
 }
 
+// WriteEntries writes entries in the layout of version
 // Returns: indexEntries, indexBytesWritten, error
-func WriteEntries(file *os.File, entries []*Entry) ([]IndexEntry, int64, error) {
+func WriteEntries(file *os.File, entries []*Entry, version uint32) ([]IndexEntry, int64, error) {
 
 	var currentOffset int64 = 0
 
@@ -117,9 +53,9 @@ func WriteEntries(file *os.File, entries []*Entry) ([]IndexEntry, int64, error)
 
 	for _, entry := range entries {
 
-		bytesWritten, err := WriteEntry(file, entry.Key, entry.Value, entry.Timestamp, entry.Deleted)
+		bytesWritten, err := EncodeEntry(file, entry, version)
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to write entry: %v", err)
+			return nil, 0, err
 		}
 
 		indexEntries = append(indexEntries, IndexEntry{
@@ -175,7 +111,7 @@ func WriteIndex(file *os.File, indexEntries []IndexEntry) (int64, int64, error)
 	return indexStartOffset, bytesWritten, nil
 }
 
-func WriteFooter(file *os.File, indexStartOffset int64, numberOfEntries int64) (int64, error) {
+func WriteFooter(file *os.File, indexStartOffset int64, numberOfEntries int64, version uint32) (int64, error) {
 
 	var bytesWritten int64 = 0
 
@@ -191,7 +127,7 @@ func WriteFooter(file *os.File, indexStartOffset int64, numberOfEntries int64) (
 	}
 	bytesWritten += 8
 
-	err = binary.Write(file, binary.LittleEndian, uint32(Version))
+	err = binary.Write(file, binary.LittleEndian, version)
 	if err != nil {
 		return bytesWritten, fmt.Errorf("failed to write version: %v", err)
 	}
@@ -207,7 +143,54 @@ func WriteFooter(file *os.File, indexStartOffset int64, numberOfEntries int64) (
 
 }
 
+// CreateSSTable writes entries to a temp file and renames it into place,
+// so a crash never leaves a half-written file under an SSTable name. The
+// file and then the directory are synced, making the new name durable.
 func CreateSSTable(path string, entries []*Entry) error {
+	return CreateSSTableWithOptions(path, entries, SSTableOptions{})
+}
+
+// CreateSSTableWithOptions is CreateSSTable with control over the format
+func CreateSSTableWithOptions(path string, entries []*Entry, opts SSTableOptions) error {
+
+	tmpPath := path + ".tmp"
+
+	err := writeSSTableFile(tmpPath, entries, opts)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename sstable: %v", err)
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+func writeSSTableFile(path string, entries []*Entry, opts SSTableOptions) error {
+
+	uniqueKeys := countUniqueKeys(entries)
+	entries, err := dedupEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	version := uint32(Version)
+	var dict []byte
+	if opts.Dictionary {
+		dict = trainDictionary(entries)
+	}
+	if dict != nil {
+		compressed, err := compressEntries(entries, dict)
+		if err != nil {
+			return fmt.Errorf("failed to compress entries: %v", err)
+		}
+		entries = compressed
+		version = VersionDict
+	}
 
 	file, err := os.Create(path)
 
@@ -216,17 +199,29 @@ func CreateSSTable(path string, entries []*Entry) error {
 	}
 	defer file.Close()
 
-	indexEntries, _, err := WriteEntries(file, entries)
+	indexEntries, _, err := WriteEntries(file, entries, version)
 	if err != nil {
 		return fmt.Errorf("failed to write entries: %v", err)
 	}
+	// The footer counts what was written and readers index it by key, so
+	// the two only agree if exactly one entry per key made it out
+	if len(indexEntries) != uniqueKeys {
+		return fmt.Errorf("%w: index has %d entries for %d distinct keys", ErrIndexCorruption, len(indexEntries), uniqueKeys)
+	}
+
+	if version == VersionDict {
+		err = writeDictionary(file, dict)
+		if err != nil {
+			return fmt.Errorf("failed to write dictionary: %v", err)
+		}
+	}
 
 	indexStartOffset, _, err := WriteIndex(file, indexEntries)
 	if err != nil {
 		return fmt.Errorf("failed to write index: %v", err)
 	}
 
-	_, err = WriteFooter(file, indexStartOffset, int64(len(entries)))
+	_, err = WriteFooter(file, indexStartOffset, int64(len(entries)), version)
 	if err != nil {
 		return fmt.Errorf("failed to write footer: %v", err)
 	}
@@ -239,9 +234,107 @@ func CreateSSTable(path string, entries []*Entry) error {
 	return nil
 }
 
-func FlushMemTableToSSTable(memTable *MemTable, path string) error {
+// dedupEntries collapses runs of entries with the same key into the
+// newest of them. The index maps a key to one offset, so a duplicate would
+// be counted in the footer but unreachable. Entries must be in key order;
+// anything else is an error, since a duplicate could then go unnoticed.
+func dedupEntries(entries []*Entry) ([]*Entry, error) {
+	duplicates := 0
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Key < entries[i-1].Key {
+			return nil, fmt.Errorf("sstable entries out of order: %q after %q", entries[i].Key, entries[i-1].Key)
+		}
+		if entries[i].Key == entries[i-1].Key {
+			duplicates++
+		}
+	}
+	if duplicates == 0 {
+		return entries, nil
+	}
 
-	entries := memTable.GetAllEntries()
+	fmt.Printf("Dropping %d duplicate keys while writing sstable\n", duplicates)
+	deduped := make([]*Entry, 0, len(entries)-duplicates)
+	for _, entry := range entries {
+		last := len(deduped) - 1
+		if last >= 0 && deduped[last].Key == entry.Key {
+			deduped[last] = mergeEntries(deduped[last], entry)
+			continue
+		}
+		deduped = append(deduped, entry)
+	}
+	return deduped, nil
+}
+
+// countUniqueKeys counts the distinct keys in entries, which are in key
+// order (dedupEntries rejects them otherwise)
+func countUniqueKeys(entries []*Entry) int {
+	unique := 0
+	for i, entry := range entries {
+		if i == 0 || entry.Key != entries[i-1].Key {
+			unique++
+		}
+	}
+	return unique
+}
+
+// compressEntries returns copies of entries with every value that isn't a
+// tombstone compressed against dict
+func compressEntries(entries []*Entry, dict []byte) ([]*Entry, error) {
+	compressor, err := newDictCompressor(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := make([]*Entry, len(entries))
+	for i, entry := range entries {
+		entryCopy := *entry
+		if !entry.Deleted {
+			entryCopy.Value, err = compressor.compress(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		compressed[i] = &entryCopy
+	}
+	return compressed, nil
+}
+
+// writeDictionary writes dict followed by its length, so a reader can
+// find it by stepping back from the index
+func writeDictionary(file *os.File, dict []byte) error {
+	_, err := file.Write(dict)
+	if err != nil {
+		return err
+	}
+	return binary.Write(file, binary.LittleEndian, uint32(len(dict)))
+}
+
+// syncDirFile syncs an opened directory; tests replace it to see which
+// directories are synced, and when
+var syncDirFile = (*os.File).Sync
+
+// SyncDir fsyncs a directory so files created, renamed or removed in it
+// survive a crash. Syncing a file only covers its contents, not its name.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer d.Close()
+
+	err = syncDirFile(d)
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
+
+func FlushMemTableToSSTable(memTable *MemTable, path string, opts SSTableOptions) error {
+
+	entries, err := memTable.GetAllEntries()
+	if err != nil {
+		return err
+	}
 
 	if len(entries) == 0 {
 		return fmt.Errorf("memtable is empty nothing to flush")
@@ -249,5 +342,5 @@ func FlushMemTableToSSTable(memTable *MemTable, path string) error {
 
 	// memTable.MakeImmutable()
 
-	return CreateSSTable(path, entries)
+	return CreateSSTableWithOptions(path, entries, opts)
 }
@@ -5,6 +5,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// footerSize is the size of SSTableFooter on disk
+	footerSize = 20
+
+	// indexEntryOverhead is what an index entry takes besides its key:
+	// the key length and the offset
+	indexEntryOverhead = 4 + 8
 )
 
 type SSTableFooter struct {
@@ -16,9 +27,27 @@ type SSTableFooter struct {
 
 type SSTable struct {
 	filePath string
-	file     *os.File
+	files    *FilePool        // the file is opened on demand through the pool
 	index    map[string]int64 // key → offset mapping
 	footer   *SSTableFooter
+
+	// indexCorrupt is set once the index was found pointing at the wrong
+	// entry; compaction then reads the table with a scan and rewrites it
+	indexCorrupt atomic.Bool
+
+	// dict is the shared compression dictionary of a VersionDict table,
+	// loaded once when the table is opened; nil for other versions
+	dict []byte
+
+	// dataEnd is where the entries stop: the dictionary, or else the index
+	dataEnd int64
+
+	// minKey and maxKey bound the keys in the index, found once on open
+	minKey, maxKey string
+
+	// bloom is built from the index on open and rules out most keys the
+	// table doesn't hold before the index is looked at
+	bloom *bloomFilter
 }
 
 func ReadFooter(file *os.File) (*SSTableFooter, error) {
@@ -28,10 +57,9 @@ func ReadFooter(file *os.File) (*SSTableFooter, error) {
 		return nil, err
 	}
 	fileSize := info.Size()
-	footerSize := int64(20)
 
 	if fileSize < footerSize {
-		return nil, fmt.Errorf("file is too small to contain a footer")
+		return nil, fmt.Errorf("%w: file is too small to contain a footer", ErrSSTableCorrupt)
 	}
 
 	footerOffset := fileSize - footerSize
@@ -63,15 +91,34 @@ func ReadFooter(file *os.File) (*SSTableFooter, error) {
 	}
 
 	if footer.MagicNumber != MagicNumber {
-		return nil, fmt.Errorf("invalid magic number: %v", footer.MagicNumber)
+		return nil, fmt.Errorf("%w: invalid magic number: %v", ErrSSTableCorrupt, footer.MagicNumber)
+	}
+
+	if !supportedVersion(footer.Version) {
+		return nil, fmt.Errorf("%w %d (versions %d to %d can be read); it may have been written by a newer server",
+			ErrUnsupportedVersion, footer.Version, VersionV1, VersionDict)
 	}
 
 	return footer, nil
 }
 
 func ReadIndex(file *os.File, footer *SSTableFooter) (map[string]int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// The index runs from its start to the footer. Every length read from
+	// it is checked against what is left before anything is allocated.
+	remaining := info.Size() - footerSize - footer.IndexStartOffset
+	if footer.IndexStartOffset < 0 || remaining < 0 {
+		return nil, fmt.Errorf("%w: index offset %d is outside the file", ErrIndexCorruption, footer.IndexStartOffset)
+	}
+	if int64(footer.NumberOfEntries)*indexEntryOverhead > remaining {
+		return nil, fmt.Errorf("%w: %d entries don't fit in an index of %d bytes", ErrIndexCorruption, footer.NumberOfEntries, remaining)
+	}
 
-	_, err := file.Seek(footer.IndexStartOffset, io.SeekStart)
+	_, err = file.Seek(footer.IndexStartOffset, io.SeekStart)
 	if err != nil {
 		return nil, fmt.Errorf("failed to seek to index: %v", err)
 	}
@@ -82,19 +129,25 @@ func ReadIndex(file *os.File, footer *SSTableFooter) (map[string]int64, error) {
 		var keyLength uint32
 		err = binary.Read(file, binary.LittleEndian, &keyLength)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read key length: %v", err)
+			return nil, readError("key length", err)
+		}
+
+		remaining -= indexEntryOverhead
+		if int64(keyLength) > remaining {
+			return nil, fmt.Errorf("%w: key length %d runs past the end of the index (%d bytes left)", ErrIndexCorruption, keyLength, remaining)
 		}
+		remaining -= int64(keyLength)
 
 		key := make([]byte, keyLength)
 		_, err = io.ReadFull(file, key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read key: %v", err)
+			return nil, readError("key", err)
 		}
 
 		var offset int64
 		err = binary.Read(file, binary.LittleEndian, &offset)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read offset: %v", err)
+			return nil, readError("offset", err)
 		}
 
 		index[string(key)] = offset
@@ -103,96 +156,166 @@ func ReadIndex(file *os.File, footer *SSTableFooter) (map[string]int64, error) {
 	return index, nil
 }
 
-func ReadEntryAtOffset(file *os.File, offset int64) (*Entry, error) {
-
-	_, err := file.Seek(offset, io.SeekStart)
+// ReadDictionary reads a VersionDict table's compression dictionary, which
+// sits just before the index. Returns the dictionary and where it starts,
+// which is also where the entries end.
+func ReadDictionary(file *os.File, footer *SSTableFooter) ([]byte, int64, error) {
+	var dictLength uint32
+	lengthReader := io.NewSectionReader(file, footer.IndexStartOffset-4, 4)
+	err := binary.Read(lengthReader, binary.LittleEndian, &dictLength)
 	if err != nil {
-		return nil, fmt.Errorf("failed to seek to entry: %v", err)
+		return nil, 0, readError("dictionary length", err)
 	}
 
-	keyLength := uint32(0)
-	err = binary.Read(file, binary.LittleEndian, &keyLength)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read key length: %v", err)
+	start := footer.IndexStartOffset - 4 - int64(dictLength)
+	if start < 0 {
+		return nil, 0, fmt.Errorf("%w: dictionary length %d runs past the start of the file", ErrSSTableCorrupt, dictLength)
 	}
 
-	keyBytes := make([]byte, keyLength)
-	_, err = io.ReadFull(file, keyBytes)
+	dict := make([]byte, dictLength)
+	_, err = file.ReadAt(dict, start)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read key: %v", err)
+		return nil, 0, readError("dictionary", err)
 	}
 
-	valueLength := uint32(0)
-	err = binary.Read(file, binary.LittleEndian, &valueLength)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read value length: %v", err)
-	}
-
-	valueBytes := make([]byte, valueLength)
-	_, err = io.ReadFull(file, valueBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read value: %v", err)
-	}
-
-	var timestamp int64
-	err = binary.Read(file, binary.LittleEndian, &timestamp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read timestamp: %v", err)
-	}
+	return dict, start, nil
+}
 
-	var deleted byte
-	err = binary.Read(file, binary.LittleEndian, &deleted)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read deleted: %v", err)
+// ReadEntryAtOffset decodes one entry using the layout of the given file version.
+// The entry must lie before end, where the file's entries stop. It reads
+// with ReadAt, so concurrent readers can share the file.
+func ReadEntryAtOffset(sstFile *os.File, offset int64, end int64, version uint32) (*Entry, error) {
+	if offset < 0 || offset >= end {
+		return nil, fmt.Errorf("%w: entry offset %d is outside the entries (0 to %d)", ErrIndexCorruption, offset, end)
 	}
-
-	return &Entry{
-		Key:       string(keyBytes),
-		Value:     valueBytes,
-		Timestamp: timestamp,
-		Deleted:   deleted != 0,
-	}, nil
+	return DecodeEntry(io.NewSectionReader(sstFile, offset, end-offset), end-offset, version)
 }
 
-func OpenSSTable(filePath string) (*SSTable, error) {
+// OpenSSTable loads the footer and index. The file is closed afterwards;
+// entry reads reopen it through files, which bounds how many stay open.
+func OpenSSTable(filePath string, files *FilePool) (*SSTable, error) {
 	// Open File
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
+	defer file.Close()
 
 	// Read Footer
 	footer, err := ReadFooter(file)
 	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to read footer: %v", err)
+		return nil, fmt.Errorf("failed to read footer: %w", err)
 	}
 
 	// Read Index
 	index, err := ReadIndex(file, footer)
 	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to read index: %v", err)
+		return nil, fmt.Errorf("failed to read index: %w", err)
 	}
 
-	return &SSTable{
+	sst := &SSTable{
 		filePath: filePath,
-		file:     file,
+		files:    files,
 		index:    index,
 		footer:   footer,
-	}, nil
+		dataEnd:  footer.IndexStartOffset,
+	}
+	sst.minKey, sst.maxKey = indexKeyRange(index)
+	sst.bloom = newBloomFilter(index)
+
+	if footer.Version == VersionDict {
+		sst.dict, sst.dataEnd, err = ReadDictionary(file, footer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dictionary: %w", err)
+		}
+	}
+
+	return sst, nil
+}
+
+// indexKeyRange returns the smallest and largest key in index
+func indexKeyRange(index map[string]int64) (string, string) {
+	first := true
+	var minKey, maxKey string
+	for key := range index {
+		if first || key < minKey {
+			minKey = key
+		}
+		if first || key > maxKey {
+			maxKey = key
+		}
+		first = false
+	}
+	return minKey, maxKey
+}
+
+// KeyRange returns the smallest and largest key in the table, both ""
+// for an empty table
+func (sst *SSTable) KeyRange() (string, string) {
+	return sst.minKey, sst.maxKey
+}
+
+// inKeyRange reports whether key falls within the table's key range, so
+// a lookup outside it can skip the table
+func (sst *SSTable) inKeyRange(key string) bool {
+	return len(sst.index) > 0 && key >= sst.minKey && key <= sst.maxKey
 }
 
 // Close the SSTable (file)
 func (s *SSTable) Close() error {
-	if s.file != nil {
-		return s.file.Close()
+	return s.files.Evict(s.filePath)
+}
+
+// readEntry reads the entry at offset, borrowing the file from the pool
+func (s *SSTable) readEntry(offset int64) (*Entry, error) {
+	entry, _, err := s.readEntrySized(offset)
+	return entry, err
+}
+
+// readEntrySized is readEntry that also returns how many bytes the entry
+// takes up in the file. Values compressed against the table's dictionary
+// are inflated.
+func (s *SSTable) readEntrySized(offset int64) (*Entry, int64, error) {
+	file, err := s.files.Acquire(s.filePath)
+	if err != nil {
+		return nil, 0, err
 	}
-	return nil
+	defer s.files.Release(s.filePath)
+
+	entry, err := ReadEntryAtOffset(file, offset, s.dataEnd, s.footer.Version)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := EncodedEntrySize(entry, s.footer.Version)
+
+	if s.dict != nil && !entry.Deleted {
+		entry.Value, err = inflateWithDict(entry.Value, s.dict)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: failed to decompress value of %q: %v", ErrSSTableCorrupt, entry.Key, err)
+		}
+	}
+
+	return entry, size, nil
 }
 
 // Returns: value, found, error
 func (s *SSTable) Get(key string) ([]byte, bool, error) {
+	entry, exists, err := s.Lookup(key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	if entry.Deleted || entry.IsExpired(time.Now().UnixNano()) {
+		return nil, false, nil
+	}
+
+	return entry.Value, true, nil
+}
+
+// Lookup returns the raw entry stored for key, including tombstones and
+// expired entries
+// Returns: entry, exists, error
+func (s *SSTable) Lookup(key string) (*Entry, bool, error) {
 	// Check Index
 	offset, exists := s.index[key]
 	if !exists {
@@ -200,26 +323,53 @@ func (s *SSTable) Get(key string) ([]byte, bool, error) {
 	}
 
 	// Read Entry at Offset
-	entry, err := ReadEntryAtOffset(s.file, offset)
+	entry, err := s.readEntry(offset)
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to read entry: %v", err)
+		return nil, false, fmt.Errorf("failed to read entry: %w", err)
 	}
 
 	// Check Key (should be the same)
 	if entry.Key != key {
-		return nil, false, fmt.Errorf("Index Corruption: %s != %s", entry.Key, key)
+		return nil, false, fmt.Errorf("%w: %s != %s", ErrIndexCorruption, entry.Key, key)
 	}
 
-	if entry.Deleted {
-		return nil, false, nil
+	return entry, true, nil
+}
+
+// ScanLookup is Lookup without the index: it reads every entry in the
+// file looking for key. Used to repair reads when the index is corrupt.
+func (s *SSTable) ScanLookup(key string) (*Entry, bool, error) {
+	var found *Entry
+	err := s.walk(func(entry *Entry, _ int64) {
+		if entry.Key == key {
+			found = entry
+		}
+	})
+	if err != nil {
+		return nil, false, err
 	}
+	return found, found != nil, nil
+}
 
-	return entry.Value, true, nil
+// walk reads the entries one after another from the start of the file up
+// to the dictionary or index, calling fn with each and its size in the file
+func (s *SSTable) walk(fn func(*Entry, int64)) error {
+	offset := int64(0)
+	for offset < s.dataEnd {
+		entry, size, err := s.readEntrySized(offset)
+		if err != nil {
+			return fmt.Errorf("failed to scan entry at offset %d: %w", offset, err)
+		}
+		fn(entry, size)
+		offset += size
+	}
+	return nil
 }
 
-// NumEntries returns the number of entries in the SSTable
+// NumEntries returns the number of entries in the SSTable, as recorded in
+// the footer, so it doesn't depend on the index being loaded
 func (sst *SSTable) NumEntries() int {
-	return len(sst.index)
+	return int(sst.footer.NumberOfEntries)
 }
 
 // FilePath returns the file path
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestSSTable writes entries, in key order, to a new SSTable and
+// returns its path
+func writeTestSSTable(t *testing.T, entries ...*Entry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sstable_0.db")
+	if err := CreateSSTable(path, entries); err != nil {
+		t.Fatalf("CreateSSTable: %v", err)
+	}
+	return path
+}
+
+// patchUint32 overwrites the uint32 at offset in the file at path
+func patchUint32(t *testing.T, path string, offset int64, value uint32) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(binary.LittleEndian.AppendUint32(nil, value), offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// patchUint64 overwrites the uint64 at offset in the file at path
+func patchUint64(t *testing.T, path string, offset int64, value uint64) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(binary.LittleEndian.AppendUint64(nil, value), offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFooter(t *testing.T, path string) (*os.File, *SSTableFooter) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	footer, err := ReadFooter(file)
+	if err != nil {
+		t.Fatalf("ReadFooter: %v", err)
+	}
+	return file, footer
+}
+
+// A damaged key length in the index is caught before it is allocated
+func TestReadIndexRejectsOversizedKeyLength(t *testing.T) {
+	path := writeTestSSTable(t, &Entry{Key: "a", Value: []byte("1")}, &Entry{Key: "b", Value: []byte("2")})
+	_, footer := readTestFooter(t, path)
+	patchUint32(t, path, footer.IndexStartOffset, 0xFFFFFFF0)
+
+	file, footer := readTestFooter(t, path)
+	_, err := ReadIndex(file, footer)
+	if !errors.Is(err, ErrIndexCorruption) {
+		t.Fatalf("ReadIndex with a 4GB key length: %v, want ErrIndexCorruption", err)
+	}
+	if !errors.Is(err, ErrSSTableCorrupt) {
+		t.Errorf("ErrIndexCorruption should be a kind of ErrSSTableCorrupt")
+	}
+}
+
+// A footer claiming more entries than the index can hold is refused
+// before the index map is sized from it
+func TestReadIndexRejectsOversizedEntryCount(t *testing.T) {
+	path := writeTestSSTable(t, &Entry{Key: "a", Value: []byte("1")})
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchUint32(t, path, info.Size()-footerSize+8, 1<<31)
+
+	file, footer := readTestFooter(t, path)
+	_, err = ReadIndex(file, footer)
+	if !errors.Is(err, ErrIndexCorruption) {
+		t.Fatalf("ReadIndex with 2^31 entries: %v, want ErrIndexCorruption", err)
+	}
+}
+
+// A damaged value length in an entry is caught before it is allocated
+func TestReadEntryRejectsOversizedValueLength(t *testing.T) {
+	path := writeTestSSTable(t, &Entry{Key: "a", Value: []byte("1")}, &Entry{Key: "b", Value: []byte("2")})
+	patchUint32(t, path, 4+1, 0xFFFFFFF0) // value length of "a"
+
+	file, footer := readTestFooter(t, path)
+	_, err := ReadEntryAtOffset(file, 0, footer.IndexStartOffset, footer.Version)
+	if !errors.Is(err, ErrIndexCorruption) {
+		t.Fatalf("ReadEntryAtOffset with a 4GB value length: %v, want ErrIndexCorruption", err)
+	}
+
+	_, err = ReadEntryAtOffset(file, footer.IndexStartOffset, footer.IndexStartOffset, footer.Version)
+	if !errors.Is(err, ErrIndexCorruption) {
+		t.Errorf("ReadEntryAtOffset past the entries: %v, want ErrIndexCorruption", err)
+	}
+}
+
+func TestDecodeEntryRejectsLengthPastSize(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := EncodeEntry(&buf, &Entry{Key: "key", Value: []byte("value")}, Version); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// One byte short of the entry: the value no longer fits
+	_, err := DecodeEntry(bytes.NewReader(data), int64(len(data)-1), Version)
+	if !errors.Is(err, ErrIndexCorruption) {
+		t.Errorf("DecodeEntry with a short size: %v, want ErrIndexCorruption", err)
+	}
+
+	binary.LittleEndian.PutUint32(data, 1<<31)
+	_, err = DecodeEntry(bytes.NewReader(data), int64(len(data)), Version)
+	if !errors.Is(err, ErrIndexCorruption) {
+		t.Errorf("DecodeEntry with a 2GB key length: %v, want ErrIndexCorruption", err)
+	}
+}
+
+// An index entry leading to another key's entry is reported as
+// ErrIndexCorruption, which callers can also match as a StorageError
+func TestSSTableGetReportsIndexCorruption(t *testing.T) {
+	path := writeTestSSTable(t, &Entry{Key: "a", Value: []byte("1")}, &Entry{Key: "b", Value: []byte("2")})
+	sst, err := OpenSSTable(path, NewFilePool(DefaultMaxOpenFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sst.Close() })
+	sst.index["a"] = sst.index["b"]
+
+	_, _, err = sst.Get("a")
+	if !errors.Is(err, ErrIndexCorruption) || !errors.Is(err, ErrSSTableCorrupt) {
+		t.Fatalf("Get through a wrong index entry: %v, want ErrIndexCorruption", err)
+	}
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) || storageErr != ErrIndexCorruption {
+		t.Errorf("errors.As found %v, want ErrIndexCorruption", storageErr)
+	}
+	if value, found, err := sst.Get("b"); err != nil || !found || string(value) != "2" {
+		t.Errorf("b = %q, %v, %v; want it unaffected", value, found, err)
+	}
+}
+
+// writeVersionedSSTable writes entries, in key order, as an SSTable of
+// version, the way servers of that version did
+func writeVersionedSSTable(t *testing.T, version uint32, entries ...*Entry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sstable_0.db")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	indexEntries, _, err := WriteEntries(file, entries, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexStart, _, err := WriteIndex(file, indexEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteFooter(file, indexStart, int64(len(entries)), version); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Version 1 tables, whose entries have no expiry, and version 2 tables
+// are each read with their own layout
+func TestReadSSTableVersions(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	for _, version := range []uint32{VersionV1, Version} {
+		path := writeVersionedSSTable(t, version,
+			&Entry{Key: "a", Value: []byte("alpha"), Timestamp: 1},
+			&Entry{Key: "b", Value: []byte("beta"), Timestamp: 2, ExpiresAt: expiresAt},
+			&Entry{Key: "c", Timestamp: 3, Deleted: true},
+		)
+		if entries, problems := VerifySSTable(path); entries != 3 || len(problems) > 0 {
+			t.Errorf("v%d: VerifySSTable = %d entries, %q", version, entries, problems)
+		}
+
+		sst, err := OpenSSTable(path, NewFilePool(4))
+		if err != nil {
+			t.Fatalf("v%d: OpenSSTable: %v", version, err)
+		}
+		if sst.footer.Version != version {
+			t.Errorf("v%d: footer has version %d", version, sst.footer.Version)
+		}
+		for _, want := range []struct {
+			key       string
+			value     string
+			expiresAt int64
+			deleted   bool
+		}{
+			{"a", "alpha", 0, false},
+			{"b", "beta", expiresAt, false},
+			{"c", "", 0, true},
+		} {
+			if version == VersionV1 {
+				want.expiresAt = 0
+			}
+			entry, found, err := sst.Lookup(want.key)
+			if err != nil || !found {
+				t.Errorf("v%d: Lookup(%s) = %v, %v", version, want.key, found, err)
+				continue
+			}
+			if string(entry.Value) != want.value || entry.ExpiresAt != want.expiresAt || entry.Deleted != want.deleted {
+				t.Errorf("v%d: %s = %q expiring %d deleted %v, want %q expiring %d deleted %v", version, want.key,
+					entry.Value, entry.ExpiresAt, entry.Deleted, want.value, want.expiresAt, want.deleted)
+			}
+		}
+		sst.Close()
+	}
+}
+
+// A table from a newer server is refused with ErrUnsupportedVersion, not
+// read as corrupt or with the wrong layout, and the store won't open on it
+func TestReadSSTableRejectsFutureVersion(t *testing.T) {
+	path := writeVersionedSSTable(t, Version, &Entry{Key: "a", Value: []byte("alpha")})
+	patchUint32(t, path, fileSize(t, path)-footerSize+12, VersionDict+1)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = ReadFooter(file)
+	if !errors.Is(err, ErrUnsupportedVersion) || errors.Is(err, ErrSSTableCorrupt) {
+		t.Errorf("ReadFooter = %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := OpenSSTable(path, NewFilePool(4)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("OpenSSTable = %v, want ErrUnsupportedVersion", err)
+	}
+
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("data", "sstable-0.db"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewLSMStore(0, "data")
+	if err == nil {
+		store.Close()
+		store.WAL.Close()
+		t.Fatal("NewLSMStore opened a store holding a table of an unknown version")
+	}
+	if !errors.Is(err, ErrUnsupportedVersion) || !strings.Contains(err.Error(), "sstable-0.db") {
+		t.Errorf("NewLSMStore = %v, want ErrUnsupportedVersion naming the file", err)
+	}
+}
+
+// KeyRange is the smallest and largest key in the loaded table, in byte
+// order, tombstones included; lookups outside it skip the table
+func TestSSTableKeyRange(t *testing.T) {
+	path := writeTestSSTable(t,
+		&Entry{Key: "Zebra", Value: []byte("z"), Timestamp: 1},
+		&Entry{Key: "apple", Value: []byte("a"), Timestamp: 1},
+		&Entry{Key: "mango", Value: []byte("m"), Timestamp: 1},
+		&Entry{Key: "zz", Timestamp: 1, Deleted: true},
+	)
+	sst, err := OpenSSTable(path, NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+
+	if minKey, maxKey := sst.KeyRange(); minKey != "Zebra" || maxKey != "zz" {
+		t.Errorf("KeyRange = %q, %q; want Zebra, zz", minKey, maxKey)
+	}
+	for key, want := range map[string]bool{
+		"Zebra": true, "zz": true, "b": true, "Zebr": false, "zzz": false, "A": false,
+	} {
+		if got := sst.inKeyRange(key); got != want {
+			t.Errorf("inKeyRange(%q) = %v, want %v", key, got, want)
+		}
+	}
+
+	single, err := OpenSSTable(writeTestSSTable(t, &Entry{Key: "only", Value: []byte("v")}), NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	if minKey, maxKey := single.KeyRange(); minKey != "only" || maxKey != "only" {
+		t.Errorf("KeyRange of a one-key table = %q, %q", minKey, maxKey)
+	}
+
+	empty, err := OpenSSTable(writeTestSSTable(t), NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if minKey, maxKey := empty.KeyRange(); minKey != "" || maxKey != "" || empty.inKeyRange("") {
+		t.Errorf("KeyRange of an empty table = %q, %q", minKey, maxKey)
+	}
+}
+
+// The store skips a table whose key range can't hold the key, before
+// consulting its bloom filter or index
+func TestLookupSkipsTablesOutOfRange(t *testing.T) {
+	store := openTestStore(t, []*Entry{
+		{Key: "b", Value: []byte("1"), Timestamp: 1},
+		{Key: "d", Value: []byte("2"), Timestamp: 1},
+	})
+
+	for _, key := range []string{"a", "e", "dd"} {
+		if _, found, _ := store.Get(key); found {
+			t.Fatalf("%s found", key)
+		}
+	}
+	if stats := store.ReadStats(); stats.SSTableProbes != 0 || stats.BloomFilterRejections != 0 {
+		t.Errorf("lookups outside the table's range reached it: %+v", stats)
+	}
+	if value, found, _ := store.Get("d"); !found || string(value) != "2" {
+		t.Errorf("Get(d) = %q, %v", value, found)
+	}
+	if stats := store.ReadStats(); stats.SSTableProbes != 1 {
+		t.Errorf("a lookup in range made %d probes, want 1", stats.SSTableProbes)
+	}
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Duplicate keys collapse to their newest entry, so the footer counts
+// exactly what the index can reach
+func TestCreateSSTableDedupsKeys(t *testing.T) {
+	path := writeTestSSTable(t,
+		&Entry{Key: "a", Value: []byte("1"), Timestamp: 1},
+		&Entry{Key: "b", Value: []byte("old"), Timestamp: 1},
+		&Entry{Key: "b", Value: []byte("new"), Timestamp: 3},
+		&Entry{Key: "b", Value: []byte("middle"), Timestamp: 2},
+		&Entry{Key: "c", Value: []byte("3"), Timestamp: 1},
+	)
+
+	sst, err := OpenSSTable(path, NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+
+	if sst.NumEntries() != 3 || len(sst.index) != 3 {
+		t.Errorf("footer counts %d entries and the index %d, want 3 each", sst.NumEntries(), len(sst.index))
+	}
+	value, found, err := sst.Get("b")
+	if err != nil || !found || string(value) != "new" {
+		t.Errorf("Get(b) = %q, %v, %v; want the newest value", value, found, err)
+	}
+	if _, problems := VerifySSTable(path); len(problems) > 0 {
+		t.Errorf("VerifySSTable: %v", problems)
+	}
+}
+
+// recordDirSyncs replaces the directory sync for the rest of the test,
+// calling check with each directory synced
+func recordDirSyncs(t *testing.T, check func(dir string)) {
+	t.Helper()
+	var mu sync.Mutex
+	syncDirFile = func(d *os.File) error {
+		mu.Lock()
+		defer mu.Unlock()
+		check(d.Name())
+		return d.Sync()
+	}
+	t.Cleanup(func() { syncDirFile = (*os.File).Sync })
+}
+
+// A new SSTable or rewritten WAL has its directory synced once the rename
+// is done, so the new name survives a crash
+func TestSyncDirAfterRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sstable-0.db")
+	tmpPath := path + ".tmp"
+	synced := 0
+	recordDirSyncs(t, func(name string) {
+		if name != dir {
+			return
+		}
+		synced++
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("directory synced before the rename: %v", err)
+		}
+		if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+			t.Errorf("temp file still there when the directory was synced: %v", err)
+		}
+	})
+
+	err := CreateSSTable(path, []*Entry{{Key: "k", Value: []byte("v"), Timestamp: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != 1 {
+		t.Errorf("directory synced %d times creating an SSTable, want once after the rename", synced)
+	}
+
+	path = filepath.Join(dir, "wal.log")
+	tmpPath = path + ".rewrite"
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for i := 0; i < 3; i++ {
+		wal.WriteEntry("SET", "k", fmt.Sprint(i))
+	}
+	synced = 0
+	if err := wal.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	if synced != 1 {
+		t.Errorf("directory synced %d times rewriting the WAL, want once after the rename", synced)
+	}
+}
+
+// footerEntries reads the entry count from the footer of the file at path
+func footerEntries(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	footer, err := ReadFooter(file)
+	if err != nil {
+		t.Fatalf("ReadFooter(%s): %v", path, err)
+	}
+	return int(footer.NumberOfEntries)
+}
+
+// The entry count is written to the footer in either format, read back on
+// open without the index, and matches what compaction keeps: the newest
+// live entry of each key, spread over the output tables
+func TestFooterEntryCount(t *testing.T) {
+	dir := t.TempDir()
+	var entries []*Entry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, &Entry{Key: fmt.Sprintf("key:%04d", i), Value: []byte("value"), Timestamp: 1})
+	}
+	for _, opts := range []SSTableOptions{{}, {Dictionary: true}} {
+		path := filepath.Join(dir, fmt.Sprintf("dict-%v.db", opts.Dictionary))
+		if err := CreateSSTableWithOptions(path, entries, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := footerEntries(t, path); got != 500 {
+			t.Errorf("footer of %s counts %d entries, want 500", path, got)
+		}
+		sst, err := OpenSSTable(path, NewFilePool(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sst.index = nil
+		if got := sst.NumEntries(); got != 500 {
+			t.Errorf("NumEntries of %s = %d, want the footer's 500", path, got)
+		}
+		sst.Close()
+	}
+
+	// 1000 keys split between two tables, then 100 of them deleted and
+	// 100 rewritten already expired by a third
+	now := time.Now().UnixNano()
+	value := bytes.Repeat([]byte("v"), 100)
+	tables := make([][]*Entry, 3)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		tables[i%2] = append(tables[i%2], &Entry{Key: key, Value: value, Timestamp: 1})
+		switch {
+		case i < 100:
+			tables[2] = append(tables[2], &Entry{Key: key, Timestamp: 2, Deleted: true})
+		case i < 200:
+			tables[2] = append(tables[2], &Entry{Key: key, Value: value, Timestamp: 2, ExpiresAt: now - int64(time.Hour)})
+		}
+	}
+	sstables := openTestSSTables(t, dir, tables...)
+	paths, err := CompactSSTables(sstables, func(part int) string {
+		return filepath.Join(dir, fmt.Sprintf("out-%d.db", part))
+	}, 16<<10, SSTableOptions{}, nil)
+	if err != nil {
+		t.Fatalf("CompactSSTables: %v", err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("compaction wrote %d table, want its output split", len(paths))
+	}
+
+	total := 0
+	files := NewFilePool(len(paths))
+	for _, path := range paths {
+		sst, err := OpenSSTable(path, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned, err := getAllEntriesFromSSTable(sst, nil)
+		sst.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := footerEntries(t, path); got != len(scanned) {
+			t.Errorf("footer of %s counts %d entries, the table holds %d", path, got, len(scanned))
+		}
+		total += len(scanned)
+	}
+	if total != 800 {
+		t.Errorf("compaction kept %d entries, want the 800 live keys", total)
+	}
+}
+
+func TestCreateSSTableRejectsUnsortedEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sstable-0.db")
+	err := CreateSSTable(path, []*Entry{
+		{Key: "b", Value: []byte("1")},
+		{Key: "a", Value: []byte("2")},
+		{Key: "b", Value: []byte("3")},
+	})
+	if err == nil {
+		t.Error("CreateSSTable accepted entries out of key order")
+	}
+}
+
+func TestCountUniqueKeys(t *testing.T) {
+	entries := []*Entry{{Key: "a"}, {Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "c"}}
+	if n := countUniqueKeys(entries); n != 3 {
+		t.Errorf("countUniqueKeys = %d, want 3", n)
+	}
+	if n := countUniqueKeys(nil); n != 0 {
+		t.Errorf("countUniqueKeys(nil) = %d, want 0", n)
+	}
+}
+
+// Values sharing a structure compress better against the table's shared
+// dictionary than each compressed on its own, and read back intact
+func TestSSTableDictionaryCompression(t *testing.T) {
+	var entries []*Entry
+	rawBytes, independentBytes := 0, 0
+	for i := 0; i < 500; i++ {
+		value := []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":true,"roles":["reader","writer"],"created_at":"2024-01-%02dT10:00:00Z"}`,
+			i, i, i, i%28+1))
+		entries = append(entries, &Entry{Key: fmt.Sprintf("user:%04d", i), Value: value, Timestamp: 1})
+
+		rawBytes += len(value)
+		if compressed, ok := compressValue(value); ok {
+			independentBytes += len(compressed)
+		} else {
+			independentBytes += len(value)
+		}
+	}
+
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "sstable-0.db")
+	dictPath := filepath.Join(dir, "sstable-1.db")
+	if err := CreateSSTableWithOptions(plainPath, entries, SSTableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSSTableWithOptions(dictPath, entries, SSTableOptions{Dictionary: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plain table with each value compressed on its own, dictionary
+	// included in the size of the other
+	independentSize := fileSize(t, plainPath) - int64(rawBytes) + int64(independentBytes)
+	if dictSize := fileSize(t, dictPath); dictSize >= independentSize {
+		t.Errorf("dictionary table is %d bytes, want less than the %d of per-value compression", dictSize, independentSize)
+	}
+
+	sst, err := OpenSSTable(dictPath, NewFilePool(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	if sst.footer.Version != VersionDict || sst.dict == nil {
+		t.Fatalf("table version %d without a dictionary loaded", sst.footer.Version)
+	}
+	for _, entry := range entries {
+		value, found, err := sst.Get(entry.Key)
+		if err != nil || !found || !bytes.Equal(value, entry.Value) {
+			t.Fatalf("Get(%s) = %q, %v, %v; want %q", entry.Key, value, found, err, entry.Value)
+		}
+	}
+	if _, problems := VerifySSTable(dictPath); len(problems) > 0 {
+		t.Errorf("VerifySSTable: %v", problems)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
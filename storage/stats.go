@@ -0,0 +1,67 @@
+package storage
+
+import "sync/atomic"
+
+// ReadStats counts what reads cost. SSTableProbes against hits and misses
+// shows read amplification: how many tables a lookup checks before it
+// finds the key, or gives up. BloomFilterRejections counts the tables
+// skipped without a probe.
+type ReadStats struct {
+	KeyspaceHits          int64 // Gets that found a live value
+	KeyspaceMisses        int64 // Gets that didn't
+	SSTableProbes         int64 // SSTable indexes checked by lookups
+	SSTableReads          int64 // entries read from SSTable files by lookups
+	BloomFilterRejections int64 // SSTables in a lookup's key range ruled out by their bloom filter
+}
+
+// readCounters is ReadStats as the store updates it
+type readCounters struct {
+	hits, misses    atomic.Int64
+	probes, reads   atomic.Int64
+	bloomRejections atomic.Int64
+}
+
+// ReadStats returns the read counters since the store was created
+func (store *LSMStore) ReadStats() ReadStats {
+	return ReadStats{
+		KeyspaceHits:   store.readCounters.hits.Load(),
+		KeyspaceMisses: store.readCounters.misses.Load(),
+		SSTableProbes:  store.readCounters.probes.Load(),
+		SSTableReads:   store.readCounters.reads.Load(),
+
+		BloomFilterRejections: store.readCounters.bloomRejections.Load(),
+	}
+}
+
+// PipelineStats shows whether background work is keeping up with writes
+type PipelineStats struct {
+	// PendingFlushes is how many full memtables wait to be written to an
+	// SSTable. The store has one slot for them, so it is 0 or 1; while it
+	// is 1 the active memtable grows past its size.
+	PendingFlushes int
+
+	SSTables int
+
+	// CompactionPending is how many SSTables wait for a compaction: all
+	// of them once CompactionThreshold is reached, or those flushed since
+	// the running compaction picked its inputs
+	CompactionPending int
+}
+
+// PipelineStats returns the current flush and compaction backlog
+func (store *LSMStore) PipelineStats() PipelineStats {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	stats := PipelineStats{SSTables: len(store.sstables)}
+	if store.immutableMemTable != nil {
+		stats.PendingFlushes = 1
+	}
+
+	if inputs := int(store.compactionInputs.Load()); inputs > 0 {
+		stats.CompactionPending = max(stats.SSTables-inputs, 0)
+	} else if store.tableGroups() >= CompactionThreshold {
+		stats.CompactionPending = stats.SSTables
+	}
+	return stats
+}
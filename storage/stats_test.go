@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Two SSTables with interleaved keys: every lookup falls in both tables'
+// key ranges, so only the bloom filters keep it from probing both
+func TestReadStats(t *testing.T) {
+	var even, odd []*Entry
+	for i := 0; i < 100; i++ {
+		entry := &Entry{Key: fmt.Sprintf("key:%03d", i), Value: []byte("v"), Timestamp: 1}
+		if i%2 == 0 {
+			even = append(even, entry)
+		} else {
+			odd = append(odd, entry)
+		}
+	}
+	store := openTestStore(t, even, odd)
+
+	for i := 0; i < 100; i++ {
+		if _, found, _ := store.Get(fmt.Sprintf("key:%03d", i)); !found {
+			t.Fatalf("key:%03d not found", i)
+		}
+	}
+	stats := store.ReadStats()
+	if stats.KeyspaceHits != 100 || stats.KeyspaceMisses != 0 {
+		t.Errorf("after 100 hits: %+v", stats)
+	}
+	if stats.SSTableReads != 100 {
+		t.Errorf("100 hits read %d entries, want 100", stats.SSTableReads)
+	}
+
+	// Keys between the stored ones: in range for both tables, held by neither
+	for i := 10; i < 90; i++ {
+		if _, found, _ := store.Get(fmt.Sprintf("key:%03d-missing", i)); found {
+			t.Fatalf("key:%03d-missing found", i)
+		}
+	}
+	before := stats
+	stats = store.ReadStats()
+	if stats.KeyspaceMisses != 80 {
+		t.Errorf("after 80 misses: %+v", stats)
+	}
+	rejections := stats.BloomFilterRejections - before.BloomFilterRejections
+	probes := stats.SSTableProbes - before.SSTableProbes
+	if rejections+probes != 160 {
+		t.Errorf("80 misses over 2 tables: %d rejections and %d probes, want 160 in all", rejections, probes)
+	}
+	if rejections < 140 {
+		t.Errorf("only %d of 160 table lookups were ruled out by a bloom filter", rejections)
+	}
+	if stats.SSTableReads != before.SSTableReads {
+		t.Errorf("misses read %d entries from SSTables", stats.SSTableReads-before.SSTableReads)
+	}
+}
+
+// waitForPipeline waits until the store has no flush pending and no
+// compaction running or due
+func waitForPipeline(t *testing.T, store *LSMStore) PipelineStats {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stats := store.PipelineStats()
+		_, compacting := store.CompactionStatus()
+		if stats.PendingFlushes == 0 && stats.CompactionPending == 0 && !compacting {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background work didn't drain: %+v, compacting %v", stats, compacting)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Writing faster than a tiny memtable can be flushed leaves flushes and
+// then compactions pending, and both drain once the writes stop
+func TestPipelineStatsRiseAndDrain(t *testing.T) {
+	store := openSmallTestStore(t, 1<<10)
+	if stats := store.PipelineStats(); stats != (PipelineStats{}) {
+		t.Fatalf("new store has %+v", stats)
+	}
+
+	// Each flush takes everything written while the last one ran, so
+	// writes go on until enough SSTables pile up for a compaction
+	value := []byte(strings.Repeat("v", 100))
+	var peak PipelineStats
+	written := 0
+	for deadline := time.Now().Add(10 * time.Second); peak.CompactionPending == 0 && time.Now().Before(deadline); written++ {
+		if err := store.Set(fmt.Sprintf("key:%d", written), value); err != nil {
+			t.Fatal(err)
+		}
+		if written%100 == 0 {
+			time.Sleep(time.Millisecond) // let flushes run, even on one CPU
+		}
+		stats := store.PipelineStats()
+		peak.PendingFlushes = max(peak.PendingFlushes, stats.PendingFlushes)
+		peak.SSTables = max(peak.SSTables, stats.SSTables)
+		peak.CompactionPending = max(peak.CompactionPending, stats.CompactionPending)
+	}
+	if peak.PendingFlushes != 1 {
+		t.Errorf("pending flushes peaked at %d under sustained writes, want 1", peak.PendingFlushes)
+	}
+	if peak.CompactionPending == 0 {
+		t.Errorf("no SSTables were ever pending compaction, with up to %d of them", peak.SSTables)
+	}
+
+	stats := waitForPipeline(t, store)
+	if stats.SSTables == 0 || stats.SSTables >= CompactionThreshold {
+		t.Errorf("after draining: %+v", stats)
+	}
+	if n, err := store.CountKeys(); err != nil || n != int64(written) {
+		t.Errorf("CountKeys = %d, %v after draining, want %d", n, err, written)
+	}
+}
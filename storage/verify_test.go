@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifySSTables(t *testing.T) {
+	store := openTestStore(t,
+		[]*Entry{{Key: "a", Value: []byte("1"), Timestamp: 1}, {Key: "b", Value: []byte("2"), Timestamp: 1}},
+		[]*Entry{{Key: "c", Value: []byte("3"), Timestamp: 2}, {Key: "d", Timestamp: 2, Deleted: true}, {Key: "e", Value: []byte("5"), Timestamp: 2}},
+	)
+
+	report := store.VerifySSTables()
+	if !report.OK() || report.FilesScanned != 2 || report.EntriesVerified != 5 {
+		t.Fatalf("clean tables: %v %v", report, report.Problems)
+	}
+
+	// Point the index entry of "a" one byte into its entry
+	damaged := filepath.Join("data", "sstable-0.db")
+	_, footer := readTestFooter(t, damaged)
+	patchUint32(t, damaged, footer.IndexStartOffset+4+1, 1)
+
+	report = store.VerifySSTables()
+	if report.OK() || report.FilesScanned != 2 {
+		t.Fatalf("damaged table: %v", report)
+	}
+	for _, problem := range report.Problems {
+		if !strings.HasPrefix(problem, damaged+": ") {
+			t.Errorf("problem reported outside the damaged table: %s", problem)
+		}
+	}
+	if !strings.Contains(report.String(), "2 SSTables scanned") {
+		t.Errorf("summary = %q", report.String())
+	}
+}
+
+// Each kind of damage VerifySSTable looks for is reported
+func TestVerifySSTableFindsDamage(t *testing.T) {
+	entries := []*Entry{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}}
+	for _, tc := range []struct {
+		name    string
+		damage  func(path string, footer *SSTableFooter)
+		problem string
+	}{
+		{"value length", func(path string, _ *SSTableFooter) {
+			patchUint32(t, path, 4+1, 0xFFFFFFF0)
+		}, "unreadable"},
+		{"index offset", func(path string, footer *SSTableFooter) {
+			patchUint32(t, path, footer.IndexStartOffset+4+1, 3)
+		}, "expected 0"},
+		{"entry count", func(path string, footer *SSTableFooter) {
+			patchUint32(t, path, footer.IndexStartOffset+2*(indexEntryOverhead+1)+8, 1)
+		}, "entries end at"},
+		{"magic number", func(path string, footer *SSTableFooter) {
+			patchUint32(t, path, footer.IndexStartOffset+2*(indexEntryOverhead+1)+16, 0)
+		}, "bad footer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestSSTable(t, entries...)
+			_, footer := readTestFooter(t, path)
+			tc.damage(path, footer)
+
+			_, problems := VerifySSTable(path)
+			if !strings.Contains(strings.Join(problems, "; "), tc.problem) {
+				t.Errorf("problems %q, want one mentioning %q", problems, tc.problem)
+			}
+		})
+	}
+}
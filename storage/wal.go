@@ -2,53 +2,288 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// WALFailureThreshold is how many writes in a row may fail before the WAL
+// reports itself as failed
+const WALFailureThreshold = 3
+
 // WAL represents a Write-Ahead Log
 type WAL struct {
 	file   *os.File
 	writer *bufio.Writer
 	path   string
+
+	// version is the entry layout of the file's records; guarded by mu
+	version uint32
+
+	// buf is reused to encode each record so writes don't allocate;
+	// both it and writer are guarded by mu
+	buf []byte
+	mu  sync.Mutex
+
+	// failures counts consecutive failed writes; guarded by mu
+	failures int
+
+	// size is the length of the file, rewriteBase its length after the
+	// last rewrite and rewriteSize the size for automatic rewrites (see
+	// wal_rewrite.go); guarded by mu
+	size        int64
+	rewriteBase int64
+	rewriteSize int64
+
+	// rewriting is set while a rewrite runs
+	rewriting atomic.Bool
+
+	// resets counts Reset calls, so a rewrite can tell the log was
+	// emptied under it; guarded by mu
+	resets int
+
+	// tx checksums the records of the open transaction, nil outside
+	// one (see wal_transaction.go); guarded by mu
+	tx *walTransaction
+
+	// paused is set while writes aren't logged, see Pause
+	paused atomic.Bool
 }
 
+// NewWAL opens the log at path, creating it if needed. A log in the text
+// format of older versions is converted first (see wal_legacy.go).
 func NewWAL(path string) (*WAL, error) {
+	version, err := prepareWALFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 	return &WAL{
-		file:   file,
-		writer: bufio.NewWriter(file),
-		path:   path,
+		file:        file,
+		writer:      bufio.NewWriter(file),
+		path:        path,
+		version:     version,
+		size:        info.Size(),
+		rewriteBase: info.Size(),
+		rewriteSize: DefaultWALRewriteSize,
 	}, nil
 }
 
+// prepareWALFile makes sure the file at path starts with a WAL header
+// and returns its version. A missing or empty file gets a header; so does
+// one cut short while its header was being written.
+func prepareWALFile(path string) (uint32, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("failed to read WAL header: %v", err)
+	}
+	header = header[:n]
+
+	if version, ok := readWALHeader(header); ok {
+		if !walVersionSupported(version) {
+			return 0, fmt.Errorf("unsupported WAL entry version %d in %s (versions %d to %d can be read); it may have been written by a newer server",
+				version, path, VersionV1, Version)
+		}
+		return version, nil
+	}
+
+	if bytes.HasPrefix(appendWALHeader(nil, walVersion), header) {
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.WriteAt(appendWALHeader(nil, walVersion), 0)
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write WAL header: %v", err)
+		}
+		return walVersion, nil
+	}
+
+	if isLegacyWAL(header) {
+		file.Close()
+		err = convertLegacyWAL(path)
+		if err != nil {
+			return 0, err
+		}
+		return walVersion, nil
+	}
+	return 0, fmt.Errorf("%s is not a WAL", path)
+}
+
+// NewDisabledWAL returns a WAL that records nothing and recovers
+// nothing, for stores without persistence
+func NewDisabledWAL() *WAL {
+	return &WAL{}
+}
+
+// disabled reports whether the WAL is a disabled one. It goes by the path,
+// which never changes, as a rewrite swaps the file under w.mu.
+func (w *WAL) disabled() bool {
+	return w.path == ""
+}
+
+// Pause stops logging writes, and resetting the log, until the returned
+// function is called. It is for replaying writes that another log already
+// holds, such as the AOF at startup: logging them again would only copy
+// that log into this one, and a reset would drop records of writes that
+// the replay leaves unlogged.
+func (w *WAL) Pause() (resume func()) {
+	w.paused.Store(true)
+	return func() { w.paused.Store(false) }
+}
+
+// WriteEntry logs a write: operation is SET, with the value, or DEL
 func (w *WAL) WriteEntry(operation string, key string, value string) error {
+	switch operation {
+	case "SET":
+		return w.write(walWrite{kind: walEntry, key: key, value: value})
+	case "DEL":
+		return w.write(walWrite{kind: walEntry, key: key, deleted: true})
+	default:
+		return fmt.Errorf("unknown WAL operation %q", operation)
+	}
+}
+
+// WriteExpiringEntry logs a SET of a value that expires at expiresAt
+// (Unix nanoseconds)
+func (w *WAL) WriteExpiringEntry(key string, value string, expiresAt int64) error {
+	return w.write(walWrite{kind: walEntry, key: key, value: value, expiresAt: expiresAt})
+}
+
+// write appends one record, adding it to the open transaction if any
+func (w *WAL) write(record walWrite) error {
+	if w.disabled() || w.paused.Load() {
+		return nil
+	}
 
-	// Format: timestamp|operation|key|value
-	timestamp := time.Now().Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	entry := fmt.Sprintf("%d|%s|%s|%s\n", timestamp, operation, key, value)
+	err := w.writeRecord(record)
+	if err == nil && w.tx != nil {
+		w.tx.add(w.buf)
+	}
+	return err
+}
 
-	fmt.Printf("writing to WAL: %s", entry)
+// writeRecord appends one record, timestamped now in Unix nanoseconds,
+// and flushes it. Caller must hold w.mu.
+func (w *WAL) writeRecord(record walWrite) error {
+	w.buf = appendWALRecord(w.buf[:0], record, time.Now().UnixNano(), w.version)
 
 	// Write to buffer
-	_, err := w.writer.WriteString(entry)
+	_, err := w.writer.Write(w.buf)
+	if err == nil {
+		// Flush to disk immediately for durability
+		err = w.writer.Flush()
+	}
 	if err != nil {
-		fmt.Printf("error writing to WAL: %v", err)
+		w.failures++
+		fmt.Printf("error writing to WAL (%d in a row): %v\n", w.failures, err)
 		return err
 	}
 
-	// Flush to disk immediately for durability
-	return w.writer.Flush()
+	w.failures = 0
+	w.size += int64(len(w.buf))
+	w.maybeRewrite()
+	return nil
+}
+
+// Failed reports whether the last WALFailureThreshold writes all failed
+// (disk full, IO errors). The server stops taking writes until ClearErrors.
+func (w *WAL) Failed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failures >= WALFailureThreshold
+}
+
+// ClearErrors forgets past failures so writes are attempted again. The
+// buffered writer keeps its first error forever, so it is reset, and the
+// file is cut back to its last complete record, dropping whatever part of
+// a record the failed writes left behind.
+func (w *WAL) ClearErrors() error {
+	if w.disabled() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.failures = 0
+	w.writer.Reset(w.file)
+	return w.file.Truncate(w.size)
+}
+
+// Reset empties the log. A rewrite in progress gives up rather than
+// bring back what it read, and an open transaction is begun again.
+func (w *WAL) Reset() error {
+	if w.disabled() || w.paused.Load() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writer.Reset(w.file)
+	err := w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	header := appendWALHeader(nil, walVersion)
+	_, err = w.file.Write(header)
+	if err != nil {
+		return err
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	w.resets++
+	w.version = walVersion
+	w.size = int64(len(header))
+	w.rewriteBase = w.size
+	if w.tx != nil {
+		w.tx = nil
+		err = w.writeRecord(walWrite{kind: walBegin})
+		if err != nil {
+			return err
+		}
+		w.tx = &walTransaction{}
+	}
+	return nil
 }
 
 func (w *WAL) Close() error {
+	if w.disabled() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	// Flush any remaining data to disk
 	w.writer.Flush()
@@ -57,7 +292,26 @@ func (w *WAL) Close() error {
 	return w.file.Close()
 }
 
-func (w *WAL) Recover(store *LSMStore) error {
+// KVStore is anything the WAL can replay writes into. Each write carries
+// its original timestamp so the store can ignore records it already holds
+// a write for at or after that time, which makes replay safe to repeat.
+type KVStore interface {
+	ReplaySet(key string, value []byte, expiresAt int64, timestamp int64) error
+	ReplayDelete(key string, timestamp int64) error
+}
+
+// walReadBufferSize is how much of the log Recover and a rewrite read
+// at a time
+const walReadBufferSize = 1 << 20
+
+// Recover replays the WAL into the given store. Records are read one at a
+// time, so reading the log takes memory for one record however long it is.
+// The log is cut at the first record that is torn or damaged, so what is
+// written next follows the last good record.
+func (w *WAL) Recover(store KVStore) error {
+	if w.disabled() {
+		return nil
+	}
 
 	// Open the file for reading
 	file, err := os.Open(w.path)
@@ -69,38 +323,74 @@ func (w *WAL) Recover(store *LSMStore) error {
 	}
 	defer file.Close()
 
-	// Read the file line by line
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
-
-	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := newWALReader(file, info.Size())
+	if err != nil {
+		return err
+	}
 
-		parts := strings.SplitN(line, "|", 4)
-		if len(parts) < 4 {
-			fmt.Printf("error parsing line %d: unexpected EOF or corrupt WAL entry\n", lineNum)
-			continue
+	replayed := 0
+	var transactions walTransactionReader
+	for {
+		offset := reader.offset
+		record, err := reader.next()
+		if err == io.EOF {
+			break
 		}
-		operation := parts[1]
-		key := parts[2]
-		value := parts[3]
-
-		switch operation {
-		case "SET":
-			store.Set(key, []byte(value))
-		case "DEL":
-			store.Delete(key)
-		default:
-			fmt.Printf("unknown operation: %s", operation)
+		if errors.Is(err, ErrWALCorrupt) {
+			fmt.Printf("WAL record at offset %d: %v; dropping the last %d bytes of the log\n", offset, err, info.Size()-offset)
+			err = w.truncate(offset)
+			if err != nil {
+				return fmt.Errorf("failed to truncate WAL: %v", err)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading WAL: %v", err)
 		}
 
+		// Records inside a transaction come back at its COMMIT
+		for _, record := range transactions.read(record, reader.raw, offset) {
+			replayRecord(store, record)
+			replayed++
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading WAL: %v", err)
+	if tx := transactions.unfinished(); tx != nil {
+		fmt.Printf("dropping %d WAL records of a transaction that was never committed\n", len(tx.records))
+		err = w.abortTransaction()
+		if err != nil {
+			return fmt.Errorf("failed to close unfinished WAL transaction: %v", err)
+		}
 	}
 
-	fmt.Printf("WAL recovery complete: replayed %d entries\n", lineNum)
+	fmt.Printf("WAL recovery complete: replayed %d entries\n", replayed)
 	return nil
 }
+
+// truncate cuts the log to its first size bytes
+func (w *WAL) truncate(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	w.size = size
+	w.rewriteBase = min(w.rewriteBase, size)
+	return w.file.Sync()
+}
+
+// replayRecord applies one SET or DEL record
+func replayRecord(store KVStore, record walRecord) {
+	entry := record.entry
+	if entry.Deleted {
+		store.ReplayDelete(entry.Key, entry.Timestamp)
+		return
+	}
+	store.ReplaySet(entry.Key, entry.Value, entry.ExpiresAt, entry.Timestamp)
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Older versions wrote the WAL as text, one record per line:
+//
+//	timestamp|operation|key|value
+//
+// where operation is SET, DEL or SETEXAT, whose value is the expiry in
+// Unix nanoseconds, a '|' and the value. Transactions were framed by
+// timestamp|BEGIN|| and timestamp|COMMIT|count|checksum, the checksum
+// being the hex CRC32 of the lines in between, and closed after a crash
+// with timestamp|ABORT||. A text WAL found at startup is converted to the
+// current format before anything is appended to it.
+
+// isLegacyWAL reports whether a WAL starting with header is in the text
+// format: it starts with a timestamp, or with the blank line a failed
+// write left behind
+func isLegacyWAL(header []byte) bool {
+	if len(header) == 0 {
+		return false
+	}
+	c := header[0]
+	return (c >= '0' && c <= '9') || c == '\n' || c == '\r'
+}
+
+// convertLegacyWAL rewrites the text WAL at path in the current format.
+// The new file is written next to it and renamed over it, so a crash
+// leaves one or the other.
+func convertLegacyWAL(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %v", err)
+	}
+	defer source.Close()
+
+	tmpPath := path + ".convert"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer tmp.Close()
+	defer os.Remove(tmpPath) // a no-op once renamed
+
+	writer := bufio.NewWriter(tmp)
+	writer.Write(appendWALHeader(nil, walVersion))
+
+	var buf []byte
+	converted := 0
+	err = readLegacyWAL(source, func(record string) {
+		write, timestamp, err := parseLegacyRecord(record)
+		if err != nil {
+			fmt.Printf("dropping text WAL record %q: %v\n", truncateRecord(record), err)
+			return
+		}
+		buf = appendWALRecord(buf[:0], write, timestamp, walVersion)
+		writer.Write(buf)
+		converted++
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write converted WAL: %v", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to rename converted WAL: %v", err)
+	}
+	err = SyncDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Converted text WAL %s to the binary format: %d records\n", path, converted)
+	return nil
+}
+
+// readLegacyWAL calls fn with every record of a text WAL that recovery
+// would have replayed: those outside transactions, and those of committed
+// transactions once their COMMIT is read
+func readLegacyWAL(r io.Reader, fn func(record string)) error {
+	reader := bufio.NewReaderSize(r, walReadBufferSize)
+
+	var tx *walTransaction
+	var held []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading WAL: %v", err)
+		}
+		if line == "" && err == io.EOF {
+			return nil
+		}
+
+		record := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if record == "" {
+			continue // written by ClearErrors after a failed write
+		}
+		parts := strings.SplitN(record, "|", 4)
+		operation := ""
+		if len(parts) == 4 {
+			operation = parts[1]
+		}
+
+		switch operation {
+		case "BEGIN":
+			tx, held = &walTransaction{}, nil
+			continue
+		case "ABORT":
+			tx = nil
+			continue
+		case "COMMIT":
+			if tx != nil && parts[2] == strconv.Itoa(tx.count) && parts[3] == fmt.Sprintf("%08x", tx.crc) {
+				for _, record := range held {
+					fn(record)
+				}
+			}
+			tx = nil
+			continue
+		}
+
+		if tx == nil {
+			fn(record)
+			continue
+		}
+		tx.add([]byte(line))
+		held = append(held, record)
+	}
+}
+
+// parseLegacyRecord parses a SET, SETEXAT or DEL line of a text WAL into
+// the record to write and its timestamp
+func parseLegacyRecord(record string) (walWrite, int64, error) {
+	parts := strings.SplitN(record, "|", 4)
+	if len(parts) < 4 {
+		return walWrite{}, 0, fmt.Errorf("expected 4 fields, found %d", len(parts))
+	}
+	timestamp, err := parseLegacyTimestamp(parts[0])
+	if err != nil {
+		return walWrite{}, 0, fmt.Errorf("invalid timestamp %q", parts[0])
+	}
+
+	key := parts[2]
+	switch parts[1] {
+	case "SET":
+		return walWrite{kind: walEntry, key: key, value: parts[3]}, timestamp, nil
+	case "SETEXAT":
+		expiresAt, value, err := splitExpiringValue(parts[3])
+		if err != nil {
+			return walWrite{}, 0, err
+		}
+		return walWrite{kind: walEntry, key: key, value: value, expiresAt: expiresAt}, timestamp, nil
+	case "DEL":
+		return walWrite{kind: walEntry, key: key, deleted: true}, timestamp, nil
+	default:
+		return walWrite{}, 0, fmt.Errorf("unknown operation %q", parts[1])
+	}
+}
+
+// legacyTimestampLimit separates old second-resolution WAL timestamps
+// from nanosecond ones (1e12 seconds is tens of thousands of years away)
+const legacyTimestampLimit = 1e12
+
+// parseLegacyTimestamp returns a record's timestamp in nanoseconds. The
+// oldest records only have whole seconds; they're placed at the end of
+// their second so a record written in the same second as an SSTable value
+// still replays, as it always did.
+func parseLegacyTimestamp(field string) (int64, error) {
+	timestamp, err := strconv.ParseInt(field, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if timestamp < legacyTimestampLimit {
+		timestamp = (timestamp+1)*int64(time.Second) - 1
+	}
+	return timestamp, nil
+}
+
+// splitExpiringValue splits the value of a SETEXAT record into the
+// expiry and the value that was set
+func splitExpiringValue(field string) (int64, string, error) {
+	expiry, value, found := strings.Cut(field, "|")
+	if !found {
+		return 0, "", fmt.Errorf("missing expiry")
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid expiry %q", expiry)
+	}
+	return expiresAt, value, nil
+}
+
+// truncateRecord shortens a record for a log message
+func truncateRecord(record string) string {
+	if len(record) > 64 {
+		return record[:64] + "..."
+	}
+	return record
+}
+
+// verifyLegacyWAL is verifyWAL for a text WAL: every line must be a
+// complete record with a timestamp, a known operation, a key and a value.
+// The text format has no checksums, so damage inside a key or value that
+// keeps the framing intact is not detected.
+func verifyLegacyWAL(section *io.SectionReader) (*WALReport, error) {
+	report := &WALReport{CorruptOffset: -1}
+	reader := bufio.NewReaderSize(section, walReadBufferSize)
+
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading WAL: %v", err)
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		problem := legacyRecordProblem(line)
+		if problem != "" {
+			report.CorruptOffset = offset
+			report.Problem = problem
+			break
+		}
+		if line != "\n" {
+			report.Records++ // blank lines are left by ClearErrors
+		}
+		offset += int64(len(line))
+	}
+
+	report.Bytes = section.Size()
+	return report, nil
+}
+
+// legacyRecordProblem describes what is wrong with one line of a text
+// WAL, including its newline, or returns "" if it would replay
+func legacyRecordProblem(line string) string {
+	if !strings.HasSuffix(line, "\n") {
+		return "record is missing its line ending (torn write)"
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" {
+		return ""
+	}
+
+	parts := strings.SplitN(line, "|", 4)
+	if len(parts) < 4 {
+		return fmt.Sprintf("expected 4 fields, found %d", len(parts))
+	}
+	switch parts[1] {
+	case "BEGIN", "COMMIT", "ABORT":
+		if _, err := parseLegacyTimestamp(parts[0]); err != nil {
+			return fmt.Sprintf("invalid timestamp %q", parts[0])
+		}
+		return ""
+	}
+	if _, _, err := parseLegacyRecord(line); err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The WAL starts with a header:
+//
+//	magic    uint32 walMagic
+//	version  uint32 entry layout of the records (see entry_format.go)
+//
+// followed by records:
+//
+//	length   uint32 size of the type and entry
+//	checksum uint32 CRC32 of the type and entry
+//	type     byte   walEntry, walBegin, walCommit or walAbort
+//	entry    Entry in the layout of the header's version
+//
+// A SET is logged as an entry record holding the value and its expiry, a
+// DEL as one holding a tombstone. Transaction markers (see
+// wal_transaction.go) hold an entry with an empty key. Records are
+// replayed up to the first one that is cut short or fails its checksum.
+// Integers are little endian, as in SSTables.
+
+const (
+	walMagic            = 0x4C575253 // "SRWL" on disk
+	walHeaderSize       = 8
+	walRecordHeaderSize = 8
+)
+
+// Record types
+const (
+	walEntry  byte = 1
+	walBegin  byte = 2
+	walCommit byte = 3
+	walAbort  byte = 4
+)
+
+// walVersion is the entry layout new WAL files are written in. Files of
+// older versions are still replayed, and appended to in their own layout
+// until a rewrite or reset starts a new file.
+const walVersion = Version
+
+// walVersionSupported reports whether WAL records of version can be read.
+// The dictionary layout is only used by SSTables.
+func walVersionSupported(version uint32) bool {
+	return version >= VersionV1 && version <= Version
+}
+
+// walWrite is one record to append. The value is a string so the
+// command layer's arguments are logged without being copied.
+type walWrite struct {
+	kind      byte
+	key       string
+	value     string
+	deleted   bool
+	expiresAt int64
+}
+
+// walRecord is one record read back from the WAL
+type walRecord struct {
+	kind  byte
+	entry *Entry
+	raw   []byte // the record as in the file, kept by a rewrite
+}
+
+// appendWALHeader appends the header of a WAL in version to buf
+func appendWALHeader(buf []byte, version uint32) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, walMagic)
+	return binary.LittleEndian.AppendUint32(buf, version)
+}
+
+// appendWALRecord appends record, written at timestamp, to buf in the
+// layout of version
+func appendWALRecord(buf []byte, record walWrite, timestamp int64, version uint32) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, walRecordHeaderSize)...)
+	buf = append(buf, record.kind)
+	buf = appendEntryFields(buf, record.key, record.value, timestamp, record.deleted, record.expiresAt, version)
+
+	body := buf[start+walRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(body))
+	return buf
+}
+
+// readWALHeader returns the version in a WAL header, or ok=false if the
+// bytes aren't one
+func readWALHeader(header []byte) (uint32, bool) {
+	if len(header) < walHeaderSize || binary.LittleEndian.Uint32(header) != walMagic {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(header[4:]), true
+}
+
+// walReader reads the records of a WAL one at a time
+type walReader struct {
+	reader  *bufio.Reader
+	version uint32
+	size    int64
+
+	// offset is where the next record starts, and raw holds the last
+	// record read, header included; reused from one record to the next
+	offset int64
+	raw    []byte
+}
+
+// newWALReader reads the header of the first size bytes of file
+func newWALReader(file io.ReaderAt, size int64) (*walReader, error) {
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, size), walReadBufferSize)
+
+	header := make([]byte, walHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read header: %v", ErrWALCorrupt, err)
+	}
+	version, ok := readWALHeader(header)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid header", ErrWALCorrupt)
+	}
+	if !walVersionSupported(version) {
+		return nil, fmt.Errorf("unsupported WAL entry version %d (versions %d to %d can be read); it may have been written by a newer server",
+			version, VersionV1, Version)
+	}
+
+	return &walReader{
+		reader:  reader,
+		version: version,
+		size:    size,
+		offset:  walHeaderSize,
+	}, nil
+}
+
+// next reads the record at r.offset and moves past it. It returns io.EOF
+// at the end of the log, and an ErrWALCorrupt error if the record is cut
+// short or damaged, leaving r.offset at its start.
+func (r *walReader) next() (walRecord, error) {
+	remaining := r.size - r.offset
+	if remaining == 0 {
+		return walRecord{}, io.EOF
+	}
+	if remaining < walRecordHeaderSize {
+		return walRecord{}, fmt.Errorf("%w: record header is cut short (torn write)", ErrWALCorrupt)
+	}
+
+	var header [walRecordHeaderSize]byte
+	_, err := io.ReadFull(r.reader, header[:])
+	if err != nil {
+		return walRecord{}, fmt.Errorf("failed to read record: %v", err)
+	}
+	length := int64(binary.LittleEndian.Uint32(header[:]))
+	checksum := binary.LittleEndian.Uint32(header[4:])
+
+	// The length is checked against the file before anything is
+	// allocated for it
+	if length > remaining-walRecordHeaderSize {
+		return walRecord{}, fmt.Errorf("%w: record of %d bytes runs past the end of the log (torn write)", ErrWALCorrupt, length)
+	}
+	if length == 0 {
+		return walRecord{}, fmt.Errorf("%w: empty record", ErrWALCorrupt)
+	}
+
+	r.raw = append(r.raw[:0], header[:]...)
+	r.raw = append(r.raw, make([]byte, length)...)
+	body := r.raw[walRecordHeaderSize:]
+	_, err = io.ReadFull(r.reader, body)
+	if err != nil {
+		return walRecord{}, fmt.Errorf("failed to read record: %v", err)
+	}
+
+	if crc32.ChecksumIEEE(body) != checksum {
+		return walRecord{}, fmt.Errorf("%w: checksum mismatch", ErrWALCorrupt)
+	}
+	kind := body[0]
+	if kind < walEntry || kind > walAbort {
+		return walRecord{}, fmt.Errorf("%w: unknown record type %d", ErrWALCorrupt, kind)
+	}
+
+	entryReader := bytes.NewReader(body[1:])
+	entry, err := DecodeEntry(entryReader, int64(entryReader.Len()), r.version)
+	if err == nil && entryReader.Len() > 0 {
+		err = fmt.Errorf("%d bytes left over", entryReader.Len())
+	}
+	if err != nil {
+		return walRecord{}, fmt.Errorf("%w: invalid entry: %v", ErrWALCorrupt, err)
+	}
+
+	r.offset += int64(len(r.raw))
+	return walRecord{kind: kind, entry: entry}, nil
+}
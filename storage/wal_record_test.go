@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayLog is a KVStore that records what a recovery replays
+type replayLog []Entry
+
+func (l *replayLog) ReplaySet(key string, value []byte, expiresAt int64, timestamp int64) error {
+	*l = append(*l, Entry{Key: key, Value: value, ExpiresAt: expiresAt, Timestamp: timestamp})
+	return nil
+}
+
+func (l *replayLog) ReplayDelete(key string, timestamp int64) error {
+	*l = append(*l, Entry{Key: key, Deleted: true, Timestamp: timestamp})
+	return nil
+}
+
+// recoverWAL opens the WAL at path, replays it and closes it
+func recoverWAL(t *testing.T, path string) replayLog {
+	t.Helper()
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	defer wal.Close()
+
+	var log replayLog
+	err = wal.Recover(&log)
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	return log
+}
+
+func checkReplayed(t *testing.T, got replayLog, want ...Entry) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d records, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Key != w.Key || string(g.Value) != string(w.Value) || g.Deleted != w.Deleted || g.ExpiresAt != w.ExpiresAt {
+			t.Errorf("record %d: got %+v, want %+v", i, g, w)
+		}
+		if w.Timestamp != 0 && g.Timestamp != w.Timestamp {
+			t.Errorf("record %d: timestamp %d, want %d", i, g.Timestamp, w.Timestamp)
+		}
+	}
+}
+
+func TestWALRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "1")
+	wal.WriteExpiringEntry("b", "2", 1<<60)
+	wal.WriteEntry("DEL", "a", "")
+	if err := wal.WriteEntry("INCR", "a", ""); err == nil {
+		t.Error("WriteEntry accepted an unknown operation")
+	}
+	wal.Close()
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "a", Value: []byte("1")},
+		Entry{Key: "b", Value: []byte("2"), ExpiresAt: 1 << 60},
+		Entry{Key: "a", Deleted: true},
+	)
+}
+
+// A WAL whose header says its entries are in an older layout is replayed
+// in that layout, and appended to in it
+func TestWALRecoverOlderVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	data := appendWALHeader(nil, VersionV1)
+	data = appendWALRecord(data, walWrite{kind: walEntry, key: "old", value: "v1"}, 1000, VersionV1)
+	data = appendWALRecord(data, walWrite{kind: walEntry, key: "gone", deleted: true}, 2000, VersionV1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "old", Value: []byte("v1"), Timestamp: 1000},
+		Entry{Key: "gone", Deleted: true, Timestamp: 2000},
+	)
+
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "new", "v")
+	wal.Close()
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "old", Value: []byte("v1")},
+		Entry{Key: "gone", Deleted: true},
+		Entry{Key: "new", Value: []byte("v")},
+	)
+	report, err := VerifyWALFile(path)
+	if err != nil || !report.OK() || report.Records != 3 {
+		t.Errorf("VerifyWALFile: %v, %v", report, err)
+	}
+}
+
+func TestWALRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	if err := os.WriteFile(path, appendWALHeader(nil, Version+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWAL(path); err == nil {
+		t.Error("NewWAL opened a WAL of a newer version")
+	}
+}
+
+// A WAL left in the old text format is converted when it is opened,
+// replaying what the text recovery would have
+func TestWALConvertsLegacyText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	text := "1699123456000000000|SET|user:1|Alice\n" +
+		"1699123459|SET|user:3|Charlie\n" +
+		"1699123460000000000|SETEXAT|session:9|1699127060000000000|token\n" +
+		"\n" +
+		"1699123461000000000|BEGIN||\n" +
+		"1699123462000000000|SET|tx:1|a\n" +
+		"1699123463000000000|DEL|user:1|\n"
+	tx := &walTransaction{}
+	tx.add([]byte("1699123462000000000|SET|tx:1|a\n"))
+	tx.add([]byte("1699123463000000000|DEL|user:1|\n"))
+	text += "1699123464000000000|COMMIT|2|" + fmt.Sprintf("%08x", tx.crc) + "\n" +
+		"1699123465000000000|BEGIN||\n" +
+		"1699123466000000000|SET|uncommitted|x\n"
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "user:1", Value: []byte("Alice"), Timestamp: 1699123456000000000},
+		Entry{Key: "user:3", Value: []byte("Charlie"), Timestamp: 1699123460000000000 - 1},
+		Entry{Key: "session:9", Value: []byte("token"), ExpiresAt: 1699127060000000000},
+		Entry{Key: "tx:1", Value: []byte("a")},
+		Entry{Key: "user:1", Deleted: true, Timestamp: 1699123463000000000},
+	)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, ok := readWALHeader(data); !ok || version != walVersion {
+		t.Errorf("converted WAL header is %q", data[:min(len(data), walHeaderSize)])
+	}
+}
+
+// Recovery stops at a record cut short by a crash and truncates the log
+// there, so the next write follows the last good record
+func TestWALRecoverTruncatesTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "1")
+	wal.WriteEntry("SET", "b", "2")
+	wal.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := info.Size()
+	torn := appendWALRecord(nil, walWrite{kind: walEntry, key: "c", value: "3"}, 1, walVersion)
+	appendFile(t, path, torn[:len(torn)-2])
+
+	report, err := VerifyWALFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Records != 2 || report.CorruptOffset != good {
+		t.Errorf("VerifyWALFile on a torn log: %v", report)
+	}
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "a", Value: []byte("1")},
+		Entry{Key: "b", Value: []byte("2")},
+	)
+	info, err = os.Stat(path)
+	if err != nil || info.Size() != good {
+		t.Fatalf("WAL is %d bytes after recovery, want %d (%v)", info.Size(), good, err)
+	}
+
+	wal, err = NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "d", "4")
+	wal.Close()
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "a", Value: []byte("1")},
+		Entry{Key: "b", Value: []byte("2")},
+		Entry{Key: "d", Value: []byte("4")},
+	)
+}
+
+// A byte changed inside a value fails the record's checksum
+func TestWALChecksumCatchesDamagedValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "hello")
+	wal.WriteEntry("SET", "b", "world")
+	wal.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := int64(len(appendWALRecord(nil, walWrite{kind: walEntry, key: "a", value: "hello"}, 0, walVersion)))
+	i := walHeaderSize + int(first) + walRecordHeaderSize + 1 + 4 + 1 + 4 // "world"
+	data[i] ^= 0x20
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyWALFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Records != 1 || report.CorruptOffset != walHeaderSize+first {
+		t.Errorf("VerifyWALFile: %v", report)
+	}
+	checkReplayed(t, recoverWAL(t, path), Entry{Key: "a", Value: []byte("hello")})
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A rewrite keeps the newest record of each key, copied as it is, so the
+// new file stays in the old one's version
+func TestWALRewriteKeepsVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	data := appendWALHeader(nil, VersionV1)
+	for i, value := range []string{"1", "2", "3"} {
+		data = appendWALRecord(data, walWrite{kind: walEntry, key: "k", value: value}, int64(i+1), VersionV1)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	wal.WriteEntry("SET", "other", "x")
+	wal.Close()
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, ok := readWALHeader(data); !ok || version != VersionV1 {
+		t.Errorf("rewritten WAL has version %d, want %d", version, VersionV1)
+	}
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "k", Value: []byte("3"), Timestamp: 3},
+		Entry{Key: "other", Value: []byte("x")},
+	)
+}
+
+// finalState applies replayed records in order, the newest record of each
+// key winning
+func finalState(log replayLog) map[string]Entry {
+	state := make(map[string]Entry)
+	for _, entry := range log {
+		state[entry.Key] = entry
+	}
+	return state
+}
+
+// A rewrite coalesces many overwrites and deletes of a few keys into one
+// record per key, and replaying it gives the same state as the original
+func TestWALRewriteCoalesces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		wal.WriteEntry("SET", fmt.Sprintf("k%d", i%4), fmt.Sprintf("value %d", i))
+	}
+	wal.WriteEntry("DEL", "k3", "")
+	wal.WriteExpiringEntry("k2", "expiring", 1<<62)
+	wal.Close()
+	before := recoverWAL(t, path)
+	sizeBefore := fileSize(t, path)
+
+	wal, err = NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	wal.Close()
+	after := recoverWAL(t, path)
+
+	if len(after) != 4 {
+		t.Errorf("rewritten WAL replays %d records, want one per key: %+v", len(after), after)
+	}
+	if size := fileSize(t, path); size >= sizeBefore/10 {
+		t.Errorf("rewritten WAL is %d bytes, was %d", size, sizeBefore)
+	}
+	want, got := finalState(before), finalState(after)
+	for key, w := range want {
+		g := got[key]
+		if string(g.Value) != string(w.Value) || g.Deleted != w.Deleted || g.ExpiresAt != w.ExpiresAt || g.Timestamp != w.Timestamp {
+			t.Errorf("%s after the rewrite = %+v, want %+v", key, g, w)
+		}
+	}
+}
+
+// Once the WAL reaches the rewrite size it is rewritten in the background
+func TestWALRewritesAutomatically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	wal.SetRewriteSize(4096)
+
+	for i := 0; i < 1000; i++ {
+		wal.WriteEntry("SET", "k", fmt.Sprintf("value %d", i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for wal.rewriting.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Writes that come in during a rewrite are carried over as they are,
+	// so the last rewrite may not leave one record; but the log never
+	// stays at twice what that rewrite left without being rewritten again
+	wal.mu.Lock()
+	size, base := wal.size, wal.rewriteBase
+	wal.mu.Unlock()
+	if base == 0 {
+		t.Fatalf("WAL of %d bytes was never rewritten", size)
+	}
+	if size >= 2*base {
+		t.Errorf("WAL is %d bytes, twice the %d its last rewrite left, and wasn't rewritten again", size, base)
+	}
+	if onDisk := fileSize(t, path); onDisk != size {
+		t.Errorf("WAL file is %d bytes, the WAL counts %d", onDisk, size)
+	}
+	wal.WriteEntry("SET", "other", "x")
+	wal.Close()
+
+	state := finalState(recoverWAL(t, path))
+	if string(state["k"].Value) != "value 999" || string(state["other"].Value) != "x" || len(state) != 2 {
+		t.Errorf("recovered %+v after automatic rewrites", state)
+	}
+}
+
+// Values over 64KB, and over the read buffer, are replayed rather than
+// failing recovery, in both the current and the legacy text format, and
+// survive a rewrite
+func TestWALRecoverLargeValues(t *testing.T) {
+	medium := strings.Repeat("m", 100<<10)
+	large := strings.Repeat("L", walReadBufferSize+1000)
+
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "medium", medium)
+	wal.WriteEntry("SET", "large", large)
+	wal.WriteEntry("SET", "after", "small")
+	wal.Close()
+	want := []Entry{
+		{Key: "medium", Value: []byte(medium)},
+		{Key: "large", Value: []byte(large)},
+		{Key: "after", Value: []byte("small")},
+	}
+	checkReplayed(t, recoverWAL(t, path), want...)
+
+	wal, err = NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	wal.Close()
+	got := finalState(recoverWAL(t, path))
+	for _, w := range want {
+		if string(got[w.Key].Value) != string(w.Value) {
+			t.Errorf("%s after the rewrite has %d bytes, want %d", w.Key, len(got[w.Key].Value), len(w.Value))
+		}
+	}
+
+	legacy := filepath.Join(t.TempDir(), "wal.log")
+	text := "1699123456000000000|SET|medium|" + medium + "\n" +
+		"1699123457000000000|SET|after|small\n"
+	if err := os.WriteFile(legacy, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkReplayed(t, recoverWAL(t, legacy),
+		Entry{Key: "medium", Value: []byte(medium)},
+		Entry{Key: "after", Value: []byte("small")},
+	)
+}
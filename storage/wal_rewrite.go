@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DefaultWALRewriteSize is the smallest WAL that is rewritten automatically
+const DefaultWALRewriteSize = 64 * 1024 * 1024
+
+// The WAL is never truncated, records of writes that are already in
+// SSTables included, so it is rewritten to hold just the newest record of
+// each key once it is at least rewriteSize and has doubled since the last
+// rewrite. Replaying that gives the same state: every older record of a
+// key would be skipped for the newer one anyway.
+
+// SetRewriteSize sets the size at which the WAL starts being rewritten
+// automatically; 0 turns automatic rewrites off
+func (w *WAL) SetRewriteSize(size int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rewriteSize = size
+}
+
+// maybeRewrite starts a background rewrite if the WAL has grown enough.
+// Caller must hold w.mu.
+func (w *WAL) maybeRewrite() {
+	if w.rewriteSize <= 0 || w.size < w.rewriteSize || w.size < 2*w.rewriteBase {
+		return
+	}
+	if !w.rewriting.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer w.rewriting.Store(false)
+		err := w.rewrite()
+		if err != nil {
+			fmt.Printf("WAL rewrite failed: %v\n", err)
+		}
+	}()
+}
+
+// Rewrite coalesces the WAL now
+func (w *WAL) Rewrite() error {
+	if w.disabled() {
+		return nil
+	}
+	if !w.rewriting.CompareAndSwap(false, true) {
+		return fmt.Errorf("WAL rewrite already in progress")
+	}
+	defer w.rewriting.Store(false)
+	return w.rewrite()
+}
+
+// rewrite coalesces the records written so far into a new file without
+// blocking writers, then briefly takes the lock to copy over what was
+// written in the meantime and swap the new file in
+func (w *WAL) rewrite() error {
+	// The file size rather than w.size: a failed write may have left part
+	// of a record behind
+	w.mu.Lock()
+	info, err := w.file.Stat()
+	resets := w.resets
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	tmpPath := w.path + ".rewrite"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer tmp.Close()
+	defer os.Remove(tmpPath) // a no-op once renamed
+
+	records, version, end, err := w.latestRecords(end)
+	if err != nil {
+		return err
+	}
+
+	// The records are copied as they are, so the new file keeps the
+	// old one's version
+	writer := bufio.NewWriter(tmp)
+	writer.Write(appendWALHeader(nil, version))
+	for _, record := range records {
+		writer.Write(record)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.resets != resets {
+		return fmt.Errorf("WAL was reset during the rewrite")
+	}
+
+	// Records written since end go after the coalesced ones, as they are
+	source, err := os.Open(w.path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %v", err)
+	}
+	defer source.Close()
+
+	info, err = source.Stat()
+	if err != nil {
+		return err
+	}
+	oldSize := info.Size()
+
+	_, err = io.Copy(writer, io.NewSectionReader(source, end, oldSize-end))
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write rewritten WAL: %v", err)
+	}
+
+	info, err = tmp.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, w.path)
+	if err != nil {
+		return fmt.Errorf("failed to rename rewritten WAL: %v", err)
+	}
+	err = SyncDir(filepath.Dir(w.path))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen WAL: %v", err)
+	}
+	w.file.Close()
+	w.file = file
+	w.writer.Reset(file)
+	w.version = version
+
+	fmt.Printf("WAL rewritten: %d -> %d bytes\n", oldSize, info.Size())
+	w.size = info.Size()
+	w.rewriteBase = w.size
+	return nil
+}
+
+// latestRecords reads the first end bytes of the WAL and returns the last
+// record of each key, in key order, as they are in the file, along with
+// the file's version. The records of transactions that weren't committed
+// are dropped. If a transaction is still being written at end, it is left
+// out and where it begins is returned, so its records are carried over
+// with their markers; otherwise end is returned. Reading stops at a
+// damaged record, which is carried over too.
+func (w *WAL) latestRecords(end int64) ([][]byte, uint32, int64, error) {
+	file, err := os.Open(w.path)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to open WAL: %v", err)
+	}
+	defer file.Close()
+
+	reader, err := newWALReader(file, end)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	latest := make(map[string][]byte)
+	var transactions walTransactionReader
+	for {
+		offset := reader.offset
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrWALCorrupt) {
+			end = offset
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("error reading WAL: %v", err)
+		}
+
+		// A transaction's records are only handed back at its COMMIT,
+		// after reader.raw has moved on
+		record.raw = bytes.Clone(reader.raw)
+		for _, record := range transactions.read(record, reader.raw, offset) {
+			latest[record.entry.Key] = record.raw
+		}
+	}
+	if tx := transactions.unfinished(); tx != nil {
+		end = tx.start
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([][]byte, len(keys))
+	for i, key := range keys {
+		records[i] = latest[key]
+	}
+	return records, reader.version, end, nil
+}
@@ -0,0 +1,466 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Recovering into an LSMStore puts the logged writes back in its
+// memtable, with binary values intact
+func TestWALRecoverIntoLSMStore(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	binary := string([]byte{0, 1, '\n', 0xff})
+	wal, err := NewWAL("wal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "1")
+	wal.WriteEntry("SET", "b", binary)
+	wal.WriteExpiringEntry("c", "3", 1<<62)
+	wal.WriteEntry("SET", "a", "2")
+	wal.WriteEntry("SET", "gone", "x")
+	wal.WriteEntry("DEL", "gone", "")
+	wal.Close()
+
+	store, err := NewLSMStore(0, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.WAL.Close()
+	})
+
+	if n := store.NumSSTables(); n != 0 {
+		t.Errorf("recovery flushed %d SSTables, want the writes left in the memtable", n)
+	}
+	for key, want := range map[string]string{"a": "2", "b": binary, "c": "3"} {
+		value, found, _ := store.memTable.Get(key)
+		if !found || !bytes.Equal(value, []byte(want)) {
+			t.Errorf("memtable %s = %q, %v; want %q", key, value, found, want)
+		}
+	}
+	if entry, found := store.memTable.Lookup("gone"); !found || !entry.Deleted {
+		t.Errorf("memtable gone = %+v, want a tombstone", entry)
+	}
+	if expiresAt, _ := store.ExpiresAt("c"); expiresAt != 1<<62 {
+		t.Errorf("c expires at %d, want %d", expiresAt, int64(1<<62))
+	}
+	if _, found, _ := store.Get("gone"); found {
+		t.Error("gone is still there after its DEL was replayed")
+	}
+
+	// A store opened on the same WAL again recovers the same keys
+	store.Close()
+	store.WAL.Close()
+	store, err = NewLSMStore(0, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	if value, found, _ := store.Get("a"); !found || string(value) != "2" {
+		t.Errorf("a = %q, %v after a second recovery", value, found)
+	}
+}
+
+// Writes and resets while the WAL is paused leave the log as it was, and
+// logging picks up again on resume
+func TestWALPause(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	wal, err := NewWAL("wal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "1")
+	resume := wal.Pause()
+	wal.WriteEntry("SET", "paused", "x")
+	wal.WriteExpiringEntry("paused-ttl", "x", 1<<62)
+	if err := wal.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	resume()
+	wal.WriteEntry("SET", "b", "2")
+	wal.Close()
+
+	store, err := NewLSMStore(0, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.WAL.Close()
+	})
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if value, found, _ := store.Get(key); !found || string(value) != want {
+			t.Errorf("%s = %q, %v; want %q", key, value, found, want)
+		}
+	}
+	for _, key := range []string{"paused", "paused-ttl"} {
+		if _, found, _ := store.Get(key); found {
+			t.Errorf("%s was logged while the WAL was paused", key)
+		}
+	}
+}
+
+// A WAL larger than the memtable is streamed into SSTables during
+// recovery: the memtable never holds more than one table's worth, and
+// every key is still there afterwards
+func TestWALRecoverLargerThanMemTable(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	const memtableSize = 1024
+	value := strings.Repeat("v", 64)
+	wal, err := NewWAL("wal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		wal.WriteEntry("SET", "key:"+strconv.Itoa(i), value)
+	}
+	wal.WriteEntry("DEL", "key:0", "")
+	wal.Close()
+
+	store, err := NewLSMStore(memtableSize, "data")
+	if err != nil {
+		t.Fatalf("NewLSMStore: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store.WAL.Close()
+	})
+
+	if n := store.NumSSTables(); n < 2 {
+		t.Errorf("recovery flushed %d SSTables, want several", n)
+	}
+	if size := store.memTable.Size(); size >= memtableSize+int64(len(value))*2 {
+		t.Errorf("memtable holds %d bytes after recovery, over its size of %d", size, memtableSize)
+	}
+	if _, found, _ := store.Get("key:0"); found {
+		t.Error("key:0 is still there after its DEL was replayed")
+	}
+	for i := 1; i < 30; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if got, found, _ := store.Get(key); !found || string(got) != value {
+			t.Errorf("%s = %q, %v after recovery", key, got, found)
+		}
+	}
+}
+
+// writeSyntheticWAL writes a WAL at path setting records keys in order,
+// each to a value of valueSize bytes, and returns the file's size
+func writeSyntheticWAL(t *testing.T, path string, records, valueSize int) int64 {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriterSize(file, walReadBufferSize)
+
+	buf := appendWALHeader(nil, walVersion)
+	value := strings.Repeat("v", valueSize)
+	size := int64(0)
+	for i := 0; i < records; i++ {
+		record := walWrite{kind: walEntry, key: fmt.Sprintf("key:%08d", i), value: value}
+		buf = appendWALRecord(buf, record, int64(i+1), walVersion)
+		if _, err := writer.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		size += int64(len(buf))
+		buf = buf[:0]
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return size
+}
+
+// Recovering a WAL of millions of records into a small memtable flushes
+// as it goes: the memtables never hold more than their size, however
+// long the log, and every key comes back
+func TestWALRecoverBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes and replays a WAL of a hundred megabytes")
+	}
+	const records, valueSize, memtableSize = 2000000, 32, 4 << 20
+
+	store := openSmallTestStore(t, memtableSize)
+	walSize := writeSyntheticWAL(t, "big.log", records, valueSize)
+	wal, err := NewWAL("big.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wal.Close() })
+
+	// Sample how much the memtables hold while the log is replayed
+	var peak atomic.Int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			store.mu.RLock()
+			held := store.memTable.Size()
+			if store.immutableMemTable != nil {
+				held += store.immutableMemTable.Size()
+			}
+			store.mu.RUnlock()
+			if held > peak.Load() {
+				peak.Store(held)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	store.recovering.Store(true)
+	err = wal.Recover(store)
+	store.recovering.Store(false)
+	close(stop)
+	<-sampled
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	t.Logf("WAL of %d bytes recovered into %d SSTables; memtables peaked at %d bytes, live heap grew by %d",
+		walSize, store.NumSSTables(), peak.Load(), int64(after.HeapAlloc)-int64(before.HeapAlloc))
+
+	if limit := int64(memtableSize + 2*(valueSize+64)); peak.Load() > limit {
+		t.Errorf("memtables held %d bytes during recovery, want at most %d", peak.Load(), limit)
+	}
+	if int64(records)*int64(valueSize) < 10*memtableSize || store.NumSSTables() < 10 {
+		t.Errorf("recovery flushed %d SSTables, want the WAL spread over many", store.NumSSTables())
+	}
+
+	count, err := store.CountKeys()
+	if err != nil || count != records {
+		t.Errorf("CountKeys = %d, %v; want %d", count, err, records)
+	}
+	value := strings.Repeat("v", valueSize)
+	for i := 0; i < records; i += 9973 {
+		key := fmt.Sprintf("key:%08d", i)
+		if got, found, _ := store.Get(key); !found || string(got) != value {
+			t.Fatalf("%s = %q, %v after recovery", key, got, found)
+		}
+	}
+}
+
+// Writers running at once each get whole records into the log: every
+// record decodes on its own, none is lost, and each writer's records stay
+// in the order it wrote them
+func TestWALConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, perWriter = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%d", w)
+				value := strings.Repeat(strconv.Itoa(i), 1+i%7)
+				var err error
+				if i%3 == 0 {
+					err = wal.WriteExpiringEntry(key, value, int64(i+1))
+				} else {
+					err = wal.WriteEntry("SET", key, value)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	wal.Close()
+
+	replayed := recoverWAL(t, path)
+	if len(replayed) != writers*perWriter {
+		t.Fatalf("replayed %d records, want %d", len(replayed), writers*perWriter)
+	}
+	next := make(map[string]int)
+	for _, entry := range replayed {
+		i := next[entry.Key]
+		next[entry.Key]++
+		if want := strings.Repeat(strconv.Itoa(i), 1+i%7); string(entry.Value) != want {
+			t.Fatalf("record %d of %s holds %q, want %q", i, entry.Key, entry.Value, want)
+		}
+		if (i%3 == 0) != (entry.ExpiresAt == int64(i+1)) {
+			t.Fatalf("record %d of %s expires at %d", i, entry.Key, entry.ExpiresAt)
+		}
+	}
+}
+
+// Logging a write reuses the WAL's buffer instead of allocating
+func TestWALWriteDoesNotAllocate(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	value := strings.Repeat("v", 100)
+	wal.WriteEntry("SET", "key", value) // sizes the buffer
+	allocs := testing.AllocsPerRun(100, func() {
+		wal.WriteEntry("SET", "key", value)
+	})
+	if allocs != 0 {
+		t.Errorf("WriteEntry allocates %.1f times per call", allocs)
+	}
+}
+
+func BenchmarkWALWriteEntry(b *testing.B) {
+	wal, err := NewWAL(filepath.Join(b.TempDir(), "wal.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer wal.Close()
+
+	value := strings.Repeat("v", 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wal.WriteEntry("SET", "key", value)
+	}
+}
+
+func BenchmarkWALWriteEntryParallel(b *testing.B) {
+	wal, err := NewWAL(filepath.Join(b.TempDir(), "wal.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer wal.Close()
+
+	value := strings.Repeat("v", 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			wal.WriteEntry("SET", "key", value)
+		}
+	})
+}
+
+// A write that is both in the WAL and in an SSTable, as after a crash
+// between a flush and the WAL reset, is replayed by timestamp: an older
+// logged write never replaces a newer value on disk. Replaying twice
+// gives the same result.
+func TestWALReplayOverSSTables(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	wal, err := NewWAL("wal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "wal")
+	wal.WriteEntry("DEL", "b", "")
+	wal.WriteEntry("SET", "c", "wal")
+	wal.WriteEntry("DEL", "d", "")
+	wal.Close()
+
+	newer := time.Now().Add(time.Hour).UnixNano()
+	if err := os.Mkdir("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = CreateSSTable(filepath.Join("data", "sstable-0.db"), []*Entry{
+		{Key: "a", Value: []byte("sstable"), Timestamp: newer},
+		{Key: "b", Value: []byte("sstable"), Timestamp: newer},
+		{Key: "c", Value: []byte("sstable"), Timestamp: 1},
+		{Key: "d", Value: []byte("sstable"), Timestamp: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "sstable", "b": "sstable", "c": "wal"}
+	for round := 1; round <= 2; round++ {
+		store, err := NewLSMStore(0, "data")
+		if err != nil {
+			t.Fatalf("NewLSMStore: %v", err)
+		}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			value, found, _ := store.Get(key)
+			if string(value) != want[key] || found != (want[key] != "") {
+				t.Errorf("round %d: %s = %q, %v; want %q", round, key, value, found, want[key])
+			}
+		}
+		store.Close()
+		store.WAL.Close()
+	}
+}
+
+// Writes that keep failing put the WAL in the failed state once there
+// are WALFailureThreshold of them in a row; ClearErrors lets writes
+// through again and the log stays readable
+func TestWALFailureThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	wal.WriteEntry("SET", "before", "1")
+
+	// Swap in a handle that can't be written, as with a full disk
+	file := wal.file
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	wal.file = readOnly
+	wal.writer.Reset(readOnly)
+
+	for i := 1; i <= WALFailureThreshold; i++ {
+		if wal.Failed() {
+			t.Fatalf("failed after %d failed writes, want %d", i-1, WALFailureThreshold)
+		}
+		if err := wal.WriteEntry("SET", "lost", "x"); err == nil {
+			t.Fatal("write to a read-only file succeeded")
+		}
+	}
+	if !wal.Failed() {
+		t.Fatalf("not failed after %d failed writes", WALFailureThreshold)
+	}
+
+	wal.file = file
+	if err := wal.ClearErrors(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.Failed() {
+		t.Error("still failed after ClearErrors")
+	}
+	if err := wal.WriteEntry("SET", "after", "2"); err != nil {
+		t.Fatalf("write after ClearErrors: %v", err)
+	}
+	wal.Close()
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "before", Value: []byte("1")},
+		Entry{Key: "after", Value: []byte("2")},
+	)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// A transaction's records are framed by a BEGIN and a COMMIT record. The
+// COMMIT's value is the number of records in between and their CRC32,
+// each a uint32. Recovery holds the records back until it reads a COMMIT
+// that matches them, so a crash part way through a transaction, or damage
+// inside one, replays none of it. A transaction a crash left open is
+// closed with an ABORT record when the log is next recovered, so the
+// records written after the restart aren't taken as part of it.
+
+// walTransaction collects the records of one transaction
+type walTransaction struct {
+	crc     uint32
+	count   int
+	records []walRecord // read back by recovery; the writer only checksums
+	start   int64       // offset of the BEGIN record
+}
+
+// add checksums one record as it is in the file, header included
+func (tx *walTransaction) add(record []byte) {
+	tx.crc = crc32.Update(tx.crc, crc32.IEEETable, record)
+	tx.count++
+}
+
+// commitValue is the count and checksum a COMMIT record carries
+func (tx *walTransaction) commitValue() string {
+	value := binary.LittleEndian.AppendUint32(nil, uint32(tx.count))
+	return string(binary.LittleEndian.AppendUint32(value, tx.crc))
+}
+
+// matches reports whether a COMMIT record's value is the count and
+// checksum of the records read since BEGIN
+func (tx *walTransaction) matches(value []byte) bool {
+	return string(value) == tx.commitValue()
+}
+
+// BeginTransaction writes a BEGIN marker. The records written until
+// CommitTransaction are replayed together or not at all. Only one
+// transaction may be open, and nothing outside it may write meanwhile.
+func (w *WAL) BeginTransaction() error {
+	if w.disabled() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.tx != nil {
+		return fmt.Errorf("WAL transaction already open")
+	}
+	err := w.writeRecord(walWrite{kind: walBegin})
+	if err != nil {
+		return err
+	}
+	w.tx = &walTransaction{}
+	return nil
+}
+
+// CommitTransaction writes the COMMIT marker that makes the open
+// transaction's records replayable. If it fails, recovery drops them.
+func (w *WAL) CommitTransaction() error {
+	if w.disabled() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.tx == nil {
+		return fmt.Errorf("no WAL transaction open")
+	}
+	value := w.tx.commitValue()
+	w.tx = nil
+	return w.writeRecord(walWrite{kind: walCommit, value: value})
+}
+
+// abortTransaction closes a transaction left open by a crash
+func (w *WAL) abortTransaction() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeRecord(walWrite{kind: walAbort})
+}
+
+// walTransactionReader tracks transaction markers while the log is read
+// back, deciding for each record whether to use it now, hold it back, or
+// drop it
+type walTransactionReader struct {
+	tx *walTransaction // open transaction, nil outside one
+}
+
+// read takes one record of the log, raw as it is in the file starting at
+// offset, and returns the records that can be used: the record itself
+// outside a transaction, a committed transaction's records at its COMMIT,
+// and nothing otherwise. Dropped transactions are logged.
+func (r *walTransactionReader) read(record walRecord, raw []byte, offset int64) []walRecord {
+	switch record.kind {
+	case walBegin:
+		if r.tx != nil {
+			fmt.Printf("dropping %d WAL records of a transaction that was never committed\n", len(r.tx.records))
+		}
+		r.tx = &walTransaction{start: offset}
+		return nil
+
+	case walAbort:
+		r.tx = nil
+		return nil
+
+	case walCommit:
+		tx := r.tx
+		r.tx = nil
+		if tx == nil {
+			fmt.Printf("ignoring WAL COMMIT at offset %d outside a transaction\n", offset)
+			return nil
+		}
+		if !tx.matches(record.entry.Value) {
+			fmt.Printf("dropping %d WAL records of a transaction whose checksum doesn't match\n", len(tx.records))
+			return nil
+		}
+		return tx.records
+	}
+
+	if r.tx == nil {
+		return []walRecord{record}
+	}
+	r.tx.add(raw)
+	r.tx.records = append(r.tx.records, record)
+	return nil
+}
+
+// unfinished returns the transaction still open at the end of the log,
+// or nil. Its records must not be used.
+func (r *walTransactionReader) unfinished() *walTransaction {
+	return r.tx
+}
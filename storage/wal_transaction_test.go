@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTransaction logs a SET outside any transaction, then a transaction
+// of two writes, and returns the log's size just before its COMMIT
+func writeTransaction(t *testing.T, path string) int64 {
+	t.Helper()
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	wal.WriteEntry("SET", "before", "x")
+	if err := wal.BeginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "a", "1")
+	wal.WriteEntry("DEL", "before", "")
+	beforeCommit := wal.size
+	if err := wal.CommitTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	return beforeCommit
+}
+
+func TestWALTransactionCommitted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	writeTransaction(t, path)
+
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "before", Value: []byte("x")},
+		Entry{Key: "a", Value: []byte("1")},
+		Entry{Key: "before", Deleted: true},
+	)
+}
+
+// A log cut off before the COMMIT replays none of the transaction, and
+// what is written after the restart isn't taken as part of it
+func TestWALTransactionWithoutCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	beforeCommit := writeTransaction(t, path)
+	if err := os.Truncate(path, beforeCommit); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplayed(t, recoverWAL(t, path), Entry{Key: "before", Value: []byte("x")})
+
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteEntry("SET", "after", "y")
+	wal.Close()
+	checkReplayed(t, recoverWAL(t, path),
+		Entry{Key: "before", Value: []byte("x")},
+		Entry{Key: "after", Value: []byte("y")},
+	)
+}
+
+// A COMMIT whose count and checksum don't match the records before it
+// drops the transaction
+func TestWALTransactionChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.BeginTransaction()
+	wal.WriteEntry("SET", "a", "1")
+	wal.tx.count++ // as if a record had gone missing
+	wal.CommitTransaction()
+	wal.WriteEntry("SET", "b", "2")
+	wal.Close()
+
+	checkReplayed(t, recoverWAL(t, path), Entry{Key: "b", Value: []byte("2")})
+}
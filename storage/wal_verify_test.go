@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeVerifyTestWAL writes a few records and returns the WAL's path and
+// the offset each record starts at, followed by the file size
+func writeVerifyTestWAL(t *testing.T) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	offsets := []int64{fileSize(t, path)}
+	for _, write := range []func() error{
+		func() error { return wal.WriteEntry("SET", "a", "hello") },
+		func() error { return wal.WriteExpiringEntry("b", "world", 1<<60) },
+		func() error { return wal.WriteEntry("DEL", "a", "") },
+		func() error { return wal.WriteEntry("SET", "c", "a somewhat longer value") },
+	} {
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, fileSize(t, path))
+	}
+	return path, offsets
+}
+
+// A clean WAL verifies fully, both as a file and while it is open
+func TestVerifyWALClean(t *testing.T) {
+	path, offsets := writeVerifyTestWAL(t)
+	records, size := len(offsets)-1, offsets[len(offsets)-1]
+
+	report, err := VerifyWALFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != records || report.Bytes != size {
+		t.Errorf("VerifyWALFile = %v, want %d records in %d bytes", report, records, size)
+	}
+
+	wal, err := NewWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	wal.WriteEntry("SET", "d", "after")
+	report, err = wal.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != records+1 {
+		t.Errorf("Verify = %v, want %d records", report, records+1)
+	}
+}
+
+// A byte flipped inside any record is reported at that record's offset,
+// with the records before it counted, and the file is left as it was
+func TestVerifyWALFlippedByte(t *testing.T) {
+	path, offsets := writeVerifyTestWAL(t)
+	clean, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(offsets)-1; i++ {
+		start, end := offsets[i], offsets[i+1]
+		damaged := bytes.Clone(clean)
+		damaged[(start+end)/2] ^= 0x01
+		if err := os.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := VerifyWALFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.OK() || report.CorruptOffset != start || report.Records != i {
+			t.Errorf("record %d damaged: VerifyWALFile = %v, want corruption at %d after %d records", i, report, start, i)
+		}
+		if after, _ := os.ReadFile(path); !bytes.Equal(after, damaged) {
+			t.Errorf("record %d damaged: VerifyWALFile changed the file", i)
+		}
+	}
+}
+
+// In a text WAL, a line that isn't a record is reported at its offset
+func TestVerifyLegacyWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	good := "1699123456000000000|SET|a|1\n1699123457000000000|DEL|a|\n"
+	if err := os.WriteFile(path, []byte(good+"1699123458000000000|SET-b-2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyWALFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.CorruptOffset != int64(len(good)) || report.Records != 2 {
+		t.Errorf("VerifyWALFile = %v, want corruption at %d after 2 records", report, len(good))
+	}
+}
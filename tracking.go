@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// invalidateChannel is the pub/sub channel redirected invalidations are
+// sent on
+const invalidateChannel = "__redis__:invalidate"
+
+// trackingTable remembers which tracking clients have read each key, so
+// they can be told when it changes. A key's entry is dropped once the
+// invalidation is sent; the client has to read the key again to hear
+// about the next change.
+type trackingTable struct {
+	mu   sync.Mutex
+	keys map[string]map[int64]bool // key → ids of clients that read it
+}
+
+// Global table for CLIENT TRACKING
+var tracking = &trackingTable{
+	keys: make(map[string]map[int64]bool),
+}
+
+func (t *trackingTable) remember(key string, id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	readers, exists := t.keys[key]
+	if !exists {
+		readers = make(map[int64]bool)
+		t.keys[key] = readers
+	}
+	readers[id] = true
+}
+
+// invalidate tells every client that read key that it has changed
+func (t *trackingTable) invalidate(key string) {
+	t.mu.Lock()
+	readers := t.keys[key]
+	delete(t.keys, key)
+	t.mu.Unlock()
+
+	for id := range readers {
+		sendInvalidation(id, key)
+	}
+}
+
+// invalidateAll tells tracking clients that every key they read has
+// changed, after the keyspace is flushed
+func (t *trackingTable) invalidateAll() {
+	t.mu.Lock()
+	keys := t.keys
+	t.keys = make(map[string]map[int64]bool)
+	t.mu.Unlock()
+
+	for key, readers := range keys {
+		for id := range readers {
+			sendInvalidation(id, key)
+		}
+	}
+}
+
+// sendInvalidation notifies client id that key changed, on its own
+// connection or on invalidateChannel of the client it redirects to.
+// Clients that have since disconnected or turned tracking off are
+// skipped, as are redirect targets not subscribed to the channel.
+func sendInvalidation(id int64, key string) {
+	// Holding the registry lock keeps the target's outbox open
+	clients.mu.RLock()
+	defer clients.mu.RUnlock()
+
+	sess, exists := clients.sessions[id]
+	if !exists || !sess.tracking.Load() {
+		return
+	}
+
+	target := sess
+	if redirect := sess.trackingRedirect.Load(); redirect != 0 {
+		target, exists = clients.sessions[redirect]
+		if !exists || !pubsub.isSubscribed(invalidateChannel, target) {
+			return
+		}
+	} else if sess.resp3.Load() {
+		// RESP3 has a push type of its own for invalidations
+		sess.push(fmt.Sprintf(">2\r\n$10\r\ninvalidate\r\n*1\r\n%s", bulkString(key)))
+		return
+	}
+
+	target.push(target.pushFrame(fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n*1\r\n%s",
+		len(invalidateChannel), invalidateChannel, bulkString(key))))
+}
+
+// trackingCommand handles CLIENT TRACKING ON|OFF [REDIRECT id]
+func (sess *session) trackingCommand(args []string) string {
+	if len(args) < 3 {
+		return "-ERR wrong number of arguments for 'client|tracking' command\r\n"
+	}
+
+	var on bool
+	switch strings.ToUpper(args[2]) {
+	case "ON":
+		on = true
+	case "OFF":
+		on = false
+	default:
+		return "-ERR syntax error\r\n"
+	}
+
+	redirect := int64(0)
+	for i := 3; i < len(args); i++ {
+		if strings.ToUpper(args[i]) != "REDIRECT" || i+1 >= len(args) || !on {
+			return "-ERR syntax error\r\n"
+		}
+		id, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if _, exists := clients.get(id); !exists {
+			return "-ERR The client ID you want redirect to does not exist\r\n"
+		}
+		redirect = id
+		i++
+	}
+
+	sess.trackingRedirect.Store(redirect)
+	sess.tracking.Store(on)
+	return "+OK\r\n"
+}
+
+// trackReads remembers the keys a read-only command looked at
+func (sess *session) trackReads(command string, args []string) {
+	if !sess.tracking.Load() || !hasFlag(command, flagReadOnly) {
+		return
+	}
+	for _, key := range commandKeys(command, args) {
+		tracking.remember(key, sess.id)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// sendRaw writes args to conn as a RESP command
+func sendRaw(t *testing.T, conn net.Conn, args ...string) {
+	t.Helper()
+	var b strings.Builder
+	writeAOFCommand(&b, args)
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// skipUntil reads lines up to and including line
+func skipUntil(t *testing.T, reader *bufio.Reader, line string) {
+	t.Helper()
+	for {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading until %q: %v", line, err)
+		}
+		if got == line {
+			return
+		}
+	}
+}
+
+// A RESP3 tracking client is pushed an invalidation on its own connection
+// when another client changes a key it read, and only the first time
+func TestTrackingInvalidatesOwnConnection(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "v")
+
+	conn, reader := dialRaw(t)
+	sendRaw(t, conn, "HELLO", "3")
+	sendRaw(t, conn, "PING")
+	skipUntil(t, reader, "+PONG\r\n")
+	sendRaw(t, conn, "CLIENT", "TRACKING", "ON")
+	readExpected(t, reader, "+OK\r\n")
+	sendRaw(t, conn, "GET", "k")
+	readExpected(t, reader, "$1\r\nv\r\n")
+
+	expect(t, c, "OK", "SET", "k", "new")
+	readExpected(t, reader, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n")
+
+	// Not read since, so a second change sends nothing
+	expect(t, c, "OK", "SET", "k", "newer")
+	sendRaw(t, conn, "PING")
+	readExpected(t, reader, "+PONG\r\n")
+}
+
+// With REDIRECT the invalidation goes to the subscriber of the
+// invalidation channel instead
+func TestTrackingRedirect(t *testing.T) {
+	useTestStore(t)
+	c := dialTest(t)
+	expect(t, c, "OK", "SET", "k", "v")
+
+	sub, subReader := dialRaw(t)
+	sendRaw(t, sub, "CLIENT", "ID")
+	id, err := subReader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(id, ":") {
+		t.Fatalf("CLIENT ID = %q, %v", id, err)
+	}
+	sendRaw(t, sub, "SUBSCRIBE", invalidateChannel)
+	readExpected(t, subReader, countReply("subscribe", invalidateChannel, 1))
+
+	tracker := dialTest(t)
+	expect(t, tracker, "OK", "CLIENT", "TRACKING", "ON", "REDIRECT", strings.TrimSpace(id[1:]))
+	expect(t, tracker, "v", "GET", "k")
+
+	expect(t, c, 1, "DEL", "k")
+	readExpected(t, subReader, "*3\r\n$7\r\nmessage\r\n$20\r\n"+invalidateChannel+"\r\n*1\r\n$1\r\nk\r\n")
+}
+
+func TestTrackingRedirectToUnknownClient(t *testing.T) {
+	c := dialTest(t)
+	expect(t, c, "ERR The client ID you want redirect to does not exist", "CLIENT", "TRACKING", "ON", "REDIRECT", "999999")
+	expect(t, c, "ERR syntax error", "CLIENT", "TRACKING", "MAYBE")
+}